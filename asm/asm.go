@@ -0,0 +1,523 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/evanphx/m13/insn"
+	"github.com/evanphx/m13/value"
+)
+
+type Error struct {
+	Line int
+	Text string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Msg, e.Text)
+}
+
+type section struct {
+	code    *value.Code
+	strings map[string]int
+}
+
+type assembler struct {
+	env value.Env
+
+	top  *section
+	cur  *section
+	subs map[string]*section
+}
+
+func (a *assembler) findString(s string) int {
+	if i, ok := a.cur.strings[s]; ok {
+		return i
+	}
+
+	c := a.cur.code
+
+	i := len(c.Strings)
+
+	c.Strings = append(c.Strings, a.env.InternString(s))
+	a.cur.strings[s] = i
+
+	return i
+}
+
+func (a *assembler) addCallsite(name string, kw []string) int {
+	c := a.cur.code
+
+	i := len(c.Calls)
+
+	c.Calls = append(c.Calls, &value.CallSite{Name: name, KWTable: kw})
+
+	return i
+}
+
+func (a *assembler) emit(i insn.Instruction) {
+	a.cur.code.Instructions = append(a.cur.code.Instructions, i)
+}
+
+func newSection() *section {
+	return &section{
+		code:    &value.Code{},
+		strings: make(map[string]int),
+	}
+}
+
+// openSub switches to the sub code at path, such as "0" or "1.0". Parents
+// must have been declared before their children, as Disassemble does.
+func (a *assembler) openSub(path string) error {
+	parent := a.top
+	parentPath := ""
+
+	if dot := strings.LastIndexByte(path, '.'); dot != -1 {
+		parentPath = path[:dot]
+
+		p, ok := a.subs[parentPath]
+		if !ok {
+			return fmt.Errorf("sub %s declared before its parent", path)
+		}
+
+		parent = p
+	}
+
+	idxStr := path
+
+	if parentPath != "" {
+		idxStr = path[len(parentPath)+1:]
+	}
+
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil {
+		return fmt.Errorf("bad sub path")
+	}
+
+	if idx != len(parent.code.SubCode) {
+		return fmt.Errorf("sub %s declared out of order", path)
+	}
+
+	sec := newSection()
+
+	parent.code.SubCode = append(parent.code.SubCode, sec.code)
+
+	a.subs[path] = sec
+	a.cur = sec
+
+	return nil
+}
+
+var (
+	reIndex  = regexp.MustCompile(`^\d+\s+`)
+	reSub    = regexp.MustCompile(`^=+ Sub ([0-9.]+) =+$`)
+	reHeader = regexp.MustCompile(`^Refs: (\d+) Regs: (\d+)$`)
+	reArgs   = regexp.MustCompile(`^Args: (.*?)\s*\(required: (\d+)\)$`)
+	reLine   = regexp.MustCompile(`^@line (\d+)$`)
+)
+
+type form struct {
+	re   *regexp.Regexp
+	regs []int
+	f    func(a *assembler, m []string) error
+}
+
+// reg is only used on the register submatches of a form, which line has
+// already checked with parseReg.
+func reg(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+// num is only used on submatches of `\d+`. A number too big for an int
+// comes back as -1, which Validate rejects as out of range.
+func num(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+
+	return i
+}
+
+// mustForm compiles an instruction pattern, where R stands for a register,
+// remembering which submatches are registers.
+func mustForm(pat string, f func(a *assembler, m []string) error) form {
+	var (
+		regs  []int
+		group int
+	)
+
+	for i := 0; i < len(pat); i++ {
+		switch {
+		case pat[i] == '\\':
+			i++
+		case pat[i] == '(':
+			group++
+		case pat[i] == 'R':
+			group++
+			regs = append(regs, group)
+		}
+	}
+
+	pat = strings.Replace(pat, "R", `r(\d+)`, -1)
+	return form{regexp.MustCompile("^" + pat + "$"), regs, f}
+}
+
+var b = insn.Builder
+
+// parseArgs checks that the registers in list are the ones directly
+// following base and returns how many positional and named arguments
+// there are.
+func parseArgs(base int, list string) (int, []string, error) {
+	list = strings.TrimSpace(list)
+
+	if list == "" {
+		return 0, nil, nil
+	}
+
+	next := base + 1
+
+	if parts := strings.Split(list, " to "); len(parts) == 2 {
+		start, err := parseReg(parts[0])
+		if err != nil {
+			return 0, nil, err
+		}
+
+		end, err := parseReg(parts[1])
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if start != next || end < start {
+			return 0, nil, fmt.Errorf("arguments must directly follow r%d", base)
+		}
+
+		return end - start + 1, nil, nil
+	}
+
+	var (
+		pos int
+		kw  []string
+	)
+
+	for _, arg := range strings.Split(list, ",") {
+		arg = strings.TrimSpace(arg)
+
+		name := ""
+
+		if eq := strings.IndexByte(arg, '='); eq != -1 {
+			name = arg[:eq]
+			arg = arg[eq+1:]
+		}
+
+		rn, err := parseReg(arg)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if rn != next {
+			return 0, nil, fmt.Errorf("arguments must directly follow r%d", base)
+		}
+
+		next++
+
+		if name == "" {
+			if len(kw) > 0 {
+				return 0, nil, fmt.Errorf("positional argument after named")
+			}
+
+			pos++
+		} else {
+			kw = append(kw, name)
+		}
+	}
+
+	return pos, kw, nil
+}
+
+func parseReg(s string) (int, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.HasPrefix(s, "r") {
+		return 0, fmt.Errorf("expected a register, got '%s'", s)
+	}
+
+	i, err := strconv.Atoi(s[1:])
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("expected a register, got '%s'", s)
+	}
+
+	if i > insn.Reg0Mask {
+		return 0, fmt.Errorf("register %s out of range, the most is r%d", s, insn.Reg0Mask)
+	}
+
+	return i, nil
+}
+
+var forms = []form{
+	mustForm(`noop`, func(a *assembler, m []string) error {
+		a.emit(b.Noop())
+		return nil
+	}),
+	mustForm(`ret R`, func(a *assembler, m []string) error {
+		a.emit(b.Return(reg(m[1])))
+		return nil
+	}),
+	mustForm(`goto (\d+)`, func(a *assembler, m []string) error {
+		a.emit(b.Goto(num(m[1])))
+		return nil
+	}),
+	mustForm(`if !R goto (\d+)`, func(a *assembler, m []string) error {
+		a.emit(b.GotoIfFalse(reg(m[1]), num(m[2])))
+		return nil
+	}),
+	mustForm(`ref\((\d+)\) = R`, func(a *assembler, m []string) error {
+		a.emit(b.StoreRef(num(m[1]), reg(m[2])))
+		return nil
+	}),
+	mustForm(`\$(\S+) = R`, func(a *assembler, m []string) error {
+		a.emit(b.SetScoped(reg(m[2]), a.findString(m[1])))
+		return nil
+	}),
+	mustForm(`@(\S+) = R`, func(a *assembler, m []string) error {
+		a.emit(b.SetIvar(reg(m[2]), a.findString(m[1])))
+		return nil
+	}),
+	mustForm(`R << R`, func(a *assembler, m []string) error {
+		a.emit(b.ListAppend(reg(m[1]), reg(m[2])))
+		return nil
+	}),
+	mustForm(`R\[R\] = R`, func(a *assembler, m []string) error {
+		if reg(m[3]) != reg(m[2])+1 {
+			return fmt.Errorf("map value must directly follow the key register")
+		}
+
+		a.emit(b.SetMap(reg(m[1]), reg(m[2])))
+		return nil
+	}),
+	mustForm(`R = nil`, func(a *assembler, m []string) error {
+		a.emit(b.StoreNil(reg(m[1])))
+		return nil
+	}),
+	mustForm(`R = (true|false)`, func(a *assembler, m []string) error {
+		a.emit(b.StoreBool(reg(m[1]), m[2] == "true"))
+		return nil
+	}),
+	mustForm(`R = int\((-?\d+)\)`, func(a *assembler, m []string) error {
+		i, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		a.emit(b.Store(reg(m[1]), insn.Int(i)))
+		return nil
+	}),
+	mustForm(`R = R`, func(a *assembler, m []string) error {
+		a.emit(b.StoreReg(reg(m[1]), reg(m[2])))
+		return nil
+	}),
+	mustForm(`R = ref\((\d+)\)`, func(a *assembler, m []string) error {
+		a.emit(b.ReadRef(reg(m[1]), num(m[2])))
+		return nil
+	}),
+	mustForm(`R = self`, func(a *assembler, m []string) error {
+		a.emit(b.Self(reg(m[1])))
+		return nil
+	}),
+	mustForm(`R = mirror\(R\)`, func(a *assembler, m []string) error {
+		a.emit(b.GetMirror(reg(m[1]), reg(m[2])))
+		return nil
+	}),
+	mustForm(`R = \$(\S+)`, func(a *assembler, m []string) error {
+		a.emit(b.GetScoped(reg(m[1]), a.findString(m[2])))
+		return nil
+	}),
+	mustForm(`R = @(\S+)`, func(a *assembler, m []string) error {
+		a.emit(b.GetIvar(reg(m[1]), a.findString(m[2])))
+		return nil
+	}),
+	mustForm(`R = (".*")`, func(a *assembler, m []string) error {
+		s, err := strconv.Unquote(m[2])
+		if err != nil {
+			return err
+		}
+
+		a.emit(b.String(reg(m[1]), a.findString(s)))
+		return nil
+	}),
+	mustForm(`R = \[\]\(res=(\d+)\)`, func(a *assembler, m []string) error {
+		a.emit(b.NewList(reg(m[1]), num(m[2])))
+		return nil
+	}),
+	mustForm(`R = \{\}`, func(a *assembler, m []string) error {
+		a.emit(b.NewMap(reg(m[1])))
+		return nil
+	}),
+	mustForm(`R = lambda\(args=(\d+), refs=(\d+), sub=(\d+)\)`, func(a *assembler, m []string) error {
+		a.emit(b.CreateLambda(reg(m[1]), num(m[2]), num(m[3]), num(m[4])))
+		return nil
+	}),
+	mustForm(`R = R\.\((.*)\)`, func(a *assembler, m []string) error {
+		pos, kw, err := parseArgs(reg(m[2]), m[3])
+		if err != nil {
+			return err
+		}
+
+		if len(kw) > 0 {
+			return fmt.Errorf("invoke does not take named arguments")
+		}
+
+		a.emit(b.Invoke(reg(m[1]), reg(m[2]), pos))
+		return nil
+	}),
+	mustForm("R = R\\.`([^`]+)`\\((.*)\\)", func(a *assembler, m []string) error {
+		pos, kw, err := parseArgs(reg(m[2]), m[4])
+		if err != nil {
+			return err
+		}
+
+		lit := a.addCallsite(m[3], kw)
+
+		if len(kw) == 0 {
+			a.emit(b.CallN(reg(m[1]), reg(m[2]), pos, lit))
+		} else {
+			a.emit(b.CallKW(reg(m[1]), reg(m[2]), pos, len(kw), lit))
+		}
+
+		return nil
+	}),
+	mustForm("R = R\\.`([^`]+)`", func(a *assembler, m []string) error {
+		a.emit(b.Call0(reg(m[1]), reg(m[2]), a.addCallsite(m[3], nil)))
+		return nil
+	}),
+}
+
+func (a *assembler) line(text string) error {
+	if m := reSub.FindStringSubmatch(text); m != nil {
+		return a.openSub(m[1])
+	}
+
+	c := a.cur.code
+
+	switch {
+	case strings.HasPrefix(text, "Code: "):
+		name, err := strconv.Unquote(strings.TrimPrefix(text, "Code: "))
+		if err != nil {
+			return err
+		}
+
+		c.Name = name
+		return nil
+	case strings.HasPrefix(text, "File: "):
+		file, err := strconv.Unquote(strings.TrimPrefix(text, "File: "))
+		if err != nil {
+			return err
+		}
+
+		c.File = file
+		return nil
+	}
+
+	if m := reHeader.FindStringSubmatch(text); m != nil {
+		c.NumRefs = num(m[1])
+		c.NumRegs = num(m[2])
+		return nil
+	}
+
+	if m := reArgs.FindStringSubmatch(text); m != nil {
+		sig := &value.Signature{Required: num(m[2])}
+
+		if m[1] != "" {
+			for _, arg := range strings.Split(m[1], ",") {
+				sig.Args = append(sig.Args, strings.TrimSpace(arg))
+			}
+		}
+
+		c.Signature = sig
+		return nil
+	}
+
+	if m := reLine.FindStringSubmatch(text); m != nil {
+		c.Lines = append(c.Lines, value.LineEntry{
+			Start: len(c.Instructions),
+			Line:  num(m[1]),
+		})
+		return nil
+	}
+
+	if loc := reIndex.FindStringIndex(text); loc != nil {
+		idx := num(strings.TrimSpace(text[:loc[1]]))
+		if idx != len(c.Instructions) {
+			return fmt.Errorf("instruction index %d out of sequence, expected %d", idx, len(c.Instructions))
+		}
+
+		text = text[loc[1]:]
+	}
+
+	for _, f := range forms {
+		if m := f.re.FindStringSubmatch(text); m != nil {
+			for _, g := range f.regs {
+				if _, err := parseReg("r" + m[g]); err != nil {
+					return err
+				}
+			}
+
+			return f.f(a, m)
+		}
+	}
+
+	return fmt.Errorf("unknown instruction")
+}
+
+// Assemble parses the text format written by value.Code.Disassemble back
+// into a Code. Blank lines and lines starting with '#' are ignored, and the
+// instruction index prefix is optional.
+func Assemble(env value.Env, rd io.Reader) (*value.Code, error) {
+	a := &assembler{
+		env:  env,
+		top:  newSection(),
+		subs: make(map[string]*section),
+	}
+
+	a.cur = a.top
+
+	scan := bufio.NewScanner(rd)
+
+	var lineNo int
+
+	for scan.Scan() {
+		lineNo++
+
+		text := strings.TrimSpace(scan.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if err := a.line(text); err != nil {
+			return nil, &Error{Line: lineNo, Text: text, Msg: err.Error()}
+		}
+	}
+
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	// The VM trusts its operands, so make sure every register, ref, jump
+	// and index is in range.
+	if err := a.top.code.Validate(); err != nil {
+		return nil, err
+	}
+
+	return a.top.code, nil
+}
+
+func AssembleString(env value.Env, src string) (*value.Code, error) {
+	return Assemble(env, strings.NewReader(src))
+}
@@ -0,0 +1,184 @@
+package asm
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/insn"
+	"github.com/evanphx/m13/parser"
+	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestAssembler(t *testing.T) {
+	n := neko.Start(t)
+
+	n.It("assembles hand written bytecode", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		code, err := AssembleString(v, `
+Refs: 0 Regs: 3
+# count up to 3
+000 r0 = int(0)
+001 r2 = int(3)
+002 r1 = r0
+003 r1 = r1.`+"`<`"+`(r2)
+004 if !r1 goto 007
+005 r0 = r0.`+"`++`"+`
+006 goto 002
+007 ret r0
+`)
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, code.NumRegs)
+		assert.Equal(t, insn.Call0, code.Instructions[5].Op())
+
+		val, err := v.ExecuteContext(context.TODO(), value.ExecuteContext{Code: code})
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), val)
+	})
+
+	n.It("assembles sub code sections", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		code, err := AssembleString(v, `
+Refs: 0 Regs: 2
+r0 = lambda(args=1, refs=0, sub=0)
+r1 = int(41)
+r0 = r0.(r1)
+ret r0
+
+==== Sub 0 =====
+Code: "inc"
+Refs: 0 Regs: 1
+Args: x (required: 1)
+r0 = r0.`+"`++`"+`
+ret r0
+`)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(code.SubCode))
+
+		sub := code.SubCode[0]
+
+		assert.Equal(t, "inc", sub.Name)
+		assert.Equal(t, []string{"x"}, sub.Signature.Args)
+
+		val, err := v.ExecuteContext(context.TODO(), value.ExecuteContext{Code: code})
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(42), val)
+	})
+
+	n.It("round trips the disassembler output", func() {
+		src := `
+import test
+
+class Point {
+  has @x is r
+
+  def initialize(x) {
+    @x = x
+  }
+}
+
+def run(list) {
+  m = { a: 1, b: "two" }
+  list << m["a"]
+  p = Point.new(x=3)
+  total = 0
+  list.each(v => {
+    total = total + v
+  })
+  $stdout.puts(p.^inspect)
+  total
+}
+`
+		p, err := parser.NewParser(src)
+		require.NoError(t, err)
+
+		tree, err := p.Parse()
+		require.NoError(t, err)
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		g, err := gen.NewGenerator(v, "__top__")
+		require.NoError(t, err)
+
+		code, err := g.GenerateTop(tree)
+		require.NoError(t, err)
+
+		code.Lines = []value.LineEntry{{Start: 0, Line: 2}, {Start: 3, Line: 4}}
+
+		var first bytes.Buffer
+
+		code.Disassemble(&first)
+
+		out, err := AssembleString(v, first.String())
+		require.NoError(t, err)
+
+		var second bytes.Buffer
+
+		out.Disassemble(&second)
+
+		assert.Equal(t, first.String(), second.String())
+		assert.Equal(t, code.Instructions, out.Instructions)
+	})
+
+	n.It("reports the line of a bad instruction", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		_, err = AssembleString(v, "Refs: 0 Regs: 1\nr0 = bogus\n")
+		require.Error(t, err)
+
+		ae, ok := err.(*Error)
+		require.True(t, ok)
+
+		assert.Equal(t, 2, ae.Line)
+	})
+
+	n.It("rejects arguments that are not contiguous", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		_, err = AssembleString(v, "r0 = r1.`+`(r3)\n")
+		require.Error(t, err)
+	})
+
+	n.It("rejects registers out of range", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		_, err = AssembleString(v, "Refs: 0 Regs: 1\nr300 = int(1)\nret r0\n")
+		require.Error(t, err)
+
+		ae, ok := err.(*Error)
+		require.True(t, ok)
+
+		assert.Equal(t, 2, ae.Line)
+		assert.Equal(t, "register r300 out of range, the most is r255", ae.Msg)
+
+		_, err = AssembleString(v, "Refs: 0 Regs: 1\nr0 = r0.`+`(r256)\n")
+		require.Error(t, err)
+
+		_, err = AssembleString(v, "Refs: 0 Regs: 1\nr1 = int(1)\nret r0\n")
+		require.Error(t, err)
+
+		bad, ok := err.(*value.ErrBadOperand)
+		require.True(t, ok)
+
+		assert.Equal(t, "register r1 out of range, code has 1", bad.Problem)
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,431 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The JSON and S-expression forms of a tree are built from the same
+// description of each node: a kind and its fields, in a fixed order. The
+// kinds and field names are part of the format, so they are spelled out
+// here rather than derived from the Go types.
+
+type encoded struct {
+	node   Node
+	kind   string
+	fields []field
+}
+
+type field struct {
+	name  string
+	value interface{}
+}
+
+func (e *encoded) add(name string, val interface{}) *encoded {
+	e.fields = append(e.fields, field{name, val})
+	return e
+}
+
+func node(kind string) *encoded {
+	return &encoded{kind: kind}
+}
+
+func typeName(t *Type) interface{} {
+	if t == nil {
+		return nil
+	}
+
+	return t.Name
+}
+
+func stringList(list []string) []interface{} {
+	out := []interface{}{}
+
+	for _, s := range list {
+		out = append(out, s)
+	}
+
+	return out
+}
+
+func encodeList(nodes []Node) ([]interface{}, error) {
+	out := []interface{}{}
+
+	for _, n := range nodes {
+		e, err := encode(n)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, e)
+	}
+
+	return out, nil
+}
+
+func encodeArgs(args *Args) ([]interface{}, error) {
+	if args == nil {
+		return []interface{}{}, nil
+	}
+
+	return encodeList(args.Args)
+}
+
+func encodeArgDef(d *ArgDef) *encoded {
+	return node("arg").add("name", d.Name).add("type_name", typeName(d.Type))
+}
+
+func encodeArgDefs(defs []*ArgDef) []interface{} {
+	out := []interface{}{}
+
+	for _, d := range defs {
+		e := encodeArgDef(d)
+		e.node = d
+		out = append(out, e)
+	}
+
+	return out
+}
+
+func encode(n Node) (interface{}, error) {
+	if n == nil {
+		return nil, nil
+	}
+
+	var (
+		e    *encoded
+		list = func(name string, nodes []Node) error {
+			l, err := encodeList(nodes)
+			if err != nil {
+				return err
+			}
+
+			e.add(name, l)
+			return nil
+		}
+		child = func(name string, c Node) error {
+			v, err := encode(c)
+			if err != nil {
+				return err
+			}
+
+			e.add(name, v)
+			return nil
+		}
+		err error
+	)
+
+	switch n := n.(type) {
+	case *Integer:
+		e = node("integer").add("value", n.Value)
+	case *String:
+		e = node("string").add("value", n.Value)
+	case *Atom:
+		e = node("atom").add("value", n.Value)
+	case *True:
+		e = node("true")
+	case *False:
+		e = node("false")
+	case *Nil:
+		e = node("nil")
+	case *Self:
+		e = node("self")
+	case *Variable:
+		e = node("variable").add("name", n.Name)
+	case *ScopeVar:
+		e = node("scope_var").add("name", n.Name)
+	case *IVar:
+		e = node("ivar").add("name", n.Name)
+	case *Type:
+		e = node("type").add("name", n.Name)
+	case *Comment:
+		e = node("comment").add("text", n.Comment)
+	case *Package:
+		e = node("package").add("name", n.Name)
+	case *Import:
+		e = node("import").add("path", stringList(n.Path)).add("relative", n.Relative)
+	case *ArgDef:
+		e = encodeArgDef(n)
+	case *Args:
+		e = node("args")
+		err = list("args", n.Args)
+	case NamedArg:
+		e = node("named_arg").add("name", n.Name)
+		err = child("value", n.Value)
+	case *NamedArg:
+		e = node("named_arg").add("name", n.Name)
+		err = child("value", n.Value)
+	case *Call:
+		e = node("call")
+		if err = child("receiver", n.Receiver); err == nil {
+			e.add("name", n.MethodName)
+
+			var args []interface{}
+
+			args, err = encodeArgs(n.Args)
+			e.add("args", args)
+		}
+	case *UpCall:
+		e = node("upcall")
+		if err = child("receiver", n.Receiver); err == nil {
+			e.add("name", n.MethodName)
+			err = list("args", n.Args)
+		}
+	case *Invoke:
+		e = node("invoke")
+		if err = child("target", n.Var); err == nil {
+			var args []interface{}
+
+			args, err = encodeArgs(n.Args)
+			e.add("args", args)
+		}
+	case *Assign:
+		e = node("assign").add("name", n.Name)
+		err = child("value", n.Value)
+	case *IVarAssign:
+		e = node("ivar_assign").add("name", n.Name)
+		err = child("value", n.Value)
+	case *Attribute:
+		e = node("attribute")
+		if err = child("receiver", n.Receiver); err == nil {
+			e.add("name", n.Name)
+		}
+	case *AttributeAssign:
+		e = node("attribute_assign")
+		if err = child("receiver", n.Receiver); err == nil {
+			e.add("name", n.Name)
+			err = child("value", n.Value)
+		}
+	case *Lambda:
+		e = node("lambda").add("name", n.Name).add("args", encodeArgDefs(n.Args))
+		err = child("body", n.Expr)
+	case *Block:
+		e = node("block")
+		err = list("expressions", n.Expressions)
+	case *Definition:
+		e = node("def").
+			add("name", n.Name.Name).
+			add("operator", n.Name.Operator).
+			add("args", encodeArgDefs(n.Arguments)).
+			add("private", n.Private)
+		err = child("body", n.Body)
+	case *GoDefinition:
+		e = node("go_def").
+			add("name", n.Name.Name).
+			add("operator", n.Name.Operator).
+			add("args", encodeArgDefs(n.Arguments)).
+			add("body", n.Body)
+	case *ClassDefinition:
+		e = node("class").
+			add("name", n.Name).
+			add("super", typeName(n.Super)).
+			add("private", n.Private)
+		err = child("body", n.Body)
+	case *Has:
+		e = node("has").
+			add("name", n.Variable).
+			add("type_name", typeName(n.Type)).
+			add("traits", stringList(n.Traits))
+	case *Op:
+		e = node("op").add("name", n.Name)
+		if err = child("left", n.Left); err == nil {
+			err = child("right", n.Right)
+		}
+	case *If:
+		e = node("if")
+		if err = child("cond", n.Cond); err == nil {
+			if err = child("body", n.Body); err == nil {
+				err = child("else", n.Else)
+			}
+		}
+	case *While:
+		e = node("while")
+		if err = child("cond", n.Cond); err == nil {
+			err = child("body", n.Body)
+		}
+	case *Inc:
+		e = node("inc")
+		err = child("receiver", n.Receiver)
+	case *Dec:
+		e = node("dec")
+		err = child("receiver", n.Receiver)
+	case *List:
+		e = node("list")
+		err = list("elements", n.Elements)
+	case *Pair:
+		e = node("pair")
+		if err = child("key", n.Key); err == nil {
+			err = child("value", n.Value)
+		}
+	case *Map:
+		var pairs []Node
+
+		for _, p := range n.Elements {
+			pairs = append(pairs, p)
+		}
+
+		e = node("map")
+		err = list("elements", pairs)
+	default:
+		return nil, fmt.Errorf("ast: can't encode a %T", n)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.node = n
+
+	return e, nil
+}
+
+// JSON returns n as indented JSON. Each node is an object holding its
+// "type", then "line" and "column" when pos knows where it starts, then
+// its fields. pos may be nil.
+func JSON(n Node, pos Positions) ([]byte, error) {
+	e, err := encode(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf, out bytes.Buffer
+
+	writeJSON(&buf, e, pos)
+
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+
+	out.WriteByte('\n')
+
+	return out.Bytes(), nil
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}, pos Positions) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case string:
+		data, _ := json.Marshal(v)
+		buf.Write(data)
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case []interface{}:
+		buf.WriteByte('[')
+
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+
+			writeJSON(buf, elem, pos)
+		}
+
+		buf.WriteByte(']')
+	case *encoded:
+		fmt.Fprintf(buf, `{"type":%q`, v.kind)
+
+		if p, ok := pos[v.node]; ok {
+			fmt.Fprintf(buf, `,"line":%d,"column":%d`, p.Line, p.Column)
+		}
+
+		for _, f := range v.fields {
+			fmt.Fprintf(buf, `,%q:`, f.name)
+			writeJSON(buf, f.value, pos)
+		}
+
+		buf.WriteByte('}')
+	}
+}
+
+// sexpWidth is how long a line may get before a node's fields are put on
+// lines of their own.
+const sexpWidth = 80
+
+// Sexp returns n as an S-expression. A node is its type followed by its
+// fields in order, as in (op "+" (integer 1) (integer 2)). Lists are
+// written in brackets, a missing node as nil.
+func Sexp(n Node) (string, error) {
+	e, err := encode(n)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+
+	writeSexp(&buf, e, 0)
+	buf.WriteByte('\n')
+
+	return buf.String(), nil
+}
+
+func flatSexp(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		var parts []string
+
+		for _, elem := range v {
+			parts = append(parts, flatSexp(elem))
+		}
+
+		return "[" + strings.Join(parts, " ") + "]"
+	case *encoded:
+		parts := []string{v.kind}
+
+		for _, f := range v.fields {
+			parts = append(parts, flatSexp(f.value))
+		}
+
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+
+	return ""
+}
+
+func writeSexp(buf *bytes.Buffer, v interface{}, indent int) {
+	flat := flatSexp(v)
+
+	if indent+len(flat) <= sexpWidth {
+		buf.WriteString(flat)
+		return
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		buf.WriteByte('[')
+
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString("\n" + strings.Repeat(" ", indent+1))
+			}
+
+			writeSexp(buf, elem, indent+1)
+		}
+
+		buf.WriteByte(']')
+	case *encoded:
+		buf.WriteString("(" + v.kind)
+
+		for _, f := range v.fields {
+			buf.WriteString("\n" + strings.Repeat(" ", indent+2))
+			writeSexp(buf, f.value, indent+2)
+		}
+
+		buf.WriteByte(')')
+	default:
+		buf.WriteString(flat)
+	}
+}
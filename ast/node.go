@@ -65,6 +65,10 @@ func (v *Variable) NodeType() string {
 type Scope struct {
 	Locals []string
 	Refs   []string
+
+	// ArgRefs maps the register of each argument that's captured by a
+	// closure to the ref it lives in.
+	ArgRefs map[int]int
 }
 
 func (s *Scope) RefIndex(name string) int {
@@ -217,6 +221,7 @@ type Definition struct {
 	Name      *MethodName
 	Arguments []*ArgDef
 	Body      Node
+	Private   bool
 }
 
 func (v *Definition) NodeType() string {
@@ -224,9 +229,10 @@ func (v *Definition) NodeType() string {
 }
 
 type ClassDefinition struct {
-	Name  string
-	Body  Node
-	Super *Type
+	Name    string
+	Body    Node
+	Super   *Type
+	Private bool
 }
 
 func (v *ClassDefinition) NodeType() string {
@@ -353,3 +359,20 @@ type Type struct {
 func (t *Type) NodeType() string {
 	return "type"
 }
+
+// Position is where a node starts in its source. Line and Column are
+// 1-based, Offset is in bytes.
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+// Positions records the starting position of each statement the parser
+// produced.
+type Positions map[Node]Position
+
+// Line returns the line n starts on, or 0 if it isn't known.
+func (p Positions) Line(n Node) int {
+	return p[n].Line
+}
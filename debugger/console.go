@@ -0,0 +1,235 @@
+package debugger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
+)
+
+type command struct {
+	names []string
+	args  string
+	help  string
+
+	// run performs the command and reports if execution should resume.
+	run func(d *Debugger, f *vm.Frame, arg string) bool
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{[]string{"break", "b"}, "<file:line|line>", "set a breakpoint", cmdBreak},
+		{[]string{"delete", "d"}, "<id>", "remove a breakpoint", cmdDelete},
+		{[]string{"breaks"}, "", "list breakpoints", cmdBreaks},
+		{[]string{"continue", "c"}, "", "run until the next breakpoint", cmdContinue},
+		{[]string{"step", "s"}, "", "run to the next line, entering calls", cmdStep},
+		{[]string{"next", "n"}, "", "run to the next line, stepping over calls", cmdNext},
+		{[]string{"out", "o"}, "", "run until the current frame returns", cmdOut},
+		{[]string{"locals"}, "", "show the variables of the current frame", cmdLocals},
+		{[]string{"print", "p"}, "<expr>", "evaluate an expression in the current frame", cmdPrint},
+		{[]string{"backtrace", "bt"}, "", "show the active frames", cmdBacktrace},
+		{[]string{"list", "l"}, "", "show the source around the current line", cmdList},
+		{[]string{"help", "h"}, "", "show this help", cmdHelp},
+		{[]string{"quit", "q"}, "", "stop the program", cmdQuit},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		for _, n := range cmd.names {
+			if n == name {
+				return cmd
+			}
+		}
+	}
+
+	return nil
+}
+
+// pause shows where f stopped and runs commands until one resumes
+// execution. Running out of input detaches the debugger.
+func (d *Debugger) pause(f *vm.Frame, reason string) {
+	fmt.Fprintf(d.out, "stopped (%s) in %s\n", reason, d.location(f))
+	d.showLine(f, f.Line(), true)
+
+	for {
+		fmt.Fprintf(d.out, "(m13) ")
+
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			d.Detach()
+			return
+		}
+
+		line := strings.TrimSpace(d.in.Text())
+
+		// An empty line repeats the previous command, which makes
+		// stepping through code easier.
+		if line == "" {
+			line = d.last
+		}
+
+		if line == "" {
+			continue
+		}
+
+		d.last = line
+
+		name, arg := line, ""
+
+		if idx := strings.IndexAny(line, " \t"); idx != -1 {
+			name, arg = line[:idx], strings.TrimSpace(line[idx+1:])
+		}
+
+		cmd := findCommand(name)
+		if cmd == nil {
+			fmt.Fprintf(d.out, "unknown command: %s (try help)\n", name)
+			continue
+		}
+
+		if cmd.run(d, f, arg) {
+			return
+		}
+	}
+}
+
+func cmdBreak(d *Debugger, f *vm.Frame, arg string) bool {
+	// A bare line number refers to the file being debugged.
+	if !strings.Contains(arg, ":") && f.Code.File != "" {
+		arg = f.Code.File + ":" + arg
+	}
+
+	bp, err := d.Break(arg)
+	if err != nil {
+		fmt.Fprintf(d.out, "%s\n", err)
+		return false
+	}
+
+	fmt.Fprintf(d.out, "breakpoint %d at %s\n", bp.ID, bp)
+
+	return false
+}
+
+func cmdDelete(d *Debugger, f *vm.Frame, arg string) bool {
+	id, err := strconv.Atoi(arg)
+	if err != nil || !d.Delete(id) {
+		fmt.Fprintf(d.out, "no breakpoint %s\n", arg)
+	}
+
+	return false
+}
+
+func cmdBreaks(d *Debugger, f *vm.Frame, arg string) bool {
+	if len(d.breakpoints) == 0 {
+		fmt.Fprintf(d.out, "no breakpoints\n")
+	}
+
+	for _, bp := range d.breakpoints {
+		fmt.Fprintf(d.out, "%d: %s (hits: %d)\n", bp.ID, bp, bp.Hits)
+	}
+
+	return false
+}
+
+func cmdContinue(d *Debugger, f *vm.Frame, arg string) bool {
+	d.Continue()
+	return true
+}
+
+func cmdStep(d *Debugger, f *vm.Frame, arg string) bool {
+	d.StepInto(f)
+	return true
+}
+
+func cmdNext(d *Debugger, f *vm.Frame, arg string) bool {
+	d.StepOver(f)
+	return true
+}
+
+func cmdOut(d *Debugger, f *vm.Frame, arg string) bool {
+	d.StepOut(f)
+	return true
+}
+
+func cmdLocals(d *Debugger, f *vm.Frame, arg string) bool {
+	locals := Locals(f)
+
+	if len(locals) == 0 {
+		fmt.Fprintf(d.out, "no locals\n")
+	}
+
+	for _, l := range locals {
+		fmt.Fprintf(d.out, "%s = %s\n", l.Name, value.Inspect(d.vm, l.Value))
+	}
+
+	return false
+}
+
+func cmdPrint(d *Debugger, f *vm.Frame, arg string) bool {
+	if arg == "" {
+		fmt.Fprintf(d.out, "print needs an expression\n")
+		return false
+	}
+
+	val, err := d.Eval(f, arg)
+	if err != nil {
+		fmt.Fprintf(d.out, "error: %s\n", err)
+		return false
+	}
+
+	fmt.Fprintf(d.out, "%s\n", value.Inspect(d.vm, val))
+
+	return false
+}
+
+func cmdBacktrace(d *Debugger, f *vm.Frame, arg string) bool {
+	for i, fr := 0, f; fr != nil; i, fr = i+1, fr.Parent {
+		fmt.Fprintf(d.out, "#%d %s\n", i, d.location(fr))
+	}
+
+	return false
+}
+
+func cmdList(d *Debugger, f *vm.Frame, arg string) bool {
+	cur := f.Line()
+
+	var shown bool
+
+	for line := cur - 3; line <= cur+3; line++ {
+		if d.showLine(f, line, line == cur) {
+			shown = true
+		}
+	}
+
+	if !shown {
+		fmt.Fprintf(d.out, "no source available\n")
+	}
+
+	return false
+}
+
+func cmdHelp(d *Debugger, f *vm.Frame, arg string) bool {
+	for _, cmd := range commands {
+		usage := strings.Join(cmd.names, ", ")
+		if cmd.args != "" {
+			usage += " " + cmd.args
+		}
+
+		fmt.Fprintf(d.out, "  %-28s %s\n", usage, cmd.help)
+	}
+
+	return false
+}
+
+func cmdQuit(d *Debugger, f *vm.Frame, arg string) bool {
+	d.quit = true
+	d.mode = running
+
+	f.Abort(ErrQuit)
+
+	return true
+}
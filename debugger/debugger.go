@@ -0,0 +1,385 @@
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/insn"
+	"github.com/evanphx/m13/parser"
+	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
+)
+
+// ErrQuit is returned from the running program when the user quits the
+// debugger.
+var ErrQuit = errors.New("quit from debugger")
+
+type Breakpoint struct {
+	ID   int
+	File string
+	Line int
+	Hits int
+}
+
+func (b *Breakpoint) String() string {
+	if b.File == "" {
+		return fmt.Sprintf("%d", b.Line)
+	}
+
+	return fmt.Sprintf("%s:%d", b.File, b.Line)
+}
+
+func (b *Breakpoint) matches(f *vm.Frame) bool {
+	if f.Line() != b.Line {
+		return false
+	}
+
+	if b.File == "" {
+		return true
+	}
+
+	return sameFile(f.Code.File, b.File)
+}
+
+func sameFile(path, name string) bool {
+	path = filepath.Clean(path)
+	name = filepath.Clean(name)
+
+	return path == name || strings.HasSuffix(path, string(filepath.Separator)+name)
+}
+
+type stepMode int
+
+const (
+	running stepMode = iota
+	stepInto
+	stepOver
+	stepOut
+)
+
+type Debugger struct {
+	vm  *vm.VM
+	in  *bufio.Scanner
+	out io.Writer
+
+	breakpoints []*Breakpoint
+	nextID      int
+
+	mode  stepMode
+	depth int
+
+	last    string
+	quit    bool
+	sources map[string][]string
+}
+
+// New returns a Debugger for v that reads commands from in and writes to
+// out. It starts out stepping, so the first line run is where it first
+// stops.
+func New(v *vm.VM, in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		vm:      v,
+		in:      bufio.NewScanner(in),
+		out:     out,
+		mode:    stepInto,
+		nextID:  1,
+		sources: make(map[string][]string),
+	}
+}
+
+// Attach installs the debugger as the VM's tracer.
+func (d *Debugger) Attach() {
+	d.vm.SetTracer(d)
+}
+
+// Detach removes the debugger from the VM, letting the program run on
+// without stopping.
+func (d *Debugger) Detach() {
+	if d.vm.Tracer() == d {
+		d.vm.SetTracer(nil)
+	}
+
+	d.mode = running
+	d.breakpoints = nil
+}
+
+// Break adds a breakpoint from a "file:line" or "line" spec. A breakpoint
+// without a file stops at that line in any file.
+func (d *Debugger) Break(spec string) (*Breakpoint, error) {
+	var file string
+
+	lineStr := spec
+
+	if idx := strings.LastIndexByte(spec, ':'); idx != -1 {
+		file = spec[:idx]
+		lineStr = spec[idx+1:]
+	}
+
+	line, err := strconv.Atoi(lineStr)
+	if err != nil || line <= 0 {
+		return nil, fmt.Errorf("invalid breakpoint: %s", spec)
+	}
+
+	bp := &Breakpoint{ID: d.nextID, File: file, Line: line}
+
+	d.nextID++
+
+	d.breakpoints = append(d.breakpoints, bp)
+
+	return bp, nil
+}
+
+// Delete removes the breakpoint with the given id.
+func (d *Debugger) Delete(id int) bool {
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breakpoints
+}
+
+// Continue runs until the next breakpoint.
+func (d *Debugger) Continue() {
+	d.mode = running
+}
+
+// StepInto stops at the next line run, following calls.
+func (d *Debugger) StepInto(f *vm.Frame) {
+	d.mode = stepInto
+	d.depth = f.Depth
+}
+
+// StepOver stops at the next line of f, or of its caller once f returns.
+func (d *Debugger) StepOver(f *vm.Frame) {
+	d.mode = stepOver
+	d.depth = f.Depth
+}
+
+// StepOut stops as soon as f has returned to its caller.
+func (d *Debugger) StepOut(f *vm.Frame) {
+	d.mode = stepOut
+	d.depth = f.Depth
+}
+
+func (d *Debugger) shouldStop(f *vm.Frame) (string, bool) {
+	lineStart := f.Code.IsLineStart(f.IP)
+
+	switch d.mode {
+	case stepInto:
+		if lineStart || f.Depth < d.depth {
+			return "step", true
+		}
+	case stepOver:
+		if (lineStart && f.Depth <= d.depth) || f.Depth < d.depth {
+			return "step", true
+		}
+	case stepOut:
+		if f.Depth < d.depth {
+			return "step", true
+		}
+	}
+
+	if !lineStart {
+		return "", false
+	}
+
+	for _, bp := range d.breakpoints {
+		if bp.matches(f) {
+			bp.Hits++
+			return fmt.Sprintf("breakpoint %d", bp.ID), true
+		}
+	}
+
+	return "", false
+}
+
+func (d *Debugger) OnInstruction(f *vm.Frame, i insn.Instruction) {
+	if d.quit {
+		f.Abort(ErrQuit)
+		return
+	}
+
+	if reason, ok := d.shouldStop(f); ok {
+		d.mode = running
+		d.pause(f, reason)
+	}
+}
+
+func (d *Debugger) OnCall(f *vm.Frame) {}
+
+func (d *Debugger) OnReturn(f *vm.Frame, val value.Value) {}
+
+func (d *Debugger) OnError(f *vm.Frame, err error) {}
+
+// Local is a named variable visible in a frame.
+type Local struct {
+	Name  string
+	Value value.Value
+}
+
+// Locals returns the variables of f, registers first and then refs.
+func Locals(f *vm.Frame) []Local {
+	var locals []Local
+
+	for i, name := range f.Code.LocalNames {
+		if name != "" && i < len(f.Regs) {
+			locals = append(locals, Local{name, f.Regs[i]})
+		}
+	}
+
+	for i, name := range f.Code.RefNames {
+		if i < len(f.Refs) && f.Refs[i] != nil {
+			locals = append(locals, Local{name, f.Refs[i].Value})
+		}
+	}
+
+	return locals
+}
+
+// Eval evaluates the expression src as though it appeared in f. Variables
+// of f can be read but not assigned.
+func (d *Debugger) Eval(f *vm.Frame, src string) (value.Value, error) {
+	p, err := parser.NewParser(src)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		gctx    = f.Context()
+		bound   = make(map[string]bool)
+		missing string
+	)
+
+	// Variables of the paused frame are passed in as scoped values, which
+	// the generated code reads by name.
+	tree = ast.Rewrite(tree, func(n ast.Node) ast.Node {
+		switch n := n.(type) {
+		case *ast.Lambda:
+			for _, arg := range n.Args {
+				bound[arg.Name] = true
+			}
+		case *ast.Variable:
+			if bound[n.Name] {
+				return n
+			}
+
+			val, ok := f.Lookup(n.Name)
+			if !ok {
+				if missing == "" {
+					missing = n.Name
+				}
+
+				return &ast.Nil{}
+			}
+
+			gctx = value.SetScoped(gctx, n.Name, val)
+
+			return &ast.ScopeVar{Name: n.Name}
+		}
+
+		return n
+	})
+
+	if missing != "" {
+		return nil, fmt.Errorf("unknown variable: %s", missing)
+	}
+
+	g, err := gen.NewGenerator(d.vm, "__eval__")
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := g.GenerateTop(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]*value.Ref, code.NumRefs)
+
+	for i := range refs {
+		refs[i] = &value.Ref{}
+	}
+
+	// Don't trace the evaluation itself.
+	tracer := d.vm.Tracer()
+	d.vm.SetTracer(nil)
+
+	defer d.vm.SetTracer(tracer)
+
+	return d.vm.ExecuteContext(gctx, value.ExecuteContext{
+		Code: code,
+		Self: f.Self,
+		Refs: refs,
+	})
+}
+
+func (d *Debugger) source(file string, line int) (string, bool) {
+	lines, ok := d.sources[file]
+	if !ok {
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+
+		d.sources[file] = lines
+	}
+
+	if line <= 0 || line > len(lines) {
+		return "", false
+	}
+
+	return lines[line-1], true
+}
+
+func frameName(f *vm.Frame) string {
+	if f.Code.Name == "" {
+		return "<lambda>"
+	}
+
+	return f.Code.Name
+}
+
+func (d *Debugger) location(f *vm.Frame) string {
+	file := f.Code.File
+	if file == "" {
+		file = "<unknown>"
+	}
+
+	return fmt.Sprintf("%s at %s:%d", frameName(f), file, f.Line())
+}
+
+func (d *Debugger) showLine(f *vm.Frame, line int, mark bool) bool {
+	src, ok := d.source(f.Code.File, line)
+	if !ok {
+		return false
+	}
+
+	prefix := "  "
+	if mark {
+		prefix = "=>"
+	}
+
+	fmt.Fprintf(d.out, "%s %4d  %s\n", prefix, line, src)
+
+	return true
+}
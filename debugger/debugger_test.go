@@ -0,0 +1,121 @@
+package debugger
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/parser"
+	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+const program = `a = 1
+f = x => {
+  y = x + a
+  y
+}
+b = f(2)
+b
+`
+
+func run(t *testing.T, commands string) (value.Value, string, error) {
+	p, err := parser.NewParser(program)
+	require.NoError(t, err)
+
+	tree, err := p.Parse()
+	require.NoError(t, err)
+
+	v, err := vm.NewVM()
+	require.NoError(t, err)
+
+	g, err := gen.NewGenerator(v, "__top__")
+	require.NoError(t, err)
+
+	g.File = "prog.m13"
+	g.Positions = p.Positions()
+
+	code, err := g.GenerateTop(tree)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+
+	New(v, strings.NewReader(commands), &out).Attach()
+
+	refs := make([]*value.Ref, code.NumRefs)
+
+	for i := range refs {
+		refs[i] = &value.Ref{}
+	}
+
+	val, err := v.ExecuteContext(context.TODO(), value.ExecuteContext{
+		Code: code,
+		Refs: refs,
+	})
+
+	return val, out.String(), err
+}
+
+func TestDebugger(t *testing.T) {
+	n := neko.Start(t)
+
+	n.It("stops at the first line", func() {
+		val, out, err := run(t, "c\n")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), val)
+		assert.Contains(t, out, "stopped (step) in __top__ at prog.m13:1")
+	})
+
+	n.It("stops at a breakpoint inside a lambda", func() {
+		val, out, err := run(t, "break prog.m13:4\nc\nlocals\nbt\nc\n")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), val)
+
+		assert.Contains(t, out, "breakpoint 1 at prog.m13:4")
+		assert.Contains(t, out, "stopped (breakpoint 1) in <lambda> at prog.m13:4")
+		assert.Contains(t, out, "x = 2\ny = 3\na = 1\n")
+		assert.Contains(t, out, "#0 <lambda> at prog.m13:4\n#1 __top__ at prog.m13:6\n")
+	})
+
+	n.It("evaluates expressions in the paused frame", func() {
+		_, out, err := run(t, "break 3\nc\np x + a\np nope\nc\n")
+		require.NoError(t, err)
+
+		assert.Contains(t, out, "(m13) 3\n")
+		assert.Contains(t, out, "error: unknown variable: nope")
+	})
+
+	n.It("steps into, over and out of calls", func() {
+		_, out, err := run(t, "n\nn\ns\ns\nout\nc\n")
+		require.NoError(t, err)
+
+		assert.Contains(t, out, "stopped (step) in __top__ at prog.m13:2")
+		assert.Contains(t, out, "stopped (step) in __top__ at prog.m13:6")
+		assert.Contains(t, out, "stopped (step) in <lambda> at prog.m13:3")
+		assert.Contains(t, out, "stopped (step) in <lambda> at prog.m13:4")
+
+		idx := strings.LastIndex(out, "stopped")
+		assert.Contains(t, out[idx:], "in __top__ at prog.m13:6")
+	})
+
+	n.It("aborts the program on quit", func() {
+		_, _, err := run(t, "q\n")
+		assert.Equal(t, ErrQuit, err)
+	})
+
+	n.It("lets the program finish when input runs out", func() {
+		val, _, err := run(t, "")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), val)
+	})
+
+	n.Meow()
+}
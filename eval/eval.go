@@ -2,49 +2,262 @@ package eval
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/evanphx/m13/ast"
 	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/loader"
 	"github.com/evanphx/m13/parser"
 	"github.com/evanphx/m13/value"
 	"github.com/evanphx/m13/vm"
 )
 
+// Evaluator is a session that runs snippets of code one after another.
+// Variables assigned at the top level of a snippet stay bound for the ones
+// that follow, as do classes, methods and imports.
 type Evaluator struct {
-}
+	vm   *vm.VM
+	ctx  context.Context
+	self value.Value
 
-func NewEvaluator() (*Evaluator, error) {
-	return &Evaluator{}, nil
+	refs  map[string]*value.Ref
+	names []string
+
+	sandboxed bool
 }
 
-func (e *Evaluator) Eval(code string) (value.Value, error) {
-	parser, err := parser.NewParser(code)
+// evalPackage identifies the code of every Evaluator to private methods. No
+// loaded package has it, as they're identified by path.
+const evalPackage = "<eval>"
+
+func NewEvaluator() (*Evaluator, error) {
+	v, err := vm.NewVM()
 	if err != nil {
 		return nil, err
 	}
 
-	tree, err := parser.Parse()
+	return NewSession(context.Background(), v, ".")
+}
+
+// NewSession returns an Evaluator running in v. Relative imports are
+// resolved against relbase.
+func NewSession(ctx context.Context, v *vm.VM, relbase string) (*Evaluator, error) {
+	e := &Evaluator{
+		vm:   v,
+		ctx:  loader.SetupContext(ctx, v, relbase),
+		self: v.Registry().OpenPackage("main"),
+		refs: make(map[string]*value.Ref),
+	}
+
+	return e, nil
+}
+
+// NewSandbox returns an Evaluator for untrusted code, which can only reach
+// what sb allows. Combine it with vm.SetLimits to bound the resources the
+// code may use.
+func NewSandbox(ctx context.Context, v *vm.VM, sb *loader.Sandbox) (*Evaluator, error) {
+	e := &Evaluator{
+		vm:        v,
+		ctx:       loader.SetupSandbox(ctx, v, sb, ""),
+		self:      v.Registry().OpenPackage("main"),
+		refs:      make(map[string]*value.Ref),
+		sandboxed: true,
+	}
+
+	return e, nil
+}
+
+func (e *Evaluator) VM() *vm.VM {
+	return e.vm
+}
+
+func (e *Evaluator) Context() context.Context {
+	return e.ctx
+}
+
+// Names returns the variables bound in the session, in the order they
+// were first assigned.
+func (e *Evaluator) Names() []string {
+	return e.names
+}
+
+func (e *Evaluator) Get(name string) (value.Value, bool) {
+	ref, ok := e.refs[name]
+	if !ok {
+		return nil, false
+	}
+
+	return ref.Value, true
+}
+
+// Set binds name to val for the code evaluated afterwards.
+func (e *Evaluator) Set(name string, val value.Value) {
+	e.ref(name).Value = val
+}
+
+func (e *Evaluator) ref(name string) *value.Ref {
+	ref, ok := e.refs[name]
+	if !ok {
+		ref = &value.Ref{}
+
+		e.refs[name] = ref
+		e.names = append(e.names, name)
+	}
+
+	return ref
+}
+
+// topLevel calls f with every node of tree that runs in the top level
+// scope, skipping the bodies of lambdas.
+func topLevel(tree ast.Node, f func(ast.Node)) {
+	ast.Descend(tree, func(n ast.Node) bool {
+		if _, ok := n.(*ast.Lambda); ok {
+			return false
+		}
+
+		f(n)
+
+		return true
+	})
+}
+
+func (e *Evaluator) Eval(code string) (val value.Value, err error) {
+	// Untrusted code must not be able to take down the host, even by
+	// tripping over a bug in the VM.
+	if e.sandboxed {
+		defer func() {
+			if r := recover(); r != nil {
+				val, err = nil, fmt.Errorf("internal error: %v", r)
+			}
+		}()
+	}
+
+	p, err := parser.NewParser(code)
 	if err != nil {
 		return nil, err
 	}
 
-	vm, err := vm.NewVM()
+	tree, err := p.Parse()
 	if err != nil {
 		return nil, err
 	}
 
-	g, err := gen.NewGenerator(vm, "eval")
+	if tree == nil {
+		return e.vm.Nil(), nil
+	}
+
+	tree = gen.DesugarAST(tree)
+
+	// Every top level variable becomes a session binding, so they are all
+	// known to the generator as outer variables.
+	var (
+		assigned = make(map[string]bool)
+		outer    = append([]string(nil), e.names...)
+	)
+
+	topLevel(tree, func(n ast.Node) {
+		if a, ok := n.(*ast.Assign); ok && !assigned[a.Name] {
+			assigned[a.Name] = true
+
+			if _, bound := e.refs[a.Name]; !bound {
+				outer = append(outer, a.Name)
+			}
+		}
+	})
+
+	g, err := gen.NewGenerator(e.vm, "__eval__")
 	if err != nil {
 		return nil, err
 	}
 
+	g.Outer = outer
+	g.Positions = p.Positions()
+
 	co, err := g.GenerateTop(tree)
 	if err != nil {
 		return nil, err
 	}
 
+	co.SetPackage(evalPackage)
+
+	refs := make([]*value.Ref, co.NumRefs)
+
+	for i, name := range co.RefNames {
+		refs[i] = e.ref(name)
+	}
+
 	ctx := value.ExecuteContext{
 		Code: co,
+		Self: e.self,
+		Refs: refs,
+	}
+
+	return e.vm.ExecuteContext(e.ctx, ctx)
+}
+
+// Inspect returns val.^inspect, the description of val used by the REPL.
+func (e *Evaluator) Inspect(val value.Value) (string, error) {
+	if val == nil {
+		val = e.vm.Nil()
+	}
+
+	mirror, err := e.vm.Mirror(e.ctx, val)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := e.vm.Send(e.ctx, mirror, "inspect")
+	if err != nil {
+		return "", err
+	}
+
+	str, ok := res.(*value.String)
+	if !ok {
+		return value.Inspect(e.vm, res), nil
+	}
+
+	return str.String, nil
+}
+
+// Incomplete reports whether src ends inside an unclosed brace, paren,
+// bracket or string, meaning more input is needed before it can be
+// evaluated.
+func Incomplete(src string) bool {
+	var (
+		depth    int
+		inString bool
+		escaped  bool
+		comment  bool
+	)
+
+	for _, r := range src {
+		switch {
+		case comment:
+			if r == '\n' {
+				comment = false
+			}
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inString = false
+			}
+		default:
+			switch r {
+			case '"':
+				inString = true
+			case '#':
+				comment = true
+			case '{', '(', '[':
+				depth++
+			case '}', ')', ']':
+				depth--
+			}
+		}
 	}
 
-	return vm.ExecuteContext(context.TODO(), ctx)
+	return inString || depth > 0
 }
@@ -1,10 +1,18 @@
 package eval
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/loader"
 	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vektra/neko"
@@ -65,5 +73,375 @@ func TestEvaluator(t *testing.T) {
 		assert.Equal(t, "I64", i.Name)
 	})
 
+	n.It("keeps top level variables between evaluations", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		_, err = ev.Eval(`a = 3`)
+		require.NoError(t, err)
+
+		_, err = ev.Eval(`b = a + 4`)
+		require.NoError(t, err)
+
+		val, err := ev.Eval(`b`)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(7), val)
+
+		assert.Equal(t, []string{"a", "b"}, ev.Names())
+
+		a, ok := ev.Get("a")
+		require.True(t, ok)
+
+		assert.Equal(t, value.I64(3), a)
+	})
+
+	n.It("shares bindings with lambdas from earlier evaluations", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		_, err = ev.Eval(`a = 1; inc = => { a = a + 1 }`)
+		require.NoError(t, err)
+
+		_, err = ev.Eval(`inc(); inc()`)
+		require.NoError(t, err)
+
+		val, err := ev.Eval(`a`)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), val)
+	})
+
+	n.It("can have bindings set from Go", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		ev.Set("x", value.I64(40))
+
+		val, err := ev.Eval(`x + 2`)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(42), val)
+	})
+
+	n.It("reports undefined variables", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		_, err = ev.Eval(`nope + 1`)
+		require.Error(t, err)
+
+		ue, ok := err.(*gen.ErrUndefined)
+		require.True(t, ok, fmt.Sprintf("%T", err))
+
+		assert.Equal(t, "nope", ue.Name)
+		assert.Equal(t, 1, ue.Line)
+	})
+
+	n.It("inspects values through their mirror", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		val, err := ev.Eval(`"hello"`)
+		require.NoError(t, err)
+
+		str, err := ev.Inspect(val)
+		require.NoError(t, err)
+
+		assert.Equal(t, `"hello"`, str)
+
+		val, err = ev.Eval(`3.^class`)
+		require.NoError(t, err)
+
+		str, err = ev.Inspect(val)
+		require.NoError(t, err)
+
+		assert.Equal(t, "builtin.I64", str)
+	})
+
+	n.It("can import packages defined from Go", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		err = ev.VM().Define("host.double", func(x int64) int64 {
+			return x * 2
+		})
+		require.NoError(t, err)
+
+		_, err = ev.VM().DefineClass("host.Box", evalBox{})
+		require.NoError(t, err)
+
+		val, err := ev.Eval("import host\nb = host.Box.new()\nb.label = \"hi\"\nhost.double(21)")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(42), val)
+
+		val, err = ev.Eval("b.label")
+		require.NoError(t, err)
+
+		str, ok := val.(*value.String)
+		require.True(t, ok)
+
+		assert.Equal(t, "hi", str.String)
+	})
+
+	n.It("denies sandboxed code what it wasn't given", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		err = v.Define("rules.double", func(x int64) int64 {
+			return x * 2
+		})
+		require.NoError(t, err)
+
+		err = v.Define("host.exit", func() {})
+		require.NoError(t, err)
+
+		ev, err := NewSandbox(context.Background(), v, &loader.Sandbox{
+			Scoped:   map[string]value.Value{"limit": value.I64(10)},
+			Packages: []string{"rules"},
+		})
+		require.NoError(t, err)
+
+		val, err := ev.Eval("import rules\nrules.double($limit)")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(20), val)
+
+		_, err = ev.Eval("$stdout")
+		require.Error(t, err)
+
+		denied, ok := err.(*value.ErrDenied)
+		require.True(t, ok, fmt.Sprintf("%T", err))
+
+		assert.Equal(t, "stdout", denied.Name)
+
+		_, err = ev.Eval("import host")
+		assert.IsType(t, &value.ErrDenied{}, err)
+
+		_, err = ev.Eval("import test")
+		assert.IsType(t, &value.ErrDenied{}, err)
+
+		_, err = ev.Eval("import .secret")
+		assert.IsType(t, &value.ErrDenied{}, err)
+	})
+
+	n.It("only shows sandboxed code the packages it could import", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		for _, pkg := range []string{"private/secret", "public/shared"} {
+			path := filepath.Join(dir, pkg)
+
+			require.NoError(t, os.MkdirAll(path, 0755))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(path, "pkg.m13"), []byte("def x() { 1 }\n"), 0644))
+		}
+
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		lo, _ := loader.FromContext(ev.Context())
+		lo.Search = []string{filepath.Join(dir, "private"), filepath.Join(dir, "public")}
+
+		_, err = ev.Eval("import secret\nimport shared")
+		require.NoError(t, err)
+
+		val, err := ev.Eval("$LOADER.loaded()")
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, val.(*value.Map).Len())
+
+		sb, err := NewSandbox(context.Background(), ev.VM(), &loader.Sandbox{
+			Roots: []string{filepath.Join(dir, "public")},
+		})
+		require.NoError(t, err)
+
+		val, err = sb.Eval("$LOADER.loaded()")
+		require.NoError(t, err)
+
+		loaded := val.(*value.Map)
+
+		assert.Equal(t, 1, loaded.Len())
+
+		_, ok := loaded.Get(ev.VM().NewString(filepath.Join(dir, "public", "shared")))
+		assert.True(t, ok)
+
+		_, ok = loaded.Get(ev.VM().NewString(filepath.Join(dir, "private", "secret")))
+		assert.False(t, ok)
+	})
+
+	n.It("stops code that exceeds its limits", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		ev, err := NewSandbox(context.Background(), v, &loader.Sandbox{})
+		require.NoError(t, err)
+
+		v.SetLimits(vm.Limits{MaxInstructions: 1000, MaxDepth: 4})
+
+		_, err = ev.Eval("i = 0\nwhile i < i + 1 { i = i + 1 }")
+		require.Error(t, err)
+
+		limit, ok := err.(*vm.ErrLimitExceeded)
+		require.True(t, ok, fmt.Sprintf("%T", err))
+
+		assert.Equal(t, "instructions", limit.Limit)
+
+		// The count starts over for each evaluation.
+		val, err := ev.Eval("i = 0\nwhile i < 10 { i = i + 1 }\ni")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(10), val)
+
+		_, err = ev.Eval("f = n => { f(n) }\nf(1)")
+		require.Error(t, err)
+
+		limit, ok = err.(*vm.ErrLimitExceeded)
+		require.True(t, ok, fmt.Sprintf("%T", err))
+
+		assert.Equal(t, "call depth", limit.Limit)
+
+		v.SetLimits(vm.Limits{MaxDuration: time.Millisecond})
+
+		_, err = ev.Eval("i = 0\nwhile i < i + 1 { i = i + 1 }")
+		require.Error(t, err)
+
+		limit, ok = err.(*vm.ErrLimitExceeded)
+		require.True(t, ok, fmt.Sprintf("%T", err))
+
+		assert.Equal(t, "execution time", limit.Limit)
+
+		v.SetLimits(vm.Limits{MaxSize: 8})
+
+		sizes := []struct {
+			code, limit string
+		}{
+			{"s = \"ab\"\nwhile 1 { s = s + s }", "string size"},
+			{"l = []\nwhile 1 { l << 1 }", "list size"},
+			{"[1, 2, 3, 4, 5, 6, 7, 8, 9]", "list size"},
+			{"{ a: 1, b: 2, c: 3, d: 4, e: 5, f: 6, g: 7, h: 8, i: 9 }", "map size"},
+		}
+
+		for _, s := range sizes {
+			_, err = ev.Eval(s.code)
+			require.Error(t, err, s.code)
+
+			limit, ok = err.(*vm.ErrLimitExceeded)
+			require.True(t, ok, fmt.Sprintf("%T", err))
+
+			assert.Equal(t, s.limit, limit.Limit)
+			assert.Equal(t, 8, limit.Max)
+		}
+
+		val, err = ev.Eval("{ a: 1, a: 2, a: 3, a: 4, a: 5, a: 6, a: 7, a: 8, a: 9 }")
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, val.(*value.Map).Len())
+	})
+
+	n.It("rescues raised values and errors", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		val, err := ev.Eval("f = => \"boom\".^raise()\nf.rescue(e => e)")
+		require.NoError(t, err)
+
+		str, ok := val.(*value.String)
+		require.True(t, ok, fmt.Sprintf("%T", val))
+
+		assert.Equal(t, "boom", str.String)
+
+		val, err = ev.Eval("g = => 1.nope()\ng.rescue(e => e.message)")
+		require.NoError(t, err)
+
+		str, ok = val.(*value.String)
+		require.True(t, ok, fmt.Sprintf("%T", val))
+
+		assert.Equal(t, "unknown operation 'nope' on 'builtin.I64'", str.String)
+
+		_, err = ev.Eval("h = => \"boom\".^raise()\nh()")
+		require.Error(t, err)
+
+		assert.Equal(t, "boom", err.Error())
+	})
+
+	n.It("doesn't rescue exceeded limits", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		ev, err := NewSandbox(context.Background(), v, &loader.Sandbox{})
+		require.NoError(t, err)
+
+		v.SetLimits(vm.Limits{MaxDepth: 4})
+
+		_, err = ev.Eval("f = n => { f(n) }\ng = => f(1)\ng.rescue(e => 1)")
+		require.Error(t, err)
+
+		_, ok := err.(*vm.ErrLimitExceeded)
+		assert.True(t, ok, fmt.Sprintf("%T", err))
+	})
+
+	n.It("calls method_missing for unknown methods", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		val, err := ev.Eval("class Ghost {\n  def method_missing(name, args) {\n    name + args.at(1).^inspect\n  }\n}\nGhost.new().boo(1, 2)")
+		require.NoError(t, err)
+
+		str, ok := val.(*value.String)
+		require.True(t, ok, fmt.Sprintf("%T", val))
+
+		assert.Equal(t, "boo2", str.String)
+	})
+
+	n.It("checks what class a value is a kind of", func() {
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		ev.Set("integer", ev.VM().Registry().I64Class.Parent)
+
+		for src, want := range map[string]bool{
+			"nil.^is_a(nil.^class)": true,
+			"3.^is_a(3.^class)":     true,
+			"3.^is_a(integer)":      true,
+			"3.^is_a(\"a\".^class)": false,
+			"nil.^is_a(3.^class)":   false,
+		} {
+			val, err := ev.Eval(src)
+			require.NoError(t, err, src)
+
+			assert.Equal(t, want, val == ev.VM().True(), src)
+		}
+	})
+
+	n.It("runs the test library without a test runner", func() {
+		src, err := ioutil.ReadFile("../test/expectations.m13")
+		require.NoError(t, err)
+
+		ev, err := NewEvaluator()
+		require.NoError(t, err)
+
+		lo, _ := loader.FromContext(ev.Context())
+		lo.Search = []string{"../lib"}
+
+		_, err = ev.Eval(string(src))
+		require.NoError(t, err)
+	})
+
+	n.It("detects incomplete input", func() {
+		assert.True(t, Incomplete(`f = x => {`))
+		assert.True(t, Incomplete(`foo(1,`))
+		assert.True(t, Incomplete(`"abc`))
+		assert.False(t, Incomplete(`f = x => { x }`))
+		assert.False(t, Incomplete(`"{"`))
+		assert.False(t, Incomplete("a # {"))
+	})
+
 	n.Meow()
 }
+
+type evalBox struct {
+	Label string
+}
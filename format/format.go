@@ -0,0 +1,426 @@
+// Package format prints m13 source in its canonical style.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/parser"
+)
+
+// Indent is the text each level of braces indents by.
+const Indent = "  "
+
+// Source formats src. The source must parse, and the formatted source
+// always parses to the same tree.
+func Source(src []byte) ([]byte, error) {
+	p, err := parser.NewParser(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	cst, err := p.ParseCST()
+	if err != nil {
+		return nil, err
+	}
+
+	// First try respacing everything. If that changes the parse tree,
+	// fall back to only reindenting lines and copy the spacing within
+	// each line as is.
+	for _, full := range []bool{true, false} {
+		out := newPrinter(cst, full).print()
+
+		if same(cst.Root.Node, out) {
+			return out, nil
+		}
+	}
+
+	return nil, fmt.Errorf("format: unable to format without changing the source's meaning")
+}
+
+// same reports whether src parses to tree, ignoring the whitespace at the
+// end of comments.
+func same(tree ast.Node, src []byte) bool {
+	p, err := parser.NewParser(string(src))
+	if err != nil {
+		return false
+	}
+
+	other, err := p.Parse()
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(trimComments(tree), trimComments(other))
+}
+
+func trimComments(n ast.Node) ast.Node {
+	if n == nil {
+		return nil
+	}
+
+	ast.Descend(n, func(n ast.Node) bool {
+		if c, ok := n.(*ast.Comment); ok {
+			c.Comment = strings.TrimRight(c.Comment, " \t")
+		}
+
+		return true
+	})
+
+	return n
+}
+
+type spacing uint8
+
+const (
+	// keep collapses any whitespace to a single space.
+	keep spacing = iota
+	none
+	one
+
+	// raw copies the whitespace exactly.
+	raw
+)
+
+type printer struct {
+	c   *parser.CST
+	out bytes.Buffer
+
+	// spaces is how to space the gap before each token, rawTok the tokens
+	// copied as is without being looked at.
+	spaces []spacing
+	rawTok []bool
+
+	braces int
+}
+
+func newPrinter(c *parser.CST, full bool) *printer {
+	p := &printer{
+		c:      c,
+		spaces: make([]spacing, len(c.Tokens)),
+		rawTok: make([]bool, len(c.Tokens)),
+	}
+
+	if full {
+		p.spaceOperators()
+		p.spaceNodes(c.Root)
+	} else {
+		for i := range p.spaces {
+			p.spaces[i] = raw
+		}
+	}
+
+	p.rawNodes(c.Root)
+
+	return p
+}
+
+func (p *printer) text(i int) string {
+	if i < 0 || i >= len(p.c.Tokens) {
+		return ""
+	}
+
+	return p.c.Tokens[i].Text
+}
+
+func isOpChar(s string) bool {
+	switch s {
+	case "*", "+", "-", "=", "<", ">":
+		return true
+	default:
+		return false
+	}
+}
+
+// endsExpr reports whether token i can be the last token of an expression,
+// which makes any operator following it binary.
+func (p *printer) endsExpr(i int) bool {
+	switch p.c.Tokens[i].Kind {
+	case parser.TokenWord, parser.TokenNumber, parser.TokenString:
+		return true
+	}
+
+	switch p.text(i) {
+	case ")", "]", "}":
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *printer) gapless(i int) bool {
+	return len(p.c.Tokens[i-1].Trailing) == 0 && len(p.c.Tokens[i].Leading) == 0
+}
+
+// spaceOperators puts a space on either side of binary operators,
+// assignments and lambda arrows. The runes of an operator are separate
+// tokens, so the runs of them are found first.
+func (p *printer) spaceOperators() {
+	for i := 1; i < len(p.c.Tokens); i++ {
+		if !isOpChar(p.text(i)) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(p.c.Tokens) && isOpChar(p.text(end)) && p.gapless(end) {
+			end++
+		}
+
+		op := ""
+		for j := i; j < end; j++ {
+			op += p.text(j)
+		}
+
+		switch {
+		case op == "++" || op == "--":
+			// Postfix, which can't have a space before it.
+		case op == "=>":
+			if p.text(i-1) != "(" && p.text(i-1) != "[" {
+				p.spaces[i] = one
+			}
+
+			p.spaces[end] = one
+		case p.endsExpr(i - 1):
+			p.spaces[i] = one
+			p.spaces[end] = one
+		}
+
+		i = end - 1
+	}
+}
+
+// spaceNodes handles the spacing that depends on what's being parsed,
+// overriding spaceOperators.
+func (p *printer) spaceNodes(n *parser.CSTNode) {
+	switch n.Node.(type) {
+	case *ast.NamedArg:
+		if p.text(n.First+1) == "=" {
+			p.spaces[n.First+1] = none
+			p.spaces[n.First+2] = none
+		}
+	case *ast.Pair, *ast.ArgDef:
+		if len(n.Children) > 0 {
+			val := n.Children[len(n.Children)-1]
+			colon := val.First - 1
+
+			if colon > n.First && p.text(colon) == ":" {
+				p.spaces[colon] = none
+				p.spaces[val.First] = one
+			}
+		}
+	}
+
+	for _, child := range n.Children {
+		p.spaceNodes(child)
+	}
+}
+
+// rawNodes marks the nodes whose text must not change, such as types and
+// the Go code of a gdef.
+func (p *printer) rawNodes(n *parser.CSTNode) {
+	switch n.Node.(type) {
+	case *ast.GoDefinition:
+		for i := n.First + 1; i < n.Last; i++ {
+			p.spaces[i] = raw
+			p.rawTok[i] = true
+		}
+
+		return
+	case *ast.Type, *ast.Atom, *ast.IVar, *ast.ScopeVar, *ast.Integer, *ast.String:
+		for i := n.First + 1; i < n.Last; i++ {
+			p.spaces[i] = raw
+		}
+	}
+
+	for _, child := range n.Children {
+		p.rawNodes(child)
+	}
+}
+
+// spaceBetween decides the spacing of a gap within a line.
+func (p *printer) spaceBetween(i int) spacing {
+	if s := p.spaces[i]; s != keep {
+		return s
+	}
+
+	a, b := p.text(i-1), p.text(i)
+
+	switch {
+	case b == "," || b == ";":
+		return none
+	case a == "," || a == ";":
+		return one
+	case a == "(" || a == "[" || b == ")" || b == "]":
+		return none
+	case a == "{" && b == "}":
+		return none
+	case a == "{" || b == "{" || b == "}":
+		return one
+	case a == "}" && p.c.Tokens[i].Kind == parser.TokenWord:
+		return one
+	}
+
+	return keep
+}
+
+func (p *printer) print() []byte {
+	for i, tok := range p.c.Tokens {
+		p.gap(i)
+
+		if tok.Kind == parser.TokenEOF {
+			break
+		}
+
+		p.out.WriteString(tok.Text)
+
+		if p.rawTok[i] {
+			continue
+		}
+
+		switch tok.Text {
+		case "{":
+			p.braces++
+		case "}":
+			if p.braces > 0 {
+				p.braces--
+			}
+		}
+	}
+
+	if p.out.Len() > 0 {
+		p.out.WriteByte('\n')
+	}
+
+	return p.out.Bytes()
+}
+
+// trivia returns the whitespace and comments before token i.
+func (p *printer) trivia(i int) []parser.Trivia {
+	var ts []parser.Trivia
+
+	if i > 0 {
+		ts = append(ts, p.c.Tokens[i-1].Trailing...)
+	}
+
+	return append(ts, p.c.Tokens[i].Leading...)
+}
+
+// gap writes what goes between token i and the one before it. Lines keep
+// their place, but are reindented and lose trailing whitespace, and runs
+// of blank lines become one.
+func (p *printer) gap(i int) {
+	ts := p.trivia(i)
+	tok := p.c.Tokens[i]
+
+	if i > 0 && p.spaces[i] == raw && p.rawTok[i] {
+		for _, t := range ts {
+			p.out.WriteString(t.Text)
+		}
+
+		return
+	}
+
+	// lines[0] is what follows the previous token on its line. The start
+	// of the source counts as a line of its own.
+	lines := [][]parser.Trivia{nil}
+	if i == 0 {
+		lines = append(lines, nil)
+	}
+
+	for _, t := range ts {
+		if t.Kind == parser.TokenNewline {
+			lines = append(lines, nil)
+		} else {
+			lines[len(lines)-1] = append(lines[len(lines)-1], t)
+		}
+	}
+
+	if len(lines) == 1 {
+		if com, ok := comment(lines[0]); ok {
+			p.out.WriteString(" " + com)
+		} else if tok.Kind != parser.TokenEOF {
+			p.space(i, lines[0])
+		}
+
+		return
+	}
+
+	if com, ok := comment(lines[0]); ok {
+		p.out.WriteString(" " + com)
+	}
+
+	// Blank lines at the start of a block are dropped, as are those at
+	// the end below.
+	blank := false
+	first := p.text(i-1) == "{"
+
+	for _, line := range lines[1 : len(lines)-1] {
+		com, ok := comment(line)
+		if !ok {
+			blank = !first
+			continue
+		}
+
+		p.newline(blank, p.braces)
+		p.out.WriteString(com)
+
+		blank = false
+		first = false
+	}
+
+	if tok.Kind == parser.TokenEOF {
+		return
+	}
+
+	depth := p.braces
+	if tok.Text == "}" && depth > 0 {
+		depth--
+		blank = false
+	}
+
+	p.newline(blank, depth)
+}
+
+// space writes the whitespace ws between token i and the one before it
+// on the same line.
+func (p *printer) space(i int, ws []parser.Trivia) {
+	s := p.spaceBetween(i)
+
+	switch {
+	case s == raw:
+		for _, t := range ws {
+			p.out.WriteString(t.Text)
+		}
+	case s == one, s == keep && len(ws) > 0:
+		p.out.WriteByte(' ')
+	}
+}
+
+// newline starts a new line indented depth levels, after a blank line if
+// there was one in the source. The source starts without either.
+func (p *printer) newline(blank bool, depth int) {
+	if p.out.Len() > 0 {
+		p.out.WriteByte('\n')
+
+		if blank {
+			p.out.WriteByte('\n')
+		}
+	}
+
+	p.out.WriteString(strings.Repeat(Indent, depth))
+}
+
+// comment returns the comment in a line's trivia, without the whitespace
+// that trails it.
+func comment(line []parser.Trivia) (string, bool) {
+	for _, t := range line {
+		if t.Kind == parser.TokenComment {
+			return strings.TrimRight(t.Text, " \t"), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,97 @@
+package format
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestFormat(t *testing.T) {
+	n := neko.Start(t)
+
+	check := func(src, expected string) {
+		out, err := Source([]byte(src))
+		require.NoError(t, err)
+
+		assert.Equal(t, expected, string(out))
+
+		again, err := Source(out)
+		require.NoError(t, err)
+
+		assert.Equal(t, expected, string(again))
+	}
+
+	n.It("spaces operators, commas and assignments", func() {
+		check("x=a+b*(c-1)\nfoo(1 ,2,3)\n", "x = a + b * (c - 1)\nfoo(1, 2, 3)\n")
+	})
+
+	n.It("spaces lambdas", func() {
+		check("f(=>1)\nx=>{ x }\n(a,b)=>a\n", "f(=> 1)\nx => { x }\n(a, b) => a\n")
+	})
+
+	n.It("keeps named arguments together", func() {
+		check("foo(1,b= 2,c=3)\n", "foo(1, b=2, c=3)\n")
+	})
+
+	n.It("spaces map literals", func() {
+		check("a = {x:1,y : 2,z: :a }\nb = { }\n", "a = { x: 1, y: 2, z: :a }\nb = {}\n")
+	})
+
+	n.It("spaces argument types", func() {
+		check("def foo(a : Int,b:[]*Int) {\n  a\n}\n", "def foo(a: Int, b: []*Int) {\n  a\n}\n")
+	})
+
+	n.It("leaves operator method names alone", func() {
+		check("def equal|==(o) { 1 }\nx.+(1)\nx++\n", "def equal|==(o) { 1 }\nx.+(1)\nx++\n")
+	})
+
+	n.It("reindents and trims blank lines", func() {
+		src := "\n\nclass Foo {\n\n    def bar {\n 1\n}\n\n\n\n    def baz { 2 }\n\n}\n\n"
+
+		check(src, "class Foo {\n  def bar {\n    1\n  }\n\n  def baz { 2 }\n}\n")
+	})
+
+	n.It("preserves comments", func() {
+		src := "# top   \n\ndef x {   # why\n      # inner\n  1\n}\n# end\n"
+
+		check(src, "# top\n\ndef x { # why\n  # inner\n  1\n}\n# end\n")
+	})
+
+	n.It("leaves Go code alone", func() {
+		src := "gdef foo(a) {\n\tif a {   return 1 }\n}\n"
+
+		check(src, src)
+	})
+
+	n.It("returns parse errors", func() {
+		_, err := Source([]byte("foo(1,"))
+		require.Error(t, err)
+	})
+
+	n.It("has formatted the repository's source", func() {
+		paths, err := filepath.Glob("../*/*.m13")
+		require.NoError(t, err)
+
+		more, err := filepath.Glob("../*/*/*.m13")
+		require.NoError(t, err)
+
+		paths = append(paths, more...)
+		require.NotEmpty(t, paths)
+
+		for _, path := range paths {
+			src, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+
+			out, err := Source(src)
+			require.NoError(t, err)
+
+			assert.Equal(t, string(src), string(out), path)
+		}
+	})
+
+	n.Meow()
+}
@@ -25,10 +25,27 @@ type Generator struct {
 	subSequences []*Generator
 
 	signature *value.Signature
+
+	// Passes selects the optimizations run over the generated code. It
+	// defaults to AllPasses and is inherited by lambda bodies.
+	Passes Pass
+
+	// File and Positions, when set, are used to record which source line
+	// each instruction came from. Both are inherited by lambda bodies.
+	File      string
+	Positions ast.Positions
+
+	// Outer names variables that live outside the top level code, such as
+	// the bindings of an interactive session. The code reads and writes
+	// them through refs, listed in Code.RefNames.
+	Outer []string
+
+	line  int
+	lines []value.LineEntry
 }
 
 func NewGenerator(env value.Env, name string) (*Generator, error) {
-	g := &Generator{env: env, name: name}
+	g := &Generator{env: env, name: name, Passes: AllPasses}
 
 	return g, nil
 }
@@ -73,6 +90,52 @@ func (g *Generator) addCallsite(l string) (*value.CallSite, int) {
 	return cs, i
 }
 
+// markLine notes that the instructions generated from here on come from
+// line.
+func (g *Generator) markLine(line int) {
+	if line == 0 || line == g.line {
+		return
+	}
+
+	g.line = line
+
+	start := len(g.seq)
+
+	if l := len(g.lines); l > 0 && g.lines[l-1].Start == start {
+		g.lines[l-1].Line = line
+		return
+	}
+
+	g.lines = append(g.lines, value.LineEntry{Start: start, Line: line})
+}
+
+// relocateLines moves the line table to match the instruction stream after
+// the optimizer removed instructions. reloc maps old positions to new.
+func relocateLines(lines []value.LineEntry, reloc []int, size int) []value.LineEntry {
+	if reloc == nil {
+		return lines
+	}
+
+	var out []value.LineEntry
+
+	for _, ent := range lines {
+		start := reloc[ent.Start]
+
+		if start >= size {
+			break
+		}
+
+		if l := len(out); l > 0 && out[l-1].Start == start {
+			out[l-1].Line = ent.Line
+			continue
+		}
+
+		out = append(out, value.LineEntry{Start: start, Line: ent.Line})
+	}
+
+	return out
+}
+
 func (g *Generator) Reserve(slot int) {
 	g.sp = slot
 }
@@ -82,10 +145,24 @@ func (g *Generator) Sequence() []insn.Instruction {
 }
 
 func (g *Generator) GenerateTop(gn ast.Node) (*value.Code, error) {
-	gn = DesugarAST(gn)
+	gn = desugar(gn, g.Positions)
+
+	if g.Passes&FoldConstants != 0 {
+		gn = FoldIntegers(gn)
+	}
 
 	scope := NewScope()
 
+	if len(g.Outer) > 0 {
+		outer := NewScope()
+
+		for _, name := range g.Outer {
+			outer.Variables[name] = &Variable{Name: name}
+		}
+
+		scope.Parent = outer
+	}
+
 	err := g.walkScope(gn, scope)
 	if err != nil {
 		return nil, err
@@ -120,12 +197,14 @@ func (g *Generator) Code() (*value.Code, error) {
 		subs = append(subs, c)
 	}
 
-	var p PeepholeOptz
+	seq, reloc := g.Passes.optimize(g.seq)
 
-	p.Optimize(g.seq)
+	g.seq = seq
+	g.lines = relocateLines(g.lines, reloc, len(seq))
 
 	code := &value.Code{
 		Name:         g.name,
+		File:         g.File,
 		NumRegs:      g.maxReg + 1,
 		NumRefs:      len(g.scope.Refs),
 		Instructions: g.seq,
@@ -133,6 +212,9 @@ func (g *Generator) Code() (*value.Code, error) {
 		Calls:        g.calls,
 		SubCode:      subs,
 		Signature:    g.signature,
+		Lines:        g.lines,
+		LocalNames:   g.scope.Locals,
+		RefNames:     g.scope.Refs,
 	}
 
 	return code, nil
@@ -163,6 +245,14 @@ func (g *Generator) GenerateLambda(gn ast.Node, sc *ast.Scope) error {
 	g.sp += len(sc.Locals)
 	g.maxReg = g.sp
 
+	// Arguments arrive in registers, so the ones closures capture have to
+	// be moved into their refs before anything reads them.
+	for reg := 0; reg < len(sc.Locals); reg++ {
+		if ref, ok := sc.ArgRefs[reg]; ok {
+			g.seq = append(g.seq, insn.Builder.StoreRef(ref, reg))
+		}
+	}
+
 	err := g.GenerateScoped(gn, sc)
 	if err != nil {
 		return err
@@ -174,111 +264,163 @@ func (g *Generator) GenerateLambda(gn ast.Node, sc *ast.Scope) error {
 }
 
 func DesugarAST(gn ast.Node) ast.Node {
+	return desugar(gn, nil)
+}
+
+// desugar rewrites gn like DesugarAST, carrying the position of each
+// rewritten statement over to its replacement.
+func desugar(gn ast.Node, pos ast.Positions) ast.Node {
 	return ast.Rewrite(gn, func(gn ast.Node) ast.Node {
-		switch n := gn.(type) {
-		case *ast.Import:
-			if n.Relative {
-				return &ast.Assign{
-					Name: n.Path[len(n.Path)-1],
-					Value: &ast.Call{
-						Receiver:   &ast.ScopeVar{Name: "LOADER"},
-						MethodName: "import_relative",
-						Args: &ast.Args{
-							Args: []ast.Node{
-								&ast.String{Value: strings.Join(n.Path, ".")},
-							},
+		n := desugarNode(gn)
+
+		if p, ok := pos[gn]; ok && n != gn {
+			pos[n] = p
+		}
+
+		return n
+	})
+}
+
+func desugarNode(gn ast.Node) ast.Node {
+	switch n := gn.(type) {
+	case *ast.Import:
+		if n.Relative {
+			return &ast.Assign{
+				Name: n.Path[len(n.Path)-1],
+				Value: &ast.Call{
+					Receiver:   &ast.ScopeVar{Name: "LOADER"},
+					MethodName: "import_relative",
+					Args: &ast.Args{
+						Args: []ast.Node{
+							&ast.String{Value: strings.Join(n.Path, ".")},
 						},
 					},
-				}
-			} else {
-				return &ast.Assign{
-					Name: n.Path[len(n.Path)-1],
-					Value: &ast.Call{
-						Receiver:   &ast.ScopeVar{Name: "LOADER"},
-						MethodName: "import",
-						Args: &ast.Args{
-							Args: []ast.Node{
-								&ast.String{Value: strings.Join(n.Path, ".")},
-							},
+				},
+			}
+		} else {
+			return &ast.Assign{
+				Name: n.Path[len(n.Path)-1],
+				Value: &ast.Call{
+					Receiver:   &ast.ScopeVar{Name: "LOADER"},
+					MethodName: "import",
+					Args: &ast.Args{
+						Args: []ast.Node{
+							&ast.String{Value: strings.Join(n.Path, ".")},
 						},
 					},
-				}
+				},
 			}
-		case *ast.Definition:
-			elements := []ast.Node{}
+		}
+	case *ast.Definition:
+		elements := []ast.Node{}
 
+		elements = append(elements,
+			&ast.UpCall{
+				Receiver:   &ast.Self{},
+				MethodName: "add_method",
+				Args: []ast.Node{
+					&ast.String{Value: n.Name.Name},
+					&ast.Lambda{
+						Name: n.Name.Name,
+						Args: n.Arguments,
+						Expr: n.Body,
+					},
+				},
+			},
+		)
+
+		if n.Name.Operator != "" {
 			elements = append(elements,
 				&ast.UpCall{
 					Receiver:   &ast.Self{},
-					MethodName: "add_method",
+					MethodName: "alias_method",
 					Args: []ast.Node{
 						&ast.String{Value: n.Name.Name},
-						&ast.Lambda{
-							Name: n.Name.Name,
-							Args: n.Arguments,
-							Expr: n.Body,
-						},
+						&ast.String{Value: n.Name.Operator},
 					},
 				},
 			)
+		}
 
-			if n.Name.Operator != "" {
-				elements = append(elements,
-					&ast.UpCall{
-						Receiver:   &ast.Self{},
-						MethodName: "alias_method",
-						Args: []ast.Node{
-							&ast.String{Value: n.Name.Name},
-							&ast.String{Value: n.Name.Operator},
-						},
-					},
-				)
-			}
+		if n.Private {
+			elements = append(elements, makePrivate(n.Name.Name))
+		}
 
-			return &ast.Block{Expressions: elements}
-		case *ast.ClassDefinition:
-			return &ast.Assign{
-				Name: n.Name,
-				Value: &ast.UpCall{
-					Receiver:   &ast.Self{},
-					MethodName: "add_class",
-					Args: []ast.Node{
-						&ast.String{Value: n.Name},
-						&ast.Lambda{
-							Name: n.Name + ".__body__",
-							Expr: n.Body,
-						},
+		return &ast.Block{Expressions: elements}
+	case *ast.ClassDefinition:
+		def := &ast.Assign{
+			Name: n.Name,
+			Value: &ast.UpCall{
+				Receiver:   &ast.Self{},
+				MethodName: "add_class",
+				Args: []ast.Node{
+					&ast.String{Value: n.Name},
+					&ast.Lambda{
+						Name: n.Name + ".__body__",
+						Expr: n.Body,
 					},
 				},
-			}
-		case *ast.Has:
-			var traits []ast.Node
+			},
+		}
 
-			for _, t := range n.Traits {
-				traits = append(traits, &ast.String{Value: t})
-			}
+		if !n.Private {
+			return def
+		}
 
-			return &ast.UpCall{
-				Receiver:   &ast.Self{},
-				MethodName: "add_ivar",
-				Args: []ast.Node{
-					&ast.String{Value: n.Variable},
-					&ast.List{Elements: traits},
-				},
-			}
-		case *ast.Attribute:
-			return &ast.Call{
-				Receiver:   n.Receiver,
-				MethodName: n.Name,
-				Args:       &ast.Args{},
-			}
-		default:
-			return n
+		return &ast.Block{
+			Expressions: []ast.Node{def, makePrivate(n.Name), &ast.Variable{Name: n.Name}},
 		}
-	})
+	case *ast.Has:
+		var traits []ast.Node
+
+		for _, t := range n.Traits {
+			traits = append(traits, &ast.String{Value: t})
+		}
+
+		return &ast.UpCall{
+			Receiver:   &ast.Self{},
+			MethodName: "add_ivar",
+			Args: []ast.Node{
+				&ast.String{Value: n.Variable},
+				&ast.List{Elements: traits},
+			},
+		}
+	case *ast.Attribute:
+		return &ast.Call{
+			Receiver:   n.Receiver,
+			MethodName: n.Name,
+			Args:       &ast.Args{},
+		}
+	case *ast.AttributeAssign:
+		return &ast.Call{
+			Receiver:   n.Receiver,
+			MethodName: n.Name + "=",
+			Args: &ast.Args{
+				Args: []ast.Node{n.Value},
+			},
+		}
+	default:
+		return n
+	}
+}
+
+// makePrivate hides the method name on self, along with its aliases, from
+// other packages.
+func makePrivate(name string) ast.Node {
+	return &ast.UpCall{
+		Receiver:   &ast.Self{},
+		MethodName: "make_private",
+		Args: []ast.Node{
+			&ast.String{Value: name},
+		},
+	}
 }
 
 func (g *Generator) GenerateScoped(gn ast.Node, scope *ast.Scope) error {
+	if p, ok := g.Positions[gn]; ok {
+		g.markLine(p.Line)
+	}
+
 	switch n := gn.(type) {
 	case *ast.Import:
 		idx := g.findString(strings.Join(n.Path, "."))
@@ -286,8 +428,14 @@ func (g *Generator) GenerateScoped(gn ast.Node, scope *ast.Scope) error {
 		g.seq = append(g.seq, insn.Builder.GetScoped(g.sp, idx))
 	case *ast.Self:
 		g.seq = append(g.seq, insn.Builder.Self(g.sp))
+	case *ast.Nil:
+		g.seq = append(g.seq, insn.Builder.StoreNil(g.sp))
 	case *ast.Integer:
 		g.seq = append(g.seq, insn.Builder.Store(g.sp, insn.Int(n.Value)))
+	case *ast.True:
+		g.seq = append(g.seq, insn.Builder.StoreBool(g.sp, true))
+	case *ast.False:
+		g.seq = append(g.seq, insn.Builder.StoreBool(g.sp, false))
 	case *ast.Op:
 		err := g.GenerateScoped(n.Left, scope)
 		if err != nil {
@@ -512,6 +660,14 @@ func (g *Generator) GenerateScoped(gn ast.Node, scope *ast.Scope) error {
 			return err
 		}
 
+		sub.Passes = g.Passes
+		sub.File = g.File
+		sub.Positions = g.Positions
+
+		// The body starts out on the line of the statement that created it,
+		// until its own statements say otherwise.
+		sub.markLine(g.line)
+
 		var sig value.Signature
 
 		sig.Required = len(n.Args)
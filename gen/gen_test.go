@@ -1,10 +1,14 @@
 package gen
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
 
 	"github.com/evanphx/m13/ast"
 	"github.com/evanphx/m13/insn"
+	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vektra/neko"
@@ -372,6 +376,21 @@ func TestGen(t *testing.T) {
 		assert.Equal(t, int64(0), i.Data())
 	})
 
+	n.It("generates bytecode for nil", func() {
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		err = g.Generate(&ast.Nil{})
+		require.NoError(t, err)
+
+		seq := g.Sequence()
+
+		i := seq[0]
+
+		assert.Equal(t, insn.Reset, i.Op())
+		assert.Equal(t, 0, i.R0())
+	})
+
 	n.It("generates bytecode for a lambda", func() {
 		g, err := NewGenerator(nil, "test")
 		require.NoError(t, err)
@@ -475,6 +494,41 @@ func TestGen(t *testing.T) {
 		assert.Equal(t, int64(1), i.Rest2())
 	})
 
+	n.It("stores arguments captured by a closure in their refs", func() {
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		tree := &ast.Lambda{
+			Args: []*ast.ArgDef{
+				{
+					Name: "a",
+				},
+				{
+					Name: "b",
+				},
+			},
+			Expr: &ast.Lambda{
+				Expr: &ast.Variable{Name: "b"},
+			},
+		}
+
+		err = g.Generate(tree)
+		require.NoError(t, err)
+
+		sub := g.subSequences[0].Sequence()
+
+		i := sub[0]
+
+		assert.Equal(t, insn.StoreRef, i.Op())
+		assert.Equal(t, 0, i.R0())
+		assert.Equal(t, 1, i.R1())
+
+		i = sub[1]
+
+		assert.Equal(t, insn.CreateLambda, i.Op())
+		assert.Equal(t, 1, i.R2())
+	})
+
 	n.It("generates bytecode for a lambda with a capture local", func() {
 		g, err := NewGenerator(nil, "test")
 		require.NoError(t, err)
@@ -930,5 +984,469 @@ func TestGen(t *testing.T) {
 		assert.Equal(t, int64(1), i.Rest1())
 	})
 
+	n.It("folds constant integer operations", func() {
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		code, err := g.GenerateTop(&ast.Op{
+			Name: "+",
+			Left: &ast.Op{
+				Name:  "+",
+				Left:  &ast.Integer{Value: 3},
+				Right: &ast.Integer{Value: 4},
+			},
+			Right: &ast.Integer{Value: 5},
+		})
+		require.NoError(t, err)
+
+		seq := code.Instructions
+
+		require.Equal(t, 2, len(seq))
+
+		i := seq[0]
+
+		assert.Equal(t, insn.StoreInt, i.Op())
+		assert.Equal(t, 0, i.R0())
+		assert.Equal(t, int64(12), i.Data())
+
+		assert.Equal(t, insn.Return, seq[1].Op())
+	})
+
+	n.It("folds every builtin integer operation", func() {
+		op := func(name string, l, r int64) ast.Node {
+			return &ast.Op{Name: name, Left: &ast.Integer{Value: l}, Right: &ast.Integer{Value: r}}
+		}
+
+		call := func(name string, recv int64, args ...int64) ast.Node {
+			c := &ast.Call{Receiver: &ast.Integer{Value: recv}, MethodName: name, Args: &ast.Args{}}
+
+			for _, a := range args {
+				c.Args.Args = append(c.Args.Args, &ast.Integer{Value: a})
+			}
+
+			return c
+		}
+
+		tests := []struct {
+			node ast.Node
+			op   insn.Op
+			data int64
+		}{
+			{op("+", 3, 4), insn.StoreInt, 7},
+			{call("add", 3, 4), insn.StoreInt, 7},
+			{&ast.Inc{Receiver: &ast.Integer{Value: 3}}, insn.StoreInt, 4},
+			{call("inc", 3), insn.StoreInt, 4},
+			{op("<", 3, 4), insn.StoreBool, 1},
+			{op("<", 4, 3), insn.StoreBool, 0},
+			{call("less_than", 4, 4), insn.StoreBool, 0},
+			{op("==", 4, 4), insn.StoreBool, 1},
+			{call("equal", 3, 4), insn.StoreBool, 0},
+		}
+
+		for _, tt := range tests {
+			g, err := NewGenerator(nil, "test")
+			require.NoError(t, err)
+
+			code, err := g.GenerateTop(tt.node)
+			require.NoError(t, err)
+
+			seq := code.Instructions
+
+			require.Equal(t, 2, len(seq), "%s", seq[0].Op())
+
+			assert.Equal(t, tt.op, seq[0].Op())
+			assert.Equal(t, tt.data, seq[0].Data())
+			assert.Equal(t, insn.Return, seq[1].Op())
+		}
+	})
+
+	n.It("skips passes that are disabled", func() {
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		g.Passes = NoPasses
+
+		code, err := g.GenerateTop(&ast.Op{
+			Name:  "+",
+			Left:  &ast.Integer{Value: 3},
+			Right: &ast.Integer{Value: 4},
+		})
+		require.NoError(t, err)
+
+		seq := code.Instructions
+
+		require.Equal(t, 4, len(seq))
+
+		assert.Equal(t, insn.CallN, seq[2].Op())
+	})
+
+	n.It("only folds integers a StoreInt can hold", func() {
+		const max = 1<<47 - 1
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		run := func(passes Pass, tree ast.Node) value.Value {
+			g, err := NewGenerator(v, "test")
+			require.NoError(t, err)
+
+			g.Passes = passes
+
+			code, err := g.GenerateTop(tree)
+			require.NoError(t, err)
+
+			val, err := v.ExecuteContext(context.TODO(), value.ExecuteContext{Code: code})
+			require.NoError(t, err)
+
+			return val
+		}
+
+		tests := []func() ast.Node{
+			func() ast.Node {
+				return &ast.Op{Name: "+", Left: &ast.Integer{Value: max}, Right: &ast.Integer{Value: 1}}
+			},
+			func() ast.Node {
+				return &ast.Op{Name: "+", Left: &ast.Integer{Value: max - 1}, Right: &ast.Integer{Value: 1}}
+			},
+			func() ast.Node {
+				return &ast.Op{Name: "+", Left: &ast.Integer{Value: -max - 1}, Right: &ast.Integer{Value: -1}}
+			},
+			func() ast.Node {
+				return &ast.Inc{Receiver: &ast.Integer{Value: max}}
+			},
+			func() ast.Node {
+				return &ast.Op{Name: "<", Left: &ast.Integer{Value: max - 1}, Right: &ast.Integer{Value: max}}
+			},
+		}
+
+		for i, tt := range tests {
+			assert.Equal(t, run(NoPasses, tt()), run(AllPasses, tt()), "case %d", i)
+		}
+
+		assert.Equal(t, value.I64(max+1), run(AllPasses, tests[0]()))
+	})
+
+	n.It("removes code after a return", func() {
+		b := insn.Builder
+
+		seq := []insn.Instruction{
+			b.Store(0, insn.Int(1)),
+			b.Return(0),
+			b.Store(0, insn.Int(2)),
+			b.Return(0),
+		}
+
+		seq = (EliminateDeadCode | RemoveNoops).Optimize(seq)
+
+		require.Equal(t, 2, len(seq))
+
+		assert.Equal(t, int64(1), seq[0].Data())
+		assert.Equal(t, insn.Return, seq[1].Op())
+	})
+
+	n.It("threads a jump to a jump", func() {
+		b := insn.Builder
+
+		seq := []insn.Instruction{
+			b.GotoIfFalse(0, 3),
+			b.Store(0, insn.Int(1)),
+			b.Return(0),
+			b.Goto(5),
+			b.Store(0, insn.Int(2)),
+			b.Return(0),
+		}
+
+		seq = ThreadJumps.Optimize(seq)
+
+		i := seq[0]
+
+		assert.Equal(t, insn.GIF, i.Op())
+		assert.Equal(t, int64(5), i.Data())
+	})
+
+	n.It("relocates jump targets when removing noops", func() {
+		b := insn.Builder
+
+		seq := []insn.Instruction{
+			b.Noop(),
+			b.GotoIfFalse(0, 3),
+			b.Noop(),
+			b.Store(0, insn.Int(1)),
+			b.Goto(1),
+		}
+
+		seq = RemoveNoops.Optimize(seq)
+
+		require.Equal(t, 3, len(seq))
+
+		assert.Equal(t, insn.GIF, seq[0].Op())
+		assert.Equal(t, int64(1), seq[0].Data())
+
+		assert.Equal(t, insn.Goto, seq[2].Op())
+		assert.Equal(t, int64(0), seq[2].Data())
+	})
+
+	n.It("keeps the refs that follow a lambda", func() {
+		b := insn.Builder
+
+		seq := []insn.Instruction{
+			b.CreateLambda(0, 0, 1, 0),
+			b.ReadRef(0, 0),
+			b.Noop(),
+			b.Return(0),
+		}
+
+		seq = AllPasses.Optimize(seq)
+
+		require.Equal(t, 3, len(seq))
+
+		assert.Equal(t, insn.CreateLambda, seq[0].Op())
+		assert.Equal(t, insn.ReadRef, seq[1].Op())
+		assert.Equal(t, insn.Return, seq[2].Op())
+	})
+
+	n.It("coalesces a temporary into its destination", func() {
+		b := insn.Builder
+
+		seq := []insn.Instruction{
+			b.Store(1, insn.Int(3)),
+			b.StoreReg(0, 1),
+			b.Return(0),
+		}
+
+		seq = (CoalesceRegisters | RemoveNoops).Optimize(seq)
+
+		require.Equal(t, 2, len(seq))
+
+		i := seq[0]
+
+		assert.Equal(t, insn.StoreInt, i.Op())
+		assert.Equal(t, 0, i.R0())
+		assert.Equal(t, int64(3), i.Data())
+	})
+
+	n.It("does not coalesce a temporary that is read later", func() {
+		b := insn.Builder
+
+		seq := []insn.Instruction{
+			b.Store(1, insn.Int(3)),
+			b.StoreReg(0, 1),
+			b.Return(1),
+		}
+
+		seq = (CoalesceRegisters | RemoveNoops).Optimize(seq)
+
+		require.Equal(t, 3, len(seq))
+
+		assert.Equal(t, 1, seq[0].R0())
+	})
+
+	n.It("parses pass names", func() {
+		p, ok := ParsePasses("fold,dce")
+		require.True(t, ok)
+
+		assert.Equal(t, FoldConstants|EliminateDeadCode, p)
+		assert.Equal(t, "fold,dce", p.String())
+
+		p, ok = ParsePasses("all")
+		require.True(t, ok)
+
+		assert.Equal(t, AllPasses, p)
+
+		_, ok = ParsePasses("bogus")
+		assert.False(t, ok)
+	})
+
+	n.It("records the source line of each statement", func() {
+		first := &ast.Assign{Name: "a", Value: &ast.Integer{Value: 1}}
+		second := &ast.Assign{Name: "b", Value: &ast.Variable{Name: "a"}}
+
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		g.File = "test.m13"
+		g.Positions = ast.Positions{
+			first:  {Line: 1},
+			second: {Line: 3},
+		}
+
+		code, err := g.GenerateTop(&ast.Block{Expressions: []ast.Node{first, second}})
+		require.NoError(t, err)
+
+		assert.Equal(t, "test.m13", code.File)
+		assert.Equal(t, []string{"a", "b"}, code.LocalNames)
+
+		require.Equal(t, 2, len(code.Lines))
+
+		assert.Equal(t, 1, code.LineFor(0))
+		assert.Equal(t, 3, code.LineFor(code.Lines[1].Start))
+		assert.True(t, code.IsLineStart(code.Lines[1].Start))
+	})
+
+	n.It("gives a lambda body the line of the statement creating it", func() {
+		lam := &ast.Lambda{
+			Args: []*ast.ArgDef{{Name: "x"}},
+			Expr: &ast.Variable{Name: "x"},
+		}
+
+		stmt := &ast.Assign{Name: "f", Value: lam}
+
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		g.File = "test.m13"
+		g.Positions = ast.Positions{stmt: {Line: 7}}
+
+		code, err := g.GenerateTop(stmt)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(code.SubCode))
+
+		sub := code.SubCode[0]
+
+		assert.Equal(t, "test.m13", sub.File)
+		assert.Equal(t, 7, sub.LineFor(0))
+		assert.Equal(t, []string{"x"}, sub.LocalNames)
+	})
+
+	n.It("reports reading a variable that's never assigned", func() {
+		read := &ast.Op{Name: "+", Left: &ast.Variable{Name: "add"}, Right: &ast.Integer{Value: 1}}
+
+		first := &ast.Assign{Name: "a", Value: &ast.Integer{Value: 1}}
+		second := &ast.Assign{Name: "f", Value: &ast.Lambda{Expr: read}}
+
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		g.File = "test.m13"
+		g.Positions = ast.Positions{
+			first:  {Line: 1},
+			second: {Line: 2},
+			read:   {Line: 3},
+		}
+
+		_, err = g.GenerateTop(&ast.Block{Expressions: []ast.Node{first, second}})
+		require.Error(t, err)
+
+		undef, ok := err.(*ErrUndefined)
+		require.True(t, ok)
+
+		assert.Equal(t, "add", undef.Name)
+		assert.Equal(t, 3, undef.Line)
+		assert.Equal(t, "test.m13:3: undefined variable: add", err.Error())
+	})
+
+	n.It("reports the line of the innermost statement holding a read", func() {
+		read := &ast.Op{Name: "+", Left: &ast.Variable{Name: "add"}, Right: &ast.Integer{Value: 1}}
+		stmt := &ast.Assign{Name: "f", Value: &ast.Lambda{Expr: read}}
+
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		g.Positions = ast.Positions{
+			stmt: {Line: 4},
+			read: {Line: 2},
+		}
+
+		_, err = g.GenerateTop(stmt)
+		require.Error(t, err)
+
+		undef, ok := err.(*ErrUndefined)
+		require.True(t, ok)
+
+		assert.Equal(t, 2, undef.Line)
+	})
+
+	n.It("describes generated code as JSON", func() {
+		lam := &ast.Lambda{
+			Args: []*ast.ArgDef{{Name: "x"}},
+			Expr: &ast.Call{Receiver: &ast.Variable{Name: "x"}, MethodName: "foo", Args: &ast.Args{}},
+		}
+
+		stmt := &ast.Assign{Name: "f", Value: lam}
+
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		g.File = "test.m13"
+		g.Positions = ast.Positions{stmt: {Line: 2}}
+
+		code, err := g.GenerateTop(stmt)
+		require.NoError(t, err)
+
+		data, err := json.Marshal(code)
+		require.NoError(t, err)
+
+		var doc struct {
+			Name         string
+			File         string
+			Instructions []struct {
+				Op   string
+				Text string
+				Line int
+			}
+			LocalNames []string `json:"local_names"`
+			SubCode    []struct {
+				Calls []struct{ Name string }
+			}
+		}
+
+		require.NoError(t, json.Unmarshal(data, &doc))
+
+		assert.Equal(t, "test", doc.Name)
+		assert.Equal(t, "test.m13", doc.File)
+		assert.Equal(t, []string{"f"}, doc.LocalNames)
+
+		require.True(t, len(doc.Instructions) > 0)
+		assert.Equal(t, "CreateLambda", doc.Instructions[0].Op)
+		assert.Equal(t, code.FormatInstruction(code.Instructions[0]), doc.Instructions[0].Text)
+		assert.Equal(t, 2, doc.Instructions[0].Line)
+
+		require.Equal(t, 1, len(doc.SubCode))
+		assert.Equal(t, "foo", doc.SubCode[0].Calls[0].Name)
+	})
+
+	n.It("accesses outer variables through refs", func() {
+		g, err := NewGenerator(nil, "test")
+		require.NoError(t, err)
+
+		g.Outer = []string{"a", "b"}
+
+		code, err := g.GenerateTop(&ast.Assign{
+			Name:  "b",
+			Value: &ast.Variable{Name: "a"},
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"b", "a"}, code.RefNames)
+		assert.Equal(t, 2, code.NumRefs)
+	})
+
+	n.It("reports reads of unassigned variables to Missing", func() {
+		a := &ast.Variable{Name: "a"}
+		b := &ast.Variable{Name: "b"}
+
+		lam := &ast.Lambda{Expr: b}
+
+		tree := &ast.Block{
+			Expressions: []ast.Node{a, lam},
+		}
+
+		var missing []*ast.Variable
+
+		scope := NewScope()
+		scope.Missing = func(v *ast.Variable) {
+			missing = append(missing, v)
+		}
+
+		scopes := AnalyzeScopes(tree, scope)
+
+		assert.Equal(t, []*ast.Variable{a, b}, missing)
+
+		require.Equal(t, 2, len(scopes))
+		assert.Equal(t, scope, scopes[0].Scope)
+		assert.Equal(t, lam, scopes[1].Lambda)
+	})
+
 	n.Meow()
 }
@@ -0,0 +1,595 @@
+package gen
+
+import (
+	"strings"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/insn"
+)
+
+type Pass uint
+
+const (
+	FoldConstants Pass = 1 << iota
+	EliminateCopies
+	CoalesceRegisters
+	ThreadJumps
+	EliminateDeadCode
+	RemoveNoops
+
+	NoPasses  Pass = 0
+	AllPasses      = FoldConstants | EliminateCopies | CoalesceRegisters |
+		ThreadJumps | EliminateDeadCode | RemoveNoops
+)
+
+var passNames = []struct {
+	pass Pass
+	name string
+}{
+	{FoldConstants, "fold"},
+	{EliminateCopies, "copies"},
+	{CoalesceRegisters, "coalesce"},
+	{ThreadJumps, "thread"},
+	{EliminateDeadCode, "dce"},
+	{RemoveNoops, "noops"},
+}
+
+func (p Pass) String() string {
+	var parts []string
+
+	for _, pn := range passNames {
+		if p&pn.pass != 0 {
+			parts = append(parts, pn.name)
+		}
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// ParsePasses converts a comma separated list of pass names, as returned by
+// Pass.String, back into a Pass. "all" and "none" are also accepted.
+func ParsePasses(s string) (Pass, bool) {
+	var p Pass
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+
+		switch part {
+		case "", "none":
+			continue
+		case "all":
+			p |= AllPasses
+			continue
+		}
+
+		var found bool
+
+		for _, pn := range passNames {
+			if pn.name == part {
+				p |= pn.pass
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, false
+		}
+	}
+
+	return p, true
+}
+
+// FoldIntegers evaluates integer operations whose operands are all integer
+// literals at compile time. Only the operations that builtin.I64 implements
+// are folded, comparisons to true or false. Nothing is folded whose operands
+// or result don't fit in the data of a StoreInt.
+func FoldIntegers(gn ast.Node) ast.Node {
+	return ast.Rewrite(gn, foldNode)
+}
+
+// unaryFolds and binaryFolds mirror the methods of builtin.I64 in
+// value/int_m13g.go, under their names and their aliases.
+var (
+	unaryFolds = map[string]func(a int64) ast.Node{
+		"inc": func(a int64) ast.Node { return &ast.Integer{Value: a + 1} },
+	}
+
+	binaryFolds = map[string]func(a, b int64) ast.Node{
+		"add":       func(a, b int64) ast.Node { return &ast.Integer{Value: a + b} },
+		"equal":     func(a, b int64) ast.Node { return boolNode(a == b) },
+		"less_than": func(a, b int64) ast.Node { return boolNode(a < b) },
+	}
+)
+
+func init() {
+	unaryFolds["++"] = unaryFolds["inc"]
+
+	binaryFolds["+"] = binaryFolds["add"]
+	binaryFolds["=="] = binaryFolds["equal"]
+	binaryFolds["<"] = binaryFolds["less_than"]
+}
+
+// StoreInt keeps its integer in the 48 bits above the register.
+const (
+	maxStoreInt = 1<<(63-insn.DataShift) - 1
+	minStoreInt = -1 << (63 - insn.DataShift)
+)
+
+func storable(n ast.Node) bool {
+	i, ok := n.(*ast.Integer)
+	if !ok {
+		return true
+	}
+
+	return i.Value >= minStoreInt && i.Value <= maxStoreInt
+}
+
+func boolNode(b bool) ast.Node {
+	if b {
+		return &ast.True{}
+	}
+
+	return &ast.False{}
+}
+
+func foldNode(gn ast.Node) ast.Node {
+	switch n := gn.(type) {
+	case *ast.Op:
+		n.Left = foldNode(n.Left)
+		n.Right = foldNode(n.Right)
+
+		if v, ok := foldBinary(n.Name, n.Left, n.Right); ok {
+			return v
+		}
+	case *ast.Call:
+		n.Receiver = foldNode(n.Receiver)
+
+		if n.Args == nil {
+			return n
+		}
+
+		for i, arg := range n.Args.Args {
+			n.Args.Args[i] = foldNode(arg)
+		}
+
+		switch len(n.Args.Args) {
+		case 0:
+			if v, ok := foldUnary(n.MethodName, n.Receiver); ok {
+				return v
+			}
+		case 1:
+			if v, ok := foldBinary(n.MethodName, n.Receiver, n.Args.Args[0]); ok {
+				return v
+			}
+		}
+	case *ast.Inc:
+		n.Receiver = foldNode(n.Receiver)
+
+		if v, ok := foldUnary("++", n.Receiver); ok {
+			return v
+		}
+	}
+
+	return gn
+}
+
+func foldUnary(name string, recv ast.Node) (ast.Node, bool) {
+	i, ok := recv.(*ast.Integer)
+	if !ok || !storable(i) {
+		return nil, false
+	}
+
+	fold, ok := unaryFolds[name]
+	if !ok {
+		return nil, false
+	}
+
+	v := fold(i.Value)
+
+	return v, storable(v)
+}
+
+func foldBinary(name string, left, right ast.Node) (ast.Node, bool) {
+	l, ok := left.(*ast.Integer)
+	if !ok || !storable(l) {
+		return nil, false
+	}
+
+	r, ok := right.(*ast.Integer)
+	if !ok || !storable(r) {
+		return nil, false
+	}
+
+	fold, ok := binaryFolds[name]
+	if !ok {
+		return nil, false
+	}
+
+	v := fold(l.Value, r.Value)
+
+	return v, storable(v)
+}
+
+// The bytecode passes below all have to step over the ReadRef instructions
+// that trail a CreateLambda. Those are operands of the CreateLambda rather
+// than real instructions and must stay directly behind it.
+
+func lambdaRefs(in insn.Instruction) int {
+	if in.Op() == insn.CreateLambda {
+		return in.R2()
+	}
+
+	return 0
+}
+
+func isJump(in insn.Instruction) bool {
+	switch in.Op() {
+	case insn.Goto, insn.GIF:
+		return true
+	default:
+		return false
+	}
+}
+
+func retarget(in insn.Instruction, pos int) insn.Instruction {
+	if in.Op() == insn.GIF {
+		return insn.Builder.GotoIfFalse(in.R0(), pos)
+	}
+
+	return insn.Builder.Goto(pos)
+}
+
+func jumpTargets(seq []insn.Instruction) map[int]bool {
+	targets := make(map[int]bool)
+
+	for i := 0; i < len(seq); i++ {
+		in := seq[i]
+
+		if isJump(in) {
+			targets[int(in.Data())] = true
+		}
+
+		i += lambdaRefs(in)
+	}
+
+	return targets
+}
+
+func successors(seq []insn.Instruction, i int) []int {
+	in := seq[i]
+	next := i + 1 + lambdaRefs(in)
+
+	switch in.Op() {
+	case insn.Return:
+		return nil
+	case insn.Goto:
+		return []int{int(in.Data())}
+	case insn.GIF:
+		return []int{next, int(in.Data())}
+	default:
+		return []int{next}
+	}
+}
+
+type regSet [4]uint64
+
+func (s *regSet) add(r int) {
+	s[r>>6] |= 1 << uint(r&63)
+}
+
+func (s *regSet) del(r int) {
+	s[r>>6] &^= 1 << uint(r&63)
+}
+
+func (s *regSet) has(r int) bool {
+	return s[r>>6]&(1<<uint(r&63)) != 0
+}
+
+func (s *regSet) union(o regSet) {
+	for i := range s {
+		s[i] |= o[i]
+	}
+}
+
+// regUsage returns the register written by in (or -1) and the registers it
+// reads. Reads always happen before the write.
+func regUsage(in insn.Instruction) (int, []int) {
+	span := func(start, cnt int) []int {
+		var regs []int
+
+		for i := 0; i <= cnt; i++ {
+			regs = append(regs, start+i)
+		}
+
+		return regs
+	}
+
+	switch in.Op() {
+	case insn.StoreInt, insn.StoreBool, insn.Reset, insn.Self, insn.GetScoped, insn.String,
+		insn.NewList, insn.NewMap, insn.GetIvar, insn.CreateLambda, insn.ReadRef:
+		return in.R0(), nil
+	case insn.CopyReg:
+		return in.R0(), []int{in.R1()}
+	case insn.Call0:
+		return in.R0(), []int{in.R1()}
+	case insn.CallN:
+		return in.R0(), span(in.R1(), int(in.Rest2()))
+	case insn.CallKW:
+		return in.R0(), span(in.R1(), in.R3()+int(in.Rest3()))
+	case insn.Invoke:
+		return in.R0(), span(in.R1(), int(in.Rest1()))
+	case insn.GetMirror:
+		return in.R0(), []int{in.R0()}
+	case insn.StoreRef:
+		return -1, []int{in.R1()}
+	case insn.SetIvar, insn.SetScoped, insn.GIF, insn.Return:
+		return -1, []int{in.R0()}
+	case insn.ListAppend:
+		return -1, []int{in.R0(), in.R1()}
+	case insn.SetMap:
+		return -1, []int{in.R0(), in.R1(), in.R1() + 1}
+	default:
+		return -1, nil
+	}
+}
+
+// liveOut computes, for every instruction, the set of registers whose
+// current value may still be read after it executes.
+func liveOut(seq []insn.Instruction) []regSet {
+	var (
+		in  = make([]regSet, len(seq)+1)
+		out = make([]regSet, len(seq)+1)
+	)
+
+	var order []int
+
+	for i := 0; i < len(seq); i++ {
+		order = append(order, i)
+		i += lambdaRefs(seq[i])
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		for j := len(order) - 1; j >= 0; j-- {
+			i := order[j]
+
+			var o regSet
+
+			for _, s := range successors(seq, i) {
+				if s < len(seq) {
+					o.union(in[s])
+				}
+			}
+
+			n := o
+
+			def, uses := regUsage(seq[i])
+			if def >= 0 {
+				n.del(def)
+			}
+
+			for _, r := range uses {
+				n.add(r)
+			}
+
+			if n != in[i] || o != out[i] {
+				in[i] = n
+				out[i] = o
+				changed = true
+			}
+		}
+	}
+
+	return out
+}
+
+func withR0(in insn.Instruction, reg int) insn.Instruction {
+	in &^= insn.Reg0Mask << insn.Reg0Shift
+	in |= insn.Instruction(reg) << insn.Reg0Shift
+
+	return in
+}
+
+// coalesceRegisters folds `rT = <op>; rX = rT` into `rX = <op>` when rT is
+// dead after the copy.
+func coalesceRegisters(seq []insn.Instruction) {
+	var (
+		targets = jumpTargets(seq)
+		live    = liveOut(seq)
+	)
+
+	for i := 0; i < len(seq)-1; i++ {
+		in := seq[i]
+
+		if skip := lambdaRefs(in); skip > 0 {
+			i += skip
+			continue
+		}
+
+		cp := seq[i+1]
+
+		if cp.Op() != insn.CopyReg || targets[i+1] {
+			continue
+		}
+
+		switch in.Op() {
+		case insn.StoreInt, insn.StoreBool, insn.Reset, insn.Self, insn.GetScoped, insn.String,
+			insn.NewList, insn.NewMap, insn.GetIvar, insn.ReadRef, insn.CopyReg,
+			insn.Call0, insn.CallN, insn.CallKW, insn.Invoke:
+		default:
+			continue
+		}
+
+		tmp := in.R0()
+
+		if cp.R1() != tmp || cp.R0() == tmp || live[i+1].has(tmp) {
+			continue
+		}
+
+		seq[i] = withR0(in, cp.R0())
+		seq[i+1] = insn.Builder.Noop()
+
+		i++
+	}
+}
+
+// threadJumps points jumps that land on a Goto (or on a run of Noops) at the
+// final destination, and turns a Goto to the next instruction into a Noop.
+func threadJumps(seq []insn.Instruction) {
+	resolve := func(pos int) int {
+		for hops := 0; pos < len(seq) && hops <= len(seq); hops++ {
+			switch seq[pos].Op() {
+			case insn.Noop:
+				pos++
+			case insn.Goto:
+				pos = int(seq[pos].Data())
+			default:
+				return pos
+			}
+		}
+
+		return pos
+	}
+
+	for i := 0; i < len(seq); i++ {
+		in := seq[i]
+
+		if skip := lambdaRefs(in); skip > 0 {
+			i += skip
+			continue
+		}
+
+		if !isJump(in) {
+			continue
+		}
+
+		dest := resolve(int(in.Data()))
+
+		if in.Op() == insn.Goto && resolve(i+1) == dest {
+			seq[i] = insn.Builder.Noop()
+			continue
+		}
+
+		if dest != int(in.Data()) {
+			seq[i] = retarget(in, dest)
+		}
+	}
+}
+
+// eliminateDeadCode replaces every instruction that can't be reached from
+// the entry point with a Noop.
+func eliminateDeadCode(seq []insn.Instruction) {
+	if len(seq) == 0 {
+		return
+	}
+
+	reached := make([]bool, len(seq))
+
+	work := []int{0}
+
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		if i >= len(seq) || reached[i] {
+			continue
+		}
+
+		reached[i] = true
+
+		for j := 1; j <= lambdaRefs(seq[i]); j++ {
+			reached[i+j] = true
+		}
+
+		work = append(work, successors(seq, i)...)
+	}
+
+	for i, ok := range reached {
+		if !ok {
+			seq[i] = insn.Builder.Noop()
+		}
+	}
+}
+
+// removeNoops deletes every Noop and relocates jump targets to match. It
+// also returns where each old position ended up.
+func removeNoops(seq []insn.Instruction) ([]insn.Instruction, []int) {
+	reloc := make([]int, len(seq)+1)
+
+	var out []insn.Instruction
+
+	for i := 0; i < len(seq); i++ {
+		in := seq[i]
+
+		reloc[i] = len(out)
+
+		if in.Op() == insn.Noop {
+			continue
+		}
+
+		out = append(out, in)
+
+		for j := 1; j <= lambdaRefs(in); j++ {
+			reloc[i+j] = len(out)
+			out = append(out, seq[i+j])
+		}
+
+		i += lambdaRefs(in)
+	}
+
+	reloc[len(seq)] = len(out)
+
+	for i := 0; i < len(out); i++ {
+		in := out[i]
+
+		if isJump(in) {
+			out[i] = retarget(in, reloc[in.Data()])
+		}
+
+		i += lambdaRefs(in)
+	}
+
+	return out, reloc
+}
+
+// Optimize runs the enabled bytecode passes over seq and returns the
+// resulting instruction stream.
+func (p Pass) Optimize(seq []insn.Instruction) []insn.Instruction {
+	seq, _ = p.optimize(seq)
+	return seq
+}
+
+// optimize is Optimize, but also returns the mapping from old instruction
+// positions to new ones when instructions were removed.
+func (p Pass) optimize(seq []insn.Instruction) ([]insn.Instruction, []int) {
+	var reloc []int
+
+	if p&EliminateCopies != 0 {
+		var po PeepholeOptz
+		po.Optimize(seq)
+	}
+
+	if p&CoalesceRegisters != 0 {
+		coalesceRegisters(seq)
+	}
+
+	if p&ThreadJumps != 0 {
+		threadJumps(seq)
+	}
+
+	if p&EliminateDeadCode != 0 {
+		eliminateDeadCode(seq)
+	}
+
+	if p&RemoveNoops != 0 {
+		seq, reloc = removeNoops(seq)
+	}
+
+	return seq, reloc
+}
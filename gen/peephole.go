@@ -4,16 +4,31 @@ import "github.com/evanphx/m13/insn"
 
 type PeepholeOptz struct{}
 
+// Optimize removes the second half of a back-to-back register swap, such as
+// `r1 = r0; r0 = r1`, unless something jumps directly to it.
 func (p *PeepholeOptz) Optimize(stream []insn.Instruction) {
-	for i, in := range stream {
-		if in.Op() == insn.CopyReg {
-			ik := stream[i+1]
-
-			if ik.Op() == insn.CopyReg {
-				if in.R0() == ik.R1() && in.R1() == ik.R0() {
-					stream[i+1] = insn.Builder.Noop()
-				}
-			}
+	targets := jumpTargets(stream)
+
+	for i := 0; i < len(stream)-1; i++ {
+		in := stream[i]
+
+		if in.Op() == insn.CreateLambda {
+			i += in.R2()
+			continue
+		}
+
+		if in.Op() != insn.CopyReg {
+			continue
+		}
+
+		ik := stream[i+1]
+
+		if ik.Op() != insn.CopyReg || targets[i+1] {
+			continue
+		}
+
+		if in.R0() == ik.R1() && in.R1() == ik.R0() {
+			stream[i+1] = insn.Builder.Noop()
 		}
 	}
 }
@@ -19,6 +19,10 @@ type Scope struct {
 	Variables map[string]*Variable
 	Ordered   []*Variable
 	Refs      []string
+
+	// Missing, when set on the outermost scope, is called with each read
+	// of a variable that's never assigned instead of panicking.
+	Missing func(*ast.Variable)
 }
 
 func (s *Scope) Find(name string) *Variable {
@@ -113,7 +117,11 @@ func (s *Scope) Read(n *ast.Variable) {
 				pv.NeedsRef = true
 				v.NeedsRef = true
 				s.makeRef(name)
+			} else if m := s.missing(); m != nil {
+				m(n)
 			}
+		} else if s.Missing != nil {
+			s.Missing(n)
 		} else {
 			panic(fmt.Sprintf("reading unassigned variable: %s", name))
 		}
@@ -134,13 +142,22 @@ func (s *Scope) Read(n *ast.Variable) {
 
 }
 
+func (s *Scope) missing() func(*ast.Variable) {
+	for s.Parent != nil {
+		s = s.Parent
+	}
+
+	return s.Missing
+}
+
 func (s *Scope) Write(n *ast.Assign) {
 	name := n.Name
 
-	if v, ok := s.Variables[name]; ok {
+	v, ok := s.Variables[name]
+	if ok {
 		v.Writes = append(v.Writes, n)
 	} else {
-		v := &Variable{
+		v = &Variable{
 			Name:   name,
 			Writes: []*ast.Assign{n},
 		}
@@ -151,7 +168,8 @@ func (s *Scope) Write(n *ast.Assign) {
 	}
 
 	if s.Parent != nil {
-		if v := s.Parent.Find(name); v != nil {
+		if pv := s.Parent.Find(name); pv != nil {
+			pv.NeedsRef = true
 			v.NeedsRef = true
 			s.makeRef(name)
 		}
@@ -161,14 +179,25 @@ func (s *Scope) Write(n *ast.Assign) {
 func (s *Scope) Close() *ast.Scope {
 	locals := len(s.Args)
 
+	// Locals is indexed by register, so the argument registers are always
+	// present even if an argument ends up living in a ref.
 	sc := &ast.Scope{
-		Refs: s.Refs,
+		Refs:   s.Refs,
+		Locals: make([]string, len(s.Args)),
 	}
 
 	for _, v := range s.Ordered {
 		if v.NeedsRef {
 			ref := s.findRef(v.Name)
 
+			if idx := s.findArg(v.Name); idx != -1 {
+				if sc.ArgRefs == nil {
+					sc.ArgRefs = make(map[int]int)
+				}
+
+				sc.ArgRefs[idx] = ref
+			}
+
 			for _, u := range v.Reads {
 				u.Ref = true
 				u.Index = ref
@@ -183,9 +212,11 @@ func (s *Scope) Close() *ast.Scope {
 			if idx == -1 {
 				idx = locals
 				locals++
-			}
 
-			sc.Locals = append(sc.Locals, v.Name)
+				sc.Locals = append(sc.Locals, v.Name)
+			} else {
+				sc.Locals[idx] = v.Name
+			}
 
 			for _, u := range v.Reads {
 				u.Index = idx
@@ -232,34 +263,127 @@ func (g *Generator) walkScopeOld(gn ast.Node, scope *Scope) error {
 	return nil
 }
 
+// ErrUndefined is a read of a variable that's never assigned. Line is
+// that of the statement the read is in, or 0 if it isn't known.
+type ErrUndefined struct {
+	File string
+	Line int
+	Name string
+}
+
+func (e *ErrUndefined) Error() string {
+	msg := "undefined variable: " + e.Name
+
+	if e.Line == 0 {
+		return msg
+	}
+
+	loc := fmt.Sprintf("%d", e.Line)
+	if e.File != "" {
+		loc = e.File + ":" + loc
+	}
+
+	return loc + ": " + msg
+}
+
 func (g *Generator) walkScope(gn ast.Node, scope *Scope) error {
-	type scopeWork struct {
-		lam   *ast.Lambda
-		scope *Scope
+	top := scope
+	for top.Parent != nil {
+		top = top.Parent
+	}
+
+	var undefined *ErrUndefined
+
+	if top.Missing == nil {
+		top.Missing = func(v *ast.Variable) {
+			if undefined == nil {
+				line, _ := g.lineOf(gn, v, 0)
+				undefined = &ErrUndefined{File: g.File, Line: line, Name: v.Name}
+			}
+		}
+	}
+
+	scopes := AnalyzeScopes(gn, scope)
+	if undefined != nil {
+		return undefined
 	}
 
-	var work, done []*scopeWork
+	for _, ls := range scopes {
+		ls.Lambda.Scope = ls.Scope.Close()
+	}
+
+	return nil
+}
+
+// lineOf finds n in the tree at root and returns the line of the innermost
+// node with a position that holds it, or line if none of them has one.
+func (g *Generator) lineOf(root, n ast.Node, line int) (int, bool) {
+	if pos, ok := g.Positions[root]; ok {
+		line = pos.Line
+	}
+
+	if root == n {
+		return line, true
+	}
+
+	var (
+		found bool
+		self  = true
+	)
+
+	ast.Descend(root, func(child ast.Node) bool {
+		if self {
+			self = false
+			return true
+		}
+
+		if found {
+			return false
+		}
+
+		if l, ok := g.lineOf(child, n, line); ok {
+			line, found = l, true
+		}
+
+		return false
+	})
+
+	return line, found
+}
+
+// LambdaScope is the variables of a lambda, or of the code at the top of
+// an analysis, which is wrapped in a lambda of its own.
+type LambdaScope struct {
+	Lambda *ast.Lambda
+	Scope  *Scope
+}
+
+// AnalyzeScopes works out the variables gn and each lambda in it read and
+// write, starting with scope. Outer scopes are returned before the scopes
+// nested in them.
+func AnalyzeScopes(gn ast.Node, scope *Scope) []*LambdaScope {
+	var work, done []*LambdaScope
 
 	lam := &ast.Lambda{Expr: gn}
 
-	work = append(work, &scopeWork{lam, scope})
+	work = append(work, &LambdaScope{lam, scope})
 
 	for len(work) > 0 {
 		ls := work[0]
 		work = work[1:]
 
-		ast.Descend(ls.lam.Expr, func(dn ast.Node) bool {
+		ast.Descend(ls.Lambda.Expr, func(dn ast.Node) bool {
 			switch n := dn.(type) {
 			case *ast.Variable:
-				ls.scope.Read(n)
+				ls.Scope.Read(n)
 			case *ast.Assign:
-				ls.scope.Write(n)
+				ls.Scope.Write(n)
 			case *ast.Lambda:
 				subScope := NewScope()
-				subScope.Parent = ls.scope
+				subScope.Parent = ls.Scope
 				subScope.SetArgs(n.Args)
 
-				work = append(work, &scopeWork{n, subScope})
+				work = append(work, &LambdaScope{n, subScope})
 
 				return false
 			}
@@ -270,9 +394,5 @@ func (g *Generator) walkScope(gn ast.Node, scope *Scope) error {
 		done = append(done, ls)
 	}
 
-	for _, ls := range done {
-		ls.lam.Scope = ls.scope.Close()
-	}
-
-	return nil
+	return done
 }
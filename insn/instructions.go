@@ -29,6 +29,7 @@ const (
 	NewMap       Op = 22
 	SetMap       Op = 23
 	CallKW       Op = 24
+	StoreBool    Op = 25
 )
 
 type Instruction int64
@@ -102,6 +103,19 @@ func (_ BuilderType) Store(reg int, i Int) Instruction {
 	return out
 }
 
+func (_ BuilderType) StoreBool(reg int, b bool) Instruction {
+	var out Instruction
+
+	out |= Instruction(StoreBool)
+	out |= (Instruction(reg) << Reg0Shift)
+
+	if b {
+		out |= (Instruction(1) << DataShift)
+	}
+
+	return out
+}
+
 func (_ BuilderType) StoreReg(dest, src int) Instruction {
 	var out Instruction
 
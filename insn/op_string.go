@@ -4,9 +4,9 @@ package insn
 
 import "fmt"
 
-const _Op_name = "NoopStoreIntCopyRegCallNResetReturnGIFCall0GotoCreateLambdaInvokeReadRefStoreRefGetMirrorSelfGetScopedSetScopedStringNewListListAppendGetIvarSetIvarNewMapSetMap"
+const _Op_name = "NoopStoreIntCopyRegCallNResetReturnGIFCall0GotoCreateLambdaInvokeReadRefStoreRefGetMirrorSelfGetScopedSetScopedStringNewListListAppendGetIvarSetIvarNewMapSetMapCallKWStoreBool"
 
-var _Op_index = [...]uint8{0, 4, 12, 19, 24, 29, 35, 38, 43, 47, 59, 65, 72, 80, 89, 93, 102, 111, 117, 124, 134, 141, 148, 154, 160}
+var _Op_index = [...]uint8{0, 4, 12, 19, 24, 29, 35, 38, 43, 47, 59, 65, 72, 80, 89, 93, 102, 111, 117, 124, 134, 141, 148, 154, 160, 166, 175}
 
 func (i Op) String() string {
 	if i < 0 || i >= Op(len(_Op_index)-1) {
@@ -0,0 +1,356 @@
+package lint
+
+import (
+	"strings"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/gen"
+)
+
+var undefinedCheck = &Check{
+	Name: "undefined",
+	Doc:  "variables that are read but never assigned",
+	run:  runUndefined,
+}
+
+var unusedCheck = &Check{
+	Name: "unused",
+	Doc:  "local variables that are assigned but never read",
+	run:  runUnused,
+}
+
+var arityCheck = &Check{
+	Name: "arity",
+	Doc:  "calls to the package's own methods with the wrong arguments",
+	run:  runArity,
+}
+
+var ivarCheck = &Check{
+	Name: "ivar",
+	Doc:  "instance variables read in a class that doesn't declare them with has",
+	run: func(p *pass) {
+		runIvars(p, false)
+	},
+}
+
+var ivarAssignCheck = &Check{
+	Name: "ivar-assign",
+	Doc:  "assignments to instance variables not declared with has",
+	run: func(p *pass) {
+		runIvars(p, true)
+	},
+}
+
+// statements returns the statements n is made of.
+func statements(n ast.Node) []ast.Node {
+	switch n := n.(type) {
+	case nil:
+		return nil
+	case *ast.Block:
+		return n.Expressions
+	default:
+		return []ast.Node{n}
+	}
+}
+
+func runUndefined(p *pass) {
+	p.desugar()
+
+	for _, f := range p.files {
+		if f.tree == nil {
+			continue
+		}
+
+		f := f
+
+		scope := gen.NewScope()
+		scope.Missing = func(v *ast.Variable) {
+			p.warn(f, v, "undefined variable %s", v.Name)
+		}
+
+		gen.AnalyzeScopes(f.tree, scope)
+	}
+}
+
+func runUnused(p *pass) {
+	p.desugar()
+
+	for _, f := range p.files {
+		if f.tree == nil {
+			continue
+		}
+
+		scope := gen.NewScope()
+		scope.Missing = func(*ast.Variable) {}
+
+		// The first scope is the top of the file, whose variables are the
+		// package's. Class bodies are skipped for the same reason.
+		for _, ls := range gen.AnalyzeScopes(f.tree, scope)[1:] {
+			if strings.HasSuffix(ls.Lambda.Name, ".__body__") {
+				continue
+			}
+
+			for _, v := range ls.Scope.Ordered {
+				if len(v.Writes) == 0 || len(v.Reads) > 0 || v.NeedsRef || strings.HasPrefix(v.Name, "_") {
+					continue
+				}
+
+				// Assignments the compiler adds have no position.
+				if _, ok := f.pos[v.Writes[0]]; ok {
+					p.warn(f, v.Writes[0], "%s is assigned but never used", v.Name)
+				}
+			}
+		}
+	}
+}
+
+type class struct {
+	def     *ast.ClassDefinition
+	methods map[string]*ast.Definition
+	ivars   map[string]bool
+}
+
+// index is the classes and methods defined at the top of a package's
+// files.
+type index struct {
+	defs    map[string]*ast.Definition
+	classes map[string]*class
+}
+
+func addDef(defs map[string]*ast.Definition, def *ast.Definition) {
+	defs[def.Name.Name] = def
+
+	if def.Name.Operator != "" {
+		defs[def.Name.Operator] = def
+	}
+}
+
+func newClass(def *ast.ClassDefinition) *class {
+	cls := &class{
+		def:     def,
+		methods: make(map[string]*ast.Definition),
+		ivars:   make(map[string]bool),
+	}
+
+	for _, stmt := range statements(def.Body) {
+		switch n := stmt.(type) {
+		case *ast.Definition:
+			addDef(cls.methods, n)
+		case *ast.Has:
+			cls.ivars[n.Variable] = true
+		}
+	}
+
+	return cls
+}
+
+func newIndex(files []*lintFile) *index {
+	x := &index{
+		defs:    make(map[string]*ast.Definition),
+		classes: make(map[string]*class),
+	}
+
+	for _, f := range files {
+		for _, stmt := range statements(f.tree) {
+			switch n := stmt.(type) {
+			case *ast.Definition:
+				addDef(x.defs, n)
+			case *ast.ClassDefinition:
+				x.classes[n.Name] = newClass(n)
+			}
+		}
+	}
+
+	return x
+}
+
+// lineage returns cls and the classes it inherits from. complete is false
+// when one of them is from outside the package, so isn't known.
+func (x *index) lineage(cls *class) (line []*class, complete bool) {
+	for cls != nil {
+		line = append(line, cls)
+
+		super := cls.def.Super
+		if super == nil {
+			return line, true
+		}
+
+		cls = x.classes[super.Name]
+
+		// A class inheriting from itself is an error for the compiler.
+		if len(line) > len(x.classes) {
+			return line, false
+		}
+	}
+
+	return line, false
+}
+
+// method finds name in cls or what it inherits from.
+func (x *index) method(cls *class, name string) *ast.Definition {
+	line, _ := x.lineage(cls)
+
+	for _, c := range line {
+		if def, ok := c.methods[name]; ok {
+			return def
+		}
+	}
+
+	return nil
+}
+
+// ivars returns the instance variables cls has, and whether they're all
+// known.
+func (x *index) ivars(cls *class) (map[string]bool, bool) {
+	line, complete := x.lineage(cls)
+
+	ivars := make(map[string]bool)
+
+	for _, c := range line {
+		for name := range c.ivars {
+			ivars[name] = true
+		}
+	}
+
+	return ivars, complete
+}
+
+type methodLookup func(name string) *ast.Definition
+
+func runArity(p *pass) {
+	pkg := func(name string) *ast.Definition {
+		return p.pkg.defs[name]
+	}
+
+	for _, f := range p.files {
+		if f.tree != nil {
+			p.arityIn(f, f.tree, pkg)
+		}
+	}
+}
+
+// arityIn checks the calls in n, where self has the methods found by
+// self, or unknown methods if it's nil.
+func (p *pass) arityIn(f *lintFile, n ast.Node, self methodLookup) {
+	ast.Descend(n, func(dn ast.Node) bool {
+		switch n := dn.(type) {
+		case *ast.ClassDefinition:
+			cls := p.pkg.classes[n.Name]
+			if cls == nil || cls.def != n {
+				cls = newClass(n)
+			}
+
+			instance := func(name string) *ast.Definition {
+				return p.pkg.method(cls, name)
+			}
+
+			for _, stmt := range statements(n.Body) {
+				if def, ok := stmt.(*ast.Definition); ok {
+					p.arityIn(f, def.Body, instance)
+				} else {
+					p.arityIn(f, stmt, nil)
+				}
+			}
+
+			return false
+		case *ast.Call:
+			var args []ast.Node
+
+			if n.Args != nil {
+				args = n.Args.Args
+			}
+
+			switch recv := n.Receiver.(type) {
+			case *ast.Self:
+				if self != nil {
+					p.checkArgs(f, n, n.MethodName, self(n.MethodName), args)
+				}
+			case *ast.Variable:
+				if cls, ok := p.pkg.classes[recv.Name]; ok && n.MethodName == "new" {
+					p.checkArgs(f, n, recv.Name+".new", p.pkg.method(cls, "initialize"), args)
+				}
+			}
+		case *ast.Attribute:
+			if _, ok := n.Receiver.(*ast.Self); ok && self != nil {
+				p.checkArgs(f, n, n.Name, self(n.Name), nil)
+			}
+		}
+
+		return true
+	})
+}
+
+func (p *pass) checkArgs(f *lintFile, call ast.Node, name string, def *ast.Definition, args []ast.Node) {
+	if def == nil {
+		return
+	}
+
+	if len(args) != len(def.Arguments) {
+		p.warn(f, call, "%s takes %d argument(s) but is called with %d", name, len(def.Arguments), len(args))
+	}
+
+	for _, arg := range args {
+		na, ok := arg.(*ast.NamedArg)
+		if !ok {
+			continue
+		}
+
+		found := false
+
+		for _, ad := range def.Arguments {
+			if ad.Name == na.Name {
+				found = true
+			}
+		}
+
+		if !found {
+			p.warn(f, call, "%s has no argument named %s", name, na.Name)
+		}
+	}
+}
+
+func runIvars(p *pass, assigns bool) {
+	for _, f := range p.files {
+		if f.tree == nil {
+			continue
+		}
+
+		ast.Descend(f.tree, func(n ast.Node) bool {
+			if cd, ok := n.(*ast.ClassDefinition); ok {
+				p.ivarsIn(f, cd, assigns)
+			}
+
+			return true
+		})
+	}
+}
+
+func (p *pass) ivarsIn(f *lintFile, cd *ast.ClassDefinition, assigns bool) {
+	cls := p.pkg.classes[cd.Name]
+	if cls == nil || cls.def != cd {
+		cls = newClass(cd)
+	}
+
+	ivars, complete := p.pkg.ivars(cls)
+	if !complete {
+		return
+	}
+
+	ast.Descend(cd.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ClassDefinition:
+			// Checked on its own.
+			return false
+		case *ast.IVar:
+			if !assigns && !ivars[n.Name] {
+				p.warn(f, n, "unknown instance variable @%s", n.Name)
+			}
+		case *ast.IVarAssign:
+			if assigns && !ivars[n.Name] {
+				p.warn(f, n, "assignment to @%s, which isn't declared with has", n.Name)
+			}
+		}
+
+		return true
+	})
+}
@@ -0,0 +1,180 @@
+// Package lint finds likely mistakes in m13 packages without running them.
+package lint
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/parser"
+)
+
+// Warning is one problem found in a file.
+type Warning struct {
+	Check string
+	File  string
+	ast.Position
+
+	Message string
+}
+
+func (w *Warning) String() string {
+	loc := w.File
+	if w.Line > 0 {
+		loc = fmt.Sprintf("%s:%d:%d", w.File, w.Line, w.Column)
+	}
+
+	return fmt.Sprintf("%s: %s (%s)", loc, w.Message, w.Check)
+}
+
+// Check is a kind of problem the linter looks for.
+type Check struct {
+	Name string
+	Doc  string
+
+	run func(*pass)
+}
+
+// Checks are all the checks, in the order they run.
+var Checks = []*Check{
+	arityCheck,
+	ivarCheck,
+	ivarAssignCheck,
+
+	// These look at the desugared trees, so they come last.
+	undefinedCheck,
+	unusedCheck,
+}
+
+// FindCheck returns the check called name.
+func FindCheck(name string) (*Check, bool) {
+	for _, c := range Checks {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// Config picks the checks to run. The zero Config runs them all.
+type Config struct {
+	// Enabled, if not empty, are the only checks run.
+	Enabled map[string]bool
+
+	// Disabled are checks not to run.
+	Disabled map[string]bool
+}
+
+func (c *Config) runs(name string) bool {
+	if len(c.Enabled) > 0 && !c.Enabled[name] {
+		return false
+	}
+
+	return !c.Disabled[name]
+}
+
+// File is a source file of a package.
+type File struct {
+	Name   string
+	Source []byte
+}
+
+type lintFile struct {
+	name string
+	tree ast.Node
+	pos  ast.Positions
+}
+
+type pass struct {
+	check    *Check
+	files    []*lintFile
+	warnings []*Warning
+
+	pkg       *index
+	desugared bool
+}
+
+// desugar rewrites the trees the way the compiler sees them. Nodes that
+// come from the source keep their positions.
+func (p *pass) desugar() {
+	if p.desugared {
+		return
+	}
+
+	p.desugared = true
+
+	for _, f := range p.files {
+		if f.tree != nil {
+			f.tree = gen.DesugarAST(f.tree)
+		}
+	}
+}
+
+func (p *pass) warn(f *lintFile, n ast.Node, format string, args ...interface{}) {
+	p.warnings = append(p.warnings, &Warning{
+		Check:    p.check.Name,
+		File:     f.name,
+		Position: f.pos[n],
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Package lints files as the files of one package, returning the warnings
+// ordered by where they are. A file that doesn't parse is an error.
+func (c *Config) Package(files []*File) ([]*Warning, error) {
+	p := &pass{}
+
+	for _, f := range files {
+		lf, err := parseFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		p.files = append(p.files, lf)
+	}
+
+	p.pkg = newIndex(p.files)
+
+	for _, check := range Checks {
+		if c.runs(check.Name) {
+			p.check = check
+			check.run(p)
+		}
+	}
+
+	warnings := p.warnings
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		a, b := warnings[i], warnings[j]
+
+		if a.File != b.File {
+			return a.File < b.File
+		}
+
+		return a.Offset < b.Offset
+	})
+
+	return warnings, nil
+}
+
+func parseFile(f *File) (*lintFile, error) {
+	p, err := parser.NewParser(string(f.Source))
+	if err != nil {
+		return nil, err
+	}
+
+	p.File = f.Name
+
+	cst, err := p.ParseCST()
+	if err != nil {
+		return nil, err
+	}
+
+	return &lintFile{
+		name: f.Name,
+		tree: cst.Root.Node,
+		pos:  cst.Positions(),
+	}, nil
+}
@@ -0,0 +1,168 @@
+package lint
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestLint(t *testing.T) {
+	n := neko.Start(t)
+
+	lint := func(cfg *Config, src string) []*Warning {
+		warnings, err := cfg.Package([]*File{{Name: "test.m13", Source: []byte(src)}})
+		require.NoError(t, err)
+
+		return warnings
+	}
+
+	messages := func(warnings []*Warning) []string {
+		var msgs []string
+
+		for _, w := range warnings {
+			msgs = append(msgs, w.String())
+		}
+
+		return msgs
+	}
+
+	n.It("reports undefined variables", func() {
+		warnings := lint(&Config{}, "a = 1\nb = a + c\nx => d")
+
+		assert.Equal(t, []string{
+			"test.m13:2:9: undefined variable c (undefined)",
+			"test.m13:3:6: undefined variable d (undefined)",
+		}, messages(warnings))
+	})
+
+	n.It("reports unused locals", func() {
+		src := "top = 1\ndef foo(a) {\n  b = a\n  _c = 2\n  d = 3\n  x => d\n}"
+
+		assert.Equal(t, []string{
+			"test.m13:3:3: b is assigned but never used (unused)",
+		}, messages(lint(&Config{}, src)))
+	})
+
+	n.It("reports calls to the package's methods with the wrong arguments", func() {
+		src := `def add(a, b) {
+  a + b
+}
+
+def run() {
+  self.add(1)
+  self.add(1, c=2)
+  self.add(1, b=2)
+  self.missing(1)
+  self.run
+}`
+
+		assert.Equal(t, []string{
+			"test.m13:6:3: add takes 2 argument(s) but is called with 1 (arity)",
+			"test.m13:7:3: add has no argument named c (arity)",
+		}, messages(lint(&Config{}, src)))
+	})
+
+	n.It("checks calls within a class against its methods", func() {
+		src := `class Base {
+  def initialize(a) {
+    self.go(a)
+  }
+
+  def go() {
+    1
+  }
+}
+
+class Sub : Base {
+  def other() {
+    self.go()
+    self.initialize()
+  }
+}
+
+x = Sub.new(1, 2)`
+
+		assert.Equal(t, []string{
+			"test.m13:3:5: go takes 0 argument(s) but is called with 1 (arity)",
+			"test.m13:14:5: initialize takes 1 argument(s) but is called with 0 (arity)",
+			"test.m13:18:5: Sub.new takes 1 argument(s) but is called with 2 (arity)",
+		}, messages(lint(&Config{}, src)))
+	})
+
+	n.It("reports instance variables not declared with has", func() {
+		src := `class Foo {
+  has @a
+
+  def initialize() {
+    @a = 1
+    @b = 2
+  }
+
+  def get() {
+    @a + @c + @d()
+  }
+}
+
+class Bar : Foo {
+  def get() {
+    @a
+  }
+}
+
+class Baz : Unknown {
+  def get() {
+    @z
+  }
+}`
+
+		assert.Equal(t, []string{
+			"test.m13:6:5: assignment to @b, which isn't declared with has (ivar-assign)",
+			"test.m13:10:10: unknown instance variable @c (ivar)",
+			"test.m13:10:15: unknown instance variable @d (ivar)",
+		}, messages(lint(&Config{}, src)))
+	})
+
+	n.It("runs only the enabled checks", func() {
+		src := "def foo() {\n  a = 1\n  b\n}"
+
+		assert.Equal(t, []string{
+			"test.m13:3:3: undefined variable b (undefined)",
+		}, messages(lint(&Config{Enabled: map[string]bool{"undefined": true}}, src)))
+
+		assert.Equal(t, []string{
+			"test.m13:2:3: a is assigned but never used (unused)",
+		}, messages(lint(&Config{Disabled: map[string]bool{"undefined": true}}, src)))
+	})
+
+	n.It("looks for methods across the package's files", func() {
+		warnings, err := (&Config{}).Package([]*File{
+			{Name: "a.m13", Source: []byte("def foo(a) {\n  a\n}")},
+			{Name: "b.m13", Source: []byte("def bar() {\n  self.foo()\n}")},
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"b.m13:2:3: foo takes 1 argument(s) but is called with 0 (arity)",
+		}, messages(warnings))
+	})
+
+	n.It("returns parse errors", func() {
+		_, err := (&Config{}).Package([]*File{{Name: "bad.m13", Source: []byte("foo(1,")}})
+		require.Error(t, err)
+	})
+
+	n.It("finds nothing wrong with the test library", func() {
+		data, err := ioutil.ReadFile("../lib/test/test.m13")
+		require.NoError(t, err)
+
+		warnings, err := (&Config{}).Package([]*File{{Name: "test.m13", Source: data}})
+		require.NoError(t, err)
+
+		assert.Empty(t, messages(warnings))
+	})
+
+	n.Meow()
+}
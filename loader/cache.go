@@ -0,0 +1,105 @@
+package loader
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanphx/m13/value"
+)
+
+// ErrImportCycle is returned when a package ends up importing itself.
+// Path starts and ends with that package.
+type ErrImportCycle struct {
+	Path []string
+}
+
+func (e *ErrImportCycle) Error() string {
+	return "import cycle: " + strings.Join(e.Path, " -> ")
+}
+
+type importEntry struct {
+	key  string
+	path string
+}
+
+type importStackKey struct{}
+
+// importStack returns the packages being executed in ctx, outermost first.
+func importStack(ctx context.Context) []importEntry {
+	stack, _ := ctx.Value(importStackKey{}).([]importEntry)
+	return stack
+}
+
+func pushImport(ctx context.Context, key, path string) context.Context {
+	stack := importStack(ctx)
+
+	next := make([]importEntry, len(stack), len(stack)+1)
+	copy(next, stack)
+
+	return context.WithValue(ctx, importStackKey{}, append(next, importEntry{key, path}))
+}
+
+// resolvePath returns the key a package at path is cached under. Names in
+// an fs.FS are already canonical, and never look like absolute paths.
+func resolvePath(fsys fs.FS, name string) (string, error) {
+	if !isOS(fsys) {
+		return path.Clean(name), nil
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = real
+	}
+
+	return abs, nil
+}
+
+// importDir returns the package in dir, loading and executing it only the
+// first time it's imported into r.
+func importDir(ctx context.Context, env value.Env, r *value.Registry, fsys fs.FS, dir string) (*value.Package, error) {
+	key, err := resolvePath(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if pkg, ok := r.LoadedPackage(key); ok {
+		return pkg, nil
+	}
+
+	stack := importStack(ctx)
+
+	for i, ent := range stack {
+		if ent.key != key {
+			continue
+		}
+
+		var cycle []string
+
+		for _, e := range stack[i:] {
+			cycle = append(cycle, e.path)
+		}
+
+		return nil, &ErrImportCycle{Path: append(cycle, dir)}
+	}
+
+	lp, err := LoadFS(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := lp.Exec(ctx, env, r)
+	if err != nil {
+		return nil, err
+	}
+
+	r.AddLoadedPackage(key, pkg)
+
+	return pkg, nil
+}
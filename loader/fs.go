@@ -0,0 +1,148 @@
+package loader
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// OS is the real filesystem as an fs.FS. Unlike os.DirFS it takes names
+// in the operating system's own form, relative or absolute, which is what
+// Load and the search path use.
+var OS fs.FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func isOS(fsys fs.FS) bool {
+	_, ok := fsys.(osFS)
+	return ok
+}
+
+// joinPath joins path elements using the separator fsys expects.
+func joinPath(fsys fs.FS, elem ...string) string {
+	if isOS(fsys) {
+		return filepath.Join(elem...)
+	}
+
+	return path.Join(elem...)
+}
+
+func dirPath(fsys fs.FS, name string) string {
+	if isOS(fsys) {
+		return filepath.Dir(name)
+	}
+
+	return path.Dir(name)
+}
+
+func basePath(fsys fs.FS, name string) string {
+	if isOS(fsys) {
+		return filepath.Base(name)
+	}
+
+	return path.Base(name)
+}
+
+func isDir(fsys fs.FS, name string) bool {
+	stat, err := fs.Stat(fsys, name)
+	return err == nil && stat.IsDir()
+}
+
+// Overlay combines several file systems into one. Files are looked up in
+// each root in turn, so earlier roots shadow later ones, and listing a
+// directory merges its entries from every root. This lets a program
+// replace parts of an embedded library with files on disk.
+type Overlay struct {
+	roots []fs.FS
+}
+
+func NewOverlay(roots ...fs.FS) *Overlay {
+	return &Overlay{roots: roots}
+}
+
+func (o *Overlay) Open(name string) (fs.File, error) {
+	for _, root := range o.roots {
+		f, err := root.Open(name)
+		if err == nil {
+			return f, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (o *Overlay) Stat(name string) (fs.FileInfo, error) {
+	for _, root := range o.roots {
+		stat, err := fs.Stat(root, name)
+		if err == nil {
+			return stat, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (o *Overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	var (
+		found   bool
+		seen    = make(map[string]bool)
+		entries []fs.DirEntry
+	)
+
+	for _, root := range o.roots {
+		list, err := fs.ReadDir(root, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		found = true
+
+		for _, ent := range list {
+			if !seen[ent.Name()] {
+				seen[ent.Name()] = true
+				entries = append(entries, ent)
+			}
+		}
+	}
+
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
@@ -3,9 +3,12 @@ package loader
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/evanphx/m13/ast"
 	"github.com/evanphx/m13/gen"
@@ -18,69 +21,200 @@ type Method struct {
 	Def  *ast.Definition
 }
 
+type file struct {
+	fsys  fs.FS
+	path  string
+	tree  ast.Node
+	pos   ast.Positions
+	cache string
+}
+
 type Package struct {
-	name    string
-	path    string
-	relbase string
-	files   []string
-	trees   []ast.Node
-	methods []*Method
+	fsys     fs.FS
+	name     string
+	path     string
+	relbase  string
+	manifest *Manifest
+	files    []*file
+	methods  []*Method
+	scanned  bool
+}
+
+// Manifest returns the package's m13.pkg, or nil if it has none.
+func (lp *Package) Manifest() *Manifest {
+	return lp.manifest
+}
+
+const (
+	SourceExt   = ".m13"
+	CompiledExt = ".m13c"
+)
+
+// CachePath returns where the compiled form of the source file at path
+// lives.
+func CachePath(path string) string {
+	return strings.TrimSuffix(path, SourceExt) + CompiledExt
+}
+
+// freshCache returns the path of the compiled form of path if it exists and
+// is at least as new as the source.
+func freshCache(fsys fs.FS, path string) (string, bool) {
+	src, err := fs.Stat(fsys, path)
+	if err != nil {
+		return "", false
+	}
+
+	cpath := CachePath(path)
+
+	cache, err := fs.Stat(fsys, cpath)
+	if err != nil {
+		return "", false
+	}
+
+	if cache.ModTime().Before(src.ModTime()) {
+		return "", false
+	}
+
+	return cpath, true
 }
 
 func Load(path string) (*Package, error) {
-	files, err := ioutil.ReadDir(path)
+	return LoadFS(OS, path)
+}
+
+// LoadFS loads the package in the directory path of fsys. Packages it
+// imports are looked for in fsys too.
+func LoadFS(fsys fs.FS, path string) (*Package, error) {
+	m, err := ReadManifestFS(fsys, path)
 	if err != nil {
 		return nil, err
 	}
 
-	name := filepath.Base(path)
-
 	lp := &Package{
-		name:    name,
-		path:    path,
-		relbase: path,
+		fsys:     fsys,
+		name:     basePath(fsys, path),
+		path:     path,
+		relbase:  path,
+		manifest: m,
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
+	if m != nil && m.Name != "" {
+		lp.name = m.Name
+	}
 
-		path := filepath.Join(path, file.Name())
-		lp.files = append(lp.files, path)
+	paths, err := sourceFiles(fsys, path, m)
+	if err != nil {
+		return nil, err
+	}
 
-		tree, err := parser.ParseFile(path)
+	for _, file := range paths {
+		err := lp.addFile(file)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		lp.trees = append(lp.trees, tree)
+	return lp, nil
+}
 
-		lp.scanForMethods(tree)
+// SourceFiles returns the paths of the source files of the package in
+// dir, which are those its manifest lists or else every source file in
+// dir.
+func SourceFiles(dir string) ([]string, error) {
+	return SourceFilesFS(OS, dir)
+}
+
+func SourceFilesFS(fsys fs.FS, dir string) ([]string, error) {
+	m, err := ReadManifestFS(fsys, dir)
+	if err != nil {
+		return nil, err
 	}
 
-	return lp, nil
+	return sourceFiles(fsys, dir, m)
+}
+
+// localName reports whether name, a file listed in a manifest, stays in
+// the package's directory.
+func localName(name string) bool {
+	name = filepath.ToSlash(name)
+
+	if filepath.IsAbs(name) || path.IsAbs(name) {
+		return false
+	}
+
+	name = path.Clean(name)
+
+	return name != ".." && !strings.HasPrefix(name, "../")
+}
+
+func sourceFiles(fsys fs.FS, dir string, m *Manifest) ([]string, error) {
+	var paths []string
+
+	if m != nil && len(m.Files) > 0 {
+		for _, name := range m.Files {
+			if !localName(name) {
+				return nil, fmt.Errorf("%s: %s is outside of the package", joinPath(fsys, dir, ManifestFile), name)
+			}
+
+			paths = append(paths, joinPath(fsys, dir, name))
+		}
+
+		return paths, nil
+	}
+
+	files, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == SourceExt {
+			paths = append(paths, joinPath(fsys, dir, file.Name()))
+		}
+	}
+
+	return paths, nil
 }
 
 func LoadFile(path string) (*Package, error) {
+	return LoadFileFS(OS, path)
+}
+
+// LoadFileFS loads the single file path of fsys as the main package.
+func LoadFileFS(fsys fs.FS, path string) (*Package, error) {
 	lp := &Package{
+		fsys:    fsys,
 		name:    "main",
 		path:    path,
-		relbase: filepath.Dir(path),
+		relbase: dirPath(fsys, path),
 	}
 
-	lp.files = append(lp.files, path)
-
-	tree, err := parser.ParseFile(path)
+	err := lp.addFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	lp.trees = append(lp.trees, tree)
+	return lp, nil
+}
 
-	lp.scanForMethods(tree)
+func (lp *Package) addFile(path string) error {
+	f := &file{fsys: lp.fsys, path: path}
 
-	return lp, nil
+	if cpath, ok := freshCache(lp.fsys, path); ok {
+		f.cache = cpath
+	} else {
+		tree, pos, err := parser.ParseFS(lp.fsys, path)
+		if err != nil {
+			return err
+		}
+
+		f.tree = tree
+		f.pos = pos
+	}
+
+	lp.files = append(lp.files, f)
+
+	return nil
 }
 
 func (lp *Package) scanForMethods(tree ast.Node) {
@@ -105,34 +239,135 @@ func (lp *Package) scanForMethods(tree ast.Node) {
 	}
 }
 
+// Methods returns the package level definitions. Files that were loaded
+// from their compiled form are parsed on demand to find them.
 func (lp *Package) Methods() []*Method {
+	if lp.scanned {
+		return lp.methods
+	}
+
+	lp.scanned = true
+
+	for _, f := range lp.files {
+		tree := f.tree
+
+		if tree == nil {
+			t, _, err := parser.ParseFS(f.fsys, f.path)
+			if err != nil {
+				continue
+			}
+
+			tree = t
+		}
+
+		lp.scanForMethods(tree)
+	}
+
 	return lp.methods
 }
 
-func (lp *Package) Exec(ctx context.Context, env value.Env, r *value.Registry) (*value.Package, error) {
-	pkg := r.OpenPackage(lp.name)
+// CompileFile parses and generates the top level code for the source file
+// at path.
+func CompileFile(env value.Env, path string) (*value.Code, error) {
+	tree, pos, err := parser.ParseFileWithPositions(path)
+	if err != nil {
+		return nil, err
+	}
 
-	cls := env.MustFindClass("builtin.Loader")
+	return compileTree(env, path, tree, pos)
+}
 
-	lo := &Loader{}
-	lo.SetClass(cls)
-	lo.Search = []string{"lib"}
-	lo.RelBase = lp.relbase
+func compileTree(env value.Env, path string, tree ast.Node, pos ast.Positions) (*value.Code, error) {
+	g, err := gen.NewGenerator(env, "__top__")
+	if err != nil {
+		return nil, err
+	}
 
-	ctx = value.SetScoped(ctx, "LOADER", lo)
-	ctx = value.SetScoped(ctx, "stdout", value.NewIO(env, os.Stdout))
+	g.File = path
+	g.Positions = pos
+
+	return g.GenerateTop(tree)
+}
+
+// WriteCache stores code as the compiled form of the source file at path.
+func WriteCache(path string, code *value.Code) error {
+	cpath := CachePath(path)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(cpath), ".m13c")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
 
-	for _, tree := range lp.trees {
-		g, err := gen.NewGenerator(env, "__top__")
+	err = value.WriteCode(tmp, code)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cpath)
+}
+
+func readCache(env value.Env, fsys fs.FS, path string) (*value.Code, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return value.ReadCode(env, f)
+}
+
+func (f *file) code(env value.Env) (*value.Code, error) {
+	if f.cache != "" {
+		code, err := readCache(env, f.fsys, f.cache)
+		if err == nil {
+			return code, nil
+		}
+
+		// A stale or corrupt cache is never fatal, fall back to the source.
+		tree, pos, err := parser.ParseFS(f.fsys, f.path)
 		if err != nil {
 			return nil, err
 		}
 
-		code, err := g.GenerateTop(tree)
+		f.tree = tree
+		f.pos = pos
+		f.cache = ""
+	}
+
+	return compileTree(env, f.path, f.tree, f.pos)
+}
+
+func (lp *Package) Exec(ctx context.Context, env value.Env, r *value.Registry) (*value.Package, error) {
+	pkg := r.OpenPackage(lp.name)
+
+	ctx = packageContext(ctx, env, lp)
+
+	// Packages from different directories may share a name, so code is
+	// tied to its package by path.
+	id := lp.path
+
+	if key, err := resolvePath(lp.fsys, lp.path); err == nil {
+		ctx = pushImport(ctx, key, lp.path)
+		id = key
+	}
+
+	for _, f := range lp.files {
+		code, err := f.code(env)
 		if err != nil {
 			return nil, err
 		}
 
+		code.SetPackage(id)
+
 		refs := make([]*value.Ref, code.NumRefs)
 
 		for i := 0; i < code.NumRefs; i++ {
@@ -182,6 +417,28 @@ type Loader struct {
 
 	RelBase string
 	Search  []string
+
+	// FS is where RelBase and Search are found, the real filesystem if
+	// it's nil.
+	FS fs.FS
+
+	sandbox  *Sandbox
+	manifest *Manifest
+}
+
+// SetupContext returns ctx with the scoped values top level code expects,
+// such as the LOADER used by import. Relative imports are resolved against
+// relbase.
+func SetupContext(ctx context.Context, env value.Env, relbase string) context.Context {
+	lo := &Loader{}
+	lo.SetClass(env.MustFindClass("builtin.Loader"))
+	lo.Search = SearchPath()
+	lo.RelBase = relbase
+
+	ctx = value.SetScoped(ctx, "LOADER", lo)
+	ctx = value.SetScoped(ctx, "stdout", value.NewIO(env, os.Stdout))
+
+	return ctx
 }
 
 func Init(pkg *value.Package, r *value.Registry) {
@@ -195,24 +452,26 @@ func Init(pkg *value.Package, r *value.Registry) {
 			lo := recv.(*Loader)
 			str := args[0].(*value.String)
 
-			for _, dir := range lo.Search {
-				path := filepath.Join(dir, str.String)
-
-				stat, err := os.Stat(path)
-				if err != nil {
-					continue
+			if path, ok := lo.Resolve(str.String); ok {
+				if lo.sandbox != nil && !lo.sandbox.contains(lo.fsys(), path) {
+					return nil, &value.ErrDenied{Kind: "package", Name: str.String}
 				}
 
-				if !stat.IsDir() {
-					continue
-				}
-
-				lp, err := Load(path)
-				if err != nil {
+				if err := lo.checkDependency(str.String, path); err != nil {
 					return nil, err
 				}
 
-				return lp.Exec(ctx, env, r)
+				return importDir(ctx, env, r, lo.fsys(), path)
+			}
+
+			// Packages defined from Go, such as with vm.Define, have no
+			// source to load.
+			if lo.sandbox != nil && !lo.sandbox.allowsPackage(str.String) {
+				return nil, &value.ErrDenied{Kind: "package", Name: str.String}
+			}
+
+			if pkg, ok := r.FindPackage(str.String); ok {
+				return pkg, nil
 			}
 
 			return nil, fmt.Errorf("Unable to find %s to import", str.String)
@@ -228,9 +487,13 @@ func Init(pkg *value.Package, r *value.Registry) {
 			lo := recv.(*Loader)
 			str := args[0].(*value.String)
 
-			path := filepath.Join(lo.RelBase, str.String)
+			path := joinPath(lo.fsys(), lo.RelBase, str.String)
+
+			if lo.sandbox != nil && (lo.RelBase == "" || !lo.sandbox.contains(lo.fsys(), path)) {
+				return nil, &value.ErrDenied{Kind: "relative import", Name: str.String}
+			}
 
-			stat, err := os.Stat(path)
+			stat, err := fs.Stat(lo.fsys(), path)
 			if err != nil {
 				return nil, err
 			}
@@ -239,12 +502,28 @@ func Init(pkg *value.Package, r *value.Registry) {
 				return nil, fmt.Errorf("Unable to find %s to import", str.String)
 			}
 
-			lp, err := Load(path)
-			if err != nil {
-				return nil, err
+			return importDir(ctx, env, r, lo.fsys(), path)
+		},
+	})
+
+	cls.AddMethod(&value.MethodDescriptor{
+		Name: "loaded",
+		Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+			lo := recv.(*Loader)
+			m := value.NewMap(env)
+
+			for _, path := range r.LoadedPaths() {
+				// Sandboxed code only sees the packages it could import
+				// itself.
+				if lo.sandbox != nil && !lo.sandbox.contains(lo.fsys(), path) {
+					continue
+				}
+
+				pkg, _ := r.LoadedPackage(path)
+				m.Set(env.NewString(path), pkg)
 			}
 
-			return lp.Exec(ctx, env, r)
+			return m, nil
 		},
 	})
 }
@@ -1,9 +1,19 @@
 package loader
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/evanphx/m13/insn"
+	"github.com/evanphx/m13/value"
 	"github.com/evanphx/m13/vm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,5 +43,471 @@ func TestLoader(t *testing.T) {
 		assert.Equal(t, "add", pkg.Class(v).Methods["add"].Name)
 	})
 
+	n.It("round trips compiled code", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		code, err := CompileFile(v, "./test/test.m13")
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+
+		err = value.WriteCode(&buf, code)
+		require.NoError(t, err)
+
+		out, err := value.ReadCode(v, &buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, code.Name, out.Name)
+		assert.Equal(t, code.File, out.File)
+		assert.Equal(t, code.NumRegs, out.NumRegs)
+		assert.Equal(t, code.Instructions, out.Instructions)
+		assert.Equal(t, code.Strings, out.Strings)
+		assert.Equal(t, code.Calls, out.Calls)
+
+		require.Equal(t, len(code.SubCode), len(out.SubCode))
+
+		assert.Equal(t, code.SubCode[0].Instructions, out.SubCode[0].Instructions)
+		assert.Equal(t, code.SubCode[0].Signature, out.SubCode[0].Signature)
+	})
+
+	n.It("rejects compiled code from another version", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		_, err = value.ReadCode(v, bytes.NewReader([]byte("M13C\x63")))
+		require.Error(t, err)
+
+		_, ok := err.(*value.ErrCodeVersion)
+		assert.True(t, ok)
+
+		_, err = value.ReadCode(v, bytes.NewReader([]byte("nope")))
+		assert.Equal(t, value.ErrBadCodeFile, err)
+	})
+
+	n.It("rejects compiled code with operands out of range", func() {
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		b := insn.Builder
+
+		tests := []struct {
+			in      insn.Instruction
+			problem string
+		}{
+			{b.StoreReg(0, 9), "register r9 out of range, code has 2"},
+			{b.Store(300, 1), "register r44 out of range, code has 2"},
+			{b.Goto(7), "jump to 7 out of range, code has 2 instructions"},
+			{b.String(0, 3), "string 3 out of range, code has 1"},
+			{b.Call0(0, 1, 2), "call 2 out of range, code has 1"},
+			{b.CallN(0, 1, 4, 0), "register r5 out of range, code has 2"},
+			{b.StoreRef(1, 0), "ref 1 out of range, code has 1"},
+			{b.CreateLambda(0, 0, 0, 1), "subcode 1 out of range, code has 1"},
+			{b.CreateLambda(0, 0, 0, 0), "lambda is given 0 refs, its code needs 1"},
+		}
+
+		for _, tt := range tests {
+			code := &value.Code{
+				Name:         "bad",
+				NumRegs:      2,
+				NumRefs:      1,
+				Instructions: []insn.Instruction{tt.in, b.Return(0)},
+				Strings:      []*value.String{v.InternString("s")},
+				Calls:        []*value.CallSite{{Name: "c"}},
+				SubCode:      []*value.Code{{Name: "sub", NumRegs: 1, NumRefs: 1}},
+			}
+
+			var buf bytes.Buffer
+
+			err = value.WriteCode(&buf, code)
+			require.NoError(t, err)
+
+			_, err = value.ReadCode(v, &buf)
+			require.Error(t, err)
+
+			bad, ok := err.(*value.ErrBadOperand)
+			require.True(t, ok, "%s", err)
+
+			assert.Equal(t, 0, bad.IP)
+			assert.Equal(t, tt.problem, bad.Problem)
+		}
+	})
+
+	n.It("uses a fresh compiled file next to the source", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		data, err := ioutil.ReadFile("./test/test.m13")
+		require.NoError(t, err)
+
+		src := filepath.Join(dir, "test.m13")
+
+		err = ioutil.WriteFile(src, data, 0644)
+		require.NoError(t, err)
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		code, err := CompileFile(v, src)
+		require.NoError(t, err)
+
+		err = WriteCache(src, code)
+		require.NoError(t, err)
+
+		lpkg, err := Load(dir)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(lpkg.files))
+		assert.Equal(t, CachePath(src), lpkg.files[0].cache)
+
+		pkg, err := lpkg.Exec(context.TODO(), v, v.Registry())
+		require.NoError(t, err)
+
+		assert.Equal(t, "add", pkg.Class(v).Methods["add"].Name)
+		assert.Equal(t, "add", lpkg.Methods()[0].Name)
+
+		past := time.Now().Add(-time.Hour)
+
+		err = os.Chtimes(CachePath(src), past, past)
+		require.NoError(t, err)
+
+		lpkg, err = Load(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, "", lpkg.files[0].cache)
+	})
+
+	n.It("runs each imported package once", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		writeFile(t, filepath.Join(dir, "shared", "shared.m13"), "import host\nhost.hit()\n")
+		writeFile(t, filepath.Join(dir, "util", "util.m13"), "import shared\n")
+		writeFile(t, filepath.Join(dir, "app", "app.m13"), "import shared\nimport util\n")
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		var hits int
+
+		err = v.Define("host.hit", func() { hits++ })
+		require.NoError(t, err)
+
+		ctx := SetupContext(context.TODO(), v, dir)
+
+		lo, _ := FromContext(ctx)
+		lo.Search = []string{dir}
+
+		lpkg, err := Load(filepath.Join(dir, "app"))
+		require.NoError(t, err)
+
+		_, err = lpkg.Exec(ctx, v, v.Registry())
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, hits)
+		assert.Equal(t, 2, len(v.Registry().LoadedPaths()))
+
+		loaded, err := v.Send(ctx, lo, "loaded")
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, loaded.(*value.Map).Len())
+	})
+
+	n.It("reports import cycles", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		writeFile(t, filepath.Join(dir, "a", "a.m13"), "import b\n")
+		writeFile(t, filepath.Join(dir, "b", "b.m13"), "import a\n")
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		ctx := SetupContext(context.TODO(), v, dir)
+
+		lo, _ := FromContext(ctx)
+		lo.Search = []string{dir}
+
+		lpkg, err := Load(filepath.Join(dir, "a"))
+		require.NoError(t, err)
+
+		_, err = lpkg.Exec(ctx, v, v.Registry())
+		require.Error(t, err)
+
+		cycle, ok := err.(*ErrImportCycle)
+		require.True(t, ok, err.Error())
+
+		expected := []string{
+			filepath.Join(dir, "a"),
+			filepath.Join(dir, "b"),
+			filepath.Join(dir, "a"),
+		}
+
+		assert.Equal(t, expected, cycle.Path)
+	})
+
+	n.It("reads package manifests", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		writeFile(t, filepath.Join(dir, ManifestFile), `
+# the utilities
+name     util
+version  1.2.0
+depends  strings 0.3.1
+depends  json
+files    main.m13
+`)
+		writeFile(t, filepath.Join(dir, "main.m13"), "def add(a, b) { a + b }\n")
+		writeFile(t, filepath.Join(dir, "skipped.m13"), "def skipped() { 1 }\n")
+
+		lpkg, err := Load(dir)
+		require.NoError(t, err)
+
+		m := lpkg.Manifest()
+		require.NotNil(t, m)
+
+		assert.Equal(t, "util", m.Name)
+		assert.Equal(t, "1.2.0", m.Version)
+		assert.Equal(t, []Dependency{{"strings", "0.3.1"}, {"json", ""}}, m.Depends)
+
+		require.Equal(t, 1, len(lpkg.files))
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		pkg, err := lpkg.Exec(context.TODO(), v, v.Registry())
+		require.NoError(t, err)
+
+		assert.Equal(t, "util", pkg.Name)
+
+		writeFile(t, filepath.Join(dir, ManifestFile), "name a b\n")
+
+		_, err = Load(dir)
+		assert.IsType(t, &ErrManifest{}, err)
+
+		for _, name := range []string{"../main.m13", "sub/../../main.m13", filepath.Join(dir, "main.m13")} {
+			writeFile(t, filepath.Join(dir, ManifestFile), "files "+name+"\n")
+
+			_, err = Load(dir)
+			require.Error(t, err, name)
+			assert.Contains(t, err.Error(), "is outside of the package")
+		}
+	})
+
+	n.It("prefers vendored packages and checks their versions", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		app := filepath.Join(dir, "app")
+
+		writeFile(t, filepath.Join(app, ManifestFile), "name app\ndepends dep 2.0\n")
+		writeFile(t, filepath.Join(app, "vendor", "dep", ManifestFile), "version 2.0\n")
+		writeFile(t, filepath.Join(app, "vendor", "dep", "dep.m13"), "def which() { 2 }\n")
+		writeFile(t, filepath.Join(dir, "path", "dep", "dep.m13"), "def which() { 1 }\n")
+		writeFile(t, filepath.Join(dir, "path", "other", "other.m13"), "def which() { 3 }\n")
+
+		os.Setenv(PathEnv, filepath.Join(dir, "path"))
+		defer os.Unsetenv(PathEnv)
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		ctx := SetupContext(context.TODO(), v, app)
+
+		lo, _ := FromContext(ctx)
+		lo.manifest, err = ReadManifest(app)
+		require.NoError(t, err)
+
+		path, ok := lo.Resolve("dep")
+		require.True(t, ok)
+
+		assert.Equal(t, filepath.Join(app, "vendor", "dep"), path)
+
+		path, ok = lo.Resolve("other")
+		require.True(t, ok)
+
+		assert.Equal(t, filepath.Join(dir, "path", "other"), path)
+
+		pkg, err := v.Send(ctx, lo, "import", v.NewString("dep"))
+		require.NoError(t, err)
+
+		res, err := v.Send(ctx, pkg, "which")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(2), res)
+
+		writeFile(t, filepath.Join(app, "vendor", "dep", ManifestFile), "version 1.0\n")
+
+		_, err = v.Send(ctx, lo, "import", v.NewString("dep"))
+		assert.IsType(t, &ErrVersionMismatch{}, err)
+	})
+
+	n.It("loads packages from an fs.FS", func() {
+		fsys := fstest.MapFS{
+			"app/main.m13":        {Data: []byte("import greet\ndef run() { greet.hi() }\n")},
+			"lib/greet/greet.m13": {Data: []byte("def hi() { 1 }\n")},
+		}
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		lpkg, err := LoadFS(fsys, "app")
+		require.NoError(t, err)
+
+		pkg, err := lpkg.Exec(context.TODO(), v, v.Registry())
+		require.NoError(t, err)
+
+		res, err := v.Send(context.TODO(), pkg, "run")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(1), res)
+
+		assert.Equal(t, []string{"lib/greet"}, v.Registry().LoadedPaths())
+	})
+
+	n.It("overlays several file systems", func() {
+		local := fstest.MapFS{
+			"lib/greet/greet.m13": {Data: []byte("def hi() { 2 }\n")},
+		}
+
+		embedded := fstest.MapFS{
+			"lib/greet/greet.m13": {Data: []byte("def hi() { 1 }\n")},
+			"lib/greet/extra.m13": {Data: []byte("def extra() { 3 }\n")},
+		}
+
+		fsys := NewOverlay(local, embedded)
+
+		entries, err := fs.ReadDir(fsys, "lib/greet")
+		require.NoError(t, err)
+
+		require.Equal(t, 2, len(entries))
+		assert.Equal(t, "extra.m13", entries[0].Name())
+		assert.Equal(t, "greet.m13", entries[1].Name())
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		lpkg, err := LoadFS(fsys, "lib/greet")
+		require.NoError(t, err)
+
+		pkg, err := lpkg.Exec(context.TODO(), v, v.Registry())
+		require.NoError(t, err)
+
+		res, err := v.Send(context.TODO(), pkg, "hi")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(2), res)
+
+		res, err = v.Send(context.TODO(), pkg, "extra")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), res)
+
+		_, err = fsys.Open("nope")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	})
+
+	n.It("hides private methods from other packages", func() {
+		fsys := fstest.MapFS{
+			"app/main.m13": {Data: []byte(`import util
+def shout() { util.shout() }
+def whisper() { util.whisper() }
+def open() { util.Box().new.open() }
+def peek() { util.Box().new.secret() }
+def hidden() { util.Hidden() }
+`)},
+			"lib/util/util.m13": {Data: []byte(`private def whisper() { 1 }
+def shout() { self.whisper() + 1 }
+class Box {
+  private def secret() { 3 }
+  def open() { self.secret() }
+}
+private class Hidden { 1 }
+`)},
+		}
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		lpkg, err := LoadFS(fsys, "app")
+		require.NoError(t, err)
+
+		pkg, err := lpkg.Exec(context.TODO(), v, v.Registry())
+		require.NoError(t, err)
+
+		res, err := v.Send(context.TODO(), pkg, "shout")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(2), res)
+
+		res, err = v.Send(context.TODO(), pkg, "open")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), res)
+
+		for _, name := range []string{"whisper", "peek", "hidden"} {
+			_, err = v.Send(context.TODO(), pkg, name)
+
+			var perr *vm.ErrPrivateMethod
+			assert.True(t, errors.As(err, &perr), name)
+		}
+	})
+
+	n.It("keys private methods on the package that defined them", func() {
+		fsys := fstest.MapFS{
+			"app/" + ManifestFile: {Data: []byte("name util\n")},
+			"app/main.m13": {Data: []byte(`import util
+def open() { util.Box().new.open() }
+def peek() { util.Box().new.secret() }
+`)},
+			"lib/util/util.m13": {Data: []byte(`class Box {
+  def secret() { 3 }
+  def open() { self.secret() }
+}
+Box.^make_private("secret")
+`)},
+		}
+
+		v, err := vm.NewVM()
+		require.NoError(t, err)
+
+		lpkg, err := LoadFS(fsys, "app")
+		require.NoError(t, err)
+
+		pkg, err := lpkg.Exec(context.TODO(), v, v.Registry())
+		require.NoError(t, err)
+
+		res, err := v.Send(context.TODO(), pkg, "open")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), res)
+
+		_, err = v.Send(context.TODO(), pkg, "peek")
+
+		var perr *vm.ErrPrivateMethod
+		require.True(t, errors.As(err, &perr), "%v", err)
+
+		assert.Equal(t, "app", perr.Package)
+	})
+
 	n.Meow()
 }
+
+func writeFile(t *testing.T, path, data string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	require.NoError(t, err)
+}
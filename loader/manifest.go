@@ -0,0 +1,155 @@
+package loader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// ManifestFile is the name of the file describing a package, kept in the
+// package's directory.
+const ManifestFile = "m13.pkg"
+
+// Manifest describes a package. It is written as one directive per line:
+//
+//	# comments start with a hash
+//	name     util
+//	version  1.2.0
+//	depends  strings 0.3.1
+//	depends  json
+//	files    util.m13 format.m13
+//
+// depends and files may be repeated. Without files, every source file in
+// the directory is loaded.
+type Manifest struct {
+	Name    string
+	Version string
+	Depends []Dependency
+	Files   []string
+}
+
+// Dependency is a package the manifest's package imports. An empty Version
+// accepts any version.
+type Dependency struct {
+	Name    string
+	Version string
+}
+
+type ErrManifest struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (e *ErrManifest) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+}
+
+type ErrVersionMismatch struct {
+	Name string
+	Need string
+	Have string
+}
+
+func (e *ErrVersionMismatch) Error() string {
+	return fmt.Sprintf("package %s is version %s, but %s is required", e.Name, e.Have, e.Need)
+}
+
+// ReadManifest reads the manifest in dir. It returns nil, and no error, if
+// there is none.
+func ReadManifest(dir string) (*Manifest, error) {
+	return ReadManifestFS(OS, dir)
+}
+
+func ReadManifestFS(fsys fs.FS, dir string) (*Manifest, error) {
+	path := joinPath(fsys, dir, ManifestFile)
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var (
+		m    Manifest
+		line int
+	)
+
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		line++
+
+		text := sc.Text()
+		if idx := strings.IndexByte(text, '#'); idx != -1 {
+			text = text[:idx]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		args := fields[1:]
+
+		bad := func(msg string) error {
+			return &ErrManifest{Path: path, Line: line, Msg: msg}
+		}
+
+		switch fields[0] {
+		case "name":
+			if len(args) != 1 {
+				return nil, bad("name takes one argument")
+			}
+
+			m.Name = args[0]
+		case "version":
+			if len(args) != 1 {
+				return nil, bad("version takes one argument")
+			}
+
+			m.Version = args[0]
+		case "depends":
+			switch len(args) {
+			case 1:
+				m.Depends = append(m.Depends, Dependency{Name: args[0]})
+			case 2:
+				m.Depends = append(m.Depends, Dependency{Name: args[0], Version: args[1]})
+			default:
+				return nil, bad("depends takes a package and an optional version")
+			}
+		case "files":
+			if len(args) == 0 {
+				return nil, bad("files needs at least one file")
+			}
+
+			m.Files = append(m.Files, args...)
+		default:
+			return nil, bad(fmt.Sprintf("unknown directive '%s'", fields[0]))
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Dependency returns the dependency on the package name.
+func (m *Manifest) Dependency(name string) (Dependency, bool) {
+	for _, dep := range m.Depends {
+		if dep.Name == name {
+			return dep, true
+		}
+	}
+
+	return Dependency{}, false
+}
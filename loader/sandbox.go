@@ -0,0 +1,100 @@
+package loader
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanphx/m13/value"
+)
+
+// Sandbox restricts what code can reach. Anything not listed is denied,
+// so a zero Sandbox allows nothing but the code itself.
+type Sandbox struct {
+	// Scoped are the scoped variables the code may read, besides the
+	// LOADER used by import.
+	Scoped map[string]value.Value
+
+	// Packages are the packages without source, such as those defined with
+	// vm.Define, that may be imported.
+	Packages []string
+
+	// Roots are the directories import searches. Relative imports are
+	// only allowed from packages found in them and may not leave them.
+	Roots []string
+}
+
+// SetupSandbox is SetupContext for code restricted by sb. Passing an
+// empty relbase denies relative imports.
+func SetupSandbox(ctx context.Context, env value.Env, sb *Sandbox, relbase string) context.Context {
+	lo := &Loader{
+		RelBase: relbase,
+		Search:  sb.Roots,
+		sandbox: sb,
+	}
+
+	lo.SetClass(env.MustFindClass("builtin.Loader"))
+
+	ctx = value.SetScoped(ctx, "LOADER", lo)
+
+	allowed := []string{"LOADER"}
+
+	for name, val := range sb.Scoped {
+		ctx = value.SetScoped(ctx, name, val)
+		allowed = append(allowed, name)
+	}
+
+	return value.RestrictScoped(ctx, allowed)
+}
+
+func (sb *Sandbox) allowsPackage(name string) bool {
+	for _, pkg := range sb.Packages {
+		if pkg == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contains reports whether name is inside one of the roots.
+func (sb *Sandbox) contains(fsys fs.FS, name string) bool {
+	if !isOS(fsys) {
+		name = path.Clean(name)
+
+		for _, root := range sb.Roots {
+			root = path.Clean(root)
+
+			if root == "." || name == root || strings.HasPrefix(name, root+"/") {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+
+	for _, root := range sb.Roots {
+		base, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(base, abs)
+		if err != nil {
+			continue
+		}
+
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
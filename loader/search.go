@@ -0,0 +1,171 @@
+package loader
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanphx/m13/value"
+)
+
+// PathEnv is the environment variable listing extra directories to search
+// for imported packages, separated like PATH.
+const PathEnv = "M13PATH"
+
+// SearchPath returns the directories import searches: dirs first, then
+// the entries of $M13PATH and finally lib in the current directory.
+func SearchPath(dirs ...string) []string {
+	search := append([]string(nil), dirs...)
+
+	for _, dir := range filepath.SplitList(os.Getenv(PathEnv)) {
+		if dir != "" {
+			search = append(search, dir)
+		}
+	}
+
+	return append(search, "lib")
+}
+
+// PathList is a flag.Value that collects the directories given by a
+// repeated flag.
+type PathList []string
+
+func (p *PathList) String() string {
+	return strings.Join(*p, string(filepath.ListSeparator))
+}
+
+func (p *PathList) Set(dir string) error {
+	*p = append(*p, dir)
+	return nil
+}
+
+// FromContext returns the LOADER in ctx.
+func FromContext(ctx context.Context) (*Loader, bool) {
+	v, ok := value.GetScoped(ctx, "LOADER")
+	if !ok {
+		return nil, false
+	}
+
+	lo, ok := v.(*Loader)
+
+	return lo, ok
+}
+
+// packageContext returns the context the files of lp run in. Packages
+// import from the same places as their importer, and the restrictions of a
+// sandboxed importer carry over to what it imports.
+func packageContext(ctx context.Context, env value.Env, lp *Package) context.Context {
+	parent, ok := FromContext(ctx)
+
+	switch {
+	case !ok:
+		ctx = SetupContext(ctx, env, lp.relbase)
+	case parent.sandbox != nil:
+		ctx = SetupSandbox(ctx, env, parent.sandbox, lp.relbase)
+	default:
+		ctx = SetupContext(ctx, env, lp.relbase)
+
+		lo, _ := FromContext(ctx)
+		lo.Search = parent.Search
+	}
+
+	lo, _ := FromContext(ctx)
+	lo.manifest = lp.manifest
+
+	if !isOS(lp.fsys) {
+		lo.FS = lp.fsys
+
+		if !ok {
+			lo.Search = []string{"lib"}
+		}
+	}
+
+	return ctx
+}
+
+func (lo *Loader) fsys() fs.FS {
+	if lo.FS == nil {
+		return OS
+	}
+
+	return lo.FS
+}
+
+// Resolve returns the directory of the package imported as name. A
+// vendor directory next to the importing package, or next to any
+// directory above it, is searched before the search path.
+func (lo *Loader) Resolve(name string) (string, bool) {
+	var (
+		fsys = lo.fsys()
+		rel  = joinPath(fsys, strings.Split(name, ".")...)
+	)
+
+	if lo.RelBase != "" {
+		dir := lo.RelBase
+
+		if isOS(fsys) {
+			if abs, err := filepath.Abs(dir); err == nil {
+				dir = abs
+			}
+		}
+
+		for {
+			path := joinPath(fsys, dir, "vendor", rel)
+			if isDir(fsys, path) {
+				return path, true
+			}
+
+			parent := dirPath(fsys, dir)
+			if parent == dir {
+				break
+			}
+
+			dir = parent
+		}
+	}
+
+	for _, dir := range lo.Search {
+		path := joinPath(fsys, dir, rel)
+		if isDir(fsys, path) {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// checkDependency makes sure the package in dir is the version the
+// importing package's manifest asks for.
+func (lo *Loader) checkDependency(name, dir string) error {
+	if lo.manifest == nil {
+		return nil
+	}
+
+	dep, ok := lo.manifest.Dependency(name)
+	if !ok || dep.Version == "" {
+		return nil
+	}
+
+	m, err := ReadManifestFS(lo.fsys(), dir)
+	if err != nil {
+		return err
+	}
+
+	var have string
+
+	if m != nil {
+		have = m.Version
+	}
+
+	if have != dep.Version {
+		if have == "" {
+			have = "unknown"
+		}
+
+		return &ErrVersionMismatch{Name: name, Need: dep.Version, Have: have}
+	}
+
+	return nil
+}
@@ -0,0 +1,665 @@
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/parser"
+	"github.com/evanphx/m13/value"
+)
+
+// cursor is what's around a position in a document. The receiver of a
+// method, as in recv.word, is only known by its token since the text
+// being typed rarely parses.
+type cursor struct {
+	offset int
+
+	// word is the word at the position, which starts at start.
+	word       string
+	start, end int
+
+	ivar bool
+	dot  bool
+
+	recv     parser.Token
+	recvText string
+}
+
+func (d *document) cursor(pos Position) *cursor {
+	c := &cursor{offset: d.offset(pos)}
+	c.start, c.end = c.offset, c.offset
+
+	toks := parser.Lex(d.src)
+
+	before := -1
+
+	for i, tok := range toks {
+		if tok.Kind == parser.TokenWord && tok.Start <= c.offset && c.offset <= tok.End {
+			c.word = d.src[tok.Start:tok.End]
+			c.start, c.end = tok.Start, tok.End
+			break
+		}
+
+		if tok.Start >= c.offset {
+			break
+		}
+
+		before = i
+	}
+
+	if before < 0 {
+		return c
+	}
+
+	switch d.src[toks[before].Start:toks[before].End] {
+	case "@":
+		c.ivar = true
+	case ".":
+		if before > 0 {
+			c.dot = true
+			c.recv = toks[before-1]
+			c.recvText = d.src[c.recv.Start:c.recv.End]
+		}
+	}
+
+	return c
+}
+
+// prefix is the part of the word before the cursor.
+func (c *cursor) prefix() string {
+	return c.word[:c.offset-c.start]
+}
+
+// target is what a receiver refers to: a package, an instance of a class
+// or, when meta is set, the class itself.
+type target struct {
+	pkg     *pkg
+	class   *class
+	builtin *value.Class
+	meta    bool
+}
+
+// member is something a name can refer to, such as a method or class.
+type member struct {
+	name  string
+	kind  int
+	owner string
+
+	// sig is set for methods.
+	sig *value.Signature
+
+	// decl is where the member is declared, if it's in m13 source.
+	decl *decl
+
+	// dir is the directory of an imported package.
+	dir string
+
+	// builtin is a class defined in Go.
+	builtin *value.Class
+}
+
+func defSignature(def *ast.Definition) *value.Signature {
+	sig := &value.Signature{Required: len(def.Arguments)}
+
+	for _, arg := range def.Arguments {
+		sig.Args = append(sig.Args, arg.Name)
+	}
+
+	return sig
+}
+
+// formatSignature shows a call of name with sig's arguments, naming those
+// the signature doesn't by their position.
+func formatSignature(name string, sig *value.Signature) string {
+	n := sig.Required
+	if len(sig.Args) > n {
+		n = len(sig.Args)
+	}
+
+	args := make([]string, n)
+
+	for i := range args {
+		if i < len(sig.Args) {
+			args[i] = sig.Args[i]
+		} else {
+			args[i] = fmt.Sprintf("arg%d", i+1)
+		}
+	}
+
+	return fmt.Sprintf("%s(%s)", name, strings.Join(args, ", "))
+}
+
+func (m *member) detail() string {
+	switch {
+	case m.sig != nil:
+		return formatSignature(m.name, m.sig)
+	case m.kind == CompletionClass:
+		return "class " + m.name
+	case m.kind == CompletionField:
+		return "has @" + m.name
+	case m.kind == CompletionModule:
+		return "package " + m.name
+	default:
+		return m.name
+	}
+}
+
+func (m *member) hover() string {
+	var code string
+
+	switch {
+	case m.sig != nil && m.owner != "":
+		code = m.owner + "." + formatSignature(m.name, m.sig)
+	case m.builtin != nil:
+		code = "class " + m.builtin.GlobalName
+
+		if m.builtin.Parent != nil {
+			code += " : " + m.builtin.Parent.GlobalName
+		}
+	case m.kind == CompletionClass:
+		code = "class " + m.name
+
+		if cd, ok := m.decl.node.(*ast.ClassDefinition); ok && cd.Super != nil {
+			code += " : " + cd.Super.Name
+		}
+	case m.kind == CompletionField && m.owner != "":
+		code = m.owner + " has @" + m.name
+	default:
+		code = m.detail()
+	}
+
+	text := "```m13\n" + code + "\n```"
+
+	if m.dir != "" {
+		text += "\n\n" + m.dir
+	}
+
+	return text
+}
+
+func classMembers(cls *value.Class) []*member {
+	var ms []*member
+
+	for ; cls != nil; cls = cls.Parent {
+		for name, meth := range cls.Methods {
+			sig := meth.Signature
+
+			ms = append(ms, &member{
+				name:  name,
+				kind:  CompletionMethod,
+				owner: cls.GlobalName,
+				sig:   &sig,
+			})
+		}
+	}
+
+	return ms
+}
+
+// members returns what t responds to, sorted by name. Methods a class
+// overrides hide those it inherits.
+func (s *Server) members(p *pkg, t *target) []*member {
+	var ms []*member
+
+	switch {
+	case t.pkg != nil:
+		for name, d := range t.pkg.defs {
+			ms = append(ms, &member{
+				name:  name,
+				kind:  CompletionFunction,
+				owner: t.pkg.name,
+				sig:   defSignature(d.node.(*ast.Definition)),
+				decl:  d,
+			})
+		}
+
+		for name, cls := range t.pkg.classes {
+			ms = append(ms, &member{name: name, kind: CompletionClass, decl: cls.decl})
+		}
+	case t.class != nil && t.meta:
+		line := p.lineage(t.class)
+
+		m := &member{
+			name:  "new",
+			kind:  CompletionMethod,
+			owner: t.class.name,
+			sig:   &value.Signature{},
+			decl:  t.class.decl,
+		}
+
+		for _, c := range line {
+			if d, ok := c.methods["initialize"]; ok {
+				m.sig = defSignature(d.node.(*ast.Definition))
+				m.decl = d
+				break
+			}
+		}
+
+		ms = append(ms, m)
+		ms = append(ms, classMembers(s.Registry.Class)...)
+	case t.class != nil:
+		for _, c := range p.lineage(t.class) {
+			for name, d := range c.methods {
+				ms = append(ms, &member{
+					name:  name,
+					kind:  CompletionMethod,
+					owner: c.name,
+					sig:   defSignature(d.node.(*ast.Definition)),
+					decl:  d,
+				})
+			}
+		}
+
+		ms = append(ms, classMembers(s.Registry.Object)...)
+	case t.builtin != nil && t.meta:
+		ms = classMembers(t.builtin.Class(nil))
+	case t.builtin != nil:
+		ms = classMembers(t.builtin)
+	}
+
+	// Keep the first of each name, which is the most derived.
+	seen := make(map[string]bool)
+	uniq := ms[:0]
+
+	for _, m := range ms {
+		if !seen[m.name] {
+			seen[m.name] = true
+			uniq = append(uniq, m)
+		}
+	}
+
+	sort.SliceStable(uniq, func(i, j int) bool {
+		return uniq[i].name < uniq[j].name
+	})
+
+	return uniq
+}
+
+// receiver returns what the receiver before the cursor refers to, or nil
+// if it isn't known.
+func (s *Server) receiver(p *pkg, f *file, c *cursor) *target {
+	switch c.recv.Kind {
+	case parser.TokenNumber:
+		return &target{builtin: s.Registry.I64Class}
+	case parser.TokenString:
+		return &target{builtin: s.Registry.String}
+	case parser.TokenWord:
+		return s.named(p, f, c.recvText, c.offset)
+	default:
+		return nil
+	}
+}
+
+// named returns what name refers to at offset in f. Without f, only the
+// names declared by the package are known.
+func (s *Server) named(p *pkg, f *file, name string, offset int) *target {
+	if name == "self" {
+		if f != nil {
+			if cls := p.classAt(f, offset); cls != nil {
+				return &target{class: cls}
+			}
+		}
+
+		return &target{pkg: p}
+	}
+
+	if cls, ok := p.classes[name]; ok {
+		return &target{class: cls, meta: true}
+	}
+
+	if imp, ok := p.imports[name]; ok {
+		if dir, ok := s.importDir(imp.file.dir(), imp.node.(*ast.Import)); ok {
+			return &target{pkg: s.loadPkg(dir)}
+		}
+
+		return nil
+	}
+
+	if cls, err := s.Registry.ResolveClass(name); err == nil {
+		return &target{builtin: cls, meta: true}
+	}
+
+	if f != nil {
+		return s.assigned(p, f, name, offset)
+	}
+
+	return nil
+}
+
+// assigned returns what was last assigned to the variable name before
+// offset, if it's a literal or a new instance of a known class.
+func (s *Server) assigned(p *pkg, f *file, name string, offset int) *target {
+	var val ast.Node
+
+	ast.Descend(f.cst.Root.Node, func(n ast.Node) bool {
+		if as, ok := n.(*ast.Assign); ok && as.Name == name && f.pos[n].Offset < offset {
+			val = as.Value
+		}
+
+		return true
+	})
+
+	var cls ast.Node
+
+	switch n := val.(type) {
+	case *ast.Integer:
+		return &target{builtin: s.Registry.I64Class}
+	case *ast.String:
+		return &target{builtin: s.Registry.String}
+	case *ast.List:
+		return &target{builtin: s.Registry.List}
+	case *ast.Map:
+		return &target{builtin: s.Registry.Map}
+	case *ast.Call:
+		if n.MethodName == "new" {
+			cls = n.Receiver
+		}
+	case *ast.Attribute:
+		if n.Name == "new" {
+			cls = n.Receiver
+		}
+	}
+
+	if v, ok := cls.(*ast.Variable); ok {
+		if t := s.named(p, nil, v.Name, 0); t != nil && t.meta {
+			t.meta = false
+			return t
+		}
+	}
+
+	return nil
+}
+
+// ivars returns the instance variables of the class around the cursor.
+func (s *Server) ivars(p *pkg, f *file, c *cursor) []*member {
+	if f == nil {
+		return nil
+	}
+
+	cls := p.classAt(f, c.offset)
+	if cls == nil {
+		return nil
+	}
+
+	var ms []*member
+
+	for _, c := range p.lineage(cls) {
+		for name, d := range c.ivars {
+			ms = append(ms, &member{name: name, kind: CompletionField, owner: c.name, decl: d})
+		}
+	}
+
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].name < ms[j].name
+	})
+
+	return ms
+}
+
+// globals returns the names usable without a receiver: the package's
+// classes, methods and imports and the classes defined in Go.
+func (s *Server) globals(p *pkg) []*member {
+	ms := s.members(p, &target{pkg: p})
+
+	for name, imp := range p.imports {
+		m := &member{name: name, kind: CompletionModule, decl: imp}
+
+		if dir, ok := s.importDir(imp.file.dir(), imp.node.(*ast.Import)); ok {
+			m.dir = dir
+		}
+
+		ms = append(ms, m)
+	}
+
+	if builtin, ok := s.Registry.FindPackage("builtin"); ok {
+		for name, cls := range builtin.Classes {
+			ms = append(ms, &member{name: name, kind: CompletionClass, builtin: cls})
+		}
+	}
+
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].name < ms[j].name
+	})
+
+	return ms
+}
+
+func withName(ms []*member, name string) []*member {
+	var found []*member
+
+	for _, m := range ms {
+		if m.name == name {
+			found = append(found, m)
+		}
+	}
+
+	return found
+}
+
+// lookup returns what the word at the cursor refers to. A method called
+// on a receiver that isn't known could be any method with its name.
+func (s *Server) lookup(p *pkg, doc *document, c *cursor) []*member {
+	if c.word == "" {
+		return nil
+	}
+
+	f := doc.file
+
+	switch {
+	case c.ivar:
+		return withName(s.ivars(p, f, c), c.word)
+	case c.dot:
+		if t := s.receiver(p, f, c); t != nil {
+			return withName(s.members(p, t), c.word)
+		}
+
+		var found []*member
+
+		for _, cls := range p.classes {
+			found = append(found, withName(s.members(p, &target{class: cls}), c.word)...)
+		}
+
+		found = append(found, withName(s.members(p, &target{pkg: p}), c.word)...)
+
+		sort.SliceStable(found, func(i, j int) bool {
+			return found[i].owner < found[j].owner
+		})
+
+		return found
+	}
+
+	if f != nil {
+		// The words of an import's path all refer to the package.
+		for _, n := range f.enclosing(c.offset) {
+			if imp, ok := n.(*ast.Import); ok {
+				return withName(s.globals(p), imp.Path[len(imp.Path)-1])
+			}
+		}
+
+		// Methods are declared without self.
+		if cls := p.classAt(f, c.offset); cls != nil {
+			if found := withName(s.members(p, &target{class: cls}), c.word); len(found) > 0 {
+				return found
+			}
+		}
+	}
+
+	return withName(s.globals(p), c.word)
+}
+
+func (s *Server) definition(params json.RawMessage) (interface{}, error) {
+	var p TextDocumentPositionParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	locs := []Location{}
+
+	for _, m := range s.lookup(s.pkgFor(doc), doc, doc.cursor(p.Position)) {
+		switch {
+		case m.dir != "":
+			if files := packageFiles(m.dir); len(files) > 0 {
+				locs = append(locs, Location{URI: pathURI(files[0])})
+			}
+		case m.decl != nil:
+			locs = append(locs, m.decl.location())
+		}
+	}
+
+	return locs, nil
+}
+
+func (s *Server) hover(params json.RawMessage) (interface{}, error) {
+	var p TextDocumentPositionParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	c := doc.cursor(p.Position)
+
+	found := s.lookup(s.pkgFor(doc), doc, c)
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	var parts []string
+
+	for _, m := range found {
+		parts = append(parts, m.hover())
+	}
+
+	r := doc.rangeOf(c.start, c.end)
+
+	return &Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: strings.Join(parts, "\n\n")},
+		Range:    &r,
+	}, nil
+}
+
+func (s *Server) completion(params json.RawMessage) (interface{}, error) {
+	var p TextDocumentPositionParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		c   = doc.cursor(p.Position)
+		pkg = s.pkgFor(doc)
+		ms  []*member
+	)
+
+	switch {
+	case c.ivar:
+		ms = s.ivars(pkg, doc.file, c)
+	case c.dot:
+		if t := s.receiver(pkg, doc.file, c); t != nil {
+			ms = s.members(pkg, t)
+		}
+	default:
+		ms = s.globals(pkg)
+	}
+
+	list := &CompletionList{Items: []CompletionItem{}}
+
+	for _, m := range ms {
+		// Names starting with $, such as the class of a package, can't be
+		// written in source.
+		if strings.HasPrefix(m.name, "$") {
+			continue
+		}
+
+		if strings.HasPrefix(m.name, c.prefix()) {
+			list.Items = append(list.Items, CompletionItem{
+				Label:  m.name,
+				Kind:   m.kind,
+				Detail: m.detail(),
+			})
+		}
+	}
+
+	return list, nil
+}
+
+func (s *Server) documentSymbol(params json.RawMessage) (interface{}, error) {
+	var p DocumentSymbolParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.file == nil {
+		return []DocumentSymbol{}, nil
+	}
+
+	return symbols(doc.file, doc.file.statements(), false), nil
+}
+
+func symbols(f *file, stmts []ast.Node, inClass bool) []DocumentSymbol {
+	syms := []DocumentSymbol{}
+
+	add := func(n ast.Node, name, selName, detail string, kind int, children []DocumentSymbol) {
+		syms = append(syms, DocumentSymbol{
+			Name:           name,
+			Detail:         detail,
+			Kind:           kind,
+			Range:          f.nodeRange(n),
+			SelectionRange: f.nameRange(n, selName),
+			Children:       children,
+		})
+	}
+
+	methodKind := SymbolFunction
+	if inClass {
+		methodKind = SymbolMethod
+	}
+
+	for _, stmt := range stmts {
+		switch n := stmt.(type) {
+		case *ast.ClassDefinition:
+			var detail string
+
+			if n.Super != nil {
+				detail = ": " + n.Super.Name
+			}
+
+			add(n, n.Name, n.Name, detail, SymbolClass, symbols(f, statements(n.Body), true))
+		case *ast.Definition:
+			add(n, n.Name.Name, n.Name.Name, formatSignature("", defSignature(n)), methodKind, nil)
+		case *ast.GoDefinition:
+			add(n, n.Name.Name, n.Name.Name, "", methodKind, nil)
+		case *ast.Has:
+			add(n, "@"+n.Variable, n.Variable, "", SymbolField, nil)
+		case *ast.Import:
+			name := strings.Join(n.Path, ".")
+			add(n, name, n.Path[len(n.Path)-1], "", SymbolModule, nil)
+		}
+	}
+
+	return syms
+}
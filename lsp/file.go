@@ -0,0 +1,282 @@
+package lsp
+
+import (
+	"net/url"
+	"path/filepath"
+	"sort"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/parser"
+)
+
+// text is source along with where its lines start, for converting between
+// byte offsets and LSP positions, whose characters count UTF-16 code units.
+type text struct {
+	src   string
+	lines []int
+}
+
+func newText(src string) *text {
+	t := &text{src: src, lines: []int{0}}
+
+	for i, c := range src {
+		if c == '\n' {
+			t.lines = append(t.lines, i+1)
+		}
+	}
+
+	return t
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+
+	return 1
+}
+
+func (t *text) position(offset int) Position {
+	line := sort.Search(len(t.lines), func(i int) bool {
+		return t.lines[i] > offset
+	}) - 1
+
+	var char int
+
+	for _, r := range t.src[t.lines[line]:offset] {
+		char += utf16Len(r)
+	}
+
+	return Position{Line: line, Character: char}
+}
+
+func (t *text) offset(pos Position) int {
+	switch {
+	case pos.Line < 0:
+		return 0
+	case pos.Line >= len(t.lines):
+		return len(t.src)
+	}
+
+	start := t.lines[pos.Line]
+
+	var char int
+
+	for i, r := range t.src[start:] {
+		if char >= pos.Character || r == '\n' {
+			return start + i
+		}
+
+		char += utf16Len(r)
+	}
+
+	return len(t.src)
+}
+
+func (t *text) rangeOf(start, end int) Range {
+	return Range{Start: t.position(start), End: t.position(end)}
+}
+
+// tokenRange returns the range of the token at offset, which is empty if
+// there's nothing to underline there, such as at the end of a line.
+func (t *text) tokenRange(offset int) Range {
+	for _, tok := range parser.Lex(t.src) {
+		if tok.Start <= offset && offset < tok.End {
+			switch tok.Kind {
+			case parser.TokenNewline, parser.TokenSpace:
+				return t.rangeOf(offset, offset)
+			default:
+				return t.rangeOf(tok.Start, tok.End)
+			}
+		}
+	}
+
+	return t.rangeOf(offset, offset)
+}
+
+// file is a source file that parsed.
+type file struct {
+	*text
+
+	path string
+	uri  string
+
+	cst   *parser.CST
+	pos   ast.Positions
+	nodes map[ast.Node]*parser.CSTNode
+}
+
+func parseFile(path, uri, src string) (*file, error) {
+	p, err := parser.NewParser(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p.File = path
+
+	cst, err := p.ParseCST()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &file{
+		text:  newText(src),
+		path:  path,
+		uri:   uri,
+		cst:   cst,
+		pos:   cst.Positions(),
+		nodes: make(map[ast.Node]*parser.CSTNode),
+	}
+
+	var walk func(n *parser.CSTNode)
+
+	walk = func(n *parser.CSTNode) {
+		if n.Node != nil {
+			f.nodes[n.Node] = n
+		}
+
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+
+	walk(cst.Root)
+
+	return f, nil
+}
+
+// statements returns the statements at the top of the file.
+func (f *file) statements() []ast.Node {
+	return statements(f.cst.Root.Node)
+}
+
+func statements(n ast.Node) []ast.Node {
+	switch n := n.(type) {
+	case nil:
+		return nil
+	case *ast.Block:
+		return n.Expressions
+	default:
+		return []ast.Node{n}
+	}
+}
+
+// nodeRange returns the range of n's text.
+func (f *file) nodeRange(n ast.Node) Range {
+	cn, ok := f.nodes[n]
+	if !ok {
+		return f.rangeOf(f.pos[n].Offset, f.pos[n].Offset)
+	}
+
+	return f.rangeOf(cn.Start, cn.End)
+}
+
+// nameRange returns the range of the first word in n that is name, or
+// n's range if there isn't one.
+func (f *file) nameRange(n ast.Node, name string) Range {
+	cn, ok := f.nodes[n]
+	if !ok {
+		return f.nodeRange(n)
+	}
+
+	for _, tok := range f.cst.Tokens[cn.First:cn.Last] {
+		if tok.Kind == parser.TokenWord && tok.Text == name {
+			return f.rangeOf(tok.Start, tok.End)
+		}
+	}
+
+	return f.nodeRange(n)
+}
+
+// enclosing returns the nodes around offset, outermost first.
+func (f *file) enclosing(offset int) []ast.Node {
+	var path []ast.Node
+
+	for n := f.cst.Root; n != nil; {
+		var next *parser.CSTNode
+
+		for _, child := range n.Children {
+			if child.Start <= offset && offset < child.End {
+				next = child
+				break
+			}
+		}
+
+		if next != nil && next.Node != nil {
+			path = append(path, next.Node)
+		}
+
+		n = next
+	}
+
+	return path
+}
+
+// dir is the directory of the file, or "" if it isn't on disk.
+func (f *file) dir() string {
+	if _, ok := uriPath(f.uri); !ok {
+		return ""
+	}
+
+	return filepath.Dir(f.path)
+}
+
+// pathURI converts between file paths and file URIs. Documents with other
+// URIs, such as unsaved ones, have no path.
+func pathURI(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+}
+
+func uriPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+
+	return filepath.FromSlash(u.Path), true
+}
+
+// document is a file the client has open.
+type document struct {
+	*text
+
+	uri     string
+	path    string
+	version int
+
+	// file is the last parse of the document that succeeded, which is
+	// what it's understood as while it doesn't parse.
+	file *file
+	err  error
+}
+
+func (d *document) update(src string, version int) {
+	d.text = newText(src)
+	d.version = version
+
+	name := d.path
+	if name == "" {
+		name = d.uri
+	}
+
+	f, err := parseFile(name, d.uri, src)
+
+	d.err = err
+	if err == nil {
+		d.file = f
+	}
+}
+
+// dir is the directory the document's package is in.
+func (d *document) dir() string {
+	if d.path == "" {
+		return ""
+	}
+
+	return filepath.Dir(d.path)
+}
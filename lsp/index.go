@@ -0,0 +1,264 @@
+package lsp
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/loader"
+)
+
+// decl is a def, class, has or import and the file it's in.
+type decl struct {
+	file *file
+	node ast.Node
+	name string
+}
+
+func (d *decl) location() Location {
+	return Location{URI: d.file.uri, Range: d.file.nameRange(d.node, d.name)}
+}
+
+type class struct {
+	*decl
+
+	def     *ast.ClassDefinition
+	methods map[string]*decl
+	ivars   map[string]*decl
+}
+
+// pkg is what the top level statements of a package's files declare.
+type pkg struct {
+	name  string
+	dir   string
+	files []*file
+
+	defs    map[string]*decl
+	classes map[string]*class
+	imports map[string]*decl
+}
+
+func addDef(defs map[string]*decl, f *file, def *ast.Definition) {
+	defs[def.Name.Name] = &decl{file: f, node: def, name: def.Name.Name}
+
+	if def.Name.Operator != "" {
+		defs[def.Name.Operator] = defs[def.Name.Name]
+	}
+}
+
+func newClass(f *file, def *ast.ClassDefinition) *class {
+	cls := &class{
+		decl:    &decl{file: f, node: def, name: def.Name},
+		def:     def,
+		methods: make(map[string]*decl),
+		ivars:   make(map[string]*decl),
+	}
+
+	for _, stmt := range statements(def.Body) {
+		switch n := stmt.(type) {
+		case *ast.Definition:
+			addDef(cls.methods, f, n)
+		case *ast.Has:
+			cls.ivars[n.Variable] = &decl{file: f, node: n, name: n.Variable}
+		}
+	}
+
+	return cls
+}
+
+func newPkg(name, dir string, files []*file) *pkg {
+	p := &pkg{
+		name:    name,
+		dir:     dir,
+		files:   files,
+		defs:    make(map[string]*decl),
+		classes: make(map[string]*class),
+		imports: make(map[string]*decl),
+	}
+
+	for _, f := range files {
+		for _, stmt := range f.statements() {
+			switch n := stmt.(type) {
+			case *ast.Definition:
+				addDef(p.defs, f, n)
+			case *ast.ClassDefinition:
+				p.classes[n.Name] = newClass(f, n)
+			case *ast.Import:
+				name := n.Path[len(n.Path)-1]
+				p.imports[name] = &decl{file: f, node: n, name: name}
+			}
+		}
+	}
+
+	return p
+}
+
+// lineage returns cls and the classes in the package it inherits from.
+func (p *pkg) lineage(cls *class) []*class {
+	var line []*class
+
+	for cls != nil && len(line) <= len(p.classes) {
+		line = append(line, cls)
+
+		if cls.def.Super == nil {
+			break
+		}
+
+		cls = p.classes[cls.def.Super.Name]
+	}
+
+	return line
+}
+
+// classAt returns the class whose body offset is in.
+func (p *pkg) classAt(f *file, offset int) *class {
+	var found *class
+
+	for _, n := range f.enclosing(offset) {
+		if cd, ok := n.(*ast.ClassDefinition); ok {
+			if cls, ok := p.classes[cd.Name]; ok && cls.def == cd {
+				found = cls
+			} else {
+				found = newClass(f, cd)
+			}
+		}
+	}
+
+	return found
+}
+
+// packageFiles returns the paths of the source files of the package dir
+// is in, or nil if it isn't a package.
+func packageFiles(dir string) []string {
+	if dir == "" {
+		return nil
+	}
+
+	paths, err := loader.SourceFiles(dir)
+	if err != nil {
+		return nil
+	}
+
+	return paths
+}
+
+// pkgFor returns the package doc is a file of. Open documents are used in
+// place of the files they're for. Files that don't parse are left out.
+func (s *Server) pkgFor(doc *document) *pkg {
+	var (
+		files []*file
+		found bool
+	)
+
+	for _, name := range packageFiles(doc.dir()) {
+		if name == doc.path {
+			found = true
+		}
+
+		if f := s.fileFor(name); f != nil {
+			files = append(files, f)
+		}
+	}
+
+	// A file on its own, such as one not saved yet, is a package by
+	// itself.
+	if !found {
+		files = nil
+
+		if doc.file != nil {
+			files = append(files, doc.file)
+		}
+	}
+
+	name := strings.TrimSuffix(path.Base(doc.uri), loader.SourceExt)
+	if found {
+		name = pkgName(doc.dir())
+	}
+
+	return newPkg(name, doc.dir(), files)
+}
+
+// loadPkg returns the package in dir.
+func (s *Server) loadPkg(dir string) *pkg {
+	var files []*file
+
+	for _, name := range packageFiles(dir) {
+		if f := s.fileFor(name); f != nil {
+			files = append(files, f)
+		}
+	}
+
+	return newPkg(pkgName(dir), dir, files)
+}
+
+// pkgName returns the name of the package in dir, which its manifest can
+// give in place of the directory's.
+func pkgName(dir string) string {
+	if m, err := loader.ReadManifest(dir); err == nil && m != nil && m.Name != "" {
+		return m.Name
+	}
+
+	return filepath.Base(dir)
+}
+
+// parsed is a file read from disk, kept until the file changes.
+type parsed struct {
+	mod  time.Time
+	size int64
+	file *file
+}
+
+// fileFor returns the file called name, using the open document for it if
+// there is one. Files on disk are only parsed again once they change.
+func (s *Server) fileFor(name string) *file {
+	for _, doc := range s.docs {
+		if doc.path == name {
+			return doc.file
+		}
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		delete(s.files, name)
+		return nil
+	}
+
+	if p, ok := s.files[name]; ok && p.mod.Equal(info.ModTime()) && p.size == info.Size() {
+		return p.file
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+
+	// A file that doesn't parse is remembered too, so it isn't parsed
+	// again until it changes.
+	f, err := parseFile(name, pathURI(name), string(data))
+	if err != nil {
+		f = nil
+	}
+
+	s.files[name] = &parsed{mod: info.ModTime(), size: info.Size(), file: f}
+
+	return f
+}
+
+// importDir returns the directory of the package imp, in a file in dir,
+// imports.
+func (s *Server) importDir(dir string, imp *ast.Import) (string, bool) {
+	name := strings.Join(imp.Path, ".")
+
+	if imp.Relative {
+		rel := filepath.Join(dir, name)
+		return rel, len(packageFiles(rel)) > 0
+	}
+
+	lo := &loader.Loader{RelBase: dir, Search: s.Search}
+
+	return lo.Resolve(name)
+}
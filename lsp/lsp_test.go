@@ -0,0 +1,531 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+const mainSource = `import greet
+
+class Foo {
+  has @name
+
+  def initialize(name) {
+    @name = name
+  }
+
+  def hello(who) {
+    greet.hi(@name + who)
+  }
+}
+
+def run() {
+  x = 3
+  f = Foo.new("a")
+  f.hello("b")
+  self.helper(x.add(1))
+}
+`
+
+// client drives a Server the way an editor would.
+type client struct {
+	t    *testing.T
+	dir  string
+	in   *io.PipeWriter
+	msgs chan *Message
+	done chan error
+
+	id    int
+	notes []*Message
+}
+
+func newClient(t *testing.T) *client {
+	dir, err := ioutil.TempDir("", "m13")
+	require.NoError(t, err)
+
+	write := func(name, src string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(src), 0644))
+	}
+
+	write("app/main.m13", mainSource)
+	write("app/util.m13", "def helper(a) {\n  a\n}\n")
+	write("lib/greet/greet.m13", "def hi(who) {\n  who\n}\n")
+
+	s := NewServer()
+	s.Search = []string{filepath.Join(dir, "lib")}
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	c := &client{
+		t:    t,
+		dir:  dir,
+		in:   inW,
+		msgs: make(chan *Message, 100),
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		c.done <- s.Serve(inR, outW)
+		outW.Close()
+	}()
+
+	go func() {
+		br := bufio.NewReader(outR)
+
+		for {
+			msg, err := readMessage(br)
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+
+			c.msgs <- msg
+		}
+	}()
+
+	return c
+}
+
+func (c *client) close() {
+	c.notify("exit", nil)
+	require.NoError(c.t, <-c.done)
+	os.RemoveAll(c.dir)
+}
+
+func (c *client) uri(name string) string {
+	return pathURI(filepath.Join(c.dir, name))
+}
+
+func (c *client) send(msg *Message, params interface{}) {
+	data, err := json.Marshal(params)
+	require.NoError(c.t, err)
+
+	msg.Params = data
+
+	require.NoError(c.t, writeMessage(c.in, msg))
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.send(&Message{Method: method}, params)
+}
+
+// call sends a request and decodes its result into result.
+func (c *client) call(method string, params, result interface{}) *ResponseError {
+	c.id++
+
+	id := json.RawMessage(strconv.Itoa(c.id))
+
+	c.send(&Message{ID: &id, Method: method}, params)
+
+	for msg := range c.msgs {
+		if msg.ID == nil {
+			c.notes = append(c.notes, msg)
+			continue
+		}
+
+		require.Equal(c.t, string(id), string(*msg.ID))
+
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		if result != nil {
+			require.NoError(c.t, json.Unmarshal(msg.Result, result))
+		}
+
+		return nil
+	}
+
+	c.t.Fatal("the server stopped")
+	return nil
+}
+
+// diagnostics returns the next diagnostics the server publishes.
+func (c *client) diagnostics() *PublishDiagnosticsParams {
+	for {
+		var msg *Message
+
+		if len(c.notes) > 0 {
+			msg, c.notes = c.notes[0], c.notes[1:]
+		} else {
+			var ok bool
+
+			msg, ok = <-c.msgs
+			require.True(c.t, ok, "the server stopped")
+		}
+
+		if msg.Method == "textDocument/publishDiagnostics" {
+			var p PublishDiagnosticsParams
+			require.NoError(c.t, json.Unmarshal(msg.Params, &p))
+
+			return &p
+		}
+	}
+}
+
+func (c *client) open(name, src string) *PublishDiagnosticsParams {
+	c.notify("textDocument/didOpen", &DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: c.uri(name), LanguageID: "m13", Version: 1, Text: src},
+	})
+
+	return c.diagnostics()
+}
+
+func (c *client) change(name, src string, version int) *PublishDiagnosticsParams {
+	c.notify("textDocument/didChange", &DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{URI: c.uri(name), Version: version},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: src}},
+	})
+
+	return c.diagnostics()
+}
+
+// at returns the position delta bytes into the first occurrence of
+// needle in src.
+func at(src, needle string, delta int) Position {
+	offset := strings.Index(src, needle) + delta
+
+	return newText(src).position(offset)
+}
+
+func (c *client) position(name, src, needle string, delta int) *TextDocumentPositionParams {
+	return &TextDocumentPositionParams{
+		TextDocument: TextDocumentIdentifier{URI: c.uri(name)},
+		Position:     at(src, needle, delta),
+	}
+}
+
+func labels(list *CompletionList) []string {
+	var names []string
+
+	for _, item := range list.Items {
+		names = append(names, item.Label)
+	}
+
+	return names
+}
+
+func TestServer(t *testing.T) {
+	n := neko.Start(t)
+
+	n.It("initializes and shuts down", func() {
+		c := newClient(t)
+		defer c.close()
+
+		var res InitializeResult
+
+		require.Nil(t, c.call("initialize", &InitializeParams{}, &res))
+		assert.True(t, res.Capabilities.DefinitionProvider)
+		assert.Equal(t, SyncFull, res.Capabilities.TextDocumentSync)
+		assert.Equal(t, []string{".", "@"}, res.Capabilities.CompletionProvider.TriggerCharacters)
+
+		require.Nil(t, c.call("shutdown", nil, nil))
+	})
+
+	n.It("rejects unknown methods", func() {
+		c := newClient(t)
+		defer c.close()
+
+		err := c.call("textDocument/rename", nil, nil)
+		require.NotNil(t, err)
+		assert.Equal(t, CodeMethodNotFound, err.Code)
+	})
+
+	n.It("publishes parse errors and lint warnings", func() {
+		c := newClient(t)
+		defer c.close()
+
+		diags := c.open("app/main.m13", "def run() {\n  x = (1\n}\n")
+		assert.Equal(t, c.uri("app/main.m13"), diags.URI)
+		require.Equal(t, 1, len(diags.Diagnostics))
+
+		d := diags.Diagnostics[0]
+		assert.Equal(t, SeverityError, d.Severity)
+		assert.Equal(t, 1, d.Range.Start.Line)
+		assert.Contains(t, d.Message, "syntax error, expected")
+
+		diags = c.change("app/main.m13", "def run() {\n  y = 1\n  self.helper(z, 2)\n}\n", 2)
+		assert.Equal(t, 2, diags.Version)
+
+		var msgs []string
+
+		for _, d := range diags.Diagnostics {
+			assert.Equal(t, SeverityWarning, d.Severity)
+			msgs = append(msgs, d.Code+": "+d.Message)
+		}
+
+		assert.Equal(t, []string{
+			"unused: y is assigned but never used",
+			"arity: helper takes 1 argument(s) but is called with 2",
+			"undefined: undefined variable z",
+		}, msgs)
+
+		z := diags.Diagnostics[2].Range
+		assert.Equal(t, Range{Start: Position{Line: 2, Character: 14}, End: Position{Line: 2, Character: 15}}, z)
+
+		diags = c.change("app/main.m13", mainSource, 3)
+		assert.Empty(t, diags.Diagnostics)
+	})
+
+	n.It("finds definitions", func() {
+		c := newClient(t)
+		defer c.close()
+
+		c.open("app/main.m13", mainSource)
+
+		def := func(needle string, delta int) []Location {
+			var locs []Location
+			require.Nil(t, c.call("textDocument/definition", c.position("app/main.m13", mainSource, needle, delta), &locs))
+
+			return locs
+		}
+
+		main := c.uri("app/main.m13")
+
+		assert.Equal(t, []Location{{URI: main, Range: Range{
+			Start: Position{Line: 2, Character: 6},
+			End:   Position{Line: 2, Character: 9},
+		}}}, def("Foo.new", 1))
+
+		assert.Equal(t, []Location{{URI: main, Range: Range{
+			Start: Position{Line: 5, Character: 6},
+			End:   Position{Line: 5, Character: 16},
+		}}}, def("Foo.new", 5))
+
+		assert.Equal(t, []Location{{URI: main, Range: Range{
+			Start: Position{Line: 3, Character: 7},
+			End:   Position{Line: 3, Character: 11},
+		}}}, def("@name +", 2))
+
+		assert.Equal(t, []Location{{URI: main, Range: Range{
+			Start: Position{Line: 9, Character: 6},
+			End:   Position{Line: 9, Character: 11},
+		}}}, def("f.hello", 3))
+
+		assert.Equal(t, []Location{{URI: c.uri("app/util.m13"), Range: Range{
+			Start: Position{Line: 0, Character: 4},
+			End:   Position{Line: 0, Character: 10},
+		}}}, def("self.helper", 6))
+
+		greet := []Location{{URI: c.uri("lib/greet/greet.m13")}}
+
+		assert.Equal(t, greet, def("import greet", 8))
+		assert.Equal(t, greet, def("greet.hi", 1))
+
+		assert.Equal(t, []Location{{URI: c.uri("lib/greet/greet.m13"), Range: Range{
+			Start: Position{Line: 0, Character: 4},
+			End:   Position{Line: 0, Character: 6},
+		}}}, def("greet.hi", 6))
+
+		assert.Empty(t, def("x = 3", 0))
+	})
+
+	n.It("shows signatures on hover", func() {
+		c := newClient(t)
+		defer c.close()
+
+		c.open("app/main.m13", mainSource)
+
+		hover := func(needle string, delta int) string {
+			var h *Hover
+			require.Nil(t, c.call("textDocument/hover", c.position("app/main.m13", mainSource, needle, delta), &h))
+
+			if h == nil {
+				return ""
+			}
+
+			return h.Contents.Value
+		}
+
+		assert.Equal(t, "```m13\nFoo.hello(who)\n```", hover("f.hello", 4))
+		assert.Equal(t, "```m13\nFoo.new(name)\n```", hover("Foo.new", 5))
+		assert.Equal(t, "```m13\nbuiltin.I64.add(arg1)\n```", hover("x.add", 3))
+		assert.Equal(t, "```m13\ngreet.hi(who)\n```", hover("greet.hi", 7))
+		assert.Equal(t, "```m13\napp.helper(a)\n```", hover("self.helper", 5))
+		assert.Equal(t, "```m13\nFoo has @name\n```", hover("@name +", 1))
+		assert.Equal(t, "", hover("x = 3", 0))
+	})
+
+	n.It("completes methods on known classes", func() {
+		c := newClient(t)
+		defer c.close()
+
+		c.open("app/main.m13", mainSource)
+
+		src := strings.Replace(mainSource, "  self.helper(x.add(1))\n", "  self.helper(x.add(1))\n  x.\n  Foo.\n  self.\n  \"s\".\n  greet.\n", 1)
+		diags := c.change("app/main.m13", src, 2)
+		require.NotEmpty(t, diags.Diagnostics)
+
+		complete := func(needle string, delta int) *CompletionList {
+			var list CompletionList
+			require.Nil(t, c.call("textDocument/completion", c.position("app/main.m13", src, needle, delta), &list))
+
+			return &list
+		}
+
+		list := complete("  x.\n", 4)
+		assert.Equal(t, []string{"+", "++", "<", "==", "add", "equal", "inc", "less_than"}, labels(list))
+		assert.Equal(t, CompletionMethod, list.Items[4].Kind)
+		assert.Equal(t, "add(arg1)", list.Items[4].Detail)
+
+		list = complete("  Foo.\n", 6)
+		assert.Equal(t, []string{"name", "new", "resolve"}, labels(list))
+		assert.Equal(t, "new(name)", list.Items[1].Detail)
+
+		list = complete("  self.\n", 7)
+		assert.Equal(t, []string{"Foo", "helper", "run"}, labels(list))
+
+		assert.Equal(t, []string{"+", "==", "include", "match"}, labels(complete("  \"s\".\n", 6)))
+		assert.Equal(t, []string{"hi"}, labels(complete("  greet.\n", 8)))
+		assert.Equal(t, []string{"name"}, labels(complete("@name +", 1)))
+		assert.Equal(t, []string{"hello"}, labels(complete("f.hello", 3)))
+	})
+
+	n.It("completes the names in scope", func() {
+		c := newClient(t)
+		defer c.close()
+
+		c.open("app/main.m13", mainSource)
+
+		var list CompletionList
+		require.Nil(t, c.call("textDocument/completion", c.position("app/main.m13", mainSource, "Foo.new", 1), &list))
+
+		assert.Equal(t, []string{"Foo"}, labels(&list))
+		assert.Equal(t, CompletionClass, list.Items[0].Kind)
+
+		require.Nil(t, c.call("textDocument/completion", c.position("app/main.m13", mainSource, "greet.hi", 2), &list))
+		assert.Equal(t, []string{"greet"}, labels(&list))
+		assert.Equal(t, CompletionModule, list.Items[0].Kind)
+
+		require.Nil(t, c.call("textDocument/completion", c.position("app/main.m13", mainSource, "Foo.new", 0), &list))
+		assert.Contains(t, labels(&list), "Foo")
+
+		for _, label := range labels(&list) {
+			assert.False(t, strings.HasPrefix(label, "$"), label)
+		}
+	})
+
+	n.It("lists document symbols", func() {
+		c := newClient(t)
+		defer c.close()
+
+		c.open("app/main.m13", mainSource)
+
+		var syms []DocumentSymbol
+		require.Nil(t, c.call("textDocument/documentSymbol", &DocumentSymbolParams{
+			TextDocument: TextDocumentIdentifier{URI: c.uri("app/main.m13")},
+		}, &syms))
+
+		type symbol struct {
+			Name, Detail string
+			Kind, Line   int
+			Children     []symbol
+		}
+
+		var simplify func(syms []DocumentSymbol) []symbol
+
+		simplify = func(syms []DocumentSymbol) []symbol {
+			var out []symbol
+
+			for _, s := range syms {
+				out = append(out, symbol{s.Name, s.Detail, s.Kind, s.SelectionRange.Start.Line, simplify(s.Children)})
+			}
+
+			return out
+		}
+
+		assert.Equal(t, []symbol{
+			{"greet", "", SymbolModule, 0, nil},
+			{"Foo", "", SymbolClass, 2, []symbol{
+				{"@name", "", SymbolField, 3, nil},
+				{"initialize", "(name)", SymbolMethod, 5, nil},
+				{"hello", "(who)", SymbolMethod, 9, nil},
+			}},
+			{"run", "()", SymbolFunction, 14, nil},
+		}, simplify(syms))
+
+		assert.Equal(t, Range{
+			Start: Position{Line: 2, Character: 0},
+			End:   Position{Line: 12, Character: 1},
+		}, syms[1].Range)
+	})
+
+	n.It("names a package by its manifest", func() {
+		c := newClient(t)
+		defer c.close()
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(c.dir, "app", "m13.pkg"), []byte("name tools\n"), 0644))
+
+		c.open("app/main.m13", mainSource)
+
+		var h *Hover
+		require.Nil(t, c.call("textDocument/hover", c.position("app/main.m13", mainSource, "self.helper", 5), &h))
+		require.NotNil(t, h)
+
+		assert.Equal(t, "```m13\ntools.helper(a)\n```", h.Contents.Value)
+	})
+
+	n.It("parses the files of a package again only once they change", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "util.m13")
+		require.NoError(t, ioutil.WriteFile(path, []byte("def helper(a) {\n  a\n}\n"), 0644))
+
+		s := NewServer()
+		s.docs = make(map[string]*document)
+		s.files = make(map[string]*parsed)
+		s.out = ioutil.Discard
+
+		f := s.fileFor(path)
+		require.NotNil(t, f)
+
+		assert.True(t, f == s.fileFor(path))
+
+		require.NoError(t, ioutil.WriteFile(path, []byte("def other(a) {\n  a\n}\n"), 0644))
+
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+
+		f = s.fileFor(path)
+		require.NotNil(t, f)
+
+		_, ok := newPkg("util", dir, []*file{f}).defs["other"]
+		assert.True(t, ok)
+
+		doc := &document{uri: pathURI(path), path: path}
+		doc.update("def other(a) {\n  a\n}\n", 1)
+
+		s.docs[doc.uri] = doc
+
+		params, err := json.Marshal(&DidSaveTextDocumentParams{
+			TextDocument: TextDocumentIdentifier{URI: doc.uri},
+		})
+		require.NoError(t, err)
+
+		_, err = s.didSave(params)
+		require.NoError(t, err)
+
+		_, ok = s.files[path]
+		assert.False(t, ok)
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,345 @@
+// Package lsp is a language server for m13, speaking the Language Server
+// Protocol over a stream such as stdin and stdout.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/evanphx/m13/lint"
+	"github.com/evanphx/m13/loader"
+	"github.com/evanphx/m13/parser"
+	"github.com/evanphx/m13/value"
+)
+
+// Server answers the requests of one client.
+type Server struct {
+	// Registry has the classes defined in Go, whose methods are completed
+	// and described along with those of the packages being edited.
+	Registry *value.Registry
+
+	// Search is where imported packages are looked for.
+	Search []string
+
+	// Lint picks the checks run on open documents.
+	Lint lint.Config
+
+	docs   map[string]*document
+	files  map[string]*parsed
+	out    io.Writer
+	exited bool
+}
+
+// NewServer returns a Server that finds imports on the usual search path.
+func NewServer() *Server {
+	return &Server{
+		Registry: value.NewRegistry(),
+		Search:   loader.SearchPath(),
+	}
+}
+
+type handler func(s *Server, params json.RawMessage) (interface{}, error)
+
+var handlers = map[string]handler{
+	"initialize":                  (*Server).initialize,
+	"initialized":                 (*Server).ignore,
+	"shutdown":                    (*Server).ignore,
+	"exit":                        (*Server).exit,
+	"$/cancelRequest":             (*Server).ignore,
+	"textDocument/didOpen":        (*Server).didOpen,
+	"textDocument/didChange":      (*Server).didChange,
+	"textDocument/didSave":        (*Server).didSave,
+	"textDocument/didClose":       (*Server).didClose,
+	"textDocument/definition":     (*Server).definition,
+	"textDocument/hover":          (*Server).hover,
+	"textDocument/completion":     (*Server).completion,
+	"textDocument/documentSymbol": (*Server).documentSymbol,
+}
+
+// Serve reads requests from r and writes the responses to w until the
+// client exits or r ends.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.docs = make(map[string]*document)
+	s.files = make(map[string]*parsed)
+	s.out = w
+	s.exited = false
+
+	br := bufio.NewReader(r)
+
+	for !s.exited {
+		msg, err := readMessage(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			var rerr *ResponseError
+
+			if errors.As(err, &rerr) {
+				if err := s.reply(nil, nil, rerr); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			return err
+		}
+
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handle runs the handler for msg, returning an error only when the
+// client can no longer be written to.
+func (s *Server) handle(msg *Message) error {
+	h, ok := handlers[msg.Method]
+	if !ok {
+		// Notifications the server doesn't know are fine to drop.
+		if msg.ID == nil {
+			return nil
+		}
+
+		return s.reply(msg.ID, nil, &ResponseError{
+			Code:    CodeMethodNotFound,
+			Message: fmt.Sprintf("unknown method '%s'", msg.Method),
+		})
+	}
+
+	result, err := h(s, msg.Params)
+
+	if msg.ID == nil {
+		if err != nil {
+			return s.notify("window/logMessage", map[string]interface{}{
+				"type":    1,
+				"message": fmt.Sprintf("%s: %s", msg.Method, err),
+			})
+		}
+
+		return nil
+	}
+
+	return s.reply(msg.ID, result, err)
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, err error) error {
+	msg := &Message{ID: id}
+
+	if err != nil {
+		rerr, ok := err.(*ResponseError)
+		if !ok {
+			rerr = &ResponseError{Code: CodeInvalidRequest, Message: err.Error()}
+		}
+
+		msg.Error = rerr
+	} else {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+
+		msg.Result = data
+	}
+
+	return writeMessage(s.out, msg)
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return writeMessage(s.out, &Message{Method: method, Params: data})
+}
+
+func decode(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &ResponseError{Code: CodeInvalidParams, Message: err.Error()}
+	}
+
+	return nil
+}
+
+func (s *Server) ignore(json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *Server) exit(json.RawMessage) (interface{}, error) {
+	s.exited = true
+	return nil, nil
+}
+
+func (s *Server) initialize(params json.RawMessage) (interface{}, error) {
+	return &InitializeResult{
+		Capabilities: ServerCapabilities{
+			TextDocumentSync:   SyncFull,
+			DefinitionProvider: true,
+			HoverProvider:      true,
+			CompletionProvider: CompletionOptions{
+				TriggerCharacters: []string{".", "@"},
+			},
+			DocumentSymbolProvider: true,
+		},
+		ServerInfo: ServerInfo{Name: "m13"},
+	}, nil
+}
+
+func (s *Server) didOpen(params json.RawMessage) (interface{}, error) {
+	var p DidOpenTextDocumentParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc := &document{uri: p.TextDocument.URI}
+	doc.path, _ = uriPath(doc.uri)
+	doc.update(p.TextDocument.Text, p.TextDocument.Version)
+
+	s.docs[doc.uri] = doc
+
+	return nil, s.publish(doc)
+}
+
+func (s *Server) didChange(params json.RawMessage) (interface{}, error) {
+	var p DidChangeTextDocumentParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	if n := len(p.ContentChanges); n > 0 {
+		doc.update(p.ContentChanges[n-1].Text, p.TextDocument.Version)
+	}
+
+	delete(s.files, doc.path)
+
+	return nil, s.publish(doc)
+}
+
+func (s *Server) didSave(params json.RawMessage) (interface{}, error) {
+	var p DidSaveTextDocumentParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(s.files, doc.path)
+
+	return nil, s.publish(doc)
+}
+
+func (s *Server) didClose(params json.RawMessage) (interface{}, error) {
+	var p DidCloseTextDocumentParams
+
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	delete(s.docs, p.TextDocument.URI)
+
+	return nil, s.notify("textDocument/publishDiagnostics", &PublishDiagnosticsParams{
+		URI:         p.TextDocument.URI,
+		Diagnostics: []Diagnostic{},
+	})
+}
+
+func (s *Server) document(uri string) (*document, error) {
+	doc, ok := s.docs[uri]
+	if !ok {
+		return nil, &ResponseError{
+			Code:    CodeInvalidParams,
+			Message: fmt.Sprintf("document '%s' isn't open", uri),
+		}
+	}
+
+	return doc, nil
+}
+
+// publish sends the client the problems with doc: its parse errors if it
+// doesn't parse, otherwise what lint finds in it.
+func (s *Server) publish(doc *document) error {
+	diags := []Diagnostic{}
+
+	if doc.err != nil {
+		var errs parser.ErrorList
+
+		if !errors.As(doc.err, &errs) {
+			diags = append(diags, Diagnostic{
+				Range:    doc.rangeOf(0, 0),
+				Severity: SeverityError,
+				Source:   "m13",
+				Message:  doc.err.Error(),
+			})
+		}
+
+		for _, e := range errs {
+			diags = append(diags, Diagnostic{
+				Range:    doc.tokenRange(e.Offset),
+				Severity: SeverityError,
+				Source:   "m13",
+				Message:  e.Message(),
+			})
+		}
+	} else {
+		for _, w := range s.lint(doc) {
+			diags = append(diags, Diagnostic{
+				Range:    doc.tokenRange(w.Offset),
+				Severity: SeverityWarning,
+				Code:     w.Check,
+				Source:   "m13 lint",
+				Message:  w.Message,
+			})
+		}
+	}
+
+	return s.notify("textDocument/publishDiagnostics", &PublishDiagnosticsParams{
+		URI:         doc.uri,
+		Version:     doc.version,
+		Diagnostics: diags,
+	})
+}
+
+// lint returns the warnings in doc, linting it along with the rest of its
+// package so that calls between files are checked.
+func (s *Server) lint(doc *document) []*lint.Warning {
+	pkg := s.pkgFor(doc)
+
+	var files []*lint.File
+
+	for _, f := range pkg.files {
+		files = append(files, &lint.File{Name: f.path, Source: []byte(f.src)})
+	}
+
+	warnings, err := s.Lint.Package(files)
+	if err != nil {
+		return nil
+	}
+
+	var mine []*lint.Warning
+
+	for _, w := range warnings {
+		if w.File == doc.file.path {
+			mine = append(mine, w)
+		}
+	}
+
+	return mine
+}
@@ -0,0 +1,318 @@
+package parser
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/evanphx/m13/ast"
+)
+
+// Trivia is source the grammar skips over: spaces, newlines and comments.
+type Trivia struct {
+	Token
+	Text string
+}
+
+// CSTToken is a significant token along with the trivia around it. The
+// trailing trivia runs up to the end of the token's line, the leading
+// trivia is everything between that and the previous token's trailing
+// trivia.
+type CSTToken struct {
+	Token
+	Text string
+
+	Leading  []Trivia
+	Trailing []Trivia
+}
+
+// CSTNode is an AST node along with the tokens it was parsed from,
+// Tokens[First:Last] of the CST. Start and End are the byte offsets of
+// the node's text, not counting the trivia around it. Comments are
+// trivia, so a comment statement has no tokens of its own and First equals
+// Last.
+type CSTNode struct {
+	Node ast.Node
+
+	First, Last int
+	Start, End  int
+
+	Children []*CSTNode
+}
+
+// CST is a lossless concrete syntax tree. Every byte of the source is in
+// exactly one token or trivia, so the source can always be reproduced.
+type CST struct {
+	Source string
+
+	// Tokens ends with a TokenEOF, whose leading trivia is whatever
+	// follows the last significant token.
+	Tokens []CSTToken
+
+	// Root covers the whole source. Its Node is what Parse returns.
+	Root *CSTNode
+
+	parser *Parser
+}
+
+type span struct {
+	start, end int
+}
+
+func isTrivia(k TokenKind) bool {
+	switch k {
+	case TokenSpace, TokenNewline, TokenComment:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseCST parses the source like Parse, keeping the tokens and trivia
+// each node was parsed from.
+func (p *Parser) ParseCST() (*CST, error) {
+	p.spans = make(map[ast.Node]span)
+	defer func() { p.spans = nil }()
+
+	tree, err := p.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CST{
+		Source: p.source,
+		Tokens: attachTrivia(p.source, Lex(p.source)),
+		parser: p,
+	}
+
+	c.Root = &CSTNode{
+		Node:  tree,
+		First: 0,
+		Last:  len(c.Tokens) - 1,
+		Start: 0,
+		End:   len(p.source),
+	}
+
+	// Several statements come back in a Block covering the whole source,
+	// which the root stands in for.
+	if _, ok := tree.(*ast.Block); ok && p.spans[tree] == (span{0, len(p.source)}) {
+		c.Root.Children = c.buildChildren(p.spans, tree)
+	} else if tree != nil {
+		c.Root.Children = c.build(p.spans, tree)
+	}
+
+	return c, nil
+}
+
+// span records that v, if it's a node, was parsed from source[start:end].
+// A node returned as is by an enclosing rule only grows to cover that rule
+// when it's enclosed on both sides, as by parentheses, so that separators
+// such as a leading comma stay out of it.
+func (p *Parser) span(v RuleValue, start, end int) {
+	node, ok := v.(ast.Node)
+	if !ok || node == nil {
+		return
+	}
+
+	if prev, ok := p.spans[node]; ok && (start >= prev.start || end <= prev.end) {
+		return
+	}
+
+	p.spans[node] = span{start, end}
+}
+
+func attachTrivia(src string, toks []Token) []CSTToken {
+	var (
+		out     []CSTToken
+		pending []Trivia
+	)
+
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+
+		if isTrivia(tok.Kind) {
+			pending = append(pending, Trivia{tok, src[tok.Start:tok.End]})
+			continue
+		}
+
+		ct := CSTToken{
+			Token:   tok,
+			Text:    src[tok.Start:tok.End],
+			Leading: pending,
+		}
+
+		pending = nil
+
+		for i+1 < len(toks) {
+			next := toks[i+1]
+			if next.Kind != TokenSpace && next.Kind != TokenComment {
+				break
+			}
+
+			ct.Trailing = append(ct.Trailing, Trivia{next, src[next.Start:next.End]})
+			i++
+		}
+
+		out = append(out, ct)
+	}
+
+	return out
+}
+
+func (c *CST) build(spans map[ast.Node]span, n ast.Node) []*CSTNode {
+	sp, ok := spans[n]
+	if !ok {
+		return c.buildChildren(spans, n)
+	}
+
+	toks := c.Tokens[:len(c.Tokens)-1]
+
+	first := sort.Search(len(toks), func(i int) bool {
+		return toks[i].Start >= sp.start
+	})
+
+	last := sort.Search(len(toks), func(i int) bool {
+		return toks[i].End > sp.end
+	})
+
+	cn := &CSTNode{
+		Node:  n,
+		First: first,
+		Last:  last,
+	}
+
+	if first < last {
+		cn.Start = toks[first].Start
+		cn.End = toks[last-1].End
+	} else {
+		// Only trivia, which is how comments come out.
+		text := c.Source[sp.start:sp.end]
+		cn.Start = sp.start + len(text) - len(strings.TrimLeft(text, " \t\n"))
+		cn.End = sp.start + len(strings.TrimRight(text, " \t\n"))
+		cn.Last = first
+	}
+
+	cn.Children = c.buildChildren(spans, n)
+
+	return []*CSTNode{cn}
+}
+
+// buildChildren returns the nodes for the children of n in source order.
+// Children without a span of their own, such as those the parser
+// synthesizes, are skipped over in favor of their children.
+func (c *CST) buildChildren(spans map[ast.Node]span, n ast.Node) []*CSTNode {
+	var out []*CSTNode
+
+	for _, child := range childNodes(n) {
+		out = append(out, c.build(spans, child)...)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Start < out[j].Start
+	})
+
+	return out
+}
+
+func childNodes(n ast.Node) []ast.Node {
+	v := reflect.ValueOf(n)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	v = v.Elem()
+
+	var kids []ast.Node
+
+	for i := 0; i < v.NumField(); i++ {
+		kids = appendNodes(kids, v.Field(i))
+	}
+
+	return kids
+}
+
+func appendNodes(kids []ast.Node, f reflect.Value) []ast.Node {
+	if !f.CanInterface() {
+		return kids
+	}
+
+	switch f.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if f.IsNil() {
+			return kids
+		}
+
+		if node, ok := f.Interface().(ast.Node); ok {
+			kids = append(kids, node)
+		}
+	case reflect.Slice:
+		for i := 0; i < f.Len(); i++ {
+			kids = appendNodes(kids, f.Index(i))
+		}
+	}
+
+	return kids
+}
+
+// String reproduces the source the CST was parsed from.
+func (c *CST) String() string {
+	var sb strings.Builder
+
+	for _, tok := range c.Tokens {
+		for _, t := range tok.Leading {
+			sb.WriteString(t.Text)
+		}
+
+		sb.WriteString(tok.Text)
+
+		for _, t := range tok.Trailing {
+			sb.WriteString(t.Text)
+		}
+	}
+
+	return sb.String()
+}
+
+// Text returns the source of n, without the trivia around it.
+func (c *CST) Text(n *CSTNode) string {
+	return c.Source[n.Start:n.End]
+}
+
+// Leading returns the trivia before n, such as the comments above it.
+func (c *CST) Leading(n *CSTNode) []Trivia {
+	if n.First >= n.Last {
+		return nil
+	}
+
+	return c.Tokens[n.First].Leading
+}
+
+// Trailing returns the trivia after n on its last line.
+func (c *CST) Trailing(n *CSTNode) []Trivia {
+	if n.First >= n.Last {
+		return nil
+	}
+
+	return c.Tokens[n.Last-1].Trailing
+}
+
+// Positions returns where each node in the CST starts.
+func (c *CST) Positions() ast.Positions {
+	pos := make(ast.Positions)
+
+	var walk func(n *CSTNode)
+
+	walk = func(n *CSTNode) {
+		if n.Node != nil {
+			pos[n.Node] = c.parser.position(n.Start)
+		}
+
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+
+	walk(c.Root)
+
+	return pos
+}
@@ -0,0 +1,178 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The most errors a single parse reports before giving up.
+const maxErrors = 10
+
+// ParseError describes where the source stopped matching the grammar.
+type ParseError struct {
+	File   string
+	Line   int
+	Column int
+	Offset int
+
+	// Expected are the tokens and rules that could have matched at the
+	// error, such as "}" or word.
+	Expected []string
+
+	// Source is the text of the line the error is on.
+	Source string
+}
+
+func (e *ParseError) Error() string {
+	loc := fmt.Sprintf("%d:%d", e.Line, e.Column)
+	if e.File != "" {
+		loc = e.File + ":" + loc
+	}
+
+	return loc + ": " + e.Message() + "\n" + e.Excerpt()
+}
+
+// Message describes the error without its location.
+func (e *ParseError) Message() string {
+	if len(e.Expected) > 0 {
+		return "syntax error, expected " + joinExpected(e.Expected)
+	}
+
+	return "syntax error"
+}
+
+// Is makes every ParseError match ErrParse.
+func (e *ParseError) Is(target error) bool {
+	return target == ErrParse
+}
+
+// Excerpt returns the line the error is on with a caret under the column.
+func (e *ParseError) Excerpt() string {
+	var pad []rune
+
+	for i, c := range e.Source {
+		if i >= e.Column-1 {
+			break
+		}
+
+		if c == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+
+	return e.Source + "\n" + string(pad) + "^"
+}
+
+func joinExpected(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// ErrorList is every error found by one parse, in source order.
+type ErrorList []*ParseError
+
+func (l ErrorList) Error() string {
+	var msgs []string
+
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+func (l ErrorList) Is(target error) bool {
+	return target == ErrParse
+}
+
+// expect records that the terminal rule failed to match at pos. Only the
+// rules failing at the furthest position are kept, as those are what the
+// source should have contained.
+func (p *Parser) expect(pos int, r Rule) {
+	switch {
+	case pos > p.failPos:
+		p.failPos = pos
+		p.expected = p.expected[:0]
+	case pos < p.failPos:
+		return
+	}
+
+	p.expected = append(p.expected, r)
+}
+
+func (p *Parser) resetExpected() {
+	p.failPos = 0
+	p.expected = nil
+}
+
+func (p *Parser) parseError(ml *markingReader) *ParseError {
+	offset := ml.furthest
+	pos := p.position(offset)
+
+	perr := &ParseError{
+		File:   p.File,
+		Line:   pos.Line,
+		Column: pos.Column,
+		Offset: offset,
+		Source: p.line(pos.Line),
+	}
+
+	if p.failPos == offset {
+		seen := map[string]bool{}
+
+		for _, r := range p.expected {
+			name := descRule(r)
+
+			if !seen[name] {
+				seen[name] = true
+				perr.Expected = append(perr.Expected, name)
+			}
+		}
+
+		sort.Strings(perr.Expected)
+	}
+
+	return perr
+}
+
+// line returns the text of line n, counting from 1.
+func (p *Parser) line(n int) string {
+	start := p.lines[n-1]
+
+	end := len(p.source)
+	if n < len(p.lines) {
+		end = p.lines[n] - 1
+	}
+
+	return p.source[start:end]
+}
+
+// nextStatement returns the offset of the first top level statement after
+// the line containing offset, or -1 if there is none. Top level statements
+// are the lines that start at the left margin, so an error in the middle
+// of a definition skips the rest of it.
+func (p *Parser) nextStatement(offset int) int {
+	line := p.position(offset).Line
+
+	for n := line + 1; n <= len(p.lines); n++ {
+		text := p.line(n)
+		if text == "" {
+			continue
+		}
+
+		switch text[0] {
+		case ' ', '\t', '\r', '}':
+			continue
+		}
+
+		return p.lines[n-1]
+	}
+
+	return -1
+}
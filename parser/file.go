@@ -1,12 +1,56 @@
 package parser
 
 import (
+	"io/fs"
 	"io/ioutil"
 
 	"github.com/evanphx/m13/ast"
 )
 
 func ParseFile(path string) (ast.Node, error) {
+	tree, _, err := ParseFileWithPositions(path)
+	return tree, err
+}
+
+// ParseFileWithPositions parses the file at path and also returns where
+// each statement in it begins.
+func ParseFileWithPositions(path string) (ast.Node, ast.Positions, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parseSource(path, string(data))
+}
+
+func parseSource(name, src string) (ast.Node, ast.Positions, error) {
+	p, err := NewParser(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.File = name
+
+	tree, err := p.Parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tree, p.Positions(), nil
+}
+
+// ParseFS is ParseFileWithPositions for the file name in fsys.
+func ParseFS(fsys fs.FS, name string) (ast.Node, ast.Positions, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parseSource(name, string(data))
+}
+
+// ParseFileCST parses the file at path into a lossless CST.
+func ParseFileCST(path string) (*CST, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -17,5 +61,7 @@ func ParseFile(path string) (ast.Node, error) {
 		return nil, err
 	}
 
-	return p.Parse()
+	p.File = path
+
+	return p.ParseCST()
 }
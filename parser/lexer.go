@@ -0,0 +1,196 @@
+package parser
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// TokenKind classifies the tokens the lexer splits source into.
+type TokenKind uint8
+
+const (
+	tokenUnknown TokenKind = iota
+
+	// TokenOther is any single rune the other kinds don't cover, such as
+	// punctuation and operator characters.
+	TokenOther
+
+	// TokenWord is a letter or underscore followed by letters, digits and
+	// underscores.
+	TokenWord
+
+	TokenNumber
+	TokenSpace
+	TokenNewline
+
+	// TokenString is a double quoted string, including the quotes. An
+	// unterminated string runs to the end of the source.
+	TokenString
+
+	// TokenComment runs from a # to the end of the line.
+	TokenComment
+
+	TokenEOF
+)
+
+var tokenNames = map[TokenKind]string{
+	TokenOther:   "other",
+	TokenWord:    "word",
+	TokenNumber:  "number",
+	TokenSpace:   "space",
+	TokenNewline: "newline",
+	TokenString:  "string",
+	TokenComment: "comment",
+	TokenEOF:     "end of input",
+}
+
+func (k TokenKind) String() string {
+	if name, ok := tokenNames[k]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Token is the source between the offsets Start and End.
+type Token struct {
+	Kind  TokenKind
+	Start int
+	End   int
+}
+
+// Lex splits src into tokens, ending with a TokenEOF. Concatenating the
+// text of every token reproduces src.
+func Lex(src string) []Token {
+	var toks []Token
+
+	for pos := 0; ; {
+		tok := lexAt(src, pos)
+		toks = append(toks, tok)
+
+		if tok.Kind == TokenEOF {
+			return toks
+		}
+
+		pos = tok.End
+	}
+}
+
+// lexAt returns the token starting at pos. Tokens are determined by their
+// first rune alone, so the result doesn't depend on what comes before pos.
+func lexAt(src string, pos int) Token {
+	if pos >= len(src) {
+		return Token{Kind: TokenEOF, Start: len(src), End: len(src)}
+	}
+
+	r, size := utf8.DecodeRuneInString(src[pos:])
+	end := pos + size
+
+	var kind TokenKind
+
+	switch {
+	case unicode.IsLetter(r) || r == '_':
+		kind = TokenWord
+		end = scanWhile(src, end, func(r rune) bool {
+			return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+		})
+	case r >= '0' && r <= '9':
+		kind = TokenNumber
+		end = scanWhile(src, end, func(r rune) bool {
+			return r >= '0' && r <= '9'
+		})
+	case r == ' ' || r == '\t':
+		kind = TokenSpace
+		end = scanWhile(src, end, func(r rune) bool {
+			return r == ' ' || r == '\t'
+		})
+	case r == '\n':
+		kind = TokenNewline
+	case r == '#':
+		kind = TokenComment
+		end = scanWhile(src, end, func(r rune) bool {
+			return r != '\n'
+		})
+	case r == '"':
+		kind = TokenString
+		end = scanString(src, end)
+	default:
+		kind = TokenOther
+	}
+
+	return Token{Kind: kind, Start: pos, End: end}
+}
+
+func scanWhile(src string, pos int, f func(rune) bool) int {
+	for pos < len(src) {
+		r, size := utf8.DecodeRuneInString(src[pos:])
+		if !f(r) {
+			break
+		}
+
+		pos += size
+	}
+
+	return pos
+}
+
+// scanString returns the offset just past the closing quote of the string
+// whose body starts at pos.
+func scanString(src string, pos int) int {
+	for pos < len(src) {
+		switch src[pos] {
+		case '\\':
+			pos += 2
+		case '"':
+			return pos + 1
+		default:
+			pos++
+		}
+	}
+
+	return len(src)
+}
+
+type lexEntry struct {
+	end  int32
+	kind TokenKind
+}
+
+// tokenTable remembers the token starting at each offset of the source, so
+// every rule asking for the token at an offset shares one lex of it.
+type tokenTable struct {
+	src     string
+	entries []lexEntry
+}
+
+// newTokenTable lexes src front to back, which covers the offsets the
+// grammar normally asks about. Any other offset is lexed when first used.
+func newTokenTable(src string) *tokenTable {
+	t := &tokenTable{
+		src:     src,
+		entries: make([]lexEntry, len(src)),
+	}
+
+	for _, tok := range Lex(src) {
+		if tok.Kind != TokenEOF {
+			t.entries[tok.Start] = lexEntry{end: int32(tok.End), kind: tok.Kind}
+		}
+	}
+
+	return t
+}
+
+func (t *tokenTable) at(pos int) Token {
+	if pos >= len(t.src) {
+		return Token{Kind: TokenEOF, Start: len(t.src), End: len(t.src)}
+	}
+
+	ent := t.entries[pos]
+	if ent.kind == tokenUnknown {
+		tok := lexAt(t.src, pos)
+		t.entries[pos] = lexEntry{end: int32(tok.End), kind: tok.Kind}
+		return tok
+	}
+
+	return Token{Kind: ent.kind, Start: pos, End: int(ent.end)}
+}
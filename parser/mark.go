@@ -1,32 +1,70 @@
 package parser
 
 import (
+	"errors"
 	"io"
-	"os"
-	"strings"
+	"unicode/utf8"
 )
 
+// markingReader reads runes directly out of the source string, keeping
+// track of the furthest offset any rule got to.
 type markingReader struct {
-	r   *strings.Reader
-	err error
-	pos int
+	src  string
+	pos  int
+	size int
 
-	furthest int64
+	furthest int
+}
+
+func newMarkingReader(src string) *markingReader {
+	return &markingReader{src: src}
 }
 
 func (m *markingReader) Mark() int {
-	pos, _ := m.r.Seek(0, os.SEEK_CUR)
-	if pos > m.furthest {
-		m.furthest = pos
+	if m.pos > m.furthest {
+		m.furthest = m.pos
 	}
 
-	return int(pos)
+	return m.pos
 }
 
 func (m *markingReader) Rewind(p int) {
-	m.r.Seek(int64(p), os.SEEK_SET)
+	m.pos = p
+	m.size = 0
 }
 
 func (m *markingReader) RuneScanner() io.RuneScanner {
-	return m.r
+	return m
+}
+
+// Rest returns the source from the current offset on.
+func (m *markingReader) Rest() string {
+	return m.src[m.pos:]
+}
+
+func (m *markingReader) ReadRune() (rune, int, error) {
+	if m.pos >= len(m.src) {
+		m.size = 0
+		return 0, 0, io.EOF
+	}
+
+	r, size := utf8.DecodeRuneInString(m.src[m.pos:])
+
+	m.pos += size
+	m.size = size
+
+	return r, size, nil
+}
+
+var errUnread = errors.New("UnreadRune: previous operation was not ReadRune")
+
+func (m *markingReader) UnreadRune() error {
+	if m.size == 0 {
+		return errUnread
+	}
+
+	m.pos -= m.size
+	m.size = 0
+
+	return nil
 }
@@ -1,25 +1,50 @@
 package parser
 
 import (
-	"fmt"
-	"strings"
+	"sort"
 
 	"github.com/evanphx/m13/ast"
 	"github.com/pkg/errors"
 )
 
 type Parser struct {
+	// File names the source in errors.
+	File string
+
 	source string
+	tokens *tokenTable
 
 	root  Rule
 	rootG Rule
 	expr  Rule
 
 	applyDepth int
+
+	lines     []int
+	positions ast.Positions
+
+	// spans is where each node came from, kept only by ParseCST.
+	spans map[ast.Node]span
+
+	failPos  int
+	expected []Rule
+
+	// rules counts the memoized rules, giving each its own id in memo.
+	rules     int
+	memo      packratTable
+	recursive []*RecursiveRule
+
+	// lrDepth is how many left recursive rules are being evaluated, and
+	// lrTaint the shallowest of those the current result depends on.
+	lrDepth int
+	lrTaint int
 }
 
 func NewParser(str string) (*Parser, error) {
-	p := &Parser{source: str}
+	p := &Parser{
+		source: str,
+		tokens: newTokenTable(str),
+	}
 
 	p.SetupRules()
 
@@ -42,6 +67,61 @@ func (s *NodeStack) Pop() ast.Node {
 	return v
 }
 
+// resetMemo forgets every memoized result, so that each parse sees every
+// rule run and can report the furthest it got.
+func (p *Parser) resetMemo() {
+	p.memo = make(packratTable, len(p.source)+1)
+
+	for _, rr := range p.recursive {
+		rr.memo = make(map[int]*rrMemo)
+	}
+}
+
+// taint records that the current result depends on the unfinished left
+// recursive evaluation at depth.
+func (p *Parser) taint(depth int) {
+	if depth != 0 && (p.lrTaint == 0 || depth < p.lrTaint) {
+		p.lrTaint = depth
+	}
+}
+
+// Positions returns where each statement seen by the last parse begins.
+func (p *Parser) Positions() ast.Positions {
+	return p.positions
+}
+
+func (p *Parser) record(n ast.Node, offset int) {
+	if p.positions == nil {
+		p.positions = make(ast.Positions)
+	}
+
+	p.positions[n] = p.position(offset)
+}
+
+func (p *Parser) position(offset int) ast.Position {
+	if p.lines == nil {
+		p.lines = []int{0}
+
+		for i, c := range p.source {
+			if c == '\n' {
+				p.lines = append(p.lines, i+1)
+			}
+		}
+	}
+
+	idx := sort.Search(len(p.lines), func(i int) bool {
+		return p.lines[i] > offset
+	}) - 1
+
+	return ast.Position{
+		Offset: offset,
+		Line:   idx + 1,
+		Column: offset - p.lines[idx] + 1,
+	}
+}
+
+// Parse parses the source as a sequence of statements. Syntax errors are
+// returned as an ErrorList.
 func (p *Parser) Parse() (ast.Node, error) {
 	return p.parseFrom(p.root)
 }
@@ -50,43 +130,55 @@ func (p *Parser) ParseG() (ast.Node, error) {
 	return p.parseFrom(p.rootG)
 }
 
+// parseFrom matches r against the whole source. When it fails, parsing
+// resumes at the next top level statement so that one run reports every
+// error, up to maxErrors.
 func (p *Parser) parseFrom(r Rule) (ast.Node, error) {
-	ml := &markingReader{r: strings.NewReader(p.source)}
+	p.resetExpected()
+	p.resetMemo()
+
+	ml := newMarkingReader(p.source)
 
-	var lineNum int
 	v, ok := r.Match(ml)
-	if !ok {
-		lines := strings.Split(p.source, "\n")
-
-		var start int64
-		var target string
-		var targetPos int64
-
-		for _, line := range lines {
-			lineNum++
-			if ml.furthest > start && ml.furthest <= start+int64(len(line)) {
-				targetPos = ml.furthest - start - 1
-				target = line
-				break
-			}
+	if ok {
+		return v.(ast.Node), nil
+	}
+
+	var errs ErrorList
+
+	for len(errs) < maxErrors {
+		perr := p.parseError(ml)
+		errs = append(errs, perr)
 
-			start += (int64(len(line)) + 1)
+		next := p.nextStatement(perr.Offset)
+		if next == -1 {
+			break
 		}
 
-		marked := fmt.Sprintf("%[1]s\n% [2]*[3]s^", target, targetPos, " ")
-		fmt.Printf("%s\n", marked)
-		return nil, errors.Wrapf(ErrParse, "Error at position: %d (line: %d, col: %d)\n%s", ml.furthest, lineNum, targetPos, marked)
+		p.resetExpected()
+
+		ml.Rewind(next)
+		ml.furthest = next
+
+		if _, ok := r.Match(ml); ok {
+			break
+		}
 	}
 
-	return v.(ast.Node), nil
+	return nil, errs
 }
 
+// ParseExpr parses the source as a single expression. Errors are returned
+// as an ErrorList, like Parse.
 func (p *Parser) ParseExpr() (ast.Node, error) {
-	ml := &markingReader{r: strings.NewReader(p.source)}
+	p.resetExpected()
+	p.resetMemo()
+
+	ml := newMarkingReader(p.source)
 
 	v, ok := p.expr.Match(ml)
 	if !ok {
-		return nil, ErrParse
+		return nil, ErrorList{p.parseError(ml)}
 	}
 
 	return v.(ast.Node), nil
@@ -1,8 +1,12 @@
 package parser
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/evanphx/m13/ast"
@@ -681,6 +685,38 @@ os.stdout().puts("hello m13");`
 		assert.Equal(t, int64(1), blk.Expressions[0].(*ast.Integer).Value)
 	})
 
+	n.It("parses private definitions", func() {
+		src := `private def foo() { 1 }; private class Blah { 1 }; def bar() { 2 }`
+
+		parser, err := NewParser(src)
+		require.NoError(t, err)
+
+		tree, err := parser.Parse()
+		require.NoError(t, err)
+
+		blk, ok := tree.(*ast.Block)
+		require.True(t, ok)
+
+		require.Equal(t, 3, len(blk.Expressions))
+
+		def, ok := blk.Expressions[0].(*ast.Definition)
+		require.True(t, ok)
+
+		assert.Equal(t, "foo", def.Name.Name)
+		assert.True(t, def.Private)
+
+		cls, ok := blk.Expressions[1].(*ast.ClassDefinition)
+		require.True(t, ok)
+
+		assert.Equal(t, "Blah", cls.Name)
+		assert.True(t, cls.Private)
+
+		def, ok = blk.Expressions[2].(*ast.Definition)
+		require.True(t, ok)
+
+		assert.False(t, def.Private)
+	})
+
 	n.It("parses a comment", func() {
 		src := `# hello, newman`
 
@@ -802,6 +838,21 @@ os.stdout().puts("hello m13");`
 		assert.Equal(t, int64(4), op.Right.(*ast.Integer).Value)
 	})
 
+	n.It("parses `3 != 4`", func() {
+		src := `3 != 4`
+
+		parser, err := NewParser(src)
+		require.NoError(t, err)
+
+		tree, err := parser.Parse()
+		require.NoError(t, err)
+
+		op, ok := tree.(*ast.Op)
+		require.True(t, ok)
+
+		assert.Equal(t, "!=", op.Name)
+	})
+
 	n.It("parses `3 + 4 * 2`", func() {
 		src := `3 + 4 * 2`
 
@@ -1254,6 +1305,234 @@ os.stdout().puts("hello m13");`
 		assert.Equal(t, "bar", call.Args.Args[0].(*ast.String).Value)
 	})
 
+	n.It("records the position of each statement", func() {
+		src := "a = 1\n\n  b = a\nif b {\n  c = 2\n}"
+
+		parser, err := NewParser(src)
+		require.NoError(t, err)
+
+		tree, err := parser.Parse()
+		require.NoError(t, err)
+
+		blk, ok := tree.(*ast.Block)
+		require.True(t, ok)
+
+		require.Equal(t, 3, len(blk.Expressions))
+
+		pos := parser.Positions()
+
+		assert.Equal(t, ast.Position{Offset: 0, Line: 1, Column: 1}, pos[blk.Expressions[0]])
+		assert.Equal(t, ast.Position{Offset: 9, Line: 3, Column: 3}, pos[blk.Expressions[1]])
+		assert.Equal(t, 4, pos.Line(blk.Expressions[2]))
+
+		ifn, ok := blk.Expressions[2].(*ast.If)
+		require.True(t, ok)
+
+		body, ok := ifn.Body.(*ast.Block)
+		require.True(t, ok)
+
+		assert.Equal(t, 5, pos.Line(body.Expressions[0]))
+	})
+
+	n.It("writes a tree as an S-expression", func() {
+		parser, err := NewParser("def add(a, b) {\n  a + b\n}\nadd(1, \"two\")")
+		require.NoError(t, err)
+
+		tree, err := parser.Parse()
+		require.NoError(t, err)
+
+		str, err := ast.Sexp(tree)
+		require.NoError(t, err)
+
+		assert.Equal(t, `(block
+  [(def
+     "add"
+     ""
+     [(arg "a" nil) (arg "b" nil)]
+     false
+     (block [(op "+" (variable "a") (variable "b"))]))
+   (invoke (variable "add") [(integer 1) (string "two")])])
+`, str)
+	})
+
+	n.It("writes a tree as JSON with the position of each statement", func() {
+		parser, err := NewParser("x = 1\nx.foo(y=2)")
+		require.NoError(t, err)
+
+		tree, err := parser.Parse()
+		require.NoError(t, err)
+
+		data, err := ast.JSON(tree, parser.Positions())
+		require.NoError(t, err)
+
+		var doc struct {
+			Type        string
+			Expressions []map[string]interface{}
+		}
+
+		require.NoError(t, json.Unmarshal(data, &doc))
+
+		assert.Equal(t, "block", doc.Type)
+		require.Equal(t, 2, len(doc.Expressions))
+
+		assign := doc.Expressions[0]
+
+		assert.Equal(t, "assign", assign["type"])
+		assert.Equal(t, "x", assign["name"])
+		assert.Equal(t, 1.0, assign["line"])
+		assert.Equal(t, map[string]interface{}{"type": "integer", "value": 1.0}, assign["value"])
+
+		call := doc.Expressions[1]
+
+		assert.Equal(t, 2.0, call["line"])
+		assert.Equal(t, "foo", call["name"])
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{
+				"type":  "named_arg",
+				"name":  "y",
+				"value": map[string]interface{}{"type": "integer", "value": 2.0},
+			},
+		}, call["args"])
+	})
+
+	n.It("lexes source into tokens", func() {
+		src := "foo_1 = 42 # hi\n\"a \\\" b\".x"
+
+		var kinds []TokenKind
+
+		for _, tok := range Lex(src) {
+			kinds = append(kinds, tok.Kind)
+		}
+
+		assert.Equal(t, []TokenKind{
+			TokenWord, TokenSpace, TokenOther, TokenSpace, TokenNumber,
+			TokenSpace, TokenComment, TokenNewline, TokenString, TokenOther,
+			TokenWord, TokenEOF,
+		}, kinds)
+	})
+
+	n.It("keeps comments and whitespace in the CST", func() {
+		src := "# adds\ndef add(a, b) {  # sum\n\ta + (b)\n}\n\nadd(1,  2) \n"
+
+		parser, err := NewParser(src)
+		require.NoError(t, err)
+
+		cst, err := parser.ParseCST()
+		require.NoError(t, err)
+
+		assert.Equal(t, src, cst.String())
+
+		require.Equal(t, 3, len(cst.Root.Children))
+
+		com := cst.Root.Children[0]
+		assert.Equal(t, "# adds", cst.Text(com))
+		assert.Equal(t, com.First, com.Last)
+
+		def := cst.Root.Children[1]
+		assert.Equal(t, "def add(a, b) {  # sum\n\ta + (b)\n}", cst.Text(def))
+
+		lead := cst.Leading(def)
+		require.Equal(t, 2, len(lead))
+		assert.Equal(t, TokenComment, lead[0].Kind)
+		assert.Equal(t, "# adds", lead[0].Text)
+
+		brace := cst.Tokens[def.First+7]
+		assert.Equal(t, "{", brace.Text)
+		require.Equal(t, 2, len(brace.Trailing))
+		assert.Equal(t, "# sum", brace.Trailing[1].Text)
+
+		require.Equal(t, 3, len(def.Children))
+
+		body := def.Children[2]
+		assert.Equal(t, "{  # sum\n\ta + (b)\n}", cst.Text(body))
+
+		require.Equal(t, 2, len(body.Children))
+		assert.Equal(t, "# sum", cst.Text(body.Children[0]))
+		assert.Equal(t, "a + (b)", cst.Text(body.Children[1]))
+
+		call := cst.Root.Children[2]
+		assert.Equal(t, "add(1,  2)", cst.Text(call))
+		assert.Equal(t, " ", cst.Trailing(call)[0].Text)
+
+		pos := cst.Positions()
+		assert.Equal(t, ast.Position{Offset: 31, Line: 3, Column: 2}, pos[body.Children[1].Node])
+	})
+
+	n.It("reports where and why parsing failed", func() {
+		parser, err := NewParser("a = 1\nfoo(1,")
+		require.NoError(t, err)
+
+		parser.File = "test.m13"
+
+		_, err = parser.Parse()
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, ErrParse))
+
+		list, ok := err.(ErrorList)
+		require.True(t, ok)
+
+		require.Equal(t, 1, len(list))
+
+		perr := list[0]
+
+		assert.Equal(t, "test.m13", perr.File)
+		assert.Equal(t, 2, perr.Line)
+		assert.Equal(t, 7, perr.Column)
+		assert.Equal(t, 12, perr.Offset)
+		assert.Equal(t, "foo(1,", perr.Source)
+		assert.Contains(t, perr.Expected, "integer")
+		assert.Contains(t, perr.Expected, `"("`)
+
+		assert.Equal(t, "foo(1,\n      ^", perr.Excerpt())
+		assert.Contains(t, perr.Error(), "test.m13:2:7: syntax error, expected ")
+	})
+
+	n.It("reports each broken statement", func() {
+		src := `a = 1 +
+def foo() {
+  x = (1
+  y = 2
+}
+b = 3
+c = [1, 2
+d = 4`
+
+		parser, err := NewParser(src)
+		require.NoError(t, err)
+
+		_, err = parser.Parse()
+		require.Error(t, err)
+
+		list, ok := err.(ErrorList)
+		require.True(t, ok)
+
+		require.Equal(t, 3, len(list))
+
+		assert.Equal(t, 1, list[0].Line)
+		assert.Equal(t, 3, list[1].Line)
+		assert.Equal(t, 7, list[2].Line)
+
+		assert.Contains(t, list[1].Expected, `")"`)
+		assert.Contains(t, list[2].Expected, `"]"`)
+	})
+
+	n.It("reports where an expression failed", func() {
+		parser, err := NewParser("1 + )")
+		require.NoError(t, err)
+
+		_, err = parser.ParseExpr()
+		require.Error(t, err)
+
+		list, ok := err.(ErrorList)
+		require.True(t, ok)
+
+		require.Equal(t, 1, len(list))
+
+		assert.Equal(t, 1, list[0].Line)
+		assert.Equal(t, 5, list[0].Column)
+	})
+
 	n.Meow()
 }
 
@@ -1486,6 +1765,28 @@ func TestMethodParses(t *testing.T) {
 		assert.Equal(t, "b", n.MethodName)
 	})
 
+	n.It("parses an up method call with arguments", func() {
+		src := `a.^foo(1)`
+
+		parser, err := NewParser(src)
+		require.NoError(t, err)
+
+		tree, err := parser.Parse()
+		require.NoError(t, err)
+
+		n, ok := tree.(*ast.UpCall)
+		require.True(t, ok)
+
+		assert.Equal(t, "foo", n.MethodName)
+
+		require.Equal(t, 1, len(n.Args))
+
+		i, ok := n.Args[0].(*ast.Integer)
+		require.True(t, ok)
+
+		assert.Equal(t, int64(1), i.Value)
+	})
+
 	n.It("parses a method call without parens", func() {
 		src := `a.b 3`
 
@@ -1616,3 +1917,96 @@ func TestTest(t *testing.T) {
 	_, err = parser.Parse()
 	require.NoError(t, err, string(data))
 }
+
+const syntheticChunk = `# helper number %[1]d
+def helper%[1]d(a, b) {
+  x = a + b * 2
+  if x > 10 {
+    y = [1, 2, x]
+    z = {a: x, b: "y\n"}
+  }
+  l = v => v + 1
+  l(x)
+}
+
+class Thing%[1]d {
+  has @name is r
+
+  def initialize(name) {
+    @name = name
+  }
+
+  def greet(other) {
+    $stdout.puts("hi " + other.name + @name)
+    self.^class.name
+  }
+}
+
+`
+
+// syntheticSource returns a package of at least lines lines.
+func syntheticSource(lines int) string {
+	var buf bytes.Buffer
+
+	for i := 0; strings.Count(buf.String(), "\n") < lines; i++ {
+		fmt.Fprintf(&buf, syntheticChunk, i)
+	}
+
+	return buf.String()
+}
+
+func TestSyntheticSource(t *testing.T) {
+	src := syntheticSource(500)
+
+	parser, err := NewParser(src)
+	require.NoError(t, err)
+
+	tree, err := parser.Parse()
+	require.NoError(t, err)
+
+	blk, ok := tree.(*ast.Block)
+	require.True(t, ok)
+
+	// Each chunk is a comment, a def and a class.
+	assert.Equal(t, 3*strings.Count(src, "# helper"), len(blk.Expressions))
+
+	var text bytes.Buffer
+
+	for _, tok := range Lex(src) {
+		text.WriteString(src[tok.Start:tok.End])
+	}
+
+	assert.Equal(t, src, text.String())
+
+	cst, err := parser.ParseCST()
+	require.NoError(t, err)
+
+	assert.Equal(t, src, cst.String())
+}
+
+func BenchmarkLex(b *testing.B) {
+	src := syntheticSource(5000)
+
+	b.SetBytes(int64(len(src)))
+
+	for i := 0; i < b.N; i++ {
+		Lex(src)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	src := syntheticSource(5000)
+
+	b.SetBytes(int64(len(src)))
+
+	for i := 0; i < b.N; i++ {
+		parser, err := NewParser(src)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := parser.Parse(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
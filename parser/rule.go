@@ -8,6 +8,8 @@ import (
 	"io"
 	"regexp"
 	"strings"
+
+	"github.com/evanphx/m13/ast"
 )
 
 const debugApply = false
@@ -22,30 +24,11 @@ type Rule interface {
 	Match(Lexer) (RuleValue, bool)
 }
 
-type memoValue struct {
-	val RuleValue
-	ok  bool
-	pos int
-}
-
-type memoRecorder struct {
-	m map[int]memoValue
-}
-
-func (m *memoRecorder) retrieve(n Lexer) (memoValue, bool) {
-	if v, ok := m.m[n.Mark()]; ok {
-		return v, true
-	}
-
-	return memoValue{}, false
-}
-
-func (m *memoRecorder) save(p int, n Lexer, v RuleValue, ok bool) {
-	if m.m == nil {
-		m.m = make(map[int]memoValue)
-	}
-
-	m.m[p] = memoValue{v, ok, n.Mark()}
+// stringLexer is a Lexer reading from a string, which lets rules match
+// against the remaining input directly rather than rune by rune.
+type stringLexer interface {
+	Lexer
+	Rest() string
 }
 
 type RuleValue interface{}
@@ -90,6 +73,10 @@ func (cr *AndRule) Match(n Lexer) (RuleValue, bool) {
 			return nil, false
 		}
 
+		if values == nil {
+			values = make([]RuleValue, 0, len(cr.Rules))
+		}
+
 		values = append(values, val)
 	}
 
@@ -197,6 +184,10 @@ type rrMemo struct {
 	pos int
 	ans RuleValue
 	ok  bool
+
+	// depth is the nesting of the evaluation still working out ans, or 0
+	// once ans is final.
+	depth int
 }
 
 type RecursiveRule struct {
@@ -215,10 +206,15 @@ func (r *RecursiveRule) Match(n Lexer) (RuleValue, bool) {
 
 	m, ok := r.memo[p]
 	if !ok {
+		r.p.lrDepth++
+		defer r.finish(r.p.lrDepth)
+
 		lr := &rrLR{}
-		m := &rrMemo{ans: lr, pos: p}
+		m := &rrMemo{ans: lr, pos: p, depth: r.p.lrDepth}
 		r.memo[p] = m
 
+		defer func() { m.depth = 0 }()
+
 		rv, ok := r.eval(n)
 		m.ans = rv
 		m.ok = ok
@@ -230,6 +226,10 @@ func (r *RecursiveRule) Match(n Lexer) (RuleValue, bool) {
 
 		return rv, ok
 	} else {
+		if m.depth != 0 {
+			r.p.taint(m.depth)
+		}
+
 		n.Rewind(m.pos)
 		if lr, ok := m.ans.(*rrLR); ok {
 			lr.detected = true
@@ -240,6 +240,16 @@ func (r *RecursiveRule) Match(n Lexer) (RuleValue, bool) {
 	}
 }
 
+// finish ends the evaluation at depth. Whatever only depended on this
+// evaluation, or ones nested in it, can now be memoized.
+func (r *RecursiveRule) finish(depth int) {
+	if r.p.lrTaint >= depth {
+		r.p.lrTaint = 0
+	}
+
+	r.p.lrDepth--
+}
+
 func (r *RecursiveRule) growLR(n Lexer, p int, m *rrMemo) (RuleValue, bool) {
 	for {
 		n.Rewind(p)
@@ -278,6 +288,88 @@ func (r *RecursiveRule) Name() string {
 	return r.name
 }
 
+type packratEntry struct {
+	id  int
+	val RuleValue
+	ok  bool
+	end int
+}
+
+// packratTable holds the memoized results starting at each position. Only
+// a few rules are ever tried at any one position, so they're kept in a
+// short list rather than a map.
+type packratTable [][]packratEntry
+
+func (t packratTable) get(pos, id int) (packratEntry, bool) {
+	if pos < len(t) {
+		for _, ent := range t[pos] {
+			if ent.id == id {
+				return ent, true
+			}
+		}
+	}
+
+	return packratEntry{}, false
+}
+
+func (t packratTable) put(pos int, ent packratEntry) {
+	if pos < len(t) {
+		if t[pos] == nil {
+			t[pos] = make([]packratEntry, 0, 8)
+		}
+
+		t[pos] = append(t[pos], ent)
+	}
+}
+
+// PackratRule memoizes the result of Rule at each position, so no matter
+// how often the grammar backtracks over the input, Rule runs once per
+// position. Results that depend on a left recursive rule still being
+// grown are not memoized, as they change with each step of growing it.
+type PackratRule struct {
+	Rule
+
+	p  *Parser
+	id int
+}
+
+func (r *PackratRule) Match(n Lexer) (RuleValue, bool) {
+	pos := n.Mark()
+
+	if ent, ok := r.p.memo.get(pos, r.id); ok {
+		n.Rewind(ent.end)
+
+		return ent.val, ent.ok
+	}
+
+	outer := r.p.lrTaint
+	r.p.lrTaint = 0
+
+	rv, ok := r.p.match(r.Rule, n)
+
+	// Where a failed rule leaves the input doesn't matter, as whoever tries
+	// it rewinds, so failures always end where they started.
+	end := pos
+
+	if ok {
+		end = n.Mark()
+	} else {
+		n.Rewind(pos)
+	}
+
+	if r.p.lrTaint == 0 {
+		r.p.memo.put(pos, packratEntry{id: r.id, val: rv, ok: ok, end: end})
+	}
+
+	r.p.taint(outer)
+
+	return rv, ok
+}
+
+func (r *PackratRule) Name() string {
+	return descRule(r.Rule)
+}
+
 type NamedRule struct {
 	Rule
 	name string
@@ -342,18 +434,12 @@ func (t *TimesRules) Name() string {
 type GoRule struct {
 	p     *Parser
 	name  string
-	m     memoRecorder
 	until token.Token
 }
 
 func (s *GoRule) Match(n Lexer) (RuleValue, bool) {
 	pos := n.Mark()
 
-	if mv, ok := s.m.retrieve(n); ok {
-		n.Rewind(mv.pos)
-		return mv.val, mv.ok
-	}
-
 	var gs scanner.Scanner
 
 	fset := token.NewFileSet()
@@ -396,8 +482,6 @@ OUTER:
 
 	n.Rewind(pos + size)
 
-	s.m.save(pos, n, v, true)
-
 	return v, true
 }
 
@@ -408,23 +492,10 @@ func (s *GoRule) Name() string {
 type ScanRule struct {
 	name string
 	f    func(rs io.RuneScanner) (RuleValue, bool)
-	m    memoRecorder
 }
 
 func (s *ScanRule) Match(n Lexer) (RuleValue, bool) {
-	pos := n.Mark()
-
-	if mv, ok := s.m.retrieve(n); ok {
-		n.Rewind(mv.pos)
-		return mv.val, mv.ok
-	}
-
-	v, ok := s.f(n.RuneScanner())
-	if ok {
-		s.m.save(pos, n, v, true)
-	}
-
-	return v, ok
+	return s.f(n.RuneScanner())
 }
 
 func (s *ScanRule) Name() string {
@@ -432,16 +503,20 @@ func (s *ScanRule) Name() string {
 }
 
 type LiteralRule struct {
-	memoRecorder
 	literal string
 }
 
 func (s *LiteralRule) Match(n Lexer) (RuleValue, bool) {
 	pos := n.Mark()
 
-	if mv, ok := s.retrieve(n); ok {
-		n.Rewind(mv.pos)
-		return mv.val, mv.ok
+	if sl, ok := n.(stringLexer); ok {
+		if !strings.HasPrefix(sl.Rest(), s.literal) {
+			return nil, false
+		}
+
+		n.Rewind(pos + len(s.literal))
+
+		return s.literal, true
 	}
 
 	rs := n.RuneScanner()
@@ -454,8 +529,6 @@ func (s *LiteralRule) Match(n Lexer) (RuleValue, bool) {
 		}
 	}
 
-	s.save(pos, n, s.literal, true)
-
 	return s.literal, true
 }
 
@@ -463,11 +536,39 @@ func (s *LiteralRule) Name() string {
 	return fmt.Sprintf("%#v", s.literal)
 }
 
+// TokenRule matches a whole token of Kind, as split up by the lexer, and
+// returns its text. An Optional rule matches an empty string when the
+// token is some other kind.
+type TokenRule struct {
+	p        *Parser
+	Kind     TokenKind
+	Optional bool
+}
+
+func (t *TokenRule) Match(n Lexer) (RuleValue, bool) {
+	pos := n.Mark()
+
+	tok := t.p.tokens.at(pos)
+	if tok.Kind != t.Kind {
+		if t.Optional {
+			return "", true
+		}
+
+		return nil, false
+	}
+
+	n.Rewind(tok.End)
+
+	return t.p.source[pos:tok.End], true
+}
+
+func (t *TokenRule) Name() string {
+	return t.Kind.String()
+}
+
 type RegexpRule struct {
 	src string
 	pat *regexp.Regexp
-
-	m memoRecorder
 }
 
 type saveReader struct {
@@ -487,31 +588,46 @@ func (sr *saveReader) ReadRune() (rune, int, error) {
 func (r *RegexpRule) Match(n Lexer) (RuleValue, bool) {
 	pos := n.Mark()
 
-	if mv, ok := r.m.retrieve(n); ok {
-		n.Rewind(mv.pos)
-		return mv.val, mv.ok
-	}
+	var (
+		res     []int
+		capture string
+	)
 
-	sr := &saveReader{sub: n.RuneScanner()}
+	if sl, ok := n.(stringLexer); ok {
+		rest := sl.Rest()
 
-	res := r.pat.FindReaderSubmatchIndex(sr)
-	if res == nil {
-		n.Rewind(pos)
-		return nil, false
-	}
+		res = r.pat.FindStringSubmatchIndex(rest)
+		if res == nil {
+			return nil, false
+		}
 
-	if len(res) == 4 {
-		res[0] = res[2]
-		res[1] = res[3]
+		if len(res) == 4 {
+			res[0] = res[2]
+			res[1] = res[3]
+		}
+
+		capture = rest[res[0]:res[1]]
+	} else {
+		sr := &saveReader{sub: n.RuneScanner()}
+
+		res = r.pat.FindReaderSubmatchIndex(sr)
+		if res == nil {
+			n.Rewind(pos)
+			return nil, false
+		}
+
+		if len(res) == 4 {
+			res[0] = res[2]
+			res[1] = res[3]
+		}
+
+		capture = string(sr.buf.Bytes()[res[0]:res[1]])
 	}
 
 	cursor := pos + res[1]
-	capture := string(sr.buf.Bytes()[res[0]:res[1]])
 
 	n.Rewind(cursor)
 
-	r.m.save(pos, n, capture, true)
-
 	return capture, true
 }
 
@@ -572,14 +688,37 @@ func (r *CheckRule) Name() string {
 	return "check(" + descRule(r.r) + ")"
 }
 
+// PosRule records where the node produced by Rule begins.
+type PosRule struct {
+	p    *Parser
+	Rule Rule
+}
+
+func (r *PosRule) Match(n Lexer) (RuleValue, bool) {
+	start := n.Mark()
+
+	v, ok := r.p.Apply(r.Rule, n)
+	if ok {
+		if node, isNode := v.(ast.Node); isNode && node != nil {
+			r.p.record(node, start)
+		}
+	}
+
+	return v, ok
+}
+
+func (r *PosRule) Name() string {
+	return descRule(r.Rule)
+}
+
 func (p *Parser) Apply(r Rule, n Lexer) (RuleValue, bool) {
 	if !debugApply {
-		return r.Match(n)
+		return p.match(r, n)
 	}
 
 	fmt.Printf("%02d @ %d => %s\n", p.applyDepth, n.Mark(), descRule(r))
 	p.applyDepth++
-	rv, ok := r.Match(n)
+	rv, ok := p.match(r, n)
 	p.applyDepth--
 	if ok {
 		fmt.Printf("%02d * %d => %s => %#v\n", p.applyDepth, n.Mark(), descRule(r), rv)
@@ -588,16 +727,57 @@ func (p *Parser) Apply(r Rule, n Lexer) (RuleValue, bool) {
 	return rv, ok
 }
 
+// match is Match, but remembers where tokens failed to match so errors can
+// say what was expected, and where the nodes of a CST came from.
+func (p *Parser) match(r Rule, n Lexer) (RuleValue, bool) {
+	pos := n.Mark()
+
+	rv, ok := r.Match(n)
+
+	switch r.(type) {
+	case *LiteralRule, *TokenRule:
+		if !ok {
+			p.expect(pos, r)
+		}
+	case *ScanRule:
+		if !ok {
+			p.expect(pos, r)
+		} else if p.spans != nil {
+			p.span(rv, pos, n.Mark())
+		}
+	case *CodeRule, *GoRule:
+		if ok && p.spans != nil {
+			p.span(rv, pos, n.Mark())
+		}
+	}
+
+	return rv, ok
+}
+
 type Rules struct {
 	Parser *Parser
 }
 
+// packrat memoizes x. Looking a result up costs about as much as
+// rerunning most rules, so only the rules the grammar actually retries at
+// the same position are worth it; memoizing every rule that produces a
+// value made parsing slower than not memoizing at all.
+func (r *Rules) packrat(x Rule) Rule {
+	r.Parser.rules++
+
+	return &PackratRule{Rule: x, p: r.Parser, id: r.Parser.rules}
+}
+
 func (r *Rules) Rec(name string) *RecursiveRule {
-	return &RecursiveRule{
+	rr := &RecursiveRule{
 		p:    r.Parser,
 		name: name,
 		memo: make(map[int]*rrMemo),
 	}
+
+	r.Parser.recursive = append(r.Parser.recursive, rr)
+
+	return rr
 }
 
 func (r *Rules) Name(name string, n Rule) *NamedRule {
@@ -646,19 +826,27 @@ func (r *Rules) Ref(name string) *RefRule {
 	return &RefRule{name: name}
 }
 
-func (r *Rules) Scan(name string, f func(io.RuneScanner) (RuleValue, bool)) *ScanRule {
+func (r *Rules) Scan(name string, f func(io.RuneScanner) (RuleValue, bool)) Rule {
 	return &ScanRule{name: name, f: f}
 }
 
-func (r *Rules) GoCode(name string, until token.Token) *GoRule {
+func (r *Rules) GoCode(name string, until token.Token) Rule {
 	return &GoRule{p: r.Parser, name: name, until: until}
 }
 
+func (r *Rules) Tok(kind TokenKind) *TokenRule {
+	return &TokenRule{p: r.Parser, Kind: kind}
+}
+
+func (r *Rules) OptTok(kind TokenKind) *TokenRule {
+	return &TokenRule{p: r.Parser, Kind: kind, Optional: true}
+}
+
 func (r *Rules) S(lit string) *LiteralRule {
 	return &LiteralRule{literal: lit}
 }
 
-func (r *Rules) Re(pat string) *RegexpRule {
+func (r *Rules) Re(pat string) Rule {
 	return &RegexpRule{src: pat, pat: regexp.MustCompile(`\A` + pat)}
 }
 
@@ -670,6 +858,10 @@ func (r *Rules) None() *NoneRule {
 	return &NoneRule{}
 }
 
+func (r *Rules) Pos(x Rule) Rule {
+	return &PosRule{r.Parser, x}
+}
+
 func (r *Rules) Check(x Rule, f func(v RuleValue) (RuleValue, bool)) Rule {
 	return &CheckRule{r.Parser, x, f}
 }
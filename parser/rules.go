@@ -37,8 +37,8 @@ func (p *Parser) SetupRules() {
 		}
 	}
 
-	skip := r.Re(`[\t ]*`)
-	ws := r.Re(`[\t ]+`)
+	skip := r.OptTok(TokenSpace)
+	ws := r.Tok(TokenSpace)
 
 	sym := func(s string) Rule {
 		return r.Seq(r.S(s), skip)
@@ -196,39 +196,7 @@ func (p *Parser) SetupRules() {
 		}
 	})
 
-	rawword := r.Scan("word", func(rs io.RuneScanner) (RuleValue, bool) {
-		var buf bytes.Buffer
-
-		r, _, err := rs.ReadRune()
-		if err != nil {
-			return nil, false
-		}
-
-		if !(unicode.IsLetter(r) || r == '_') {
-			rs.UnreadRune()
-			return nil, false
-		}
-
-		buf.WriteRune(r)
-
-		for {
-			r, _, err := rs.ReadRune()
-			if err != nil {
-				break
-			}
-
-			cont := unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
-
-			if !cont {
-				rs.UnreadRune()
-				break
-			}
-
-			buf.WriteRune(r)
-		}
-
-		return buf.String(), true
-	})
+	rawword := r.Tok(TokenWord)
 
 	declType := r.F(
 		r.Re(`[a-zA-Z0-9\*\[\]]+`),
@@ -259,6 +227,7 @@ func (p *Parser) SetupRules() {
 
 	opChars := [127]bool{}
 
+	opChars['!'] = true
 	opChars['*'] = true
 	opChars['+'] = true
 	opChars['-'] = true
@@ -306,16 +275,20 @@ func (p *Parser) SetupRules() {
 
 	ivar := r.Re("@([a-zA-Z][a-zA-Z0-9_]*)")
 
+	variable := r.F(word, func(v RuleValue) RuleValue {
+		return &ast.Variable{Name: v.(string)}
+	})
+
+	ivarNode := r.F(ivar, func(v RuleValue) RuleValue {
+		return &ast.IVar{v.(string)}
+	})
+
 	prim := r.Or(
 		integer,
 		qstring,
 		atom,
-		r.F(word, func(v RuleValue) RuleValue {
-			return &ast.Variable{Name: v.(string)}
-		}),
-		r.F(ivar, func(v RuleValue) RuleValue {
-			return &ast.IVar{v.(string)}
-		}),
+		variable,
+		ivarNode,
 		r.F(r.Re("\\$([a-zA-Z][a-zA-Z0-9_]*)"), func(v RuleValue) RuleValue {
 			return &ast.ScopeVar{v.(string)}
 		}),
@@ -483,40 +456,40 @@ func (p *Parser) SetupRules() {
 			return &ast.UpCall{
 				Receiver:   rv[0].(ast.Node),
 				MethodName: rv[1].(string),
-				Args:       convert(rv[3].([]RuleValue)),
+				Args:       rv[3].(*ast.Args).Args,
 			}
 		})
 
 	invoke := r.Or(
 		r.Fs(
-			r.Seq(ivar, sym("("), argList, sym(")")),
+			r.Seq(ivarNode, sym("("), argList, sym(")")),
 			func(rv []RuleValue) RuleValue {
 				return &ast.Invoke{
-					Var:  &ast.IVar{Name: rv[0].(string)},
+					Var:  rv[0].(*ast.IVar),
 					Args: rv[2].(*ast.Args),
 				}
 			}),
 		r.Fs(
-			r.Seq(ivar, sym("("), sym(")")),
+			r.Seq(ivarNode, sym("("), sym(")")),
 			func(rv []RuleValue) RuleValue {
 				return &ast.Invoke{
-					Var:  &ast.IVar{Name: rv[0].(string)},
+					Var:  rv[0].(*ast.IVar),
 					Args: &ast.Args{},
 				}
 			}),
 		r.Fs(
-			r.Seq(word, sym("("), argList, sym(")")),
+			r.Seq(variable, sym("("), argList, sym(")")),
 			func(rv []RuleValue) RuleValue {
 				return &ast.Invoke{
-					Var:  &ast.Variable{Name: rv[0].(string)},
+					Var:  rv[0].(*ast.Variable),
 					Args: rv[2].(*ast.Args),
 				}
 			}),
 		r.Fs(
-			r.Seq(word, sym("("), sym(")")),
+			r.Seq(variable, sym("("), sym(")")),
 			func(rv []RuleValue) RuleValue {
 				return &ast.Invoke{
-					Var:  &ast.Variable{Name: rv[0].(string)},
+					Var:  rv[0].(*ast.Variable),
 					Args: &ast.Args{},
 				}
 			}),
@@ -729,15 +702,20 @@ func (p *Parser) SetupRules() {
 			return rv[1]
 		})
 
+	// Each step of growing expr retries every alternative at the same
+	// position, and only the ones that don't start with expr give the
+	// same answer every time, so those are memoized.
+	m := r.packrat
+
 	expr.Rules = []Rule{
-		lambdaN, lambda1, lambda0,
+		m(lambdaN), m(lambda1), m(lambda0),
 		upcallN, upcall0, upAttrAccess,
 		npcallN,
 		op, squareBrackets,
-		list, map_,
-		primcallN, primcall0, invoke,
-		attrAccess, prim,
-		parenExpr,
+		m(list), m(map_),
+		m(primcallN), m(primcall0), m(invoke),
+		attrAccess, m(prim),
+		m(parenExpr),
 	}
 
 	stmt := r.Ref("stmt")
@@ -901,6 +879,19 @@ func (p *Parser) SetupRules() {
 			}
 		})
 
+	private := r.Fs(
+		r.Seq(kw("private"), ws, r.Or(class, def)),
+		func(rv []RuleValue) RuleValue {
+			switch n := rv[2].(type) {
+			case *ast.Definition:
+				n.Private = true
+			case *ast.ClassDefinition:
+				n.Private = true
+			}
+
+			return rv[2]
+		})
+
 	comment := r.F(r.Re(`#([^\n]*)`), func(rv RuleValue) RuleValue {
 		return &ast.Comment{Comment: rv.(string)}
 	})
@@ -996,12 +987,12 @@ func (p *Parser) SetupRules() {
 			}
 		})
 
-	stmt.Rule = r.Or(
+	stmt.Rule = r.Pos(r.Or(
 		packageR,
-		comment, importR, class, def, gdef, has,
+		comment, importR, private, class, def, gdef, has,
 		ifr, while,
 		attrAssign, assign, inc, dec,
-		expr)
+		expr))
 
 	p.expr = r.F(r.Seq(expr, r.None()), r.Nth(0))
 
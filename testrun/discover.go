@@ -0,0 +1,82 @@
+package testrun
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanphx/m13/loader"
+)
+
+// IsTestFile reports whether path, found searching root, is named like a
+// test file: either name_test.m13 or a source file directly inside root's
+// test directory. Packages that happen to be called test, such as
+// lib/test, aren't tests.
+func IsTestFile(root, path string) bool {
+	if filepath.Ext(path) != loader.SourceExt {
+		return false
+	}
+
+	if strings.HasSuffix(filepath.Base(path), "_test"+loader.SourceExt) {
+		return true
+	}
+
+	return filepath.Dir(path) == filepath.Join(root, "test")
+}
+
+// Discover returns the test files in paths. Files given directly are
+// always run, directories are searched for test files. Hidden and vendor
+// directories are skipped.
+func Discover(paths ...string) ([]string, error) {
+	var (
+		found []string
+		seen  = make(map[string]bool)
+	)
+
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			found = append(found, path)
+		}
+	}
+
+	for _, root := range paths {
+		stat, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+
+		if !stat.IsDir() {
+			add(root)
+			continue
+		}
+
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				name := d.Name()
+
+				if path != root && (strings.HasPrefix(name, ".") || name == "vendor") {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			if IsTestFile(root, path) {
+				add(path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return found, nil
+}
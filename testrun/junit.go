@@ -0,0 +1,112 @@
+package testrun
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func problem(failures ...*Failure) *junitProblem {
+	var lines []string
+
+	for _, f := range failures {
+		lines = append(lines, f.String())
+	}
+
+	return &junitProblem{Message: failures[0].Message, Text: strings.Join(lines, "\n")}
+}
+
+// WriteJUnit writes results as JUnit XML, which CI systems understand.
+// Each file is a suite whose cases are named by spec and case. An error
+// outside of any case is reported as a case of its own.
+func WriteJUnit(w io.Writer, results []*File) error {
+	var doc junitSuites
+
+	for _, res := range results {
+		suite := junitSuite{
+			Name:  res.Path,
+			Tests: len(res.Cases),
+			Time:  seconds(res.Duration),
+		}
+
+		for _, c := range res.Cases {
+			jc := junitCase{
+				ClassName: c.Spec,
+				Name:      c.Name,
+				Time:      seconds(c.Duration),
+			}
+
+			if len(c.Failures) > 0 {
+				jc.Failure = problem(c.Failures...)
+				suite.Failures++
+			}
+
+			if c.Error != nil {
+				jc.Error = problem(c.Error)
+				suite.Errors++
+			}
+
+			suite.Cases = append(suite.Cases, jc)
+		}
+
+		if res.Error != nil {
+			suite.Tests++
+			suite.Errors++
+			suite.Cases = append(suite.Cases, junitCase{
+				ClassName: res.Path,
+				Name:      "(file)",
+				Time:      seconds(0),
+				Error:     problem(res.Error),
+			})
+		}
+
+		doc.Suites = append(doc.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,335 @@
+// Package testrun runs m13 test files, collecting the results of the specs
+// they declare with the test library.
+package testrun
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/evanphx/m13/insn"
+	"github.com/evanphx/m13/loader"
+	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
+)
+
+// Failure is a failed expectation or an error, and where it happened.
+// Line is 0 if that isn't known.
+type Failure struct {
+	Message string
+	File    string
+	Line    int
+}
+
+func (f *Failure) String() string {
+	if f.Line == 0 {
+		return f.Message
+	}
+
+	return fmt.Sprintf("%s:%d: %s", f.File, f.Line, f.Message)
+}
+
+// Case is the result of one it block of a spec.
+type Case struct {
+	Spec string
+	Name string
+
+	// Failures are the expectations that didn't hold.
+	Failures []*Failure
+
+	// Error is what stopped the case before it finished, if anything.
+	Error *Failure
+
+	Duration time.Duration
+}
+
+// FullName is the name -run filters are matched against.
+func (c *Case) FullName() string {
+	return c.Spec + "/" + c.Name
+}
+
+func (c *Case) Passed() bool {
+	return len(c.Failures) == 0 && c.Error == nil
+}
+
+// File is the result of running one test file.
+type File struct {
+	Path  string
+	Cases []*Case
+
+	// Error is what stopped the file outside of any case, such as it not
+	// parsing.
+	Error *Failure
+
+	Duration time.Duration
+}
+
+// Failed returns how many cases failed, counting an error in the file
+// itself as one.
+func (f *File) Failed() int {
+	var n int
+
+	if f.Error != nil {
+		n++
+	}
+
+	for _, c := range f.Cases {
+		if !c.Passed() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Filter selects the cases to run. Like go test -run, the pattern is split
+// at the first slash: the part before it must match the spec's name and the
+// part after it, if any, the case's.
+type Filter struct {
+	spec, name *regexp.Regexp
+}
+
+func NewFilter(pattern string) (*Filter, error) {
+	var (
+		f   Filter
+		err error
+	)
+
+	parts := strings.SplitN(pattern, "/", 2)
+
+	if f.spec, err = regexp.Compile(parts[0]); err != nil {
+		return nil, err
+	}
+
+	if len(parts) > 1 {
+		if f.name, err = regexp.Compile(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &f, nil
+}
+
+func (f *Filter) Match(spec, name string) bool {
+	if !f.spec.MatchString(spec) {
+		return false
+	}
+
+	return f.name == nil || f.name.MatchString(name)
+}
+
+// Runner runs test files. Each file runs in a VM of its own, and each case
+// on its own so that an error in one doesn't stop the others.
+type Runner struct {
+	// Search is where imported packages are looked for, the usual search
+	// path if it's nil.
+	Search []string
+
+	// Filter, if set, picks the cases that run.
+	Filter *Filter
+}
+
+// RunFile runs the test file at path.
+func (r *Runner) RunFile(path string) *File {
+	res := &File{Path: path}
+
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+
+	lp, err := loader.LoadFile(path)
+	if err != nil {
+		res.Error = &Failure{Message: err.Error(), File: path}
+		return res
+	}
+
+	v, err := vm.NewVM()
+	if err != nil {
+		res.Error = &Failure{Message: err.Error(), File: path}
+		return res
+	}
+
+	fr := &fileRun{runner: r, vm: v, res: res}
+
+	// Frames are only kept while there's a tracer, and they're what
+	// failures are located with.
+	v.SetTracer(fr)
+
+	ctx := loader.SetupContext(context.Background(), v, filepath.Dir(path))
+
+	lo, _ := loader.FromContext(ctx)
+
+	if r.Search != nil {
+		lo.Search = r.Search
+	}
+
+	ctx = value.SetScoped(ctx, "test", fr.reporter())
+
+	if _, err := lp.Exec(ctx, v, v.Registry()); err != nil {
+		res.Error = fr.failure(err.Error(), fr.lineOf(err))
+	}
+
+	return res
+}
+
+// fileRun is the state of running one file. It's the $test the test
+// library reports to.
+type fileRun struct {
+	runner *Runner
+	vm     *vm.VM
+	res    *File
+
+	current *Case
+
+	// errLine is the line of the test file that err, the last error seen,
+	// unwound from.
+	err     error
+	errLine int
+}
+
+func (fr *fileRun) reporter() value.Value {
+	r := fr.vm.Registry()
+
+	pkg, _ := r.FindPackage("builtin")
+	cls := r.NewClass(pkg, "TestRunner", r.Object)
+
+	cls.AddMethod(&value.MethodDescriptor{
+		Name: "run",
+		Signature: value.Signature{
+			Required: 4,
+			Args:     []string{"spec", "name", "body", "after"},
+		},
+		Func: fr.run,
+	})
+
+	cls.AddMethod(&value.MethodDescriptor{
+		Name: "fail",
+		Signature: value.Signature{
+			Required: 1,
+			Args:     []string{"message"},
+		},
+		Func: fr.fail,
+	})
+
+	obj := &value.Object{}
+	obj.SetClass(cls)
+
+	return obj
+}
+
+func (fr *fileRun) failure(msg string, line int) *Failure {
+	return &Failure{Message: msg, File: fr.res.Path, Line: line}
+}
+
+// line returns the line of the test file being run, if it's running.
+func (fr *fileRun) line() int {
+	for f := fr.vm.CurrentFrame(); f != nil; f = f.Parent {
+		if f.Code.File == fr.res.Path {
+			return f.Line()
+		}
+	}
+
+	return 0
+}
+
+func stringArg(args []value.Value, i int, what string) (string, error) {
+	s, ok := args[i].(*value.String)
+	if !ok {
+		return "", fmt.Errorf("the %s must be a string", what)
+	}
+
+	return s.String, nil
+}
+
+// run runs the case name of spec by calling body and then after, which
+// runs even if body fails.
+func (fr *fileRun) run(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+	spec, err := stringArg(args, 0, "spec name")
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := stringArg(args, 1, "case name")
+	if err != nil {
+		return nil, err
+	}
+
+	body, ok := args[2].(*value.Lambda)
+	if !ok {
+		return nil, fmt.Errorf("the body of %s must be a lambda", name)
+	}
+
+	after, ok := args[3].(*value.Lambda)
+	if !ok {
+		return nil, fmt.Errorf("the after hook of %s must be a lambda", name)
+	}
+
+	if f := fr.runner.Filter; f != nil && !f.Match(spec, name) {
+		return env.Nil(), nil
+	}
+
+	c := &Case{Spec: spec, Name: name}
+
+	prev := fr.current
+	fr.current = c
+
+	defer func() { fr.current = prev }()
+
+	start := time.Now()
+
+	for _, l := range []*value.Lambda{body, after} {
+		_, err = fr.vm.InvokeLambda(ctx, l, nil)
+		if err != nil && c.Error == nil {
+			c.Error = fr.failure(err.Error(), fr.lineOf(err))
+		}
+	}
+
+	c.Duration = time.Since(start)
+
+	fr.res.Cases = append(fr.res.Cases, c)
+
+	return env.Nil(), nil
+}
+
+func (fr *fileRun) fail(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+	msg, err := stringArg(args, 0, "message")
+	if err != nil {
+		return nil, err
+	}
+
+	if fr.current == nil {
+		return nil, fmt.Errorf("expectation failed outside of a test case: %s", msg)
+	}
+
+	fr.current.Failures = append(fr.current.Failures, fr.failure(msg, fr.line()))
+
+	return env.Nil(), nil
+}
+
+func (fr *fileRun) OnInstruction(f *vm.Frame, i insn.Instruction) {}
+func (fr *fileRun) OnCall(f *vm.Frame)                            {}
+func (fr *fileRun) OnReturn(f *vm.Frame, val value.Value)         {}
+
+// lineOf returns the line of the test file err unwound from, if known.
+func (fr *fileRun) lineOf(err error) int {
+	if err != fr.err {
+		return 0
+	}
+
+	return fr.errLine
+}
+
+func (fr *fileRun) OnError(f *vm.Frame, err error) {
+	// Errors that are rescued never reach the runner, so the line is kept
+	// for the error being unwound rather than the first one seen.
+	if err != fr.err {
+		fr.err = err
+		fr.errLine = 0
+	}
+
+	if fr.errLine == 0 && f.Code.File == fr.res.Path {
+		fr.errLine = f.Line()
+	}
+}
@@ -0,0 +1,240 @@
+package testrun
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+const sample = `import test
+
+test.spec("Math", s => {
+  s.it("adds", t => {
+    t.expect(1 + 1).equal(3)
+  })
+
+  s.it("breaks", t => {
+    1.nope
+  })
+
+  s.it("works", t => {
+    t.expect(2).equal(2)
+  })
+})
+`
+
+func TestRunner(t *testing.T) {
+	n := neko.Start(t)
+
+	write := func(dir, name, src string) string {
+		path := filepath.Join(dir, name)
+
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(src), 0644))
+
+		return path
+	}
+
+	runner := func() *Runner {
+		return &Runner{Search: []string{"../lib"}}
+	}
+
+	n.It("runs each case and reports failures with their line", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := write(dir, "math_test.m13", sample)
+
+		res := runner().RunFile(path)
+		require.Nil(t, res.Error)
+		require.Equal(t, 3, len(res.Cases))
+
+		adds := res.Cases[0]
+
+		assert.Equal(t, "Math/adds", adds.FullName())
+		require.Equal(t, 1, len(adds.Failures))
+		assert.Equal(t, "Expected 2 to equal 3", adds.Failures[0].Message)
+		assert.Equal(t, 5, adds.Failures[0].Line)
+
+		assert.True(t, res.Cases[2].Passed())
+		assert.Equal(t, 2, res.Failed())
+	})
+
+	n.It("keeps running cases after one errors", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := write(dir, "math_test.m13", sample)
+
+		res := runner().RunFile(path)
+
+		breaks := res.Cases[1]
+
+		require.NotNil(t, breaks.Error)
+		assert.Equal(t, 9, breaks.Error.Line)
+		assert.Equal(t, "works", res.Cases[2].Name)
+	})
+
+	n.It("runs after hooks when a case errors", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := write(dir, "hooks_test.m13", `import test
+
+test.spec("Hooks", s => {
+  log = []
+
+  s.after(t => log << 1)
+
+  s.it("breaks", t => {
+    1.nope()
+  })
+
+  s.it("sees the hook", t => {
+    t.expect(log.at(0)) == 1
+  })
+})
+`)
+
+		res := runner().RunFile(path)
+		require.Equal(t, 2, len(res.Cases))
+
+		require.NotNil(t, res.Cases[0].Error)
+		assert.Equal(t, 9, res.Cases[0].Error.Line)
+		assert.True(t, res.Cases[1].Passed())
+	})
+
+	n.It("passes the test library's own expectations", func() {
+		res := runner().RunFile("../test/expectations.m13")
+		require.Nil(t, res.Error)
+		require.Equal(t, 10, len(res.Cases))
+
+		for _, c := range res.Cases {
+			assert.True(t, c.Passed(), "%s: %v %v", c.FullName(), c.Failures, c.Error)
+		}
+	})
+
+	n.It("only stubs methods a class has", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := write(dir, "stub_test.m13", `import test
+
+class Box {
+  def open() {
+    1
+  }
+}
+
+test.spec("Stubs", s => {
+  s.it("breaks", t => {
+    t.stub(Box, "nope", => 1)
+  })
+})
+`)
+
+		res := runner().RunFile(path)
+		require.Equal(t, 1, len(res.Cases))
+
+		require.NotNil(t, res.Cases[0].Error)
+		assert.Contains(t, res.Cases[0].Error.Message, "can't stub nope")
+	})
+
+	n.It("reports a file that doesn't compile", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := write(dir, "bad_test.m13", "def (")
+
+		res := runner().RunFile(path)
+		require.NotNil(t, res.Error)
+		assert.Equal(t, 1, res.Failed())
+	})
+
+	n.It("runs only the cases a filter matches", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := write(dir, "math_test.m13", sample)
+
+		f, err := NewFilter("Ma/work")
+		require.NoError(t, err)
+
+		r := runner()
+		r.Filter = f
+
+		res := r.RunFile(path)
+		require.Equal(t, 1, len(res.Cases))
+		assert.Equal(t, "works", res.Cases[0].Name)
+
+		f, err = NewFilter("Other")
+		require.NoError(t, err)
+
+		r.Filter = f
+
+		res = r.RunFile(path)
+		assert.Equal(t, 0, len(res.Cases))
+	})
+
+	n.It("discovers test files", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		a := write(dir, "a_test.m13", sample)
+		b := write(dir, "test/b.m13", sample)
+		write(dir, "lib.m13", "1")
+		write(dir, ".hidden/c_test.m13", sample)
+		write(dir, "vendor/d_test.m13", sample)
+		write(dir, "lib/test/test.m13", sample)
+		write(dir, "test/e/f.m13", sample)
+
+		files, err := Discover(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{a, b}, files)
+	})
+
+	n.It("writes the results as JUnit XML", func() {
+		dir, err := ioutil.TempDir("", "m13")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		path := write(dir, "math_test.m13", sample)
+
+		res := runner().RunFile(path)
+
+		var buf bytes.Buffer
+
+		err = WriteJUnit(&buf, []*File{res})
+		require.NoError(t, err)
+
+		out := buf.String()
+
+		assert.Contains(t, out, `<testsuite name="`+path+`" tests="3" failures="1" errors="1"`)
+		assert.Contains(t, out, `<testcase classname="Math" name="adds"`)
+		assert.Contains(t, out, `math_test.m13:5: Expected 2 to equal 3</failure>`)
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	goast "go/ast"
+	"os"
+
+	"github.com/evanphx/m13/ast"
+	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/parser"
+)
+
+func init() {
+	register(&command{
+		Name:  "ast",
+		Short: "print the syntax tree of a source file",
+		Run:   runAST,
+	})
+}
+
+func runAST(args []string) error {
+	fs := flag.NewFlagSet("ast", flag.ExitOnError)
+	desugar := fs.Bool("desugar", false, "show the tree after desugaring")
+	format := fs.String("format", "sexp", "print the tree as `sexp`, json or go, the Go structs")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return usageError("expected a single file")
+	}
+
+	node, pos, err := parser.ParseFileWithPositions(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *desugar {
+		node = gen.DesugarAST(node)
+	}
+
+	switch *format {
+	case "sexp":
+		str, err := ast.Sexp(node)
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(str)
+	case "json":
+		data, err := ast.JSON(node, pos)
+		if err != nil {
+			return err
+		}
+
+		os.Stdout.Write(data)
+	case "go":
+		return goast.Print(nil, node)
+	default:
+		return usageError(fmt.Sprintf("unknown format '%s'", *format))
+	}
+
+	return nil
+}
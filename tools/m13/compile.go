@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/evanphx/m13/loader"
+	"github.com/evanphx/m13/parser"
+	"github.com/evanphx/m13/vm"
+)
+
+func init() {
+	register(&command{
+		Name:  "compile",
+		Short: "compile source files to .m13c bytecode",
+		Run:   runCompile,
+	})
+}
+
+func runCompile(args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "print the name of each file compiled")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return usageError("no files or directories given")
+	}
+
+	v, err := vm.NewVM()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+
+	for _, arg := range fs.Args() {
+		stat, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+
+		if !stat.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if !file.IsDir() && filepath.Ext(file.Name()) == loader.SourceExt {
+				paths = append(paths, filepath.Join(arg, file.Name()))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		code, err := loader.CompileFile(v, path)
+		if err != nil {
+			// Parse errors already say which file they're in.
+			if errors.Is(err, parser.ErrParse) {
+				return err
+			}
+
+			return fmt.Errorf("%s: %s", path, err)
+		}
+
+		err = loader.WriteCache(path, code)
+		if err != nil {
+			return err
+		}
+
+		if *verbose {
+			fmt.Println(loader.CachePath(path))
+		}
+	}
+
+	return nil
+}
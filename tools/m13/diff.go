@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type edit struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// diffLines returns the shortest edit script turning a into b, found with
+// Myers' algorithm.
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+
+	v := make([]int, 2*max+2)
+
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+
+			y := x - k
+
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+
+			v[off+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, off)
+			}
+		}
+	}
+
+	return nil
+}
+
+func backtrack(a, b []string, trace [][]int, off int) []edit {
+	var edits []edit
+
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var pk int
+
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+
+		px := v[off+pk]
+		py := px - pk
+
+		for x > px && y > py {
+			edits = append(edits, edit{' ', a[x-1]})
+			x--
+			y--
+		}
+
+		if x == px {
+			edits = append(edits, edit{'+', b[y-1]})
+		} else {
+			edits = append(edits, edit{'-', a[x-1]})
+		}
+
+		x, y = px, py
+	}
+
+	for x > 0 && y > 0 {
+		edits = append(edits, edit{' ', a[x-1]})
+		x--
+		y--
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+
+	return edits
+}
+
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// unifiedDiff returns the changes from a to b in unified diff format, or
+// nothing if they're the same.
+func unifiedDiff(name string, a, b []byte) []byte {
+	edits := diffLines(splitLines(a), splitLines(b))
+
+	const context = 3
+
+	var buf bytes.Buffer
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// A hunk runs until there are more unchanged lines than the
+		// context on both sides would show.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+
+		for j := i; j < len(edits); j++ {
+			if edits[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", name, name)
+		}
+
+		aline, bline := 1, 1
+
+		for _, e := range edits[:start] {
+			if e.op != '+' {
+				aline++
+			}
+
+			if e.op != '-' {
+				bline++
+			}
+		}
+
+		var acount, bcount int
+
+		for _, e := range edits[start:stop] {
+			if e.op != '+' {
+				acount++
+			}
+
+			if e.op != '-' {
+				bcount++
+			}
+		}
+
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aline, acount, bline, bcount)
+
+		for _, e := range edits[start:stop] {
+			buf.WriteByte(e.op)
+			buf.WriteString(e.text)
+
+			if !strings.HasSuffix(e.text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = stop
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/evanphx/m13/gen"
+	"github.com/evanphx/m13/loader"
+	"github.com/evanphx/m13/parser"
+	"github.com/evanphx/m13/value"
+	"github.com/evanphx/m13/vm"
+)
+
+func init() {
+	register(&command{
+		Name:  "disasm",
+		Short: "print the bytecode of source or .m13c files",
+		Run:   runDisasm,
+	})
+}
+
+func runDisasm(args []string) error {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	passes := fs.String("passes", "all", "optimization passes to run when compiling source")
+	asJSON := fs.Bool("json", false, "print the code as JSON, one document per file")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return usageError("no files given")
+	}
+
+	sel, ok := gen.ParsePasses(*passes)
+	if !ok {
+		return usageError(fmt.Sprintf("unknown optimization passes '%s'", *passes))
+	}
+
+	v, err := vm.NewVM()
+	if err != nil {
+		return err
+	}
+
+	for i, path := range fs.Args() {
+		code, err := loadCode(v, path, sel)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			data, err := json.MarshalIndent(code, "", "  ")
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("%s\n", data)
+			continue
+		}
+
+		if fs.NArg() > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+
+			fmt.Printf("== %s\n", path)
+		}
+
+		code.Disassemble(os.Stdout)
+	}
+
+	return nil
+}
+
+// loadCode reads a compiled .m13c file as is and compiles anything else
+// as source with the given passes.
+func loadCode(v *vm.VM, path string, passes gen.Pass) (*value.Code, error) {
+	if filepath.Ext(path) == loader.CompiledExt {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+
+		code, err := value.ReadCode(v, f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		return code, nil
+	}
+
+	tree, pos, err := parser.ParseFileWithPositions(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := gen.NewGenerator(v, "__top__")
+	if err != nil {
+		return nil, err
+	}
+
+	g.File = path
+	g.Positions = pos
+	g.Passes = passes
+
+	return g.GenerateTop(tree)
+}
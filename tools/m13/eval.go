@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/evanphx/m13/eval"
+	"github.com/evanphx/m13/loader"
+)
+
+func init() {
+	register(&command{
+		Name:  "eval",
+		Short: "evaluate code and print the result",
+		Run:   runEval,
+	})
+}
+
+func runEval(args []string) error {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	code := fs.String("e", "", "the code to evaluate, instead of reading it from standard input")
+	quiet := fs.Bool("q", false, "don't print the result")
+
+	var include loader.PathList
+
+	fs.Var(&include, "I", "search this directory for imported packages, may be repeated")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return usageError("unexpected arguments, pass code with -e or on standard input")
+	}
+
+	src := *code
+
+	if src == "" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		src = string(data)
+	}
+
+	ev, err := eval.NewEvaluator()
+	if err != nil {
+		return err
+	}
+
+	lo, _ := loader.FromContext(ev.Context())
+	lo.Search = loader.SearchPath(include...)
+
+	val, err := ev.Eval(src)
+	if err != nil {
+		return errors.New(describeError(ev.VM(), err, src))
+	}
+
+	if *quiet {
+		return nil
+	}
+
+	str, err := ev.Inspect(val)
+	if err != nil {
+		return errors.New(describeError(ev.VM(), err, src))
+	}
+
+	fmt.Println(str)
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/evanphx/m13/format"
+	"github.com/evanphx/m13/loader"
+)
+
+func init() {
+	register(&command{
+		Name:  "fmt",
+		Short: "format source files",
+		Run:   runFmt,
+	})
+}
+
+type fmtOptions struct {
+	write bool
+	diff  bool
+	list  bool
+
+	unformatted int
+}
+
+func runFmt(args []string) error {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+
+	var opts fmtOptions
+
+	fs.BoolVar(&opts.write, "w", false, "write the result back to the file instead of printing it")
+	fs.BoolVar(&opts.diff, "d", false, "print a diff of the changes instead of the result")
+	fs.BoolVar(&opts.list, "l", false, "list the files whose formatting differs")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		if opts.write {
+			return usageError("can't write the result back to standard input")
+		}
+
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		if err := opts.format("<stdin>", src); err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range fs.Args() {
+		err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || (path != arg && filepath.Ext(path) != loader.SourceExt) {
+				return nil
+			}
+
+			src, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			return opts.format(path, src)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// With -d or -l, unformatted files are a failure, so they can be
+	// checked for.
+	if (opts.diff || opts.list) && opts.unformatted > 0 {
+		return fmt.Errorf("%d file(s) not formatted", opts.unformatted)
+	}
+
+	return nil
+}
+
+func (o *fmtOptions) format(path string, src []byte) error {
+	out, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	changed := !bytes.Equal(src, out)
+	if changed {
+		o.unformatted++
+	}
+
+	if o.list && changed {
+		fmt.Println(path)
+	}
+
+	if o.diff {
+		os.Stdout.Write(unifiedDiff(path, src, out))
+	}
+
+	if o.write && changed {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(path, out, info.Mode())
+	}
+
+	if !o.write && !o.diff && !o.list {
+		os.Stdout.Write(out)
+	}
+
+	return nil
+}
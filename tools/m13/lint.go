@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/evanphx/m13/lint"
+	"github.com/evanphx/m13/loader"
+)
+
+func init() {
+	register(&command{
+		Name:  "lint",
+		Short: "report likely mistakes in packages",
+		Run:   runLint,
+	})
+}
+
+func checkSet(list string) (map[string]bool, error) {
+	set := map[string]bool{}
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if _, ok := lint.FindCheck(name); !ok {
+			return nil, usageError(fmt.Sprintf("unknown check '%s'", name))
+		}
+
+		set[name] = true
+	}
+
+	return set, nil
+}
+
+func runLint(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	enable := fs.String("enable", "", "run only these checks, separated by commas")
+	disable := fs.String("disable", "", "don't run these checks, separated by commas")
+	list := fs.Bool("checks", false, "list the checks and exit")
+	fs.Parse(args)
+
+	if *list {
+		for _, c := range lint.Checks {
+			fmt.Printf("%-12s %s\n", c.Name, c.Doc)
+		}
+
+		return nil
+	}
+
+	var (
+		cfg lint.Config
+		err error
+	)
+
+	if cfg.Enabled, err = checkSet(*enable); err != nil {
+		return err
+	}
+
+	if cfg.Disabled, err = checkSet(*disable); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return usageError("no files or directories given")
+	}
+
+	var count int
+
+	for _, arg := range fs.Args() {
+		paths, err := packageFiles(arg)
+		if err != nil {
+			return err
+		}
+
+		var files []*lint.File
+
+		for _, path := range paths {
+			src, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			files = append(files, &lint.File{Name: path, Source: src})
+		}
+
+		warnings, err := cfg.Package(files)
+		if err != nil {
+			return err
+		}
+
+		for _, w := range warnings {
+			fmt.Println(w)
+		}
+
+		count += len(warnings)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("%d warning(s)", count)
+	}
+
+	return nil
+}
+
+// packageFiles returns the source files of the package at path, which is
+// either a package directory or a file that's a package on its own.
+func packageFiles(path string) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !stat.IsDir() {
+		return []string{path}, nil
+	}
+
+	return loader.SourceFiles(path)
+}
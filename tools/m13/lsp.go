@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/evanphx/m13/loader"
+	"github.com/evanphx/m13/lsp"
+)
+
+func init() {
+	register(&command{
+		Name:  "lsp",
+		Short: "run a language server on stdin and stdout",
+		Run:   runLSP,
+	})
+}
+
+func runLSP(args []string) error {
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+
+	var include loader.PathList
+
+	fs.Var(&include, "I", "search this directory for imported packages, may be repeated")
+	fs.Parse(args)
+
+	s := lsp.NewServer()
+	s.Search = loader.SearchPath(include...)
+
+	return s.Serve(os.Stdin, os.Stdout)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// usageError reports arguments a command can't make sense of. It exits
+// with status 2, like a flag that doesn't parse.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// exitError ends a command that has already reported why it failed.
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+type command struct {
+	Name  string
+	Short string
+	Run   func(args []string) error
+}
+
+var commands = map[string]*command{}
+
+func register(cmd *command) {
+	commands[cmd.Name] = cmd
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: m13 <command> [arguments]\n\nCommands:\n")
+
+	var names []string
+
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].Short)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "m13: unknown command '%s'\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	os.Exit(execute(cmd, os.Args[2:]))
+}
+
+// execute runs cmd and returns the status m13 exits with: 0 on success, 1
+// when the command fails and 2 when it's used wrongly.
+func execute(cmd *command, args []string) (status int) {
+	// A bug in the VM shouldn't surface as a Go stack trace.
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "m13 %s: internal error: %v\n", cmd.Name, r)
+			status = 1
+		}
+	}()
+
+	err := cmd.Run(args)
+
+	switch err := err.(type) {
+	case nil:
+		return 0
+	case exitError:
+		return int(err)
+	case usageError:
+		fmt.Fprintf(os.Stderr, "m13 %s: %s\n", cmd.Name, err)
+		return 2
+	default:
+		fmt.Fprintf(os.Stderr, "m13 %s: %s\n", cmd.Name, err)
+		return 1
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/evanphx/m13/eval"
+	"github.com/evanphx/m13/loader"
+)
+
+func init() {
+	register(&command{
+		Name:  "repl",
+		Short: "evaluate code interactively",
+		Run:   runRepl,
+	})
+}
+
+type repl struct {
+	ev  *eval.Evaluator
+	out io.Writer
+
+	history     []string
+	historyFile string
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".m13_history")
+}
+
+func runRepl(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	history := fs.String("history", defaultHistoryFile(), "file to keep command history in")
+
+	var include loader.PathList
+
+	fs.Var(&include, "I", "search this directory for imported packages, may be repeated")
+	fs.Parse(args)
+
+	ev, err := eval.NewEvaluator()
+	if err != nil {
+		return err
+	}
+
+	lo, _ := loader.FromContext(ev.Context())
+	lo.Search = loader.SearchPath(include...)
+
+	r := &repl{ev: ev, out: os.Stdout, historyFile: *history}
+
+	r.loadHistory()
+
+	return r.run(os.Stdin)
+}
+
+// History entries are stored one per line, quoted so multi-line input
+// survives.
+func (r *repl) loadHistory() {
+	if r.historyFile == "" {
+		return
+	}
+
+	f, err := os.Open(r.historyFile)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		if entry, err := strconv.Unquote(sc.Text()); err == nil {
+			r.history = append(r.history, entry)
+		}
+	}
+}
+
+func (r *repl) remember(entry string) {
+	r.history = append(r.history, entry)
+
+	if r.historyFile == "" {
+		return
+	}
+
+	f, err := os.OpenFile(r.historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintln(f, strconv.Quote(entry))
+	f.Close()
+}
+
+func (r *repl) run(in io.Reader) error {
+	sc := bufio.NewScanner(in)
+
+	var buf []string
+
+	for {
+		if len(buf) == 0 {
+			fmt.Fprint(r.out, "m13> ")
+		} else {
+			fmt.Fprint(r.out, "...> ")
+		}
+
+		if !sc.Scan() {
+			fmt.Fprintln(r.out)
+			return sc.Err()
+		}
+
+		line := sc.Text()
+
+		if len(buf) == 0 {
+			trimmed := strings.TrimSpace(line)
+
+			if trimmed == "" {
+				continue
+			}
+
+			if strings.HasPrefix(trimmed, ".") || strings.HasPrefix(trimmed, "!") {
+				entry, quit := r.command(trimmed)
+				if quit {
+					return nil
+				}
+
+				if entry == "" {
+					continue
+				}
+
+				fmt.Fprintln(r.out, entry)
+				line = entry
+			}
+		}
+
+		buf = append(buf, line)
+
+		src := strings.Join(buf, "\n")
+
+		if eval.Incomplete(src) {
+			continue
+		}
+
+		buf = nil
+
+		r.remember(src)
+		r.eval(src)
+	}
+}
+
+// command runs a REPL command. It returns history to run again, if the
+// command recalled some, and whether to exit.
+func (r *repl) command(line string) (string, bool) {
+	if strings.HasPrefix(line, "!") {
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 1 || n > len(r.history) {
+			fmt.Fprintf(r.out, "no history entry %s\n", line[1:])
+			return "", false
+		}
+
+		return r.history[n-1], false
+	}
+
+	switch line {
+	case ".exit", ".quit":
+		return "", true
+	case ".history":
+		for i, entry := range r.history {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, strings.Replace(entry, "\n", "\n      ", -1))
+		}
+	case ".vars":
+		for _, name := range r.ev.Names() {
+			val, _ := r.ev.Get(name)
+
+			str, err := r.ev.Inspect(val)
+			if err != nil {
+				str = err.Error()
+			}
+
+			fmt.Fprintf(r.out, "%s = %s\n", name, str)
+		}
+	case ".help":
+		fmt.Fprintf(r.out, "  .vars     show the bound variables\n")
+		fmt.Fprintf(r.out, "  .history  show previous input\n")
+		fmt.Fprintf(r.out, "  !N        run history entry N again\n")
+		fmt.Fprintf(r.out, "  .exit     leave the repl\n")
+	default:
+		fmt.Fprintf(r.out, "unknown command %s (try .help)\n", line)
+	}
+
+	return "", false
+}
+
+func (r *repl) eval(src string) {
+	// A bad line shouldn't take the whole session down with it.
+	defer func() {
+		if x := recover(); x != nil {
+			fmt.Fprintf(r.out, "internal error: %v\n", x)
+		}
+	}()
+
+	val, err := r.ev.Eval(src)
+	if err != nil {
+		fmt.Fprintf(r.out, "error: %s\n", err)
+		return
+	}
+
+	str, err := r.ev.Inspect(val)
+	if err != nil {
+		fmt.Fprintf(r.out, "error: %s\n", err)
+		return
+	}
+
+	fmt.Fprintf(r.out, "=> %s\n", str)
+}
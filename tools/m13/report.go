@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/evanphx/m13/vm"
+)
+
+// sourceLine returns line n of file, or of src when the code came from
+// the command line rather than a file.
+func sourceLine(file, src string, n int) (string, bool) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", false
+		}
+
+		src = string(data)
+	}
+
+	lines := strings.Split(src, "\n")
+	if n < 1 || n > len(lines) {
+		return "", false
+	}
+
+	return strings.TrimRight(lines[n-1], "\r"), true
+}
+
+// describeError renders err the way the m13 commands print it. Errors
+// raised while running code show the line they came from and the frames
+// they unwound through; parse errors carry their own excerpt already.
+func describeError(v *vm.VM, err error, src string) string {
+	var bt []vm.Location
+
+	if v != nil {
+		bt = v.Backtrace(err)
+	}
+
+	if len(bt) == 0 {
+		return err.Error()
+	}
+
+	var buf bytes.Buffer
+
+	top := bt[0]
+
+	file := top.File
+	if file == "" {
+		file = "-e"
+	}
+
+	fmt.Fprintf(&buf, "%s:%d: %s", file, top.Line, err)
+
+	if line, ok := sourceLine(top.File, src, top.Line); ok {
+		fmt.Fprintf(&buf, "\n    %s", strings.TrimSpace(line))
+	}
+
+	for _, loc := range bt {
+		fmt.Fprintf(&buf, "\n\tat %s", loc)
+	}
+
+	return buf.String()
+}
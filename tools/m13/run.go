@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/evanphx/m13/debugger"
+	"github.com/evanphx/m13/loader"
+	"github.com/evanphx/m13/vm"
+)
+
+func init() {
+	register(&command{
+		Name:  "run",
+		Short: "run a program",
+		Run:   runRun,
+	})
+}
+
+func runRun(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	trace := fs.Bool("trace", false, "print every call and instruction to stderr")
+	debug := fs.Bool("debug", false, "run the program under the interactive debugger")
+	prof := fs.String("cpuprofile", "", "write a pprof profile of the m13 calls made to this file")
+
+	var include loader.PathList
+
+	fs.Var(&include, "I", "search this directory for imported packages, may be repeated")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return usageError("expected a single file to run")
+	}
+
+	path := fs.Arg(0)
+
+	v, err := vm.NewVM()
+	if err != nil {
+		return err
+	}
+
+	lp, err := loader.LoadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *debug:
+		debugger.New(v, os.Stdin, os.Stdout).Attach()
+	case *trace:
+		v.SetTracer(vm.NewTextTracer(v, os.Stderr))
+	}
+
+	if *prof != "" {
+		v.SetProfiler(vm.NewProfiler())
+	}
+
+	ctx := loader.SetupContext(context.Background(), v, filepath.Dir(path))
+
+	lo, _ := loader.FromContext(ctx)
+	lo.Search = loader.SearchPath(include...)
+
+	_, err = lp.Exec(ctx, v, v.Registry())
+
+	if p := v.Profiler(); p != nil {
+		p.Stop()
+
+		if perr := writeProfile(*prof, p); perr != nil {
+			fmt.Fprintf(os.Stderr, "m13 run: unable to write profile: %s\n", perr)
+		}
+	}
+
+	switch {
+	case err == nil:
+		return nil
+	case err == debugger.ErrQuit:
+		return exitError(1)
+	default:
+		return errors.New(describeError(v, err, ""))
+	}
+}
+
+func writeProfile(path string, p *vm.Profiler) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = p.WritePprof(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
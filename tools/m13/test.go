@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/evanphx/m13/loader"
+	"github.com/evanphx/m13/testrun"
+)
+
+func init() {
+	register(&command{
+		Name:  "test",
+		Short: "run the specs in test files",
+		Run:   runTest,
+	})
+}
+
+func runTest(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	run := fs.String("run", "", "run only the cases matching `spec/case`, each a regexp")
+	verbose := fs.Bool("v", false, "print every case, not just those that fail")
+	junit := fs.String("junit", "", "write the results as JUnit XML to this file")
+
+	var include loader.PathList
+
+	fs.Var(&include, "I", "search this directory for imported packages, may be repeated")
+	fs.Parse(args)
+
+	runner := &testrun.Runner{Search: loader.SearchPath(include...)}
+
+	if *run != "" {
+		f, err := testrun.NewFilter(*run)
+		if err != nil {
+			return err
+		}
+
+		runner.Filter = f
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := testrun.Discover(paths...)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no test files found")
+	}
+
+	var (
+		results        []*testrun.File
+		passed, failed int
+		start          = time.Now()
+	)
+
+	for _, path := range files {
+		res := runner.RunFile(path)
+		results = append(results, res)
+
+		printResult(res, *verbose)
+
+		failed += res.Failed()
+
+		for _, c := range res.Cases {
+			if c.Passed() {
+				passed++
+			}
+		}
+	}
+
+	if *junit != "" {
+		if err := writeJUnit(*junit, results); err != nil {
+			return err
+		}
+	}
+
+	status := "PASS"
+	if failed > 0 {
+		status = "FAIL"
+	}
+
+	fmt.Printf("%s: %d passed, %d failed in %d file(s) (%.2fs)\n",
+		status, passed, failed, len(files), time.Since(start).Seconds())
+
+	if failed > 0 {
+		return fmt.Errorf("%d test(s) failed", failed)
+	}
+
+	return nil
+}
+
+func printResult(res *testrun.File, verbose bool) {
+	for _, c := range res.Cases {
+		if c.Passed() {
+			if verbose {
+				fmt.Printf("--- PASS: %s (%.2fs)\n", c.FullName(), c.Duration.Seconds())
+			}
+
+			continue
+		}
+
+		fmt.Printf("--- FAIL: %s (%.2fs)\n", c.FullName(), c.Duration.Seconds())
+
+		for _, f := range c.Failures {
+			fmt.Printf("    %s\n", f)
+		}
+
+		if c.Error != nil {
+			fmt.Printf("    %s\n", c.Error)
+		}
+	}
+
+	switch {
+	case res.Error != nil:
+		fmt.Printf("FAIL %s\n    %s\n", res.Path, res.Error)
+	case res.Failed() > 0:
+		fmt.Printf("FAIL %s (%.2fs)\n", res.Path, res.Duration.Seconds())
+	case len(res.Cases) == 0:
+		fmt.Printf("ok   %s [no tests]\n", res.Path)
+	default:
+		fmt.Printf("ok   %s (%.2fs)\n", res.Path, res.Duration.Seconds())
+	}
+}
+
+func writeJUnit(path string, results []*testrun.File) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := testrun.WriteJUnit(f, results); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,113 @@
+package value
+
+import "sync/atomic"
+
+// The number of receiver classes a CallSite remembers before it starts
+// evicting entries. 1 entry is monomorphic, anything above is polymorphic.
+const callSiteCacheSize = 4
+
+var methodSerial uint64 = 1
+
+// MethodSerial returns the current global method table version. It changes
+// any time a method is added to or aliased on any class.
+func MethodSerial() uint64 {
+	return atomic.LoadUint64(&methodSerial)
+}
+
+func bumpMethodSerial() {
+	atomic.AddUint64(&methodSerial, 1)
+}
+
+type callSiteEntry struct {
+	class  *Class
+	method *Method
+}
+
+// callSiteCache is what a CallSite remembers. A cache is never changed once
+// it's published, each change stores a new one, so goroutines running the
+// same code can share its CallSites.
+type callSiteCache struct {
+	serial  uint64
+	next    int
+	entries [callSiteCacheSize]callSiteEntry
+}
+
+type CallSite struct {
+	Name    string
+	KWTable []string
+
+	// Package identifies the package the calling code belongs to, which
+	// decides whether it may call private methods. It is set when the code
+	// is loaded, and calls without one may call any method.
+	Package string
+
+	cache atomic.Value
+}
+
+func (cs *CallSite) current() *callSiteCache {
+	c, _ := cs.cache.Load().(*callSiteCache)
+	return c
+}
+
+// Lookup finds the method for Name on cls, consulting the inline cache
+// before walking the class hierarchy.
+func (cs *CallSite) Lookup(cls *Class) (*Method, bool) {
+	serial := MethodSerial()
+
+	c := cs.current()
+
+	if c != nil && c.serial == serial {
+		for i := range c.entries {
+			ent := &c.entries[i]
+
+			if ent.class == cls {
+				return ent.method, true
+			}
+
+			if ent.class == nil {
+				break
+			}
+		}
+	}
+
+	m, ok := cls.LookupMethod(cs.Name)
+	if !ok {
+		return nil, false
+	}
+
+	up := &callSiteCache{serial: serial}
+
+	if c != nil && c.serial == serial {
+		*up = *c
+	}
+
+	up.entries[up.next] = callSiteEntry{class: cls, method: m}
+	up.next = (up.next + 1) % callSiteCacheSize
+
+	cs.cache.Store(up)
+
+	return m, true
+}
+
+// Flush drops every cached entry.
+func (cs *CallSite) Flush() {
+	cs.cache.Store(&callSiteCache{})
+}
+
+// Cached returns the number of receiver classes currently cached.
+func (cs *CallSite) Cached() int {
+	c := cs.current()
+	if c == nil || c.serial != MethodSerial() {
+		return 0
+	}
+
+	var n int
+
+	for _, ent := range c.entries {
+		if ent.class != nil {
+			n++
+		}
+	}
+
+	return n
+}
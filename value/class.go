@@ -47,6 +47,7 @@ func (c *Class) AddMethod(cfg *MethodDescriptor) {
 		Signature: cfg.Signature,
 		Object:    cfg.Object,
 		Func:      cfg.Func,
+		Package:   cfg.Package,
 	}
 
 	c.Methods[cfg.Name] = method
@@ -54,10 +55,37 @@ func (c *Class) AddMethod(cfg *MethodDescriptor) {
 	for _, arg := range cfg.Aliases {
 		c.Methods[arg] = method
 	}
+
+	bumpMethodSerial()
 }
 
 func (c *Class) AliasMethod(from, to string) {
 	c.Methods[to] = c.Methods[from]
+
+	bumpMethodSerial()
+}
+
+// RemoveMethod removes the method name defined by c, so that calls find an
+// inherited one again.
+func (c *Class) RemoveMethod(name string) {
+	delete(c.Methods, name)
+
+	bumpMethodSerial()
+}
+
+// MakePrivate restricts calls of the method name, and its aliases, to code
+// in the package that defined it. It reports whether c has such a method.
+func (c *Class) MakePrivate(name string) bool {
+	method, ok := c.Methods[name]
+	if !ok {
+		return false
+	}
+
+	method.Private = true
+
+	bumpMethodSerial()
+
+	return true
 }
 
 func (c *Class) AddClassMethod(cfg *MethodDescriptor) {
@@ -79,6 +107,8 @@ func (c *Class) AddMethodCase(name string, cond Cond, cfg *MethodDescriptor) err
 		}
 
 		c.Methods[name] = desc
+
+		bumpMethodSerial()
 	} else {
 		cc, ok = method.Object.(*CondDispatcher)
 		if !ok {
@@ -222,6 +252,7 @@ func initClassMirror(r *Package, cls *Class) {
 				Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
 					return env.InvokeLambda(ctx, lamb.RedirectSelf(recv), args)
 				},
+				Package: lamb.Code.Package,
 			})
 
 			return name, nil
@@ -243,4 +274,52 @@ func initClassMirror(r *Package, cls *Class) {
 			return from, nil
 		},
 	})
+
+	cls.AddMethod(&MethodDescriptor{
+		Name: "make_private",
+		Signature: Signature{
+			Required: 1,
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			rc := recv.(*ClassMirror).cls
+			name := args[0].(*String)
+
+			if !rc.MakePrivate(name.String) {
+				return nil, fmt.Errorf("unknown method '%s' on '%s'", name.String, rc.FullName())
+			}
+
+			return name, nil
+		},
+	})
+	cls.AddMethod(&MethodDescriptor{
+		Name: "has_method",
+		Signature: Signature{
+			Required: 1,
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			rc := recv.(*ClassMirror).cls
+			name := args[0].(*String)
+
+			if _, ok := rc.Methods[name.String]; ok {
+				return env.True(), nil
+			}
+
+			return env.False(), nil
+		},
+	})
+
+	cls.AddMethod(&MethodDescriptor{
+		Name: "remove_method",
+		Signature: Signature{
+			Required: 1,
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			rc := recv.(*ClassMirror).cls
+			name := args[0].(*String)
+
+			rc.RemoveMethod(name.String)
+
+			return name, nil
+		},
+	})
 }
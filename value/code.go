@@ -1,19 +1,25 @@
 package value
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/evanphx/m13/insn"
 )
 
-type CallSite struct {
-	Name    string
-	KWTable []string
+// LineEntry marks that the instructions starting at Start came from the
+// source line Line. Entries in Code.Lines are sorted by Start.
+type LineEntry struct {
+	Start int
+	Line  int
 }
 
 type Code struct {
 	Name         string
+	File         string
 	NumRefs      int
 	NumRegs      int
 	Instructions []insn.Instruction
@@ -21,111 +27,232 @@ type Code struct {
 	Calls        []*CallSite
 	Signature    *Signature
 	SubCode      []*Code
+	Lines        []LineEntry
+
+	// LocalNames holds the name of the variable kept in each register, and
+	// RefNames the name of each ref. Unnamed registers are "".
+	LocalNames []string
+	RefNames   []string
+
+	// Package identifies the package the code was loaded into, see
+	// SetPackage.
+	Package string
+}
+
+// SetPackage records pkg as the package of c, the calls it makes and all of
+// its subcode. pkg must identify one package, so the loader uses its
+// canonical path rather than its name.
+func (c *Code) SetPackage(pkg string) {
+	c.Package = pkg
+
+	for _, cs := range c.Calls {
+		cs.Package = pkg
+	}
+
+	for _, sub := range c.SubCode {
+		sub.SetPackage(pkg)
+	}
+}
+
+// IsLineStart reports whether ip is the first instruction generated for a
+// source line.
+func (c *Code) IsLineStart(ip int) bool {
+	for _, ent := range c.Lines {
+		if ent.Start == ip {
+			return true
+		}
+
+		if ent.Start > ip {
+			break
+		}
+	}
+
+	return false
+}
+
+// LineFor returns the source line for the instruction at ip, or 0 if the
+// line table doesn't cover it.
+func (c *Code) LineFor(ip int) int {
+	var line int
+
+	for _, ent := range c.Lines {
+		if ent.Start > ip {
+			break
+		}
+
+		line = ent.Line
+	}
+
+	return line
 }
 
 func (c *Code) Disassemble(w io.Writer) {
+	c.disassemble(w, "")
+}
+
+func disasmArgs(start, cnt int) string {
+	switch cnt {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("r%d", start)
+	default:
+		return fmt.Sprintf("r%d to r%d", start, start+cnt-1)
+	}
+}
+
+// FormatInstruction renders i the same way Disassemble does, without the
+// index prefix or a trailing newline.
+func (c *Code) FormatInstruction(i insn.Instruction) string {
+	var buf bytes.Buffer
+
+	switch i.Op() {
+	case insn.Noop:
+		fmt.Fprintf(&buf, "noop")
+	case insn.Reset:
+		fmt.Fprintf(&buf, "r%d = nil", i.R0())
+	case insn.CopyReg:
+		fmt.Fprintf(&buf, "r%d = r%d",
+			i.R0(),
+			i.R1())
+	case insn.ReadRef:
+		fmt.Fprintf(&buf, "r%d = ref(%d)", i.R0(), i.R1())
+	case insn.StoreRef:
+		fmt.Fprintf(&buf, "ref(%d) = r%d", i.R0(), i.R1())
+	case insn.Self:
+		fmt.Fprintf(&buf, "r%d = self", i.R0())
+	case insn.StoreInt:
+		fmt.Fprintf(&buf, "r%d = int(%d)",
+			i.R0(),
+			i.Data())
+	case insn.StoreBool:
+		fmt.Fprintf(&buf, "r%d = %t", i.R0(), i.Data() != 0)
+	case insn.GetMirror:
+		fmt.Fprintf(&buf, "r%d = mirror(r%d)",
+			i.R0(),
+			i.R1())
+	case insn.GetScoped:
+		fmt.Fprintf(&buf, "r%d = $%s",
+			i.R0(),
+			c.Strings[i.R1()].String)
+	case insn.SetScoped:
+		fmt.Fprintf(&buf, "$%s = r%d",
+			c.Strings[i.R1()].String,
+			i.R0())
+	case insn.String:
+		fmt.Fprintf(&buf, "r%d = %s",
+			i.R0(),
+			strconv.Quote(c.Strings[i.R1()].String))
+	case insn.Call0:
+		fmt.Fprintf(&buf, "r%d = r%d.`%s`",
+			i.R0(),
+			i.R1(),
+			c.Calls[i.R2()].Name)
+	case insn.CallN:
+		fmt.Fprintf(&buf, "r%d = r%d.`%s`(%s)",
+			i.R0(),
+			i.R1(),
+			c.Calls[i.R2()].Name,
+			disasmArgs(i.R1()+1, int(i.Rest2())))
+	case insn.CallKW:
+		var args []string
+
+		reg := i.R1() + 1
+
+		for j := 0; j < i.R3(); j++ {
+			args = append(args, fmt.Sprintf("r%d", reg))
+			reg++
+		}
+
+		for _, name := range c.Calls[i.R2()].KWTable {
+			args = append(args, fmt.Sprintf("%s=r%d", name, reg))
+			reg++
+		}
+
+		fmt.Fprintf(&buf, "r%d = r%d.`%s`(%s)",
+			i.R0(),
+			i.R1(),
+			c.Calls[i.R2()].Name,
+			strings.Join(args, ", "))
+	case insn.Invoke:
+		fmt.Fprintf(&buf, "r%d = r%d.(%s)",
+			i.R0(),
+			i.R1(),
+			disasmArgs(i.R1()+1, int(i.Rest1())))
+	case insn.CreateLambda:
+		fmt.Fprintf(&buf, "r%d = lambda(args=%d, refs=%d, sub=%d)",
+			i.R0(),
+			i.R1(),
+			i.R2(),
+			i.Rest2())
+	case insn.Return:
+		fmt.Fprintf(&buf, "ret r%d", i.R0())
+	case insn.GetIvar:
+		fmt.Fprintf(&buf, "r%d = @%s", i.R0(), c.Strings[i.R1()].String)
+	case insn.SetIvar:
+		fmt.Fprintf(&buf, "@%s = r%d", c.Strings[i.R1()].String, i.R0())
+	case insn.NewList:
+		fmt.Fprintf(&buf, "r%d = [](res=%d)", i.R0(), i.R1())
+	case insn.ListAppend:
+		fmt.Fprintf(&buf, "r%d << r%d", i.R0(), i.R1())
+	case insn.NewMap:
+		fmt.Fprintf(&buf, "r%d = {}", i.R0())
+	case insn.SetMap:
+		fmt.Fprintf(&buf, "r%d[r%d] = r%d", i.R0(), i.R1(), i.R1()+1)
+	case insn.GIF:
+		fmt.Fprintf(&buf, "if !r%d goto %03d", i.R0(), i.Data())
+	case insn.Goto:
+		fmt.Fprintf(&buf, "goto %03d", i.Data())
+	default:
+		fmt.Fprintf(&buf, "%s %d %d %d %d",
+			i.Op().String(),
+			i.R0(), i.R1(),
+			i.R2(), i.Data(),
+		)
+	}
+
+	return buf.String()
+}
+
+func (c *Code) disassemble(w io.Writer, path string) {
+	if c.Name != "" {
+		fmt.Fprintf(w, "Code: %s\n", strconv.Quote(c.Name))
+	}
+
+	if c.File != "" {
+		fmt.Fprintf(w, "File: %s\n", strconv.Quote(c.File))
+	}
+
 	fmt.Fprintf(w, "Refs: %d Regs: %d\n", c.NumRefs, c.NumRegs)
+
+	if c.Signature != nil {
+		args := strings.Join(c.Signature.Args, ", ")
+		if args != "" {
+			args += " "
+		}
+
+		fmt.Fprintf(w, "Args: %s(required: %d)\n", args, c.Signature.Required)
+	}
+
+	lines := c.Lines
+
 	for idx, i := range c.Instructions {
-		fmt.Fprintf(w, "%03d ", idx)
-
-		switch i.Op() {
-		case insn.Noop:
-			fmt.Fprintf(w, "noop\n")
-		case insn.CopyReg:
-			fmt.Fprintf(w, "r%d = r%d\n",
-				i.R0(),
-				i.R1())
-		case insn.ReadRef:
-			fmt.Fprintf(w, "r%d = ref(%d)\n", i.R0(), i.R1())
-		case insn.StoreRef:
-			fmt.Fprintf(w, "ref(%d) = r%d\n", i.R0(), i.R1())
-		case insn.Self:
-			fmt.Fprintf(w, "r%d = self\n", i.R0())
-		case insn.StoreInt:
-			fmt.Fprintf(w, "r%d = int(%d)\n",
-				i.R0(),
-				i.R1())
-		case insn.GetMirror:
-			fmt.Fprintf(w, "r%d = mirror(r%d)\n",
-				i.R0(),
-				i.R1())
-		case insn.GetScoped:
-			fmt.Fprintf(w, "r%d = $%s\n",
-				i.R0(),
-				c.Strings[i.R1()].String)
-		case insn.String:
-			fmt.Fprintf(w, "r%d = \"%s\"\n",
-				i.R0(),
-				c.Strings[i.R1()].String)
-		case insn.CallN:
-			switch i.Rest2() {
-			case 0:
-				fmt.Fprintf(w, "r%d = r%d.`%s`()\n",
-					i.R0(),
-					i.R1(),
-					c.Calls[i.R2()].Name)
-			case 1:
-				fmt.Fprintf(w, "r%d = r%d.`%s`(r%d)\n",
-					i.R0(),
-					i.R1(),
-					c.Calls[i.R2()].Name,
-					i.R1()+1)
-			default:
-				fmt.Fprintf(w, "r%d = r%d.`%s`(r%d to r%d)\n",
-					i.R0(),
-					i.R1(),
-					c.Calls[i.R2()].Name,
-					i.R1()+1,
-					i.R1()+int(i.Rest2()))
-			}
-		case insn.Invoke:
-			switch i.Rest2() {
-			case 0:
-				fmt.Fprintf(w, "r%d = r%d.()\n",
-					i.R0(),
-					i.R1())
-			case 1:
-				fmt.Fprintf(w, "r%d = r%d.(r%d)\n",
-					i.R0(),
-					i.R1(),
-					i.R1()+1)
-			default:
-				fmt.Fprintf(w, "r%d = r%d.(r%d to r%d)\n",
-					i.R0(),
-					i.R1(),
-					i.R1()+1,
-					i.R1()+int(i.Rest2()))
-			}
-
-		case insn.CreateLambda:
-			fmt.Fprintf(w, "r%d = lambda(args=%d, refs=%d, sub=%d)\n",
-				i.R0(),
-				i.R1(),
-				i.R2(),
-				i.Rest2())
-		case insn.Return:
-			fmt.Fprintf(w, "ret r%d\n", i.R0())
-		case insn.GetIvar:
-			fmt.Fprintf(w, "r%d = @%s\n", i.R0(), c.Strings[i.R1()].String)
-		case insn.SetIvar:
-			fmt.Fprintf(w, "@%s = r%d\n", c.Strings[i.R1()].String, i.R0())
-		case insn.NewList:
-			fmt.Fprintf(w, "r%d = [](res=%d)\n", i.R0(), i.R1())
-		case insn.GIF:
-			fmt.Fprintf(w, "if !r%d goto %03d\n", i.R0(), i.R1())
-		case insn.Goto:
-			fmt.Fprintf(w, "goto %03d\n", i.Data())
-		default:
-			fmt.Fprintf(w, "%s %d %d %d %d\n",
-				i.Op().String(),
-				i.R0(), i.R1(),
-				i.R2(), i.Data(),
-			)
+		for len(lines) > 0 && lines[0].Start <= idx {
+			fmt.Fprintf(w, "@line %d\n", lines[0].Line)
+			lines = lines[1:]
 		}
+
+		fmt.Fprintf(w, "%03d %s\n", idx, c.FormatInstruction(i))
 	}
 
 	for i, sub := range c.SubCode {
-		fmt.Fprintf(w, "\n==== Sub %d =====\n", i)
-		sub.Disassemble(w)
+		sp := strconv.Itoa(i)
+
+		if path != "" {
+			sp = path + "." + sp
+		}
+
+		fmt.Fprintf(w, "\n==== Sub %s =====\n", sp)
+		sub.disassemble(w, sp)
 	}
 }
@@ -0,0 +1,471 @@
+package value
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/evanphx/m13/insn"
+)
+
+// CodeVersion is bumped whenever the serialized layout of a Code changes.
+// Files written with any other version are rejected by ReadCode.
+const CodeVersion = 2
+
+var codeMagic = []byte("M13C")
+
+var ErrBadCodeFile = errors.New("not a compiled m13 file")
+
+type ErrCodeVersion struct {
+	Got int
+}
+
+func (e *ErrCodeVersion) Error() string {
+	return fmt.Sprintf("compiled code version mismatch: expected %d, got %d", CodeVersion, e.Got)
+}
+
+// ErrBadOperand is returned by ReadCode for an instruction that refers to
+// something its code doesn't have, which would crash the VM if run.
+type ErrBadOperand struct {
+	Code    string
+	IP      int
+	Op      insn.Op
+	Problem string
+}
+
+func (e *ErrBadOperand) Error() string {
+	return fmt.Sprintf("%s: %03d %s: %s", e.Code, e.IP, e.Op, e.Problem)
+}
+
+// Validate checks that every operand of every instruction in c, and in its
+// SubCode, is in range: registers within NumRegs, refs within NumRefs,
+// jumps within the code and indexes within Strings, Calls and SubCode.
+func (c *Code) Validate() error {
+	for ip := 0; ip < len(c.Instructions); ip++ {
+		i := c.Instructions[ip]
+
+		bad := func(format string, args ...interface{}) error {
+			return &ErrBadOperand{Code: c.Name, IP: ip, Op: i.Op(), Problem: fmt.Sprintf(format, args...)}
+		}
+
+		regs := func(start int, cnt int64) error {
+			if cnt < 0 || int64(start)+cnt >= int64(c.NumRegs) {
+				return bad("register r%d out of range, code has %d", int64(start)+cnt, c.NumRegs)
+			}
+
+			return nil
+		}
+
+		str := func(idx int) error {
+			if idx >= len(c.Strings) {
+				return bad("string %d out of range, code has %d", idx, len(c.Strings))
+			}
+
+			return nil
+		}
+
+		call := func(idx int) error {
+			if idx >= len(c.Calls) {
+				return bad("call %d out of range, code has %d", idx, len(c.Calls))
+			}
+
+			return nil
+		}
+
+		ref := func(idx int64) error {
+			if idx < 0 || idx >= int64(c.NumRefs) {
+				return bad("ref %d out of range, code has %d", idx, c.NumRefs)
+			}
+
+			return nil
+		}
+
+		var err error
+
+		switch i.Op() {
+		case insn.Noop:
+		case insn.Reset, insn.StoreInt, insn.StoreBool, insn.Self, insn.NewList,
+			insn.NewMap, insn.GetMirror, insn.Return:
+			err = regs(i.R0(), 0)
+		case insn.CopyReg, insn.ListAppend:
+			if err = regs(i.R0(), 0); err == nil {
+				err = regs(i.R1(), 0)
+			}
+		case insn.SetMap:
+			if err = regs(i.R0(), 0); err == nil {
+				err = regs(i.R1(), 1)
+			}
+		case insn.String, insn.GetScoped, insn.SetScoped, insn.GetIvar, insn.SetIvar:
+			if err = regs(i.R0(), 0); err == nil {
+				err = str(i.R1())
+			}
+		case insn.Call0:
+			if err = regs(i.R0(), 0); err == nil {
+				if err = regs(i.R1(), 0); err == nil {
+					err = call(i.R2())
+				}
+			}
+		case insn.CallN:
+			if err = regs(i.R0(), 0); err == nil {
+				if err = regs(i.R1(), i.Rest2()); err == nil {
+					err = call(i.R2())
+				}
+			}
+		case insn.CallKW:
+			if err = regs(i.R0(), 0); err == nil {
+				if err = regs(i.R1(), int64(i.R3())+i.Rest3()); err == nil {
+					if err = call(i.R2()); err == nil && int(i.Rest3()) != len(c.Calls[i.R2()].KWTable) {
+						err = bad("passes %d named arguments, call has %d", i.Rest3(), len(c.Calls[i.R2()].KWTable))
+					}
+				}
+			}
+		case insn.Invoke:
+			if err = regs(i.R0(), 0); err == nil {
+				err = regs(i.R1(), i.Rest1())
+			}
+		case insn.GIF, insn.Goto:
+			if i.Op() == insn.GIF {
+				err = regs(i.R0(), 0)
+			}
+
+			if err == nil && (i.Data() < 0 || i.Data() > int64(len(c.Instructions))) {
+				err = bad("jump to %d out of range, code has %d instructions", i.Data(), len(c.Instructions))
+			}
+		case insn.ReadRef:
+			if err = regs(i.R0(), 0); err == nil {
+				err = ref(i.Data())
+			}
+		case insn.StoreRef:
+			if err = ref(int64(i.R0())); err == nil {
+				err = regs(i.R1(), 0)
+			}
+		case insn.CreateLambda:
+			if err = regs(i.R0(), 0); err != nil {
+				break
+			}
+
+			sub := i.Rest2()
+
+			if sub < 0 || sub >= int64(len(c.SubCode)) {
+				err = bad("subcode %d out of range, code has %d", sub, len(c.SubCode))
+				break
+			}
+
+			if need := c.SubCode[sub].NumRefs; i.R2() < need {
+				err = bad("lambda is given %d refs, its code needs %d", i.R2(), need)
+				break
+			}
+
+			if ip+i.R2() >= len(c.Instructions) {
+				err = bad("lambda refs run past the end of the code")
+				break
+			}
+
+			for j := 1; j <= i.R2() && err == nil; j++ {
+				if c.Instructions[ip+j].Op() != insn.ReadRef {
+					err = bad("lambda ref %d isn't a readref", j-1)
+				}
+			}
+		default:
+			err = bad("unknown instruction")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range c.SubCode {
+		if err := sub.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type codeWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (cw *codeWriter) uvarint(v uint64) {
+	if cw.err != nil {
+		return
+	}
+
+	n := binary.PutUvarint(cw.buf[:], v)
+	_, cw.err = cw.w.Write(cw.buf[:n])
+}
+
+func (cw *codeWriter) varint(v int64) {
+	if cw.err != nil {
+		return
+	}
+
+	n := binary.PutVarint(cw.buf[:], v)
+	_, cw.err = cw.w.Write(cw.buf[:n])
+}
+
+func (cw *codeWriter) int(v int) {
+	cw.uvarint(uint64(v))
+}
+
+func (cw *codeWriter) string(s string) {
+	cw.int(len(s))
+
+	if cw.err != nil {
+		return
+	}
+
+	_, cw.err = cw.w.WriteString(s)
+}
+
+func (cw *codeWriter) strings(strs []string) {
+	cw.int(len(strs))
+
+	for _, s := range strs {
+		cw.string(s)
+	}
+}
+
+func (cw *codeWriter) code(c *Code) {
+	cw.string(c.Name)
+	cw.string(c.File)
+	cw.int(c.NumRefs)
+	cw.int(c.NumRegs)
+
+	cw.int(len(c.Instructions))
+
+	for _, i := range c.Instructions {
+		cw.varint(int64(i))
+	}
+
+	cw.int(len(c.Strings))
+
+	for _, s := range c.Strings {
+		cw.string(s.String)
+	}
+
+	cw.int(len(c.Calls))
+
+	for _, cs := range c.Calls {
+		cw.string(cs.Name)
+		cw.strings(cs.KWTable)
+	}
+
+	if c.Signature == nil {
+		cw.int(0)
+	} else {
+		cw.int(1)
+		cw.int(c.Signature.Required)
+		cw.strings(c.Signature.Args)
+	}
+
+	cw.int(len(c.Lines))
+
+	for _, l := range c.Lines {
+		cw.int(l.Start)
+		cw.int(l.Line)
+	}
+
+	cw.strings(c.LocalNames)
+	cw.strings(c.RefNames)
+
+	cw.int(len(c.SubCode))
+
+	for _, sub := range c.SubCode {
+		cw.code(sub)
+	}
+}
+
+// WriteCode serializes c, including all of its SubCode, to w.
+func WriteCode(w io.Writer, c *Code) error {
+	cw := &codeWriter{w: bufio.NewWriter(w)}
+
+	if _, err := cw.w.Write(codeMagic); err != nil {
+		return err
+	}
+
+	cw.int(CodeVersion)
+	cw.code(c)
+
+	if cw.err != nil {
+		return cw.err
+	}
+
+	return cw.w.Flush()
+}
+
+type codeReader struct {
+	env Env
+	r   *bufio.Reader
+	err error
+}
+
+func (cr *codeReader) uvarint() uint64 {
+	if cr.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		cr.err = err
+	}
+
+	return v
+}
+
+func (cr *codeReader) varint() int64 {
+	if cr.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadVarint(cr.r)
+	if err != nil {
+		cr.err = err
+	}
+
+	return v
+}
+
+// count reads a length prefix, rejecting values that could not possibly
+// fit in the remaining input so a corrupt file can't trigger a huge
+// allocation.
+func (cr *codeReader) count() int {
+	v := cr.uvarint()
+
+	if v > 1<<24 {
+		if cr.err == nil {
+			cr.err = ErrBadCodeFile
+		}
+
+		return 0
+	}
+
+	return int(v)
+}
+
+func (cr *codeReader) string() string {
+	sz := cr.count()
+
+	if cr.err != nil {
+		return ""
+	}
+
+	buf := make([]byte, sz)
+
+	_, cr.err = io.ReadFull(cr.r, buf)
+
+	return string(buf)
+}
+
+func (cr *codeReader) strings() []string {
+	sz := cr.count()
+
+	var strs []string
+
+	for i := 0; i < sz && cr.err == nil; i++ {
+		strs = append(strs, cr.string())
+	}
+
+	return strs
+}
+
+func (cr *codeReader) code() *Code {
+	c := &Code{
+		Name:    cr.string(),
+		File:    cr.string(),
+		NumRefs: cr.count(),
+		NumRegs: cr.count(),
+	}
+
+	sz := cr.count()
+
+	for i := 0; i < sz && cr.err == nil; i++ {
+		c.Instructions = append(c.Instructions, insn.Instruction(cr.varint()))
+	}
+
+	sz = cr.count()
+
+	for i := 0; i < sz && cr.err == nil; i++ {
+		c.Strings = append(c.Strings, cr.env.InternString(cr.string()))
+	}
+
+	sz = cr.count()
+
+	for i := 0; i < sz && cr.err == nil; i++ {
+		cs := &CallSite{Name: cr.string()}
+		cs.KWTable = cr.strings()
+
+		c.Calls = append(c.Calls, cs)
+	}
+
+	if cr.count() == 1 {
+		c.Signature = &Signature{
+			Required: cr.count(),
+			Args:     cr.strings(),
+		}
+	}
+
+	sz = cr.count()
+
+	for i := 0; i < sz && cr.err == nil; i++ {
+		c.Lines = append(c.Lines, LineEntry{
+			Start: cr.count(),
+			Line:  cr.count(),
+		})
+	}
+
+	c.LocalNames = cr.strings()
+	c.RefNames = cr.strings()
+
+	sz = cr.count()
+
+	for i := 0; i < sz && cr.err == nil; i++ {
+		c.SubCode = append(c.SubCode, cr.code())
+	}
+
+	return c
+}
+
+// ReadCode deserializes a Code written by WriteCode. Strings are interned
+// through env, just like the generator does. The code is validated, so
+// operands that are out of range are an error rather than a crash later.
+func ReadCode(env Env, r io.Reader) (*Code, error) {
+	cr := &codeReader{env: env, r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(codeMagic))
+
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != string(codeMagic) {
+		return nil, ErrBadCodeFile
+	}
+
+	ver := cr.count()
+	if cr.err != nil {
+		return nil, ErrBadCodeFile
+	}
+
+	if ver != CodeVersion {
+		return nil, &ErrCodeVersion{Got: ver}
+	}
+
+	c := cr.code()
+
+	if cr.err != nil {
+		if cr.err == io.EOF || cr.err == io.ErrUnexpectedEOF {
+			return nil, ErrBadCodeFile
+		}
+
+		return nil, cr.err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -0,0 +1,102 @@
+package value
+
+import "encoding/json"
+
+type signatureJSON struct {
+	Required int      `json:"required"`
+	Args     []string `json:"args"`
+}
+
+type callJSON struct {
+	Name    string   `json:"name"`
+	KWTable []string `json:"kw_table,omitempty"`
+}
+
+type instructionJSON struct {
+	Op   string `json:"op"`
+	Raw  int64  `json:"raw"`
+	Text string `json:"text"`
+	Line int    `json:"line,omitempty"`
+}
+
+type lineJSON struct {
+	Start int `json:"start"`
+	Line  int `json:"line"`
+}
+
+type codeJSON struct {
+	Name         string            `json:"name"`
+	File         string            `json:"file,omitempty"`
+	NumRefs      int               `json:"num_refs"`
+	NumRegs      int               `json:"num_regs"`
+	Signature    *signatureJSON    `json:"signature,omitempty"`
+	Strings      []string          `json:"strings"`
+	Calls        []callJSON        `json:"calls"`
+	Instructions []instructionJSON `json:"instructions"`
+	Lines        []lineJSON        `json:"lines"`
+	LocalNames   []string          `json:"local_names"`
+	RefNames     []string          `json:"ref_names"`
+	SubCode      []*Code           `json:"subcode"`
+}
+
+// MarshalJSON describes c for tools outside of m13. Instructions carry
+// their encoded form alongside the text Disassemble prints for them, and
+// the source line they came from.
+func (c *Code) MarshalJSON() ([]byte, error) {
+	cj := codeJSON{
+		Name:         c.Name,
+		File:         c.File,
+		NumRefs:      c.NumRefs,
+		NumRegs:      c.NumRegs,
+		Strings:      []string{},
+		Calls:        []callJSON{},
+		Instructions: []instructionJSON{},
+		Lines:        []lineJSON{},
+		LocalNames:   c.LocalNames,
+		RefNames:     c.RefNames,
+		SubCode:      c.SubCode,
+	}
+
+	if cj.LocalNames == nil {
+		cj.LocalNames = []string{}
+	}
+
+	if cj.RefNames == nil {
+		cj.RefNames = []string{}
+	}
+
+	if cj.SubCode == nil {
+		cj.SubCode = []*Code{}
+	}
+
+	if sig := c.Signature; sig != nil {
+		cj.Signature = &signatureJSON{Required: sig.Required, Args: sig.Args}
+
+		if cj.Signature.Args == nil {
+			cj.Signature.Args = []string{}
+		}
+	}
+
+	for _, ent := range c.Lines {
+		cj.Lines = append(cj.Lines, lineJSON{Start: ent.Start, Line: ent.Line})
+	}
+
+	for _, s := range c.Strings {
+		cj.Strings = append(cj.Strings, s.String)
+	}
+
+	for _, cs := range c.Calls {
+		cj.Calls = append(cj.Calls, callJSON{Name: cs.Name, KWTable: cs.KWTable})
+	}
+
+	for ip, i := range c.Instructions {
+		cj.Instructions = append(cj.Instructions, instructionJSON{
+			Op:   i.Op().String(),
+			Raw:  int64(i),
+			Text: c.FormatInstruction(i),
+			Line: c.LineFor(ip),
+		})
+	}
+
+	return json.Marshal(&cj)
+}
@@ -14,3 +14,9 @@ func Compare(v1, v2 Value) bool {
 
 	return false
 }
+
+// Equal reports whether v1 and v2 are the same value, or are integers or
+// strings that Compare considers equal.
+func Equal(v1, v2 Value) bool {
+	return v1 == v2 || Compare(v1, v2)
+}
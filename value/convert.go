@@ -0,0 +1,466 @@
+package value
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// GoObject wraps a pointer to a Go struct whose type has been bound to a
+// class with Registry.BindGoType.
+type GoObject struct {
+	Object
+
+	Value interface{}
+}
+
+// ErrOverflow is returned when converting an integer to or from Go and it
+// doesn't fit in the type it's converted to.
+type ErrOverflow struct {
+	Value string
+	Type  string
+}
+
+func (e *ErrOverflow) Error() string {
+	return fmt.Sprintf("%s overflows %s", e.Value, e.Type)
+}
+
+var (
+	valueType = reflect.TypeOf((*Value)(nil)).Elem()
+	anyType   = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// BindGoType makes pointers to the struct type t convert to and from
+// instances of cls.
+func (r *Registry) BindGoType(t reflect.Type, cls *Class) {
+	r.goTypes[t] = cls
+}
+
+func (r *Registry) GoClass(t reflect.Type) (*Class, bool) {
+	cls, ok := r.goTypes[t]
+	return cls, ok
+}
+
+// WrapGo returns a GoObject for ptr, a pointer to a struct of a bound type.
+func WrapGo(env Env, ptr interface{}) (Value, error) {
+	cls, ok := env.Registry().GoClass(reflect.TypeOf(ptr))
+	if !ok {
+		return nil, fmt.Errorf("%T is not bound to a class", ptr)
+	}
+
+	obj := &GoObject{Value: ptr}
+	obj.SetClass(cls)
+
+	return obj, nil
+}
+
+// ToGo converts v into plain Go data. I64 becomes int64, String becomes
+// string, true and false become bool, nil becomes nil, List becomes
+// []interface{} and Map becomes map[string]interface{}. A GoObject gives
+// back the pointer it wraps and any other value is returned as is.
+func ToGo(env Env, v Value) (interface{}, error) {
+	rv, err := ConvertTo(env, v, anyType)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv.Interface(), nil
+}
+
+// FromGo converts the Go value x into an m13 value. Structs become Maps
+// keyed by field name, which an `m13:"name"` tag overrides and `m13:"-"`
+// omits, unless they are bound to a class with BindGoType.
+func FromGo(env Env, x interface{}) (Value, error) {
+	return fromGo(env, reflect.ValueOf(x))
+}
+
+// ConvertTo converts v into a Go value of type t, following the rules of
+// ToGo and FromGo in reverse.
+func ConvertTo(env Env, v Value, t reflect.Type) (reflect.Value, error) {
+	if v == nil {
+		v = env.Nil()
+	}
+
+	rv := reflect.New(t).Elem()
+
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		x, err := toAny(env, v)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		if x != nil {
+			rv.Set(reflect.ValueOf(x))
+		}
+
+		return rv, nil
+	}
+
+	if reflect.TypeOf(v).AssignableTo(t) {
+		rv.Set(reflect.ValueOf(v))
+		return rv, nil
+	}
+
+	if obj, ok := v.(*GoObject); ok && reflect.TypeOf(obj.Value).AssignableTo(t) {
+		rv.Set(reflect.ValueOf(obj.Value))
+		return rv, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := v.(I64)
+		if !ok {
+			return typeError(env, v, "builtin.I64")
+		}
+
+		if rv.OverflowInt(int64(i)) {
+			return reflect.Value{}, &ErrOverflow{Value: fmt.Sprint(int64(i)), Type: t.String()}
+		}
+
+		rv.SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, ok := v.(I64)
+		if !ok {
+			return typeError(env, v, "builtin.I64")
+		}
+
+		if i < 0 || rv.OverflowUint(uint64(i)) {
+			return reflect.Value{}, &ErrOverflow{Value: fmt.Sprint(int64(i)), Type: t.String()}
+		}
+
+		rv.SetUint(uint64(i))
+	case reflect.String:
+		str, ok := v.(*String)
+		if !ok {
+			return typeError(env, v, "builtin.String")
+		}
+
+		rv.SetString(str.String)
+	case reflect.Bool:
+		b, ok := toBool(env, v)
+		if !ok {
+			return typeError(env, v, "builtin.Bool")
+		}
+
+		rv.SetBool(b)
+	case reflect.Slice:
+		if v == env.Nil() {
+			return rv, nil
+		}
+
+		list, ok := v.(*List)
+		if !ok {
+			return typeError(env, v, "builtin.List")
+		}
+
+		rv.Set(reflect.MakeSlice(t, list.Len(), list.Len()))
+
+		for i, elem := range list.data {
+			ev, err := ConvertTo(env, elem, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+
+			rv.Index(i).Set(ev)
+		}
+	case reflect.Map:
+		if v == env.Nil() {
+			return rv, nil
+		}
+
+		m, ok := v.(*Map)
+		if !ok || t.Key().Kind() != reflect.String {
+			return typeError(env, v, "builtin.Map")
+		}
+
+		rv.Set(reflect.MakeMapWithSize(t, m.Len()))
+
+		err := eachString(env, m, func(k string, elem Value) error {
+			ev, err := ConvertTo(env, elem, t.Elem())
+			if err != nil {
+				return err
+			}
+
+			rv.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), ev)
+
+			return nil
+		})
+		if err != nil {
+			return reflect.Value{}, err
+		}
+	case reflect.Struct:
+		m, ok := v.(*Map)
+		if !ok {
+			return typeError(env, v, "builtin.Map")
+		}
+
+		fields := structFields(t)
+
+		err := eachString(env, m, func(k string, elem Value) error {
+			idx, ok := fields[k]
+			if !ok {
+				return nil
+			}
+
+			ev, err := ConvertTo(env, elem, t.Field(idx).Type)
+			if err != nil {
+				return err
+			}
+
+			rv.Field(idx).Set(ev)
+
+			return nil
+		})
+		if err != nil {
+			return reflect.Value{}, err
+		}
+	case reflect.Ptr:
+		if v == env.Nil() {
+			return rv, nil
+		}
+
+		if cls, ok := env.Registry().GoClass(t); ok {
+			return typeError(env, v, cls.GlobalName)
+		}
+
+		ev, err := ConvertTo(env, v, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		rv.Set(reflect.New(t.Elem()))
+		rv.Elem().Set(ev)
+	default:
+		return reflect.Value{}, fmt.Errorf("unable to convert to %s", t)
+	}
+
+	return rv, nil
+}
+
+func typeError(env Env, v Value, expected string) (reflect.Value, error) {
+	_, err := env.TypeError(v, expected)
+	return reflect.Value{}, err
+}
+
+func toBool(env Env, v Value) (bool, bool) {
+	switch v {
+	case env.True():
+		return true, true
+	case env.False():
+		return false, true
+	}
+
+	b, ok := v.(Bool)
+
+	return bool(b), ok
+}
+
+func toAny(env Env, v Value) (interface{}, error) {
+	if v == env.Nil() {
+		return nil, nil
+	}
+
+	if b, ok := toBool(env, v); ok {
+		return b, nil
+	}
+
+	switch sv := v.(type) {
+	case I64:
+		return int64(sv), nil
+	case *String:
+		return sv.String, nil
+	case *GoObject:
+		return sv.Value, nil
+	case *List:
+		out := make([]interface{}, len(sv.data))
+
+		for i, elem := range sv.data {
+			x, err := toAny(env, elem)
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = x
+		}
+
+		return out, nil
+	case *Map:
+		out := make(map[string]interface{}, sv.Len())
+
+		err := eachString(env, sv, func(k string, elem Value) error {
+			x, err := toAny(env, elem)
+			if err != nil {
+				return err
+			}
+
+			out[k] = x
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return out, nil
+	}
+
+	return v, nil
+}
+
+// eachString calls f with every entry of m, which must only have String
+// keys.
+func eachString(env Env, m *Map, f func(k string, v Value) error) error {
+	var err error
+
+	m.Each(func(k, v Value) {
+		if err != nil {
+			return
+		}
+
+		str, ok := k.(*String)
+		if !ok {
+			_, err = typeError(env, k, "builtin.String")
+			return
+		}
+
+		err = f(str.String, v)
+	})
+
+	return err
+}
+
+// fieldName returns the map key used for a struct field, or "" if the
+// field is skipped.
+func fieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+
+	tag := f.Tag.Get("m13")
+	if idx := strings.IndexByte(tag, ','); idx != -1 {
+		tag = tag[:idx]
+	}
+
+	switch tag {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	default:
+		return tag
+	}
+}
+
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+
+	for i := 0; i < t.NumField(); i++ {
+		if name := fieldName(t.Field(i)); name != "" {
+			fields[name] = i
+		}
+	}
+
+	return fields
+}
+
+func fromGo(env Env, rv reflect.Value) (Value, error) {
+	if !rv.IsValid() {
+		return env.Nil(), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map:
+		if rv.IsNil() {
+			return env.Nil(), nil
+		}
+	}
+
+	if rv.Type().Implements(valueType) {
+		return rv.Interface().(Value), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return I64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, &ErrOverflow{Value: fmt.Sprint(rv.Uint()), Type: "builtin.I64"}
+		}
+
+		return I64(rv.Uint()), nil
+	case reflect.String:
+		return env.NewString(rv.String()), nil
+	case reflect.Bool:
+		if rv.Bool() {
+			return env.True(), nil
+		}
+
+		return env.False(), nil
+	case reflect.Slice, reflect.Array:
+		list := NewList(env, rv.Len())
+
+		for i := 0; i < rv.Len(); i++ {
+			elem, err := fromGo(env, rv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+
+			list.Append(elem)
+		}
+
+		return list, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+
+		m := NewMap(env)
+
+		for _, key := range rv.MapKeys() {
+			elem, err := fromGo(env, rv.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+
+			m.Set(env.NewString(key.String()), elem)
+		}
+
+		return m, nil
+	case reflect.Interface:
+		return fromGo(env, rv.Elem())
+	case reflect.Ptr:
+		if _, ok := env.Registry().GoClass(rv.Type()); ok {
+			return WrapGo(env, rv.Interface())
+		}
+
+		return fromGo(env, rv.Elem())
+	case reflect.Struct:
+		if _, ok := env.Registry().GoClass(reflect.PtrTo(rv.Type())); ok {
+			ptr := reflect.New(rv.Type())
+			ptr.Elem().Set(rv)
+
+			return WrapGo(env, ptr.Interface())
+		}
+
+		m := NewMap(env)
+
+		for i := 0; i < rv.NumField(); i++ {
+			name := fieldName(rv.Type().Field(i))
+			if name == "" {
+				continue
+			}
+
+			elem, err := fromGo(env, rv.Field(i))
+			if err != nil {
+				return nil, err
+			}
+
+			m.Set(env.NewString(name), elem)
+		}
+
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("unable to convert %s to an m13 value", rv.Type())
+}
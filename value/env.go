@@ -6,6 +6,7 @@ type Env interface {
 	Nil() Value
 	True() Value
 	False() Value
+	Registry() *Registry
 	MustFindClass(name string) *Class
 	ArgumentError(expected, received int) (Value, error)
 	TypeError(value Value, expected string) (Value, error)
@@ -24,6 +25,21 @@ type Env interface {
 	InvokeLambda(ctx context.Context, lamb *Lambda, args []Value) (Value, error)
 }
 
+// SizeChecker is implemented by an Env that bounds how big strings, lists
+// and maps may grow.
+type SizeChecker interface {
+	// CheckSize returns an error if a what may not grow to size.
+	CheckSize(what string, size int) error
+}
+
+func checkSize(env Env, what string, size int) error {
+	if sc, ok := env.(SizeChecker); ok {
+		return sc.CheckSize(what, size)
+	}
+
+	return nil
+}
+
 type ExecuteContext struct {
 	Env  Env
 	Code *Code
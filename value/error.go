@@ -0,0 +1,102 @@
+package value
+
+import (
+	"context"
+	"errors"
+)
+
+// Exception is what m13 code rescues when an error wasn't raised by m13
+// code itself, such as calling a method that doesn't exist.
+type Exception struct {
+	Object
+	Err error
+}
+
+func (e *Exception) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Exception) Unwrap() error {
+	return e.Err
+}
+
+// Raised is the error returned when m13 code raises a value.
+type Raised struct {
+	Value   Value
+	Message string
+}
+
+func (r *Raised) Error() string {
+	return r.Message
+}
+
+// Unrescuable is implemented by errors that m13 code must not be able to
+// rescue, such as a resource limit being exceeded.
+type Unrescuable interface {
+	Unrescuable() bool
+}
+
+func rescuable(err error) bool {
+	var ur Unrescuable
+
+	if errors.As(err, &ur) && ur.Unrescuable() {
+		return false
+	}
+
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// Raise returns the error that raises val. Strings become the message,
+// other values are described by their message method if they have one.
+func Raise(ctx context.Context, env Env, val Value) error {
+	switch v := val.(type) {
+	case *Exception:
+		return v
+	case *String:
+		return &Raised{Value: val, Message: v.String}
+	}
+
+	if m, ok := val.Class(env).LookupMethod("message"); ok && m.Signature.Required == 0 {
+		msg, err := m.Func(ctx, env, val, nil)
+		if err != nil {
+			return err
+		}
+
+		if s, ok := msg.(*String); ok {
+			return &Raised{Value: val, Message: s.String}
+		}
+	}
+
+	return &Raised{Value: val, Message: "raised " + Inspect(env, val)}
+}
+
+// Rescue returns the value m13 code sees for err: the value that was
+// raised, or an Exception wrapping err.
+func Rescue(env Env, err error) Value {
+	var (
+		raised *Raised
+		exc    *Exception
+	)
+
+	if errors.As(err, &raised) {
+		return raised.Value
+	}
+
+	if errors.As(err, &exc) {
+		return exc
+	}
+
+	exc = &Exception{Err: err}
+	exc.SetClass(env.Registry().Error)
+
+	return exc
+}
+
+func initError(pkg *Package, cls *Class) {
+	cls.AddMethod(&MethodDescriptor{
+		Name: "message",
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			return env.NewString(recv.(*Exception).Error()), nil
+		},
+	})
+}
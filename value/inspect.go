@@ -1,6 +1,9 @@
 package value
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
 func Inspect(env Env, val Value) string {
 	if val == nil {
@@ -10,7 +13,24 @@ func Inspect(env Env, val Value) string {
 	switch sv := val.(type) {
 	case *String:
 		return fmt.Sprintf(`"%s"`, sv.String)
-	default:
-		return fmt.Sprintf("<%s:%p>", val.Class(env).GlobalName, val)
+	case I64:
+		return strconv.FormatInt(int64(sv), 10)
+	case *Class:
+		return sv.GlobalName
+	case *Package:
+		return "package " + sv.Name
+	case *Exception:
+		return fmt.Sprintf("<%s: %s>", sv.Class(env).GlobalName, sv.Error())
 	}
+
+	switch val {
+	case env.Nil():
+		return "nil"
+	case env.True():
+		return "true"
+	case env.False():
+		return "false"
+	}
+
+	return fmt.Sprintf("<%s:%p>", val.Class(env).GlobalName, val)
 }
@@ -1,5 +1,7 @@
 package value
 
+import "context"
+
 type Ref struct {
 	Value Value
 }
@@ -33,3 +35,41 @@ func (l *Lambda) RedirectSelf(recv Value) *Lambda {
 
 	return &dup
 }
+
+func initLambda(pkg *Package, cls *Class) {
+	cls.AddMethod(&MethodDescriptor{
+		Name: "rescue",
+		Signature: Signature{
+			Required: 1,
+			Args:     []string{"handler"},
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			handler, ok := args[0].(*Lambda)
+			if !ok {
+				return env.TypeError(args[0], "builtin.Lambda")
+			}
+
+			val, err := env.InvokeLambda(ctx, recv.(*Lambda), nil)
+			if err == nil || !rescuable(err) {
+				return val, err
+			}
+
+			return env.InvokeLambda(ctx, handler, []Value{Rescue(env, err)})
+		},
+	})
+	cls.AddMethod(&MethodDescriptor{
+		Name: "apply",
+		Signature: Signature{
+			Required: 1,
+			Args:     []string{"args"},
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			list, ok := args[0].(*List)
+			if !ok {
+				return env.TypeError(args[0], "builtin.List")
+			}
+
+			return env.InvokeLambda(ctx, recv.(*Lambda), list.Values())
+		},
+	})
+}
@@ -1,5 +1,7 @@
 package value
 
+import "context"
+
 func NewList(env Env, cap int) *List {
 	list := &List{}
 	list.SetClass(env.ListClass())
@@ -12,3 +14,39 @@ func NewList(env Env, cap int) *List {
 func (list *List) Append(v Value) {
 	list.data = append(list.data, v)
 }
+
+func (list *List) Len() int {
+	return len(list.data)
+}
+
+func (list *List) At(i int) Value {
+	return list.data[i]
+}
+
+// Values returns a copy of the elements of the list.
+func (list *List) Values() []Value {
+	return append([]Value(nil), list.data...)
+}
+
+func (list *List) Set(i int, v Value) {
+	list.data[i] = v
+}
+
+func initListQueries(pkg *Package, cls *Class) {
+	cls.AddMethod(&MethodDescriptor{
+		Name: "include",
+		Signature: Signature{
+			Required: 1,
+			Args:     []string{"value"},
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			for _, v := range recv.(*List).data {
+				if Equal(v, args[0]) {
+					return env.True(), nil
+				}
+			}
+
+			return env.False(), nil
+		},
+	})
+}
@@ -14,6 +14,10 @@ func methListappend_op(ctx context.Context, env Env, recv Value, args []Value) (
 	v := args[0].(Value)
 
 	{
+		if err := checkSize(env, "list", len(self.data)+1); err != nil {
+			return nil, err
+		}
+
 		self.data = append(self.data, v)
 		return self, nil
 	}
@@ -226,6 +226,8 @@ func String_add_adapter(ctx context.Context, env Env, recv Value, args []Value)
 
 	ret, err := self.add(
 
+		env,
+
 		a0,
 	)
 
@@ -154,15 +154,14 @@ func (m *Map) Set(k, v Value) {
 		return
 	}
 
-	// Grow the table.
-	n := m.entries.used * 2
-
+	// Grow the table. The size has to stay a power of 2 for the index mask
+	// to work.
 	newTable := &mapEntries{
-		entries: make([]*mapEntry, n),
+		entries: make([]*mapEntry, len(m.entries.entries)*2),
 	}
 
 	for _, old := range m.entries.entries {
-		if old == nil {
+		if old == nil || old == deletedEntry {
 			continue
 		}
 
@@ -170,6 +169,7 @@ func (m *Map) Set(k, v Value) {
 	}
 
 	newTable.add(&mapEntry{h, k, v})
+	newTable.used = newTable.fill
 
 	m.entries = newTable
 }
@@ -186,3 +186,29 @@ func (m *Map) Del(k Value) (Value, bool) {
 
 	return nil, false
 }
+
+func (m *Map) Len() int {
+	return m.entries.used
+}
+
+// Keys returns the keys of the map, in no particular order.
+func (m *Map) Keys() []Value {
+	var keys []Value
+
+	m.Each(func(k, v Value) {
+		keys = append(keys, k)
+	})
+
+	return keys
+}
+
+// Each calls f with every key and value in the map.
+func (m *Map) Each(f func(k, v Value)) {
+	for _, ent := range m.entries.entries {
+		if ent == nil || ent == deletedEntry {
+			continue
+		}
+
+		f(ent.key, ent.value)
+	}
+}
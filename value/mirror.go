@@ -28,10 +28,51 @@ func initObjectMirror(cls *Class) {
 	cls.AddMethod(&MethodDescriptor{
 		Name: "inspect",
 		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
-			om := recv.(*ObjectMirror)
-			return env.NewString(Inspect(env, om.Val)), nil
+			return env.NewString(Inspect(env, mirrored(recv))), nil
 		},
 	})
+
+	cls.AddMethod(&MethodDescriptor{
+		Name: "is_a",
+		Signature: Signature{
+			Required: 1,
+			Args:     []string{"class"},
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			target, ok := args[0].(*Class)
+			if !ok {
+				return env.TypeError(args[0], "builtin.Class")
+			}
+
+			if ISA(env, mirrored(recv), target) {
+				return env.True(), nil
+			}
+
+			return env.False(), nil
+		},
+	})
+
+	cls.AddMethod(&MethodDescriptor{
+		Name: "raise",
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			return nil, Raise(ctx, env, mirrored(recv))
+		},
+	})
+}
+
+// mirrored returns the value the mirror recv reflects. Class and package
+// mirrors inherit the methods of object mirrors, so it may be any of them.
+func mirrored(recv Value) Value {
+	switch m := recv.(type) {
+	case *ObjectMirror:
+		return m.Val
+	case *ClassMirror:
+		return m.cls
+	case *PackageMirror:
+		return m.p
+	default:
+		return recv
+	}
 }
 
 func initFinalObjectMirror(cls *Class) {
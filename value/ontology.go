@@ -53,6 +53,8 @@ func (c *Class) Metaclass(env Env) *Class {
 		mcCls.Parent = super.Metaclass(env)
 	}
 
+	bumpMethodSerial()
+
 	return mcCls
 }
 
@@ -94,12 +96,17 @@ func (r *Registry) Boot() error {
 
 	r.IO = r.NewClass(pkg, "IO", obj)
 
+	r.Error = r.NewClass(pkg, "Error", obj)
+
 	initClass(pkg, r.Class)
 	initList(pkg, r.List)
+	initListQueries(pkg, r.List)
 	initIO(pkg, r.IO)
 	initString(pkg, r.String)
 	initI64(pkg, r.I64Class)
 	initMap(pkg, r.Map)
+	initLambda(pkg, r.Lambda)
+	initError(pkg, r.Error)
 
 	initObjectMirror(r.Mirror)
 	initPackageMirror(pkg, pm)
@@ -36,9 +36,11 @@ func (m *PackageMirror) AddMethod(env Env, name *String, l *Lambda) (Value, erro
 			return env.ExecuteContext(ctx, ExecuteContext{
 				Code: l.Code,
 				Refs: l.Refs,
+				Self: recv,
 				Args: args,
 			})
 		},
+		Package: l.Code.Package,
 	})
 
 	return nil, nil
@@ -73,6 +75,23 @@ func initPackageMirror(r *Package, cls *Class) {
 		},
 	})
 
+	cls.AddMethod(&MethodDescriptor{
+		Name: "make_private",
+		Signature: Signature{
+			Required: 1,
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			pm := recv.(*PackageMirror)
+			name := args[0].(*String)
+
+			if !pm.p.Class(env).MakePrivate(name.String) {
+				return nil, fmt.Errorf("unknown method '%s' in package '%s'", name.String, pm.p.Name)
+			}
+
+			return name, nil
+		},
+	})
+
 	cls.AddMethod(&MethodDescriptor{
 		Name: "add_class",
 		Signature: Signature{
@@ -96,6 +115,7 @@ func initPackageMirror(r *Package, cls *Class) {
 				Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
 					return nc, nil
 				},
+				Package: lamb.Code.Package,
 			})
 
 			return nc, nil
@@ -1,6 +1,9 @@
 package value
 
-import "context"
+import (
+	"context"
+	"fmt"
+)
 
 type scopedVariable struct {
 	name string
@@ -18,3 +21,39 @@ func GetScoped(ctx context.Context, name string) (Value, bool) {
 func SetScoped(ctx context.Context, name string, val Value) context.Context {
 	return context.WithValue(ctx, scopedVariable{name}, val)
 }
+
+type scopeFilter struct{}
+
+// RestrictScoped returns a context in which only the scoped variables
+// named in allowed can be read. Reading any other one fails with ErrDenied.
+func RestrictScoped(ctx context.Context, allowed []string) context.Context {
+	set := make(map[string]bool)
+
+	for _, name := range allowed {
+		set[name] = true
+	}
+
+	return context.WithValue(ctx, scopeFilter{}, set)
+}
+
+// ScopedAllowed reports whether the scoped variable name may be read in
+// ctx.
+func ScopedAllowed(ctx context.Context, name string) bool {
+	set, ok := ctx.Value(scopeFilter{}).(map[string]bool)
+	if !ok {
+		return true
+	}
+
+	return set[name]
+}
+
+// ErrDenied is returned when sandboxed code reaches for something it
+// hasn't been given access to.
+type ErrDenied struct {
+	Kind string
+	Name string
+}
+
+func (e *ErrDenied) Error() string {
+	return fmt.Sprintf("sandbox: access to %s '%s' is denied", e.Kind, e.Name)
+}
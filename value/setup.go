@@ -2,6 +2,7 @@ package value
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 )
 
@@ -24,6 +25,7 @@ func RegisterSetup(f setupFunc) error {
 type Registry struct {
 	packages PackageRegistry
 	types    map[string]*Class
+	goTypes  map[reflect.Type]*Class
 
 	NilClass  *Class
 	Object    *Class
@@ -37,14 +39,17 @@ type Registry struct {
 	List      *Class
 	IO        *Class
 	Map       *Class
+	Error     *Class
 }
 
 func NewRegistry() *Registry {
 	r := &Registry{
 		packages: PackageRegistry{
 			Packages: make(map[string]*Package),
+			Loaded:   make(map[string]*Package),
 		},
-		types: make(map[string]*Class),
+		types:   make(map[string]*Class),
+		goTypes: make(map[reflect.Type]*Class),
 	}
 
 	err := r.Boot()
@@ -77,6 +82,32 @@ func (r *Registry) MustFindClass(name string) *Class {
 	return cls
 }
 
+func (r *Registry) FindPackage(name string) (*Package, bool) {
+	pkg, ok := r.packages.Packages[name]
+	return pkg, ok
+}
+
+// LoadedPackage returns the package loaded from path, which should be
+// absolute so that every way of referring to it finds the same package.
+func (r *Registry) LoadedPackage(path string) (*Package, bool) {
+	pkg, ok := r.packages.Loaded[path]
+	return pkg, ok
+}
+
+func (r *Registry) AddLoadedPackage(path string, pkg *Package) {
+	if _, ok := r.packages.Loaded[path]; !ok {
+		r.packages.LoadOrder = append(r.packages.LoadOrder, path)
+	}
+
+	r.packages.Loaded[path] = pkg
+}
+
+// LoadedPaths returns the paths of the loaded packages in the order they
+// were loaded.
+func (r *Registry) LoadedPaths() []string {
+	return r.packages.LoadOrder
+}
+
 func (r *Registry) OpenPackage(name string) *Package {
 	if pkg, ok := r.packages.Packages[name]; ok {
 		return pkg
@@ -133,8 +164,8 @@ func (r *Registry) ResolveClass(path string) (*Class, error) {
 		cls = path[dot+1:]
 	}
 
-	if pkg, ok := r.packages.Packages[pkg]; ok {
-		if obj, ok := pkg.Classes[cls]; ok {
+	if p, ok := r.packages.Packages[pkg]; ok {
+		if obj, ok := p.Classes[cls]; ok {
 			return obj, nil
 		} else {
 			return nil, fmt.Errorf("Unable to resolve class: %s", path)
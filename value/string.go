@@ -3,6 +3,8 @@ package value
 import (
 	"context"
 	"hash/fnv"
+	"regexp"
+	"strings"
 	"sync"
 )
 
@@ -44,7 +46,11 @@ func (s *String) Hash() uint64 {
 }
 
 // m13 name=+
-func (s *String) add(o *String) (*String, error) {
+func (s *String) add(env Env, o *String) (*String, error) {
+	if err := checkSize(env, "string", len(s.String)+len(o.String)); err != nil {
+		return nil, err
+	}
+
 	var ret String = *s
 
 	ret.String += o.String
@@ -76,4 +82,52 @@ func initString(r *Package, cls *Class) {
 			return env.False(), nil
 		},
 	})
+
+	cls.AddMethod(&MethodDescriptor{
+		Name: "include",
+		Signature: Signature{
+			Required: 1,
+			Args:     []string{"substring"},
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			sub, ok := args[0].(*String)
+			if !ok {
+				return env.TypeError(args[0], "builtin.String")
+			}
+
+			if strings.Contains(recv.(*String).String, sub.String) {
+				return env.True(), nil
+			}
+
+			return env.False(), nil
+		},
+	})
+
+	cls.AddMethod(&MethodDescriptor{
+		Name: "match",
+		Signature: Signature{
+			Required: 1,
+			Args:     []string{"pattern"},
+		},
+		Func: func(ctx context.Context, env Env, recv Value, args []Value) (Value, error) {
+			pat, ok := args[0].(*String)
+			if !ok {
+				return env.TypeError(args[0], "builtin.String")
+			}
+
+			re, err := regexp.Compile(pat.String)
+			if err != nil {
+				return nil, err
+			}
+
+			str := recv.(*String).String
+
+			loc := re.FindStringIndex(str)
+			if loc == nil {
+				return env.Nil(), nil
+			}
+
+			return env.NewString(str[loc[0]:loc[1]]), nil
+		},
+	})
 }
@@ -7,6 +7,10 @@ import (
 
 type PackageRegistry struct {
 	Packages map[string]*Package
+
+	// Loaded holds the packages loaded from source, keyed by path.
+	Loaded    map[string]*Package
+	LoadOrder []string
 }
 
 type ClassConfig struct {
@@ -49,6 +53,11 @@ type Method struct {
 	Signature Signature
 	Object    interface{}
 	Func      func(ctx context.Context, env Env, recv Value, args []Value) (Value, error)
+
+	// Package identifies the package whose code defined the method, and
+	// Private methods may only be called by code in that package.
+	Private bool
+	Package string
 }
 
 type MethodDescriptor struct {
@@ -57,4 +66,5 @@ type MethodDescriptor struct {
 	Signature Signature
 	Object    interface{}
 	Func      func(ctx context.Context, env Env, recv Value, args []Value) (Value, error)
+	Package   string
 }
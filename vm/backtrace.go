@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/evanphx/m13/value"
+)
+
+// Location is one frame an error unwound through.
+type Location struct {
+	File string
+	Name string
+	Line int
+}
+
+func (l Location) String() string {
+	name := l.Name
+	if name == "" {
+		name = "<lambda>"
+	}
+
+	if l.File == "" {
+		return fmt.Sprintf("%s (line %d)", name, l.Line)
+	}
+
+	return fmt.Sprintf("%s (%s:%d)", name, l.File, l.Line)
+}
+
+// unwind records that err left the frame running code at ip. Frames are
+// recorded innermost first; a new error starts a new backtrace.
+func (vm *VM) unwind(err error, code *value.Code, ip int) {
+	if vm.unwinding == nil || !errors.Is(err, vm.unwinding) {
+		vm.unwinding = err
+		vm.backtrace = nil
+	}
+
+	if ip < 0 {
+		ip = 0
+	}
+
+	vm.backtrace = append(vm.backtrace, Location{
+		File: code.File,
+		Name: code.Name,
+		Line: code.LineFor(ip),
+	})
+}
+
+// Backtrace returns the frames err unwound through, innermost first, or
+// nil if err didn't come out of m13 code run by vm.
+func (vm *VM) Backtrace(err error) []Location {
+	if vm.unwinding == nil || !errors.Is(err, vm.unwinding) {
+		return nil
+	}
+
+	return vm.backtrace
+}
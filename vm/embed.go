@@ -0,0 +1,328 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/evanphx/m13/value"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+func splitPath(path string) (string, string, error) {
+	dot := strings.LastIndexByte(path, '.')
+	if dot <= 0 || dot == len(path)-1 {
+		return "", "", fmt.Errorf("invalid path, expected pkg.Name: %s", path)
+	}
+
+	return path[:dot], path[dot+1:], nil
+}
+
+// goName converts a Go identifier into the snake_case used for m13
+// methods, so AddItem becomes add_item and HTTPServer becomes http_server.
+func goName(name string) string {
+	var (
+		rs  = []rune(name)
+		out []rune
+	)
+
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				prev := rs[i-1]
+				next := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && next) {
+					out = append(out, '_')
+				}
+			}
+
+			r = unicode.ToLower(r)
+		}
+
+		out = append(out, r)
+	}
+
+	return string(out)
+}
+
+// Define makes the Go function fn callable from m13 as path, for instance
+// "http.get". Arguments and results are converted between m13 and Go
+// values. A leading context.Context parameter receives the calling context
+// and a trailing error result is returned as the call's error.
+func (vm *VM) Define(path string, fn interface{}) error {
+	pkgName, name, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func {
+		return fmt.Errorf("unable to define %s, %T is not a function", path, fn)
+	}
+
+	gf, err := newGoFunc(path, rv, false)
+	if err != nil {
+		return err
+	}
+
+	pkg := vm.registry.OpenPackage(pkgName)
+	pkg.Class(vm).AddMethod(gf.descriptor(vm, name))
+
+	return nil
+}
+
+// DefineClass registers the Go struct type of proto, a struct or a
+// pointer to one, as the m13 class path. Calling new on the class creates a
+// zero value of the struct. The exported methods of the struct pointer
+// become methods and every exported field gets a reader and a writer, all
+// named in snake_case.
+func (vm *VM) DefineClass(path string, proto interface{}) (*value.Class, error) {
+	pkgName, name, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := reflect.TypeOf(proto)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("unable to define %s, %T is not a struct", path, proto)
+	}
+
+	ptr := reflect.PtrTo(typ)
+
+	if _, ok := vm.registry.GoClass(ptr); ok {
+		return nil, fmt.Errorf("%s is already defined", typ)
+	}
+
+	pkg := vm.registry.OpenPackage(pkgName)
+	cls := vm.registry.NewClass(pkg, name, vm.registry.Object)
+
+	vm.registry.BindGoType(ptr, cls)
+
+	cls.Metaclass(vm).AddMethod(&value.MethodDescriptor{
+		Name: "new",
+		Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+			return value.WrapGo(env, reflect.New(typ).Interface())
+		},
+	})
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" || field.Anonymous {
+			continue
+		}
+
+		cls.AddMethod(vm.fieldReader(field))
+		cls.AddMethod(vm.fieldWriter(field))
+	}
+
+	for i := 0; i < ptr.NumMethod(); i++ {
+		meth := ptr.Method(i)
+
+		gf, err := newGoFunc(path+"."+meth.Name, meth.Func, true)
+		if err != nil {
+			return nil, err
+		}
+
+		cls.AddMethod(gf.descriptor(vm, goName(meth.Name)))
+	}
+
+	pkg.Class(vm).AddMethod(&value.MethodDescriptor{
+		Name: name,
+		Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+			return cls, nil
+		},
+	})
+
+	return cls, nil
+}
+
+func goStruct(recv value.Value) (reflect.Value, error) {
+	obj, ok := recv.(*value.GoObject)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("receiver is not a Go object")
+	}
+
+	return reflect.ValueOf(obj.Value), nil
+}
+
+func (vm *VM) fieldReader(field reflect.StructField) *value.MethodDescriptor {
+	return &value.MethodDescriptor{
+		Name: goName(field.Name),
+		Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+			ptr, err := goStruct(recv)
+			if err != nil {
+				return nil, err
+			}
+
+			return value.FromGo(env, ptr.Elem().FieldByIndex(field.Index).Interface())
+		},
+	}
+}
+
+func (vm *VM) fieldWriter(field reflect.StructField) *value.MethodDescriptor {
+	return &value.MethodDescriptor{
+		Name: goName(field.Name) + "=",
+		Signature: value.Signature{
+			Required: 1,
+		},
+		Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+			ptr, err := goStruct(recv)
+			if err != nil {
+				return nil, err
+			}
+
+			rv, err := value.ConvertTo(env, args[0], field.Type)
+			if err != nil {
+				return nil, err
+			}
+
+			ptr.Elem().FieldByIndex(field.Index).Set(rv)
+
+			return args[0], nil
+		},
+	}
+}
+
+// goFunc describes how to call a Go function from m13.
+type goFunc struct {
+	path string
+	fn   reflect.Value
+
+	self     bool
+	ctx      bool
+	args     []reflect.Type
+	variadic bool
+
+	result bool
+	err    bool
+}
+
+func newGoFunc(path string, fn reflect.Value, self bool) (*goFunc, error) {
+	typ := fn.Type()
+
+	gf := &goFunc{
+		path:     path,
+		fn:       fn,
+		self:     self,
+		variadic: typ.IsVariadic(),
+	}
+
+	i := 0
+
+	if self {
+		i++
+	}
+
+	if i < typ.NumIn() && typ.In(i) == contextType {
+		gf.ctx = true
+		i++
+	}
+
+	for ; i < typ.NumIn(); i++ {
+		gf.args = append(gf.args, typ.In(i))
+	}
+
+	switch typ.NumOut() {
+	case 0:
+	case 1:
+		if typ.Out(0) == errorType {
+			gf.err = true
+		} else {
+			gf.result = true
+		}
+	case 2:
+		if typ.Out(1) != errorType {
+			return nil, fmt.Errorf("unable to define %s, the second result must be an error", path)
+		}
+
+		gf.result = true
+		gf.err = true
+	default:
+		return nil, fmt.Errorf("unable to define %s, too many results", path)
+	}
+
+	return gf, nil
+}
+
+func (gf *goFunc) required() int {
+	if gf.variadic {
+		return len(gf.args) - 1
+	}
+
+	return len(gf.args)
+}
+
+func (gf *goFunc) argType(i int) reflect.Type {
+	if gf.variadic && i >= len(gf.args)-1 {
+		return gf.args[len(gf.args)-1].Elem()
+	}
+
+	return gf.args[i]
+}
+
+func (gf *goFunc) descriptor(vm *VM, name string) *value.MethodDescriptor {
+	return &value.MethodDescriptor{
+		Name: name,
+		Signature: value.Signature{
+			Required: gf.required(),
+		},
+		Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+			return gf.call(ctx, vm, name, recv, args)
+		},
+	}
+}
+
+func (gf *goFunc) call(ctx context.Context, vm *VM, name string, recv value.Value, args []value.Value) (value.Value, error) {
+	if !gf.variadic && len(args) > len(gf.args) {
+		return nil, &ErrArityMismatch{Name: name, Got: len(args), Need: len(gf.args)}
+	}
+
+	var in []reflect.Value
+
+	if gf.self {
+		ptr, err := goStruct(recv)
+		if err != nil {
+			return nil, err
+		}
+
+		in = append(in, ptr)
+	}
+
+	if gf.ctx {
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
+
+	for i, arg := range args {
+		rv, err := value.ConvertTo(vm, arg, gf.argType(i))
+		if err != nil {
+			return nil, err
+		}
+
+		in = append(in, rv)
+	}
+
+	out := gf.fn.Call(in)
+
+	if gf.err {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, err
+		}
+	}
+
+	if !gf.result {
+		return vm.nil_, nil
+	}
+
+	return value.FromGo(vm, out[0].Interface())
+}
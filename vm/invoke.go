@@ -3,6 +3,7 @@ package vm
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/evanphx/m13/value"
 	"github.com/pkg/errors"
@@ -27,6 +28,16 @@ func (e *ErrUnknownOp) Error() string {
 	return fmt.Sprintf("unknown operation '%s' on '%s'", e.Op, e.Class.FullName())
 }
 
+type ErrPrivateMethod struct {
+	Name    string
+	Class   *value.Class
+	Package string
+}
+
+func (e *ErrPrivateMethod) Error() string {
+	return fmt.Sprintf("private method '%s' on '%s' called from package '%s'", e.Name, e.Class.FullName(), e.Package)
+}
+
 func (vm *VM) ArgumentError(got, need int) (value.Value, error) {
 	return nil, &ErrArityMismatch{Name: "unknown", Got: got, Need: need}
 }
@@ -48,18 +59,60 @@ func (vm *VM) checkArity(m *value.Method, args []value.Value) error {
 	return nil
 }
 
+// checkVisible returns an error if call may not call m, because m is
+// private to another package.
+func (vm *VM) checkVisible(m *value.Method, recv value.Value, call *value.CallSite) error {
+	if m.Private && call.Package != "" && call.Package != m.Package {
+		return &ErrPrivateMethod{Name: call.Name, Class: recv.Class(vm), Package: call.Package}
+	}
+
+	return nil
+}
+
 func (vm *VM) callN(ctx context.Context, recv value.Value, args []value.Value, call *value.CallSite) (value.Value, error) {
-	if t, ok := recv.Class(vm).LookupMethod(call.Name); ok {
+	if t, ok := call.Lookup(recv.Class(vm)); ok {
+		if err := vm.checkVisible(t, recv, call); err != nil {
+			return nil, err
+		}
+
 		if err := vm.checkArity(t, args); err != nil {
 			return nil, err
 		}
 
+		if p := vm.profiler; p != nil {
+			defer p.site(call, time.Now())
+		}
+
 		return t.Func(ctx, vm, recv, args)
 	}
 
+	if res, ok, err := vm.methodMissing(ctx, recv, call.Name, args); ok {
+		return res, err
+	}
+
 	return nil, errors.WithStack(&ErrUnknownOp{Op: call.Name, Class: recv.Class(vm)})
 }
 
+// methodMissing calls the method_missing method of recv, if it has one,
+// with the name of the method that wasn't found and a list of the
+// arguments it was called with.
+func (vm *VM) methodMissing(ctx context.Context, recv value.Value, name string, args []value.Value) (value.Value, bool, error) {
+	m, ok := recv.Class(vm).LookupMethod("method_missing")
+	if !ok {
+		return nil, false, nil
+	}
+
+	list := value.NewList(vm, len(args))
+
+	for _, arg := range args {
+		list.Append(arg)
+	}
+
+	res, err := m.Func(ctx, vm, recv, []value.Value{vm.NewString(name), list})
+
+	return res, true, err
+}
+
 func (vm *VM) callKW(
 	ctx context.Context,
 	recv value.Value,
@@ -67,12 +120,20 @@ func (vm *VM) callKW(
 	kw []value.Value,
 	call *value.CallSite,
 ) (value.Value, error) {
-	if t, ok := recv.Class(vm).LookupMethod(call.Name); ok {
+	if t, ok := call.Lookup(recv.Class(vm)); ok {
+		if err := vm.checkVisible(t, recv, call); err != nil {
+			return nil, err
+		}
+
 		got := len(pos) + len(kw)
 		if got < t.Signature.Required {
 			return nil, &ErrArityMismatch{Name: call.Name, Got: got, Need: t.Signature.Required}
 		}
 
+		if p := vm.profiler; p != nil {
+			defer p.site(call, time.Now())
+		}
+
 		args := make([]value.Value, t.Signature.Required)
 
 		copy(args, pos)
@@ -88,6 +149,14 @@ func (vm *VM) callKW(
 		return t.Func(ctx, vm, recv, args)
 	}
 
+	// Named arguments follow the positional ones, since method_missing
+	// has no names to match them against.
+	args := append(append([]value.Value{}, pos...), kw...)
+
+	if res, ok, err := vm.methodMissing(ctx, recv, call.Name, args); ok {
+		return res, err
+	}
+
 	return nil, errors.WithStack(&ErrUnknownOp{Op: call.Name, Class: recv.Class(vm)})
 }
 
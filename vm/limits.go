@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Limits bounds the resources used by each top level ExecuteContext call,
+// so that untrusted code can't run away with the host. Zero fields are
+// unlimited.
+type Limits struct {
+	// MaxInstructions is the number of instructions that may be run.
+	MaxInstructions int64
+
+	// MaxDepth is how deeply calls may nest.
+	MaxDepth int
+
+	// MaxDuration is how long execution may take.
+	MaxDuration time.Duration
+
+	// MaxSize is how many bytes a string, or elements a list or map, may
+	// grow to.
+	MaxSize int
+}
+
+type ErrLimitExceeded struct {
+	Limit string
+	Max   interface{}
+}
+
+func (e *ErrLimitExceeded) Error() string {
+	return fmt.Sprintf("limit exceeded: %s is limited to %v", e.Limit, e.Max)
+}
+
+// Unrescuable keeps code from carrying on past a limit by rescuing it.
+func (e *ErrLimitExceeded) Unrescuable() bool {
+	return true
+}
+
+// The deadline and context are only checked every so many instructions
+// since looking at the clock is comparatively expensive.
+const checkInterval = 1024
+
+type limitState struct {
+	Limits
+
+	depth    int
+	steps    int64
+	deadline time.Time
+}
+
+// SetLimits installs limits for every following execution. Passing a zero
+// Limits removes them.
+func (vm *VM) SetLimits(l Limits) {
+	if l == (Limits{}) {
+		vm.limits = nil
+		return
+	}
+
+	vm.limits = &limitState{Limits: l}
+}
+
+func (vm *VM) Limits() Limits {
+	if vm.limits == nil {
+		return Limits{}
+	}
+
+	return vm.limits.Limits
+}
+
+// CheckSize implements value.SizeChecker, refusing to let a value grow
+// past MaxSize.
+func (vm *VM) CheckSize(what string, size int) error {
+	if l := vm.limits; l != nil && l.MaxSize > 0 && size > l.MaxSize {
+		return &ErrLimitExceeded{Limit: what + " size", Max: l.MaxSize}
+	}
+
+	return nil
+}
+
+func (l *limitState) enter() error {
+	// Starting a new top level execution resets the counters.
+	if l.depth == 0 {
+		l.steps = 0
+
+		if l.MaxDuration > 0 {
+			l.deadline = time.Now().Add(l.MaxDuration)
+		}
+	}
+
+	if l.MaxDepth > 0 && l.depth >= l.MaxDepth {
+		return &ErrLimitExceeded{Limit: "call depth", Max: l.MaxDepth}
+	}
+
+	l.depth++
+
+	return nil
+}
+
+func (l *limitState) exit() {
+	l.depth--
+}
+
+func (l *limitState) step(ctx context.Context) error {
+	l.steps++
+
+	if l.MaxInstructions > 0 && l.steps > l.MaxInstructions {
+		return &ErrLimitExceeded{Limit: "instructions", Max: l.MaxInstructions}
+	}
+
+	if l.steps%checkInterval != 0 {
+		return nil
+	}
+
+	if l.MaxDuration > 0 && time.Now().After(l.deadline) {
+		return &ErrLimitExceeded{Limit: "execution time", Max: l.MaxDuration}
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,204 @@
+package vm
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// protoBuffer is just enough of a protobuf encoder to write the messages
+// in pprof's profile.proto.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+
+	b.data = append(b.data, byte(v))
+}
+
+func (b *protoBuffer) key(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuffer) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+
+	b.key(field, 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int64(field int, v int64) {
+	b.uint64(field, uint64(v))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.data)
+}
+
+func (b *protoBuffer) packed(field int, vals []uint64) {
+	var p protoBuffer
+
+	for _, v := range vals {
+		p.varint(v)
+	}
+
+	b.bytes(field, p.data)
+}
+
+// Field numbers from github.com/google/pprof/proto/profile.proto.
+const (
+	pbSampleType    = 1
+	pbSample        = 2
+	pbLocation      = 4
+	pbFunction      = 5
+	pbStringTable   = 6
+	pbTimeNanos     = 9
+	pbDurationNanos = 10
+	pbPeriodType    = 11
+	pbPeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+type stringTable struct {
+	strs  []string
+	index map[string]int
+}
+
+func (t *stringTable) id(s string) int64 {
+	if t.index == nil {
+		t.index = map[string]int{"": 0}
+		t.strs = []string{""}
+	}
+
+	if i, ok := t.index[s]; ok {
+		return int64(i)
+	}
+
+	i := len(t.strs)
+
+	t.strs = append(t.strs, s)
+	t.index[s] = i
+
+	return int64(i)
+}
+
+// WritePprof writes the profile in the gzipped protobuf format read by
+// `go tool pprof`. Each sample is a distinct m13 call stack, with the
+// number of calls and the time spent in its innermost function.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	var (
+		out protoBuffer
+		st  stringTable
+	)
+
+	st.id("")
+
+	valueType := func(field int, typ, unit string) {
+		var m protoBuffer
+
+		m.int64(valueTypeType, st.id(typ))
+		m.int64(valueTypeUnit, st.id(unit))
+
+		out.message(field, &m)
+	}
+
+	valueType(pbSampleType, "calls", "count")
+	valueType(pbSampleType, "time", "nanoseconds")
+
+	for _, key := range p.keys {
+		s := p.samples[key]
+
+		// pprof wants the innermost function first.
+		var locs []uint64
+
+		for i := len(s.stack) - 1; i >= 0; i-- {
+			locs = append(locs, s.stack[i].id)
+		}
+
+		var m protoBuffer
+
+		m.packed(sampleLocationID, locs)
+		m.packed(sampleValue, []uint64{uint64(s.calls), uint64(s.time.Nanoseconds())})
+
+		out.message(pbSample, &m)
+	}
+
+	// Every function gets a single location with the same id.
+	for _, fn := range p.order {
+		var line, loc protoBuffer
+
+		line.uint64(lineFunctionID, fn.id)
+		line.int64(lineLine, int64(fn.Line))
+
+		loc.uint64(locationID, fn.id)
+		loc.message(locationLine, &line)
+
+		out.message(pbLocation, &loc)
+	}
+
+	for _, fn := range p.order {
+		var m protoBuffer
+
+		m.uint64(functionID, fn.id)
+		m.int64(functionName, st.id(fn.Name))
+		m.int64(functionSystemName, st.id(fn.Name))
+		m.int64(functionFilename, st.id(fn.File))
+		m.int64(functionStartLine, int64(fn.Line))
+
+		out.message(pbFunction, &m)
+	}
+
+	out.int64(pbTimeNanos, p.start.UnixNano())
+	out.int64(pbDurationNanos, p.duration().Nanoseconds())
+
+	var period protoBuffer
+
+	period.int64(valueTypeType, st.id("time"))
+	period.int64(valueTypeUnit, st.id("nanoseconds"))
+
+	out.message(pbPeriodType, &period)
+	out.int64(pbPeriod, 1)
+
+	// The string table has to be written last since the messages above
+	// are still adding to it.
+	for _, s := range st.strs {
+		out.bytes(pbStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+
+	if _, err := gz.Write(out.data); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
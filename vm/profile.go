@@ -0,0 +1,254 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/evanphx/m13/value"
+)
+
+// FuncProfile accumulates the calls to one Code. Inclusive time counts the
+// outermost activation only, so recursion isn't counted twice.
+type FuncProfile struct {
+	Name string
+	File string
+	Line int
+
+	Calls     int64
+	Inclusive time.Duration
+	Exclusive time.Duration
+
+	id     uint64
+	active int
+}
+
+// SiteProfile accumulates the calls made through one CallSite, including
+// calls to native methods.
+type SiteProfile struct {
+	Name  string
+	Calls int64
+	Time  time.Duration
+}
+
+type profFrame struct {
+	fn    *FuncProfile
+	key   string
+	start time.Time
+	child time.Duration
+}
+
+type profSample struct {
+	stack []*FuncProfile
+	calls int64
+	time  time.Duration
+}
+
+// Profiler records every call and return while installed with
+// VM.SetProfiler. It is not safe for concurrent use.
+type Profiler struct {
+	start time.Time
+	end   time.Time
+
+	stack   []*profFrame
+	funcs   map[*value.Code]*FuncProfile
+	order   []*FuncProfile
+	sites   map[*value.CallSite]*SiteProfile
+	samples map[string]*profSample
+	keys    []string
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		start:   time.Now(),
+		funcs:   make(map[*value.Code]*FuncProfile),
+		sites:   make(map[*value.CallSite]*SiteProfile),
+		samples: make(map[string]*profSample),
+	}
+}
+
+// SetProfiler installs p to record calls. Passing nil stops profiling.
+func (vm *VM) SetProfiler(p *Profiler) {
+	vm.profiler = p
+}
+
+func (vm *VM) Profiler() *Profiler {
+	return vm.profiler
+}
+
+// Stop marks the end of the profiled period.
+func (p *Profiler) Stop() {
+	p.end = time.Now()
+}
+
+func (p *Profiler) duration() time.Duration {
+	end := p.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	return end.Sub(p.start)
+}
+
+func (p *Profiler) function(code *value.Code) *FuncProfile {
+	fn, ok := p.funcs[code]
+	if !ok {
+		var line int
+
+		if len(code.Lines) > 0 {
+			line = code.Lines[0].Line
+		}
+
+		// pprof hides names like "<lambda>", so anonymous code is named
+		// after where it starts instead.
+		name := code.Name
+		if name == "" {
+			name = fmt.Sprintf("lambda:%d", line)
+		}
+
+		fn = &FuncProfile{
+			Name: name,
+			File: code.File,
+			Line: line,
+			id:   uint64(len(p.order) + 1),
+		}
+
+		p.funcs[code] = fn
+		p.order = append(p.order, fn)
+	}
+
+	return fn
+}
+
+func (p *Profiler) sample(key string) *profSample {
+	s, ok := p.samples[key]
+	if !ok {
+		s = &profSample{}
+
+		for _, f := range p.stack {
+			s.stack = append(s.stack, f.fn)
+		}
+
+		p.samples[key] = s
+		p.keys = append(p.keys, key)
+	}
+
+	return s
+}
+
+func (p *Profiler) enter(code *value.Code) {
+	fn := p.function(code)
+
+	fn.Calls++
+	fn.active++
+
+	key := strconv.FormatUint(fn.id, 10)
+
+	if l := len(p.stack); l > 0 {
+		key = p.stack[l-1].key + "," + key
+	}
+
+	p.stack = append(p.stack, &profFrame{fn: fn, key: key, start: time.Now()})
+
+	p.sample(key).calls++
+}
+
+func (p *Profiler) exit() {
+	l := len(p.stack)
+	f := p.stack[l-1]
+
+	elapsed := time.Since(f.start)
+	self := elapsed - f.child
+
+	f.fn.Exclusive += self
+	f.fn.active--
+
+	if f.fn.active == 0 {
+		f.fn.Inclusive += elapsed
+	}
+
+	p.samples[f.key].time += self
+
+	p.stack = p.stack[:l-1]
+
+	if l > 1 {
+		p.stack[l-2].child += elapsed
+	}
+}
+
+func (p *Profiler) site(cs *value.CallSite, start time.Time) {
+	s, ok := p.sites[cs]
+	if !ok {
+		s = &SiteProfile{Name: cs.Name}
+		p.sites[cs] = s
+	}
+
+	s.Calls++
+	s.Time += time.Since(start)
+}
+
+// Functions returns the profile of every Code that ran, hottest first.
+func (p *Profiler) Functions() []*FuncProfile {
+	funcs := append([]*FuncProfile(nil), p.order...)
+
+	sort.SliceStable(funcs, func(i, j int) bool {
+		return funcs[i].Exclusive > funcs[j].Exclusive
+	})
+
+	return funcs
+}
+
+// CallSites returns the profile of every CallSite used, by time spent.
+func (p *Profiler) CallSites() []*SiteProfile {
+	var sites []*SiteProfile
+
+	for _, s := range p.sites {
+		sites = append(sites, s)
+	}
+
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].Time == sites[j].Time {
+			return sites[i].Name < sites[j].Name
+		}
+
+		return sites[i].Time > sites[j].Time
+	})
+
+	return sites
+}
+
+// WriteText writes a readable summary of the profile to w.
+func (p *Profiler) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%10s %12s %12s  %s\n", "calls", "flat", "cum", "function")
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range p.Functions() {
+		loc := fn.Name
+		if fn.File != "" {
+			loc = fmt.Sprintf("%s (%s:%d)", fn.Name, fn.File, fn.Line)
+		}
+
+		_, err = fmt.Fprintf(w, "%10d %12s %12s  %s\n", fn.Calls, fn.Exclusive, fn.Inclusive, loc)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "\n%10s %12s  %s\n", "calls", "time", "call site")
+	if err != nil {
+		return err
+	}
+
+	for _, s := range p.CallSites() {
+		_, err = fmt.Fprintf(w, "%10d %12s  %s\n", s.Calls, s.Time, s.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
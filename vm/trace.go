@@ -0,0 +1,184 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/evanphx/m13/insn"
+	"github.com/evanphx/m13/value"
+)
+
+// Frame describes one activation of a Code while a Tracer is installed.
+// Regs is the frame's window into the register file, so it reflects the
+// live values; tracers must not hold on to it after the hook returns.
+type Frame struct {
+	Parent *Frame
+	Depth  int
+
+	Code *value.Code
+	IP   int
+	Self value.Value
+	Refs []*value.Ref
+	Regs []value.Value
+
+	tracer Tracer
+	gctx   context.Context
+	abort  error
+}
+
+// Line returns the source line of the instruction at IP, if known.
+func (f *Frame) Line() int {
+	return f.Code.LineFor(f.IP)
+}
+
+// Context returns the context the frame is being executed with.
+func (f *Frame) Context() context.Context {
+	return f.gctx
+}
+
+// Lookup returns the value of the local or ref called name.
+func (f *Frame) Lookup(name string) (value.Value, bool) {
+	for i, n := range f.Code.LocalNames {
+		if n == name && i < len(f.Regs) {
+			return f.Regs[i], true
+		}
+	}
+
+	for i, n := range f.Code.RefNames {
+		if n == name && i < len(f.Refs) && f.Refs[i] != nil {
+			return f.Refs[i].Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Abort makes the frame fail with err instead of running the instruction
+// that was about to be executed. It may only be called from
+// Tracer.OnInstruction.
+func (f *Frame) Abort(err error) {
+	f.abort = err
+}
+
+type Tracer interface {
+	// OnInstruction is called before the instruction at f.IP runs.
+	OnInstruction(f *Frame, i insn.Instruction)
+
+	// OnCall is called when f is entered, after its arguments have been
+	// placed into its registers.
+	OnCall(f *Frame)
+
+	// OnReturn is called when f finishes normally.
+	OnReturn(f *Frame, val value.Value)
+
+	// OnError is called for every frame an error unwinds through.
+	OnError(f *Frame, err error)
+}
+
+// SetTracer installs t to observe execution. Passing nil turns tracing off,
+// which costs nothing beyond a nil check per instruction.
+func (vm *VM) SetTracer(t Tracer) {
+	vm.tracer = t
+}
+
+func (vm *VM) Tracer() Tracer {
+	return vm.tracer
+}
+
+// CurrentFrame returns the innermost frame being executed. It is only
+// maintained while a Tracer is installed.
+func (vm *VM) CurrentFrame() *Frame {
+	return vm.frame
+}
+
+func (vm *VM) enterFrame(gctx context.Context, ctx value.ExecuteContext, reg []value.Value) *Frame {
+	f := &Frame{
+		gctx:   gctx,
+		Parent: vm.frame,
+		Code:   ctx.Code,
+		Self:   ctx.Self,
+		Refs:   ctx.Refs,
+		Regs:   reg[:ctx.Code.NumRegs],
+		tracer: vm.tracer,
+	}
+
+	if f.Parent != nil {
+		f.Depth = f.Parent.Depth + 1
+	}
+
+	vm.frame = f
+
+	f.tracer.OnCall(f)
+
+	return f
+}
+
+func (vm *VM) exitFrame(f *Frame, ret *value.Value, err *error) {
+	vm.frame = f.Parent
+
+	if *err != nil {
+		f.tracer.OnError(f, *err)
+	} else {
+		f.tracer.OnReturn(f, *ret)
+	}
+}
+
+type TextTracer struct {
+	env value.Env
+	w   io.Writer
+}
+
+// NewTextTracer returns a Tracer that writes a readable trace of every
+// frame and instruction to w.
+func NewTextTracer(env value.Env, w io.Writer) *TextTracer {
+	return &TextTracer{env: env, w: w}
+}
+
+func (t *TextTracer) indent(f *Frame) string {
+	return strings.Repeat("  ", f.Depth)
+}
+
+func frameName(f *Frame) string {
+	name := f.Code.Name
+	if name == "" {
+		name = "<lambda>"
+	}
+
+	if f.Code.File != "" {
+		name = fmt.Sprintf("%s (%s)", name, f.Code.File)
+	}
+
+	return name
+}
+
+func (t *TextTracer) OnInstruction(f *Frame, i insn.Instruction) {
+	var loc string
+
+	if line := f.Line(); line > 0 {
+		loc = fmt.Sprintf(" :%d", line)
+	}
+
+	fmt.Fprintf(t.w, "%s  %03d %s%s\n", t.indent(f), f.IP, f.Code.FormatInstruction(i), loc)
+}
+
+func (t *TextTracer) OnCall(f *Frame) {
+	fmt.Fprintf(t.w, "%s=> %s\n", t.indent(f), frameName(f))
+
+	if sig := f.Code.Signature; sig != nil {
+		for i, name := range sig.Args {
+			if i < len(f.Regs) {
+				fmt.Fprintf(t.w, "%s   %s = %s\n", t.indent(f), name, value.Inspect(t.env, f.Regs[i]))
+			}
+		}
+	}
+}
+
+func (t *TextTracer) OnReturn(f *Frame, val value.Value) {
+	fmt.Fprintf(t.w, "%s<= %s: %s\n", t.indent(f), frameName(f), value.Inspect(t.env, val))
+}
+
+func (t *TextTracer) OnError(f *Frame, err error) {
+	fmt.Fprintf(t.w, "%s!! %s: %s\n", t.indent(f), frameName(f), err)
+}
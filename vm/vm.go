@@ -17,6 +17,17 @@ type VM struct {
 	nil_   value.Value
 	true_  value.Value
 	false_ value.Value
+
+	resolve *value.CallSite
+
+	tracer Tracer
+	frame  *Frame
+
+	profiler *Profiler
+	limits   *limitState
+
+	unwinding error
+	backtrace []Location
 }
 
 func NewVM() (*VM, error) {
@@ -36,6 +47,7 @@ func NewVM() (*VM, error) {
 		nil_:     nil_,
 		true_:    true_,
 		false_:   false_,
+		resolve:  &value.CallSite{Name: "resolve"},
 	}, nil
 }
 
@@ -121,9 +133,9 @@ func (vm *VM) isTrue(v value.Value) bool {
 	return true
 }
 
-func (vm *VM) ExecuteContext(gctx context.Context, ctx value.ExecuteContext) (value.Value, error) {
+func (vm *VM) ExecuteContext(gctx context.Context, ctx value.ExecuteContext) (ret value.Value, err error) {
 	if len(vm.reg) < vm.top+ctx.Code.NumRegs {
-		panic("out of registers")
+		return nil, &ErrLimitExceeded{Limit: "registers", Max: len(vm.reg)}
 	}
 
 	var (
@@ -133,16 +145,33 @@ func (vm *VM) ExecuteContext(gctx context.Context, ctx value.ExecuteContext) (va
 		seq = ctx.Code.Instructions
 	)
 
-	// fmt.Printf("=> '%s' %p\n", ctx.Code.Name, ctx.Code)
-
 	// Restore the top of the register file
 	defer func(v int) {
 		vm.top = v
-		// fmt.Printf("<= '%s' %p\n", ctx.Code.Name, ctx.Code)
 	}(vm.top)
 
+	// ip has already moved past the instruction that failed
+	defer func() {
+		if err != nil {
+			vm.unwind(err, ctx.Code, ip-1)
+		}
+	}()
+
 	vm.top += ctx.Code.NumRegs
 
+	if p := vm.profiler; p != nil {
+		p.enter(ctx.Code)
+		defer p.exit()
+	}
+
+	if l := vm.limits; l != nil {
+		if err := l.enter(); err != nil {
+			return nil, err
+		}
+
+		defer l.exit()
+	}
+
 	// TODO use overlapping call args with locals in invoked lambda
 	// rather than copy them
 
@@ -150,27 +179,48 @@ func (vm *VM) ExecuteContext(gctx context.Context, ctx value.ExecuteContext) (va
 		reg[i] = v
 	}
 
+	var f *Frame
+
+	if vm.tracer != nil {
+		f = vm.enterFrame(gctx, ctx, reg)
+		defer vm.exitFrame(f, &ret, &err)
+	}
+
 	max := len(seq)
 
 	for ip < max {
 		i := seq[ip]
 
+		if l := vm.limits; l != nil {
+			if err := l.step(gctx); err != nil {
+				return nil, err
+			}
+		}
+
+		if f != nil {
+			f.IP = ip
+			f.tracer.OnInstruction(f, i)
+
+			if f.abort != nil {
+				return nil, f.abort
+			}
+		}
+
 		ip++
 
-		/*
-			fmt.Printf("@ %d/%p => %s r0:%d r1:%d r2:%d data:%d rest1:%d rest2:%d\n",
-				ip, seq,
-				i.Op(), i.R0(), i.R1(), i.R2(),
-				i.Data(), i.Rest1(), i.Rest2())
-			// fmt.Printf("regs: %d lits: %+v\n", len(reg), lits)
-		*/
 		switch i.Op() {
 		case insn.Noop:
 			// nothing
 		case insn.Reset:
-			reg[i.R0()] = nil
+			reg[i.R0()] = vm.nil_
 		case insn.StoreInt:
 			reg[i.R0()] = value.MakeI64(i.Data())
+		case insn.StoreBool:
+			if i.Data() != 0 {
+				reg[i.R0()] = vm.true_
+			} else {
+				reg[i.R0()] = vm.false_
+			}
 		case insn.CopyReg:
 			reg[i.R0()] = reg[i.R1()]
 		case insn.Call0:
@@ -179,8 +229,6 @@ func (vm *VM) ExecuteContext(gctx context.Context, ctx value.ExecuteContext) (va
 				return nil, err
 			}
 
-			// fmt.Printf("set %d: %+v (%T)\n", i.R0(), res, res)
-
 			reg[i.R0()] = res
 		case insn.CallN:
 			res, err := vm.callN(
@@ -240,15 +288,28 @@ func (vm *VM) ExecuteContext(gctx context.Context, ctx value.ExecuteContext) (va
 		case insn.String:
 			reg[i.R0()] = ctx.Code.Strings[i.R1()]
 		case insn.GetScoped:
-			reg[i.R0()] = vm.getScoped(gctx, ctx.Code.Strings[i.R1()].String)
+			res, err := vm.getScoped(gctx, ctx.Code.Strings[i.R1()].String)
+			if err != nil {
+				return nil, err
+			}
+
+			reg[i.R0()] = res
 		case insn.NewList:
 			reg[i.R0()] = value.NewList(vm, i.R1())
 		case insn.ListAppend:
-			reg[i.R0()].(*value.List).Append(reg[i.R1()])
+			list := reg[i.R0()].(*value.List)
+
+			if err := vm.CheckSize("list", list.Len()+1); err != nil {
+				return nil, err
+			}
+
+			list.Append(reg[i.R1()])
 		case insn.NewMap:
 			reg[i.R0()] = value.NewMap(vm)
 		case insn.SetMap:
-			vm.setMap(reg[i.R0()], reg[i.R1()], reg[i.R1()+1])
+			if err := vm.setMap(reg[i.R0()], reg[i.R1()], reg[i.R1()+1]); err != nil {
+				return nil, err
+			}
 		case insn.SetIvar:
 			no := ctx.Self.(*value.NativeObject)
 			no.Ivars[no.Class(vm).Ivars[ctx.Code.Strings[i.R1()].String]] = reg[i.R0()]
@@ -294,13 +355,7 @@ func (vm *VM) createLambda(ctx value.ExecuteContext, args int, refs []*value.Ref
 }
 
 func (vm *VM) getMirror(ctx context.Context, obj value.Value) value.Value {
-	cls := vm.Registry().Mirror
-
-	call := &value.CallSite{
-		Name: "resolve",
-	}
-
-	val, err := vm.callN(ctx, cls, []value.Value{obj}, call)
+	val, err := vm.Mirror(ctx, obj)
 	if err != nil {
 		panic(err)
 	}
@@ -308,16 +363,40 @@ func (vm *VM) getMirror(ctx context.Context, obj value.Value) value.Value {
 	return val
 }
 
-func (vm *VM) getScoped(ctx context.Context, name string) value.Value {
+// Mirror returns the mirror for obj, the receiver of `obj.^name` calls.
+func (vm *VM) Mirror(ctx context.Context, obj value.Value) (value.Value, error) {
+	cls := vm.Registry().Mirror
+
+	return vm.callN(ctx, cls, []value.Value{obj}, vm.resolve)
+}
+
+// Send calls the method name on recv, just like `recv.name(args)`.
+func (vm *VM) Send(ctx context.Context, recv value.Value, name string, args ...value.Value) (value.Value, error) {
+	return vm.callN(ctx, recv, args, &value.CallSite{Name: name})
+}
+
+func (vm *VM) getScoped(ctx context.Context, name string) (value.Value, error) {
+	if !value.ScopedAllowed(ctx, name) {
+		return nil, &value.ErrDenied{Kind: "scoped variable", Name: name}
+	}
+
 	if val, ok := value.GetScoped(ctx, name); ok {
-		return val
+		return val, nil
 	}
 
-	return vm.Nil()
+	return vm.Nil(), nil
 }
 
-func (vm *VM) setMap(map_, key, val value.Value) {
+func (vm *VM) setMap(map_, key, val value.Value) error {
 	m := map_.(*value.Map)
 
+	if _, ok := m.Get(key); !ok {
+		if err := vm.CheckSize("map", m.Len()+1); err != nil {
+			return err
+		}
+	}
+
 	m.Set(key, val)
+
+	return nil
 }
@@ -1,7 +1,15 @@
 package vm
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/evanphx/m13/insn"
@@ -288,5 +296,673 @@ func TestVM(t *testing.T) {
 		assert.Equal(t, value.I64(3), val)
 	})
 
+	n.It("caches the method found for a receiver class", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		cs := &value.CallSite{Name: "+"}
+
+		val, err := vm.callN(context.TODO(), value.I64(3), []value.Value{value.I64(4)}, cs)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(7), val)
+		assert.Equal(t, 1, cs.Cached())
+
+		_, err = vm.callN(context.TODO(), value.I64(3), []value.Value{value.I64(4)}, cs)
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, cs.Cached())
+
+		_, err = vm.callN(context.TODO(), vm.NewString("a"), []value.Value{vm.NewString("b")}, cs)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, cs.Cached())
+	})
+
+	n.It("shares a call site between goroutines", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		cs := &value.CallSite{Name: "+"}
+
+		classes := []*value.Class{value.I64(1).Class(vm), vm.NewString("a").Class(vm)}
+
+		var wg sync.WaitGroup
+
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+
+			go func(g int) {
+				defer wg.Done()
+
+				for i := 0; i < 1000; i++ {
+					cls := classes[(g+i)%len(classes)]
+
+					want, _ := cls.LookupMethod("+")
+
+					m, ok := cs.Lookup(cls)
+					if !ok || m != want {
+						t.Errorf("wrong method for %s", cls.FullName())
+						return
+					}
+				}
+			}(g)
+		}
+
+		wg.Wait()
+	})
+
+	n.It("invalidates cached methods when a method is added", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		cs := &value.CallSite{Name: "+"}
+
+		_, err = vm.callN(context.TODO(), value.I64(3), []value.Value{value.I64(4)}, cs)
+		require.NoError(t, err)
+
+		vm.I64Class().AddMethod(&value.MethodDescriptor{
+			Name: "+",
+			Signature: value.Signature{
+				Required: 1,
+			},
+			Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+				return value.I64(42), nil
+			},
+		})
+
+		assert.Equal(t, 0, cs.Cached())
+
+		val, err := vm.callN(context.TODO(), value.I64(3), []value.Value{value.I64(4)}, cs)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(42), val)
+	})
+
+	n.It("invalidates cached methods when a method is aliased", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		cs := &value.CallSite{Name: "plus"}
+
+		_, err = vm.callN(context.TODO(), value.I64(3), []value.Value{value.I64(4)}, cs)
+		require.Error(t, err)
+
+		vm.I64Class().AliasMethod("add", "plus")
+
+		val, err := vm.callN(context.TODO(), value.I64(3), []value.Value{value.I64(4)}, cs)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(7), val)
+	})
+
+	n.It("reports calls and instructions to a tracer", func() {
+		c1 := &value.Code{
+			Name:    "inner",
+			NumRegs: 1,
+			Instructions: []insn.Instruction{
+				b.Store(0, insn.Int(3)),
+				b.Return(0),
+			},
+		}
+
+		ctx := value.ExecuteContext{
+			Code: &value.Code{
+				Name:    "outer",
+				NumRegs: 1,
+				Instructions: []insn.Instruction{
+					b.CreateLambda(0, 0, 0, 0),
+					b.Invoke(0, 0, 0),
+					b.Return(0),
+				},
+				SubCode: []*value.Code{c1},
+			},
+		}
+
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		var rec recordTracer
+
+		vm.SetTracer(&rec)
+
+		val, err := vm.ExecuteContext(context.TODO(), ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), val)
+
+		assert.Equal(t, []string{
+			"call outer",
+			"0 outer 0",
+			"0 outer 1",
+			"call inner",
+			"1 inner 0",
+			"1 inner 1",
+			"return inner 3",
+			"0 outer 2",
+			"return outer 3",
+		}, rec.events)
+
+		assert.Nil(t, vm.CurrentFrame())
+	})
+
+	n.It("reports errors to a tracer", func() {
+		ctx := value.ExecuteContext{
+			Code: &value.Code{
+				Name:    "outer",
+				NumRegs: 1,
+				Instructions: []insn.Instruction{
+					b.Store(0, insn.Int(3)),
+					b.Call0(0, 0, 0),
+					b.Return(0),
+				},
+				Calls: []*value.CallSite{{Name: "nope"}},
+			},
+		}
+
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		var rec recordTracer
+
+		vm.SetTracer(&rec)
+
+		_, err = vm.ExecuteContext(context.TODO(), ctx)
+		require.Error(t, err)
+
+		assert.Equal(t, "error outer", rec.events[len(rec.events)-1])
+	})
+
+	n.It("records the frames an error unwinds through", func() {
+		inner := &value.Code{
+			Name:    "inner",
+			File:    "a.m13",
+			NumRegs: 1,
+			Instructions: []insn.Instruction{
+				b.Store(0, insn.Int(3)),
+				b.Call0(0, 0, 0),
+				b.Return(0),
+			},
+			Calls: []*value.CallSite{{Name: "nope"}},
+			Lines: []value.LineEntry{{Start: 0, Line: 4}, {Start: 1, Line: 5}},
+		}
+
+		ctx := value.ExecuteContext{
+			Code: &value.Code{
+				Name:    "outer",
+				File:    "a.m13",
+				NumRegs: 1,
+				Instructions: []insn.Instruction{
+					b.CreateLambda(0, 0, 0, 0),
+					b.Invoke(0, 0, 0),
+					b.Return(0),
+				},
+				SubCode: []*value.Code{inner},
+				Lines:   []value.LineEntry{{Start: 0, Line: 1}, {Start: 1, Line: 2}},
+			},
+		}
+
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		_, err = vm.ExecuteContext(context.TODO(), ctx)
+		require.Error(t, err)
+
+		assert.Equal(t, []Location{
+			{File: "a.m13", Name: "inner", Line: 5},
+			{File: "a.m13", Name: "outer", Line: 2},
+		}, vm.Backtrace(err))
+
+		assert.Nil(t, vm.Backtrace(errors.New("other")))
+	})
+
+	n.It("profiles calls to code and call sites", func() {
+		c1 := &value.Code{
+			Name:    "inner",
+			NumRegs: 2,
+			Instructions: []insn.Instruction{
+				b.Store(0, insn.Int(3)),
+				b.Store(1, insn.Int(4)),
+				b.CallOp(0, 0, 0),
+				b.Return(0),
+			},
+			Calls: []*value.CallSite{{Name: "+"}},
+		}
+
+		ctx := value.ExecuteContext{
+			Code: &value.Code{
+				Name:    "outer",
+				NumRegs: 1,
+				Instructions: []insn.Instruction{
+					b.CreateLambda(0, 0, 0, 0),
+					b.Invoke(0, 0, 0),
+					b.CreateLambda(0, 0, 0, 0),
+					b.Invoke(0, 0, 0),
+					b.Return(0),
+				},
+				SubCode: []*value.Code{c1},
+			},
+		}
+
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		prof := NewProfiler()
+
+		vm.SetProfiler(prof)
+
+		_, err = vm.ExecuteContext(context.TODO(), ctx)
+		require.NoError(t, err)
+
+		prof.Stop()
+
+		funcs := map[string]*FuncProfile{}
+
+		for _, fn := range prof.Functions() {
+			funcs[fn.Name] = fn
+		}
+
+		require.Equal(t, 2, len(funcs))
+
+		assert.Equal(t, int64(1), funcs["outer"].Calls)
+		assert.Equal(t, int64(2), funcs["inner"].Calls)
+		assert.True(t, funcs["outer"].Inclusive >= funcs["inner"].Inclusive)
+
+		sites := prof.CallSites()
+		require.Equal(t, 1, len(sites))
+
+		assert.Equal(t, "+", sites[0].Name)
+		assert.Equal(t, int64(2), sites[0].Calls)
+
+		var buf bytes.Buffer
+
+		err = prof.WritePprof(&buf)
+		require.NoError(t, err)
+
+		gz, err := gzip.NewReader(&buf)
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+
+		assert.True(t, bytes.Contains(data, []byte("inner")))
+		assert.True(t, bytes.Contains(data, []byte("nanoseconds")))
+	})
+
+	n.It("can call Go functions defined in a package", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		err = vm.Define("host.sum", func(xs []int64) int64 {
+			var total int64
+
+			for _, x := range xs {
+				total += x
+			}
+
+			return total
+		})
+		require.NoError(t, err)
+
+		err = vm.Define("host.greet", func(ctx context.Context, names map[string]string) ([]string, error) {
+			if ctx == nil {
+				return nil, errors.New("no context")
+			}
+
+			var out []string
+
+			for k, v := range names {
+				out = append(out, k+"="+v)
+			}
+
+			return out, nil
+		})
+		require.NoError(t, err)
+
+		err = vm.Define("host.fail", func(b bool) error {
+			if b {
+				return errors.New("failed")
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+
+		pkg := vm.Registry().OpenPackage("host")
+
+		list := value.NewList(vm, 3)
+		list.Append(value.I64(1))
+		list.Append(value.I64(2))
+		list.Append(value.I64(3))
+
+		res, err := vm.Send(context.TODO(), pkg, "sum", list)
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(6), res)
+
+		m := value.NewMap(vm)
+		m.Set(vm.NewString("a"), vm.NewString("b"))
+
+		res, err = vm.Send(context.TODO(), pkg, "greet", m)
+		require.NoError(t, err)
+
+		out, ok := res.(*value.List)
+		require.True(t, ok)
+
+		require.Equal(t, 1, out.Len())
+		assert.Equal(t, "a=b", out.At(0).(*value.String).String)
+
+		res, err = vm.Send(context.TODO(), pkg, "fail", vm.False())
+		require.NoError(t, err)
+
+		assert.Equal(t, vm.Nil(), res)
+
+		_, err = vm.Send(context.TODO(), pkg, "fail", vm.True())
+		assert.Equal(t, "failed", err.Error())
+
+		_, err = vm.Send(context.TODO(), pkg, "sum", value.I64(1))
+		assert.IsType(t, &ErrTypeError{}, err)
+
+		_, err = vm.Send(context.TODO(), pkg, "sum", list, list)
+		assert.IsType(t, &ErrArityMismatch{}, err)
+
+		err = vm.Define("host.bad", 3)
+		assert.Error(t, err)
+	})
+
+	n.It("can expose Go structs as classes", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		cls, err := vm.DefineClass("host.Counter", testCounter{})
+		require.NoError(t, err)
+
+		err = vm.Define("host.make_counter", func(start int64) *testCounter {
+			return &testCounter{Count: start}
+		})
+		require.NoError(t, err)
+
+		obj, err := vm.Send(context.TODO(), cls, "new")
+		require.NoError(t, err)
+
+		_, err = vm.Send(context.TODO(), obj, "add_to", value.I64(5))
+		require.NoError(t, err)
+
+		res, err := vm.Send(context.TODO(), obj, "count")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(5), res)
+
+		_, err = vm.Send(context.TODO(), obj, "count=", value.I64(9))
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(9), obj.(*value.GoObject).Value.(*testCounter).Count)
+
+		pkg := vm.Registry().OpenPackage("host")
+
+		obj, err = vm.Send(context.TODO(), pkg, "make_counter", value.I64(3))
+		require.NoError(t, err)
+
+		assert.Equal(t, cls, obj.Class(vm))
+
+		res, err = vm.Send(context.TODO(), obj, "count")
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(3), res)
+
+		res, err = vm.Send(context.TODO(), pkg, "Counter")
+		require.NoError(t, err)
+
+		assert.Equal(t, cls, res)
+	})
+
+	n.It("converts values to and from Go", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		type item struct {
+			Name   string `m13:"name"`
+			Count  int
+			Tags   []string
+			Secret string `m13:"-"`
+		}
+
+		in := map[string]interface{}{
+			"items": []item{{Name: "a", Count: 1, Tags: []string{"x"}, Secret: "s"}},
+			"ok":    true,
+			"none":  nil,
+		}
+
+		val, err := value.FromGo(vm, in)
+		require.NoError(t, err)
+
+		m, ok := val.(*value.Map)
+		require.True(t, ok)
+
+		assert.Equal(t, 3, m.Len())
+
+		items, ok := m.Get(vm.NewString("items"))
+		require.True(t, ok)
+
+		first := items.(*value.List).At(0).(*value.Map)
+
+		assert.Equal(t, 3, first.Len())
+
+		_, ok = first.Get(vm.NewString("Secret"))
+		assert.False(t, ok)
+
+		out, err := value.ToGo(vm, val)
+		require.NoError(t, err)
+
+		expected := map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{
+					"name":  "a",
+					"Count": int64(1),
+					"Tags":  []interface{}{"x"},
+				},
+			},
+			"ok":   true,
+			"none": nil,
+		}
+
+		assert.Equal(t, expected, out)
+
+		rv, err := value.ConvertTo(vm, first, reflect.TypeOf(item{}))
+		require.NoError(t, err)
+
+		assert.Equal(t, item{Name: "a", Count: 1, Tags: []string{"x"}}, rv.Interface())
+
+		_, err = value.ConvertTo(vm, vm.NewString("a"), reflect.TypeOf(int64(0)))
+		assert.IsType(t, &ErrTypeError{}, err)
+	})
+
+	n.It("rejects integers that don't fit the type they're converted to", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		rv, err := value.ConvertTo(vm, value.I64(127), reflect.TypeOf(int8(0)))
+		require.NoError(t, err)
+
+		assert.Equal(t, int8(127), rv.Interface())
+
+		_, err = value.ConvertTo(vm, value.I64(128), reflect.TypeOf(int8(0)))
+		assert.IsType(t, &value.ErrOverflow{}, err)
+
+		_, err = value.ConvertTo(vm, value.I64(-129), reflect.TypeOf(int8(0)))
+		assert.IsType(t, &value.ErrOverflow{}, err)
+
+		rv, err = value.ConvertTo(vm, value.I64(255), reflect.TypeOf(uint8(0)))
+		require.NoError(t, err)
+
+		assert.Equal(t, uint8(255), rv.Interface())
+
+		_, err = value.ConvertTo(vm, value.I64(256), reflect.TypeOf(uint8(0)))
+		assert.IsType(t, &value.ErrOverflow{}, err)
+
+		_, err = value.ConvertTo(vm, value.I64(-1), reflect.TypeOf(uint64(0)))
+		require.Error(t, err)
+
+		assert.Equal(t, "-1 overflows uint64", err.Error())
+
+		val, err := value.FromGo(vm, uint64(math.MaxInt64))
+		require.NoError(t, err)
+
+		assert.Equal(t, value.I64(math.MaxInt64), val)
+
+		_, err = value.FromGo(vm, uint64(math.MaxInt64)+1)
+		require.Error(t, err)
+
+		assert.Equal(t, "9223372036854775808 overflows builtin.I64", err.Error())
+
+		_, err = value.FromGo(vm, []uint{math.MaxUint64})
+		assert.IsType(t, &value.ErrOverflow{}, err)
+	})
+
+	n.It("keeps every entry when a map grows", func() {
+		vm, err := NewVM()
+		require.NoError(t, err)
+
+		m := value.NewMap(vm)
+
+		for i := 0; i < 100; i++ {
+			m.Set(value.I64(i), value.I64(i*2))
+		}
+
+		assert.Equal(t, 100, m.Len())
+		assert.Equal(t, 100, len(m.Keys()))
+
+		for i := 0; i < 100; i++ {
+			v, ok := m.Get(value.I64(i))
+			require.True(t, ok)
+
+			assert.Equal(t, value.I64(i*2), v)
+		}
+	})
+
+	n.It("converts Go names to snake case", func() {
+		assert.Equal(t, "add_item", goName("AddItem"))
+		assert.Equal(t, "id", goName("ID"))
+		assert.Equal(t, "http_server", goName("HTTPServer"))
+		assert.Equal(t, "name", goName("Name"))
+	})
+
 	n.Meow()
 }
+
+type testCounter struct {
+	Count int64
+}
+
+func (c *testCounter) AddTo(n int64) {
+	c.Count += n
+}
+
+type recordTracer struct {
+	events []string
+}
+
+func (r *recordTracer) OnInstruction(f *Frame, i insn.Instruction) {
+	r.events = append(r.events, fmt.Sprintf("%d %s %d", f.Depth, f.Code.Name, f.IP))
+}
+
+func (r *recordTracer) OnCall(f *Frame) {
+	r.events = append(r.events, "call "+f.Code.Name)
+}
+
+func (r *recordTracer) OnReturn(f *Frame, val value.Value) {
+	r.events = append(r.events, fmt.Sprintf("return %s %v", f.Code.Name, val))
+}
+
+func (r *recordTracer) OnError(f *Frame, err error) {
+	r.events = append(r.events, "error "+f.Code.Name)
+}
+
+func deepClass(vm *VM, depth int) *value.Class {
+	r := vm.Registry()
+	pkg := r.OpenPackage("bench")
+
+	cls := r.NewClass(pkg, "C0", r.Object)
+
+	cls.AddMethod(&value.MethodDescriptor{
+		Name: "value",
+		Func: func(ctx context.Context, env value.Env, recv value.Value, args []value.Value) (value.Value, error) {
+			return value.I64(1), nil
+		},
+	})
+
+	for i := 1; i < depth; i++ {
+		cls = r.NewClass(pkg, fmt.Sprintf("C%d", i), cls)
+	}
+
+	return cls
+}
+
+func BenchmarkMethodLookup(b *testing.B) {
+	vm, err := NewVM()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cls := deepClass(vm, 8)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, ok := cls.LookupMethod("value"); !ok {
+				b.Fatal("missing method")
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		cs := &value.CallSite{Name: "value"}
+
+		for i := 0; i < b.N; i++ {
+			if _, ok := cs.Lookup(cls); !ok {
+				b.Fatal("missing method")
+			}
+		}
+	})
+}
+
+func BenchmarkCallLoop(b *testing.B) {
+	vm, err := NewVM()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cls := deepClass(vm, 8)
+
+	obj := &value.Object{}
+	obj.SetClass(cls)
+
+	bld := insn.Builder
+
+	// r0 = counter, r1 = receiver, r2 = condition, r3 = limit
+	code := &value.Code{
+		NumRegs: 5,
+		Instructions: []insn.Instruction{
+			bld.Store(0, insn.Int(0)),
+			bld.Store(3, insn.Int(1000)),
+			bld.StoreReg(2, 0),
+			bld.CallOp(2, 2, 0),
+			bld.GotoIfFalse(2, 8),
+			bld.Call0(4, 1, 2),
+			bld.Call0(0, 0, 1),
+			bld.Goto(2),
+			bld.Return(0),
+		},
+		Calls: []*value.CallSite{{Name: "<"}, {Name: "++"}, {Name: "value"}},
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vm.reg[1] = obj
+
+		_, err := vm.ExecuteContext(context.TODO(), value.ExecuteContext{Code: code})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}